@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics"
+)
+
+type DiffArgs struct {
+	Threshold    float64 `default:"0.1" help:"relative change of a cell to mark it as changed, e.g. 0.1 for 10%"`
+	Output       string  `help:"path to the file to write the diff csv to [default: stdout]"`
+	FailOnChange bool    `arg:"--fail-on-change" help:"exit with code 1 if any cell changed more than the threshold"`
+	OldFile      string  `arg:"positional,required" help:"path to the old report csv file"`
+	NewFile      string  `arg:"positional,required" help:"path to the new report csv file"`
+}
+
+func (DiffArgs) Description() string {
+	return "Compares two statistics reports and writes absolute and relative changes of each cell as csv.\n" +
+		"Both reports must be written with the same --duration-format and --metric."
+}
+
+func runDiff(rawArgs []string) {
+	args := &DiffArgs{}
+	mustParse(programName+" diff", rawArgs, args)
+
+	summary, err := diffReports(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Cells changed more than the threshold: %d of %d", summary.Exceeded, summary.Cells)
+	if args.FailOnChange && summary.Exceeded != 0 {
+		os.Exit(1)
+	}
+}
+
+func diffReports(args *DiffArgs) (*statistics.DiffSummary, error) {
+	if args.Output == "" {
+		summary, err := statistics.DiffReports(args.OldFile, args.NewFile, os.Stdout, args.Threshold)
+		return summary, errors.WithStack(err)
+	}
+	f, err := os.Create(args.Output)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create diff output file")
+	}
+	defer f.Close() // nolint: errcheck, gosec
+	summary, err := statistics.DiffReports(args.OldFile, args.NewFile, f, args.Threshold)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, errors.Wrap(err, "can't close diff output file")
+	}
+	return summary, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics"
+)
+
+type ExportArgs struct {
+	Concurrency int     `default:"64" help:"number of workers that will process file in parallel"`
+	Format      string  `default:"csv" help:"output file format: csv or ndjson"`
+	Ordered     bool    `help:"write rides in the input file order instead of the processing order"`
+	MetricsAddr string  `arg:"--metrics-addr" help:"address to serve Prometheus metrics on during the run, e.g. :9090"`
+	MetricsFile string  `arg:"--metrics-file" help:"path to the file to write the final Prometheus metrics snapshot to"`
+	ChunkSizeKB int     `arg:"--chunk-size-kb" default:"1024" help:"size of chunks in KB the input file is split into for parallel reading"`       // nolint: lll
+	IO          string  `arg:"--io" default:"read" help:"how to read the input file: read or mmap, mmap falls back to read if it's not available"` // nolint: lll
+	Distance    string  `default:"haversine" help:"ride distance calculation: haversine, vincenty or equirectangular"`
+	RoadNetwork string  `arg:"--road-network" help:"path to the OSM PBF or GeoJSON file with roads to snap ride points to"`
+	SnapMeters  float64 `arg:"--max-snap-distance" default:"50" help:"max distance in meters from a point to a road to snap it"`                            // nolint: lll
+	InputFile   string  `arg:"positional" default:"recorded_rides.csv" help:"path to the input csv file with recorded rides [default: recorded_rides.csv]"` // nolint: lll
+	OutputFile  string  `arg:"positional" default:"rides.csv" help:"path to the output file to write rides to [default: rides.csv]"`                        // nolint: lll
+	FilterArgs
+}
+
+func (ExportArgs) Description() string {
+	return "Exports the data of each ride: id, start and end, duration, distance, points, coordinates and speeds."
+}
+
+func runExportRides(rawArgs []string) {
+	args := &ExportArgs{}
+	mustParse(programName+" export-rides", rawArgs, args)
+
+	log.Printf(
+		"Start exporting rides; input_file=%s, output_file=%s, format=%s, ordered=%t, concurrency=%d",
+		args.InputFile, args.OutputFile, args.Format, args.Ordered, args.Concurrency,
+	)
+	var opts []statistics.Option
+	if args.MetricsAddr != "" {
+		opts = append(opts, statistics.WithMetricsAddr(args.MetricsAddr))
+	}
+	if args.MetricsFile != "" {
+		opts = append(opts, statistics.WithMetricsFile(args.MetricsFile))
+	}
+	const bytesInKB = 1024
+	opts = append(opts,
+		statistics.WithChunkSize(args.ChunkSizeKB*bytesInKB),
+		statistics.WithIOMode(args.IO),
+		statistics.WithDistance(args.Distance),
+	)
+	if args.RoadNetwork != "" {
+		opts = append(opts, statistics.WithRoadNetwork(args.RoadNetwork, args.SnapMeters))
+	}
+	if filter := args.FilterArgs.option(); filter != nil {
+		opts = append(opts, filter)
+	}
+	cfg := statistics.ExportConfig{Format: args.Format, Ordered: args.Ordered}
+	err := statistics.ExportRides(args.InputFile, args.OutputFile, args.Concurrency, cfg, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
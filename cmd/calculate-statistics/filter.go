@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics"
+)
+
+// FilterArgs are the rides filter flags shared by the commands.
+type FilterArgs struct {
+	From        dateTime      `help:"include rides started at or after this UTC date or time, e.g. 2014-07-17 or 2014-07-17T10:00:00Z"` // nolint: lll
+	To          dateTime      `help:"include rides started before this UTC date or time, e.g. 2014-07-18 or 2014-07-17T12:00:00Z"`      // nolint: lll
+	MinDuration time.Duration `arg:"--min-duration" help:"include rides lasting at least this long, e.g. 60s or 5m"`
+	MaxDuration time.Duration `arg:"--max-duration" help:"include rides lasting at most this long, e.g. 2h"`
+	MinDistance float64       `arg:"--min-distance" help:"include rides with distance of at least this many meters"`
+	MinPoints   int           `arg:"--min-points" help:"include rides with at least this many points"`
+	Filter      string        `help:"boolean expression over ride fields, e.g. 'duration >= 60 && (points > 2 || distance > 1000)'"` // nolint: lll
+}
+
+// option returns the filter option, it's nil if no filter flags are set.
+func (fa *FilterArgs) option() statistics.Option {
+	f := statistics.Filter{
+		From:        time.Time(fa.From),
+		To:          time.Time(fa.To),
+		MinDuration: fa.MinDuration,
+		MaxDuration: fa.MaxDuration,
+		MinDistance: fa.MinDistance,
+		MinPoints:   fa.MinPoints,
+		Expression:  fa.Filter,
+	}
+	if f == (statistics.Filter{}) {
+		return nil
+	}
+	return statistics.WithFilter(f)
+}
+
+// dateTime is a UTC time parsed from a date or an RFC 3339 time.
+type dateTime time.Time
+
+func (dt *dateTime) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			*dt = dateTime(t.UTC())
+			return nil
+		}
+	}
+	return errors.Errorf("invalid time %q, expected a date like 2014-07-17 or a time like 2014-07-17T10:00:00Z", text)
+}
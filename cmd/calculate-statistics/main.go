@@ -2,27 +2,186 @@ package main
 
 import (
 	"log"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/alexflint/go-arg"
+	"github.com/pkg/errors"
 
 	"github.com/georgysavva/ride-statistics/pkg/statistics"
 )
 
+const programName = "calculate-statistics"
+
 type Args struct {
-	Concurrency int    `default:"64" help:"number of workers that will process file in parallel"`
-	InputFile   string `arg:"positional" default:"recorded_rides.csv" help:"path to the input csv file with recorded rides [default: recorded_rides.csv]"` // nolint: lll
-	OutputFile  string `arg:"positional" default:"statistics.csv" help:"path to the output csv file to write statistics to [default: statistics.csv]"`     // nolint: lll
+	Concurrency int      `default:"64" help:"number of workers that will process file in parallel"`
+	MetricsAddr string   `arg:"--metrics-addr" help:"address to serve Prometheus metrics on during the run, e.g. :9090"`
+	MetricsFile string   `arg:"--metrics-file" help:"path to the file to write the final Prometheus metrics snapshot to"`
+	Checkpoint  string   `help:"path to the checkpoint file to process an append-only input file incrementally"`
+	Progress    string   `arg:"--progress-file" help:"path to the file to periodically save the run progress to"`
+	ProgressMB  int      `arg:"--progress-interval-mb" default:"64" help:"amount of the input file in MB to process between progress saves"` // nolint: lll
+	Resume      bool     `help:"continue the run from the progress file"`
+	ChunkSizeKB int      `arg:"--chunk-size-kb" default:"1024" help:"size of chunks in KB the input file is split into for parallel reading"`       // nolint: lll
+	IO          string   `arg:"--io" default:"read" help:"how to read the input file: read or mmap, mmap falls back to read if it's not available"` // nolint: lll
+	Distance    string   `default:"haversine" help:"ride distance calculation: haversine, vincenty or equirectangular"`
+	RoadNetwork string   `arg:"--road-network" help:"path to the OSM PBF or GeoJSON file with roads to snap ride points to"`                  // nolint: lll
+	SnapMeters  float64  `arg:"--max-snap-distance" default:"50" help:"max distance in meters from a point to a road to snap it"`             // nolint: lll
+	Zones       string   `help:"zones for per-zone reports: geohash:<precision> grid, e.g. geohash:6, or path to GeoJSON file with polygons"` // nolint: lll
+	ByDropoff   bool     `arg:"--zones-by-dropoff" help:"bucket rides by drop-off zones as well as pickup zones"`
+	TimeSeries  string   `arg:"--time-series" help:"report per period: day, week or rolling:<days>, written as a long-format csv"`                              // nolint: lll
+	Bootstrap   int      `arg:"--bootstrap-iterations" help:"calculate 95% confidence intervals of percentiles with this many bootstrap iterations, e.g. 1000"` // nolint: lll
+	Seed        int64    `arg:"--bootstrap-seed" default:"1" help:"seed of the bootstrap resampling"`
+	Metric      string   `arg:"--metric" default:"duration" help:"ride metric to calculate percentiles of: duration, speed in km/h or pace per km"`                                // nolint: lll
+	Percentile  string   `arg:"--percentile-method" default:"linear" help:"percentile method as in numpy.percentile, e.g. inverted_cdf or hazen, or round as the earlier reports"` // nolint: lll
+	Trim        string   `arg:"--trim-outliers" help:"trim outliers of each cell before its percentile is calculated: iqr or mad"`                                                 // nolint: lll
+	TrimK       float64  `arg:"--trim-k" help:"multiplier of the spread for outliers trimming [default: 1.5 for iqr, 3.5 for mad]"`                                                // nolint: lll
+	Histogram   string   `arg:"--histogram" help:"write duration histograms of cells instead of percentiles: linear:<width>:<max> or log:<min>:<max>:<bins>, e.g. linear:1m:1h"`   // nolint: lll
+	HistFormat  string   `arg:"--histogram-format" default:"csv" help:"format of the histogram report: csv or json"`
+	DurFormat   string   `arg:"--duration-format" default:"go" help:"format of durations in the report: go, seconds, seconds_float, minutes or hh:mm:ss"` // nolint: lll
+	OutFormat   string   `arg:"--output-format" default:"csv" help:"format of the output file: csv or xlsx with a sheet per report"`                      // nolint: lll
+	UpperIncl   bool     `arg:"--distance-upper-inclusive" help:"include upper bounds of distance ranges instead of lower bounds"`                        // nolint: lll
+	MinSpeed    float64  `arg:"--min-speed" help:"drop rides with the average speed below this many km/h"`
+	MaxSpeed    float64  `arg:"--max-speed" help:"drop rides with the average speed above this many km/h"`
+	RidesDump   string   `arg:"--rides-dump" help:"path to the file to write the data of each ride to"`
+	DumpFormat  string   `arg:"--rides-dump-format" default:"csv" help:"format of the rides dump file: csv or ndjson"`
+	MaxMemory   byteSize `arg:"--max-memory" help:"approximate memory budget, e.g. 512MB or 2GB, durations that don't fit are spilled to disk"`              // nolint: lll
+	SpillDir    string   `arg:"--spill-dir" help:"directory for files with spilled durations [default: system temporary directory]"`                         // nolint: lll
+	InputFile   string   `arg:"positional" default:"recorded_rides.csv" help:"path to the input csv file with recorded rides [default: recorded_rides.csv]"` // nolint: lll
+	OutputFile  string   `arg:"positional" default:"statistics.csv" help:"path to the output csv file to write statistics to [default: statistics.csv]"`     // nolint: lll
+	FilterArgs
+}
+
+func (Args) Description() string {
+	return "Calculates rides statistics report. Other commands: serve, export-rides, diff."
+}
+
+var subcommands = map[string]func(args []string){
+	"serve":        runServe,
+	"export-rides": runExportRides,
+	"diff":         runDiff,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			run(os.Args[2:])
+			return
+		}
+	}
+	runCalculate(os.Args[1:])
+}
+
+func runCalculate(rawArgs []string) {
 	args := &Args{}
-	arg.MustParse(args)
+	mustParse(programName, rawArgs, args)
 
 	log.Printf(
 		"Start calculating rides statitstics; input_file=%s, output_file=%s, concurrency=%d",
 		args.InputFile, args.OutputFile, args.Concurrency,
 	)
-	if err := statistics.CalculateRidesStatistics(args.InputFile, args.OutputFile, args.Concurrency); err != nil {
+	var opts []statistics.Option
+	if args.MetricsAddr != "" {
+		opts = append(opts, statistics.WithMetricsAddr(args.MetricsAddr))
+	}
+	if args.MetricsFile != "" {
+		opts = append(opts, statistics.WithMetricsFile(args.MetricsFile))
+	}
+	if args.Checkpoint != "" {
+		opts = append(opts, statistics.WithCheckpoint(args.Checkpoint))
+	}
+	if args.Progress != "" {
+		const bytesInMB = 1024 * 1024
+		opts = append(opts, statistics.WithProgressFile(args.Progress, args.ProgressMB*bytesInMB))
+	}
+	const bytesInKB = 1024
+	opts = append(opts, statistics.WithChunkSize(args.ChunkSizeKB*bytesInKB), statistics.WithIOMode(args.IO))
+	if args.Resume {
+		opts = append(opts, statistics.WithResume())
+	}
+	opts = append(opts, statistics.WithDistance(args.Distance))
+	if args.RoadNetwork != "" {
+		opts = append(opts, statistics.WithRoadNetwork(args.RoadNetwork, args.SnapMeters))
+	}
+	if args.Zones != "" {
+		opts = append(opts, statistics.WithZones(args.Zones, args.ByDropoff))
+	}
+	if args.TimeSeries != "" {
+		opts = append(opts, statistics.WithTimeSeries(args.TimeSeries))
+	}
+	if args.Bootstrap != 0 {
+		opts = append(opts, statistics.WithConfidenceIntervals(args.Bootstrap, args.Seed))
+	}
+	opts = append(opts, statistics.WithPercentileMethod(args.Percentile))
+	opts = append(opts, statistics.WithMetric(args.Metric))
+	opts = append(opts, statistics.WithDurationFormat(args.DurFormat), statistics.WithOutputFormat(args.OutFormat))
+	if args.UpperIncl {
+		opts = append(opts, statistics.WithUpperInclusiveDistances())
+	}
+	if args.Trim != "" {
+		opts = append(opts, statistics.WithOutlierTrimming(args.Trim, args.TrimK))
+	}
+	if args.Histogram != "" {
+		opts = append(opts, statistics.WithHistogram(args.Histogram, args.HistFormat))
+	}
+	if args.MinSpeed != 0 || args.MaxSpeed != 0 {
+		opts = append(opts, statistics.WithSpeedLimits(args.MinSpeed, args.MaxSpeed))
+	}
+	if args.RidesDump != "" {
+		opts = append(opts, statistics.WithRidesDump(args.RidesDump, args.DumpFormat))
+	}
+	if args.MaxMemory != 0 {
+		opts = append(opts, statistics.WithMaxMemory(int(args.MaxMemory), args.SpillDir))
+	}
+	if filter := args.FilterArgs.option(); filter != nil {
+		opts = append(opts, filter)
+	}
+	err := statistics.CalculateRidesStatistics(args.InputFile, args.OutputFile, args.Concurrency, opts...)
+	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// byteSize is a number of bytes parsed from a string with an optional KB, MB or GB suffix.
+type byteSize int
+
+func (b *byteSize) UnmarshalText(text []byte) error {
+	s := strings.ToUpper(strings.TrimSpace(string(text)))
+	multiplier := 1
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int
+	}{
+		{suffix: "KB", multiplier: 1 << 10},
+		{suffix: "MB", multiplier: 1 << 20},
+		{suffix: "GB", multiplier: 1 << 30},
+		{suffix: "B", multiplier: 1},
+	} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return errors.Errorf("invalid size %q, expected a number with an optional KB, MB or GB suffix", text)
+	}
+	*b = byteSize(n * multiplier)
+	return nil
+}
+
+func mustParse(program string, rawArgs []string, dest interface{}) {
+	p, err := arg.NewParser(arg.Config{Program: program}, dest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = p.Parse(rawArgs)
+	switch {
+	case errors.Is(err, arg.ErrHelp):
+		p.WriteHelp(os.Stdout)
+		os.Exit(0)
+	case err != nil:
+		p.Fail(err.Error())
+	}
+}
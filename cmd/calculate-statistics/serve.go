@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics"
+)
+
+const serverReadHeaderTimeout = 5 * time.Second
+
+type ServeArgs struct {
+	Concurrency    int           `default:"64" help:"number of workers that will process file in parallel"`
+	Addr           string        `default:":8080" help:"address to serve the http api on"`
+	ReloadInterval time.Duration `arg:"--reload-interval" help:"interval to recalculate the report from the input file at, e.g. 1h; SIGHUP triggers a reload as well"` // nolint: lll
+	InputFile      string        `arg:"positional" default:"recorded_rides.csv" help:"path to the input csv file with recorded rides [default: recorded_rides.csv]"`   // nolint: lll
+}
+
+func (ServeArgs) Description() string {
+	return "Serves rides statistics over http: GET /report, " +
+		"GET /p95?start=<RFC 3339 time>&distance_km=<km> and GET /predict?start=<RFC 3339 time>&distance_km=<km>."
+}
+
+func runServe(rawArgs []string) {
+	args := &ServeArgs{}
+	mustParse(programName+" serve", rawArgs, args)
+
+	log.Printf(
+		"Start serving rides statistics; input_file=%s, addr=%s, reload_interval=%s, concurrency=%d",
+		args.InputFile, args.Addr, args.ReloadInterval, args.Concurrency,
+	)
+	service := statistics.NewService(args.InputFile, args.Concurrency)
+	if err := service.Reload(); err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Addr: args.Addr, Handler: service.Handler(), ReadHeaderTimeout: serverReadHeaderTimeout}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	stopSignal := make(chan os.Signal, 1)
+	signal.Notify(stopSignal, os.Interrupt, syscall.SIGTERM)
+	var reloadTick <-chan time.Time
+	if args.ReloadInterval > 0 {
+		ticker := time.NewTicker(args.ReloadInterval)
+		defer ticker.Stop()
+		reloadTick = ticker.C
+	}
+	for {
+		select {
+		case <-reloadSignal:
+			reload(service)
+		case <-reloadTick:
+			reload(service)
+		case err := <-serverErr:
+			log.Fatal(errors.Wrap(err, "http server failed"))
+		case <-stopSignal:
+			log.Printf("Stop serving rides statistics")
+			if err := server.Shutdown(context.Background()); err != nil {
+				log.Fatal(errors.Wrap(err, "can't shutdown http server"))
+			}
+			return
+		}
+	}
+}
+
+func reload(service *statistics.Service) {
+	if err := service.Reload(); err != nil {
+		log.Printf("Can't reload report, keep serving the previous one: %+v", err)
+	}
+}
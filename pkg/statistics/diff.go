@@ -0,0 +1,46 @@
+package statistics
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/reportdiff"
+)
+
+type DiffSummary struct {
+	Cells int
+	// Exceeded is the number of cells changed more than the threshold or missing in one of the reports.
+	Exceeded int
+}
+
+// DiffReports compares two reports written by CalculateRidesStatistics, the report of all rides or the zones report,
+// and writes per cell absolute and relative changes as csv into w.
+// The threshold is relative, e.g. 0.1 for 10%, cells changed more than it are marked in the output.
+func DiffReports(oldPath, newPath string, w io.Writer, threshold float64) (*DiffSummary, error) {
+	if threshold < 0 {
+		return nil, errors.New("threshold must not be negative")
+	}
+	oldReport, err := reportdiff.ReadCSVFile(oldPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	newReport, err := reportdiff.ReadCSVFile(newPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	changes, err := reportdiff.Compare(oldReport, newReport, threshold)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't compare reports")
+	}
+	if err := reportdiff.WriteCSV(w, newReport.KeyColumns, changes); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	summary := &DiffSummary{Cells: len(changes)}
+	for _, c := range changes {
+		if c.Exceeds {
+			summary.Exceeded++
+		}
+	}
+	return summary, nil
+}
@@ -0,0 +1,70 @@
+package statistics
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/fileread"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/metrics"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/rideexport"
+)
+
+// orderedExportChunksPerReader limits how many chunks each reader can take ahead of the oldest one
+// not yet written by the ordered export, so the rides kept for reordering stay within that many chunks.
+const orderedExportChunksPerReader = 4
+
+type ExportConfig struct {
+	// Format is the output file format: "csv" or "ndjson".
+	Format string
+	// Ordered makes rides written in the input file order, otherwise they are written as soon as they are processed.
+	Ordered bool
+}
+
+// ExportRides writes the data of each ride from the input file into the output file instead of aggregating it.
+// The input file is read and processed in parallel the same way as for the report,
+// so the reading, distance and filter options apply, the others are ignored.
+func ExportRides(inputPath, outputPath string, concurrency int, cfg ExportConfig, opts ...Option) error {
+	o := newOptions(opts)
+	if err := o.validate(); err != nil {
+		return errors.WithStack(err)
+	}
+	if concurrency <= 0 {
+		return errors.New("concurrency parameter must be a positive number")
+	}
+	return errors.WithStack(runWithMetrics(o, func(m *metrics.Pipeline) error {
+		if err := o.loadRoadNetwork(); err != nil {
+			return errors.WithStack(err)
+		}
+		budget := newMemoryBudget(o.maxMemory, concurrency)
+		ridesChannel := make(chan *ride.DataBatch, budget.rideBatchesBufferSize)
+		m.ObserveChannel("ride_batches", func() (int, int) {
+			return len(ridesChannel), cap(ridesChannel)
+		})
+		if cfg.Ordered {
+			o.chunkWindow = make(chan struct{}, orderedExportChunksPerReader*concurrency)
+		}
+		exportWait, err := rideexport.StartExport(ridesChannel, outputPath, cfg.Format, cfg.Ordered, o.chunkWindow)
+		if err != nil {
+			return errors.Wrap(err, "can't start rides export")
+		}
+		m.StartStage(metrics.StageReport)
+		processWait, err := startProcessing(
+			inputPath, fileread.WholeFile, concurrency, o, budget.rowBatchesBufferSize, ridesChannel, m,
+		)
+		if err != nil {
+			// Nothing is sent into the rides channel, closing it lets the export stage finish.
+			close(ridesChannel)
+		} else {
+			err = processWait()
+		}
+		// The export is waited for even if processing fails, so the output file isn't left open.
+		if exportErr := exportWait(); exportErr != nil && err == nil {
+			err = errors.Wrap(exportErr, "rides export failed")
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		m.FinishStage(metrics.StageReport)
+		return nil
+	}))
+}
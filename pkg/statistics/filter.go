@@ -0,0 +1,41 @@
+package statistics
+
+import (
+	"time"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ridefilter"
+)
+
+// Filter defines which rides are included, zero fields don't filter rides.
+type Filter struct {
+	// From and To is the range of the ride start time, From is inclusive and To is exclusive.
+	From time.Time
+	To   time.Time
+	// MinDuration and MaxDuration are inclusive, the ride duration is in whole seconds.
+	MinDuration time.Duration
+	MaxDuration time.Duration
+	// MinDistance is in meters, inclusive.
+	MinDistance float64
+	MinPoints   int
+	// Expression is a boolean expression over the ride fields, e.g. "duration >= 60 && (points > 2 || distance > 1000)".
+	// Fields are ride_id, start_ts, end_ts, duration, distance, points, start_lat, start_lng, end_lat, end_lng,
+	// max_speed and avg_speed in the same units as in the rides export.
+	// Comparisons are combined with && and || and negated with !.
+	Expression string
+}
+
+// WithFilter enables filtering rides after they are processed, so only the rides passing the filter are aggregated.
+// The number of rejected rides is reported per filter in the run summary and the dropped rides metric.
+func WithFilter(f Filter) Option {
+	return func(o *options) {
+		o.filter = ridefilter.Config{
+			From:        f.From,
+			To:          f.To,
+			MinDuration: f.MinDuration,
+			MaxDuration: f.MaxDuration,
+			MinDistance: f.MinDistance,
+			MinPoints:   f.MinPoints,
+			Expression:  f.Expression,
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package statistics
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/fileread"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/metrics"
+)
+
+// Histogram report formats.
+const (
+	HistogramFormatCSV  = "csv"
+	HistogramFormatJSON = "json"
+)
+
+// parseHistogramBins parses the histogram spec: "linear:<width>:<max>" or "log:<min>:<max>:<bins>",
+// the width, min and max are durations, e.g. linear:1m:1h or log:10s:10h:20.
+func parseHistogramBins(spec string) (aggregation.Bins, error) {
+	parts := strings.Split(spec, ":")
+	switch {
+	case parts[0] == "linear" && len(parts) == 3:
+		width, widthErr := time.ParseDuration(parts[1])
+		max, maxErr := time.ParseDuration(parts[2])
+		if widthErr == nil && maxErr == nil {
+			bins, err := aggregation.NewLinearBins(width.Seconds(), max.Seconds())
+			return bins, errors.WithStack(err)
+		}
+	case parts[0] == "log" && len(parts) == 4:
+		min, minErr := time.ParseDuration(parts[1])
+		max, maxErr := time.ParseDuration(parts[2])
+		n, nErr := strconv.Atoi(parts[3])
+		if minErr == nil && maxErr == nil && nErr == nil {
+			bins, err := aggregation.NewLogBins(min.Seconds(), max.Seconds(), n)
+			return bins, errors.WithStack(err)
+		}
+	}
+	return aggregation.Bins{}, errors.Errorf(
+		"invalid histogram %q, expected linear:<width>:<max> or log:<min>:<max>:<bins>, e.g. linear:1m:1h", spec,
+	)
+}
+
+func calculateHistogramReport(inputPath string, concurrency int, o *options, m *metrics.Pipeline,
+) (aggregation.HistogramReport, aggregation.Bins, error) {
+	if concurrency <= 0 {
+		return nil, aggregation.Bins{}, errors.New("concurrency parameter must be a positive number")
+	}
+	bins, err := parseHistogramBins(o.histogram)
+	if err != nil {
+		return nil, aggregation.Bins{}, errors.WithStack(err)
+	}
+	if err := o.loadRoadNetwork(); err != nil {
+		return nil, aggregation.Bins{}, errors.WithStack(err)
+	}
+	aggregator, err := aggregateRides(inputPath, fileread.WholeFile, concurrency, o, nil, m)
+	if err != nil {
+		return nil, aggregation.Bins{}, errors.WithStack(err)
+	}
+	return aggregator.HistogramReport(), bins, nil
+}
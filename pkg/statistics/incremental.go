@@ -0,0 +1,83 @@
+package statistics
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/checkpoint"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/fileread"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/metrics"
+)
+
+func calculateIncrementalReport(inputPath string, concurrency int, o *options, m *metrics.Pipeline,
+) (aggregation.StatisticsReport, error) {
+	var (
+		start int
+		state *aggregation.State
+	)
+	cp, err := checkpoint.Load(o.checkpointFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if cp != nil {
+		matches, err := cp.Matches(inputPath)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		switch {
+		case !matches:
+			log.Printf("Input file doesn't match the checkpoint, process it from the beginning")
+		case cp.OptionsFingerprint != o.stateFingerprint():
+			log.Printf("Options changed since the checkpoint was saved, process input file from the beginning")
+		default:
+			start = cp.Offset
+			state = cp.State
+			log.Printf("Continue processing input file from the checkpoint offset %d", start)
+		}
+	}
+
+	// The last ride can be continued by rows appended to the input file later,
+	// so it isn't included into the checkpoint and the next run processes it again.
+	lastRideOffset, err := fileread.LastRideOffset(inputPath, start)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't find the last ride in the input file")
+	}
+	// Intermediate progress is saved into the checkpoint as well, so a crashed run is continued by the next one.
+	saveProgress := func(offset int, state *aggregation.State) error {
+		return errors.WithStack(saveCheckpoint(inputPath, o.checkpointFile, o.stateFingerprint(), offset, state))
+	}
+	aggregator, err := aggregateRidesWithProgress(
+		inputPath, fileread.Range{Start: start, End: lastRideOffset}, concurrency, o, state, m, saveProgress,
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	state = aggregator.State()
+	if err := saveProgress(lastRideOffset, state); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	const lastRideConcurrency = 1
+	lastRideRange := fileread.Range{Start: lastRideOffset, End: fileread.ToEnd}
+	aggregator, err = aggregateRides(inputPath, lastRideRange, lastRideConcurrency, o, state, m)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return aggregator.Report95Percentile(), nil
+}
+
+// stateFingerprint is a checksum of the options that change the aggregated state:
+// which rides are kept and which cells they fall into.
+func (o *options) stateFingerprint() uint32 {
+	fields := fmt.Sprintf(
+		"distance=%s road_network=%s max_snap_distance=%g zones=%s zones_by_dropoff=%t filter=%+v "+
+			"min_speed=%g max_speed=%g trimming=%s trimming_k=%g metric=%s upper_inclusive=%t",
+		o.distance, o.roadNetwork, o.maxSnapDistance, o.zones, o.zonesByDropoff, o.filter,
+		o.minSpeed, o.maxSpeed, o.trimming, o.trimmingK, o.metric, o.upperInclusive,
+	)
+	return crc32.ChecksumIEEE([]byte(fields))
+}
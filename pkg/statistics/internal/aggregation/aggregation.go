@@ -9,12 +9,55 @@ import (
 	"time"
 
 	"github.com/emirpasic/gods/maps/treemap"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/metrics"
 	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/spill"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/zone"
 )
 
 type StatisticsReport []*HourStatistics
 
+// ZonesReport contains a statistics report for each zone that has rides, ordered by zones.
+type ZonesReport []*ZoneStatistics
+
+type ZoneStatistics struct {
+	Zone
+	Report StatisticsReport
+}
+
+// Zone identifies the ride pickup zone and the drop-off zone if rides are bucketed by drop-off zones as well.
+// It's empty if zones aren't enabled.
+type Zone struct {
+	Pickup  string
+	Dropoff string
+}
+
+// PeriodsReport contains a statistics report for each period, ordered by periods start.
+type PeriodsReport []*PeriodStatistics
+
+type PeriodStatistics struct {
+	// Start is the UTC period start as a UNIX timestamp.
+	Start  int
+	Report StatisticsReport
+}
+
+// Time series periods rides can be bucketed by, periods are in UTC and weeks start on Monday.
+const (
+	PeriodDay  = "day"
+	PeriodWeek = "week"
+)
+
+// bucket identifies rides that have their own cells: rides of the same zone and period.
+// It's empty if zones and time series aren't enabled.
+type bucket struct {
+	zone Zone
+	// period is the period start, see PeriodStatistics.
+	period int
+}
+
 type HourStatistics struct {
 	StartHour          int
 	DistanceStatistics []*DistanceStatistics
@@ -22,7 +65,14 @@ type HourStatistics struct {
 
 type DistanceStatistics struct {
 	DistanceRange int
-	Value         int
+	// Value is rounded to whole seconds like durations.
+	Value int
+	// Fraction is the part of the value lost in rounding, it isn't zero if the percentile method interpolates.
+	Fraction float64
+	// Count is the number of rides the value is calculated from.
+	Count int
+	// Interval is the confidence interval of the value, it's nil unless confidence intervals are enabled.
+	Interval *Interval
 }
 
 var distanceRanges = [...]int{1, 2, 3, 5, 8, 13, 21, DistanceRangeOver21KM}
@@ -32,66 +82,419 @@ const (
 	hoursRangesNo         = 24
 	percentile95          = 0.95
 	cellsNo               = len(distanceRanges) * hoursRangesNo
+	metersInKm            = 1000
 )
 
+// State is a snapshot of all durations collected by the aggregator.
+// It can be persisted and merged into another aggregator later.
+type State struct {
+	Cells []*CellState `json:"cells"`
+}
+
+type CellState struct {
+	StartHour     int   `json:"start_hour"`
+	DistanceRange int   `json:"distance_range"`
+	Durations     []int `json:"durations"`
+}
+
 type RidesAggregator struct {
-	wg   *sync.WaitGroup
-	inCh <-chan *ride.Data
+	wg      *sync.WaitGroup
+	inCh    <-chan *ride.DataBatch
+	metrics *metrics.Pipeline
+
+	// partials are filled by collecting workers, each worker has its own partial cells,
+	// so workers don't contend on locks. Partial cells are merged into cells when collecting finishes.
+	partials []workerCells
+
+	// spilling is nil unless EnableSpilling is called.
+	spilling *spilling
+	// zones are nil unless EnableZones is called.
+	zones *zones
+	// period is empty unless EnableTimeSeries is called.
+	period string
+	// bootstrap is nil unless EnableConfidenceIntervals is called.
+	bootstrap *bootstrap
+	// percentile is the PercentileLinear method unless SetPercentileMethod is called.
+	percentile percentileMethod
+	// trimming is nil unless EnableOutlierTrimming is called.
+	trimming *trimming
+	// speedLimits are nil unless EnableSpeedLimits is called.
+	speedLimits *speedLimits
+	// bins are nil unless EnableHistograms is called.
+	bins *Bins
+	// upperInclusive is false unless EnableUpperInclusiveDistances is called.
+	upperInclusive bool
+	// metric is empty unless SetMetric is called, cells collect durations then.
+	// Otherwise cells durations are values of the metric.
+	metric string
 
-	// cells are two level nested sorted map
+	// cells contain cells of each bucket, without zones and time series there are only the cells of the empty bucket.
+	// Bucket cells are two level nested sorted map
 	// where the first dimension is hours ranges and the second dimension is distance ranges.
 	// Each individual cell contains a list of all collected durations for cell's hour and distance ranges.
-	cells *treemap.Map
+	cells map[bucket]*treemap.Map
+}
+
+type zones struct {
+	pickup zone.Locator
+	// dropoff is nil if rides aren't bucketed by drop-off zones.
+	dropoff zone.Locator
 }
 
-func NewRidesAggregator(in <-chan *ride.Data) *RidesAggregator {
+// partialCells contains durations collected by a single worker indexed by start hour and distance range index.
+type partialCells [hoursRangesNo][len(distanceRanges)][]int
+
+// workerCells contains partial cells of each bucket collected by a single worker.
+type workerCells map[bucket]*partialCells
+
+func NewRidesAggregator(in <-chan *ride.DataBatch, m *metrics.Pipeline) *RidesAggregator {
+	return &RidesAggregator{
+		inCh:       in,
+		cells:      map[bucket]*treemap.Map{{}: newBucketCells()},
+		wg:         new(sync.WaitGroup),
+		metrics:    m,
+		percentile: percentileMethods[PercentileLinear],
+	}
+}
+
+func newBucketCells() *treemap.Map {
 	cells := treemap.NewWithIntComparator()
 	for startHour := 0; startHour < hoursRangesNo; startHour++ {
 		cellsPerHour := treemap.NewWithIntComparator()
 		for _, startDistance := range distanceRanges {
-			cellsPerHour.Put(startDistance, &aggregationCell{mx: new(sync.Mutex)})
+			cellsPerHour.Put(startDistance, &aggregationCell{})
 		}
 		cells.Put(startHour, cellsPerHour)
 	}
-	return &RidesAggregator{
-		inCh:  in,
-		cells: cells,
-		wg:    new(sync.WaitGroup),
+	return cells
+}
+
+// EnableZones makes the aggregator bucket rides by the pickup zone and by the drop-off zone if dropoff isn't nil.
+// Rides outside of the zones are dropped. It must be called before StartCollecting.
+// State isn't supported for an aggregator with zones enabled, the report is returned by ZonesReport.
+func (ra *RidesAggregator) EnableZones(pickup, dropoff zone.Locator) {
+	ra.zones = &zones{pickup: pickup, dropoff: dropoff}
+}
+
+// EnableUpperInclusiveDistances makes distance ranges include their upper bounds instead of lower bounds:
+// (lower, upper] instead of [lower, upper), a ride of exactly 2 km is counted in the 1-2 km range instead of 2-3 km.
+// The first range includes zero distance anyway. It must be called before StartCollecting.
+func (ra *RidesAggregator) EnableUpperInclusiveDistances() {
+	ra.upperInclusive = true
+}
+
+// EnableTimeSeries makes the aggregator bucket rides by the period of the ride start: PeriodDay or PeriodWeek.
+// It must be called before StartCollecting.
+// State isn't supported for an aggregator with time series enabled, the report is returned by PeriodsReport.
+func (ra *RidesAggregator) EnableTimeSeries(period string) error {
+	switch period {
+	case PeriodDay, PeriodWeek:
+	default:
+		return errors.Errorf("unknown time series period: %s", period)
+	}
+	ra.period = period
+	return nil
+}
+
+// EnableSpilling limits the number of durations kept in memory while collecting.
+// When the limit is exceeded collected durations are sorted and written into a temporary file in the dir as runs,
+// the runs are merged when the report is calculated. It must be called before StartCollecting.
+// State isn't supported for an aggregator with spilling enabled.
+func (ra *RidesAggregator) EnableSpilling(maxDurations int, dir string) error {
+	if maxDurations <= 0 {
+		return errors.New("max durations must be a positive number")
 	}
+	store, err := spill.NewStore(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	ra.spilling = &spilling{store: store, maxDurations: maxDurations, mx: new(sync.Mutex)}
+	return nil
 }
 
-func (ra *RidesAggregator) StartCollecting() {
-	workersNum := cellsNo
-	ra.wg.Add(workersNum)
-	for i := 0; i < workersNum; i++ {
+// StartCollecting starts workers that read rides data from the in channel into their partial cells.
+func (ra *RidesAggregator) StartCollecting(workersNo int) {
+	ra.partials = make([]workerCells, workersNo)
+	ra.wg.Add(workersNo)
+	maxPartialDurations := 0
+	if ra.spilling != nil {
+		maxPartialDurations = ra.spilling.maxDurations / workersNo
+		if maxPartialDurations == 0 {
+			maxPartialDurations = 1
+		}
+	}
+	for i := range ra.partials {
+		partial := workerCells{}
+		ra.partials[i] = partial
 		go func() {
 			defer ra.wg.Done()
-			ra.writeRideDataToCell()
+			ra.collect(partial, maxPartialDurations)
 		}()
 	}
 }
 
-func (ra *RidesAggregator) Finish() {
+// Finish waits for all rides data to be collected and prepares cells for the report.
+// The error is returned only if spilling is enabled and it fails.
+func (ra *RidesAggregator) Finish() error {
 	ra.wg.Wait()
+	err := ra.finishCells()
+	if ra.spilling != nil {
+		if closeErr := ra.spilling.store.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return errors.WithStack(err)
+}
 
-	finishWG := &sync.WaitGroup{}
-	finishWG.Add(cellsNo)
-	ra.cells.Each(func(_ interface{}, hourCellsValue interface{}) {
-		hourCells := hourCellsValue.(*treemap.Map)
-		hourCells.Each(func(_ interface{}, cellValue interface{}) {
+func (ra *RidesAggregator) finishCells() error {
+	if ra.spilling != nil {
+		if err := ra.spilling.error(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	for _, worker := range ra.partials {
+		for b, partial := range worker {
+			for hour := range partial {
+				for i, durations := range partial[hour] {
+					if len(durations) != 0 {
+						ra.cell(b, hour, distanceRanges[i]).add(durations...)
+					}
+				}
+			}
+		}
+	}
+	ra.partials = nil
+
+	finishGroup := &errgroup.Group{}
+	for b, bucketCells := range ra.cells {
+		b := b
+		bucketCells.Each(func(hourKey interface{}, hourCellsValue interface{}) {
+			hourCells := hourCellsValue.(*treemap.Map)
+			hourCells.Each(func(distanceKey interface{}, cellValue interface{}) {
+				cell := cellValue.(*aggregationCell)
+				hour, dr := hourKey.(int), distanceKey.(int)
+				finishGroup.Go(func() error {
+					cell.sort()
+					var store *spill.Store
+					if ra.spilling != nil {
+						store = ra.spilling.store
+					}
+					if err := ra.trim(cell, store); err != nil {
+						return errors.WithStack(err)
+					}
+					if ra.bins != nil {
+						if err := cell.countBins(store, ra.bins); err != nil {
+							return errors.WithStack(err)
+						}
+					}
+					count := cell.keptCount()
+					if count == 0 {
+						// Cells without rides have an empty interval, so all cells have intervals in the report.
+						if ra.bootstrap != nil {
+							cell.interval = &Interval{}
+						}
+						return nil
+					}
+					valuesAt := func(positions []int) ([]int, error) {
+						return cell.keptValuesAt(store, positions)
+					}
+					var err error
+					if cell.percentile95, err = ra.percentile(count, percentile95).value(valuesAt); err != nil {
+						return errors.WithStack(err)
+					}
+					if ra.bootstrap == nil {
+						return nil
+					}
+					cell.interval, err = ra.bootstrap.interval(count, ra.percentile, b, hour, dr, valuesAt)
+					return errors.WithStack(err)
+				})
+			})
+		})
+	}
+	return errors.WithStack(finishGroup.Wait())
+}
+
+// Merge adds durations from the state to the aggregator cells. It must be called before Finish.
+func (ra *RidesAggregator) Merge(state *State) error {
+	for _, cs := range state.Cells {
+		hourCellsValue, found := ra.cells[bucket{}].Get(cs.StartHour)
+		if !found {
+			return errors.Errorf("state contains unknown hour %d", cs.StartHour)
+		}
+		cellValue, found := hourCellsValue.(*treemap.Map).Get(cs.DistanceRange)
+		if !found {
+			return errors.Errorf("state contains unknown distance range %d", cs.DistanceRange)
+		}
+		cellValue.(*aggregationCell).add(cs.Durations...)
+	}
+	return nil
+}
+
+// State returns a snapshot of the collected durations. It must be called after Finish.
+func (ra *RidesAggregator) State() *State {
+	state := &State{Cells: make([]*CellState, 0, cellsNo)}
+	ra.cells[bucket{}].Each(func(hourKey interface{}, hourCellsValue interface{}) {
+		hourCellsValue.(*treemap.Map).Each(func(distanceKey interface{}, cellValue interface{}) {
 			cell := cellValue.(*aggregationCell)
-			go func() {
-				defer finishWG.Done()
-				cell.sort()
-			}()
+			if len(cell.durations) == 0 {
+				return
+			}
+			state.Cells = append(state.Cells, &CellState{
+				StartHour:     hourKey.(int),
+				DistanceRange: distanceKey.(int),
+				Durations:     append([]int(nil), cell.durations...),
+			})
 		})
 	})
-	finishWG.Wait()
+	return state
 }
 
+// Report95Percentile returns the report of all rides. It must be called after Finish.
+// It's empty if zones or time series are enabled, see ZonesReport and PeriodsReport.
 func (ra *RidesAggregator) Report95Percentile() StatisticsReport {
-	report := make(StatisticsReport, 0, ra.cells.Size())
-	ra.cells.Each(func(hourKey interface{}, hourCellsValue interface{}) {
+	return bucketReport(ra.cells[bucket{}])
+}
+
+// ZonesReport returns the report of each zone that has rides. It must be called after Finish.
+func (ra *RidesAggregator) ZonesReport() ZonesReport {
+	report := make(ZonesReport, 0, len(ra.cells))
+	for b, bucketCells := range ra.cells {
+		if ra.zones != nil && b.zone == (Zone{}) {
+			continue
+		}
+		report = append(report, &ZoneStatistics{Zone: b.zone, Report: bucketReport(bucketCells)})
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Pickup != report[j].Pickup {
+			return report[i].Pickup < report[j].Pickup
+		}
+		return report[i].Dropoff < report[j].Dropoff
+	})
+	return report
+}
+
+// PeriodsReport returns the report of each period that has rides. It must be called after Finish.
+func (ra *RidesAggregator) PeriodsReport() PeriodsReport {
+	report := make(PeriodsReport, 0, len(ra.cells))
+	for _, period := range ra.periods() {
+		report = append(report, &PeriodStatistics{Start: period, Report: bucketReport(ra.cells[bucket{period: period}])})
+	}
+	return report
+}
+
+// RollingReport returns the report of each days long window, windows start on each day from the first day with rides
+// until the window covers the last day with rides. If rides span less days than the window, there is a single window.
+// Time series must be enabled by days and spilling must be disabled, since windows merge durations of several days.
+// It must be called after Finish.
+func (ra *RidesAggregator) RollingReport(days int) (PeriodsReport, error) {
+	if ra.period != PeriodDay {
+		return nil, errors.New("rolling windows require time series by days")
+	}
+	if ra.spilling != nil {
+		return nil, errors.New("rolling windows can't be calculated with spilling enabled")
+	}
+	if days <= 0 {
+		return nil, errors.New("rolling window days must be a positive number")
+	}
+	const secondsInDay = 24 * 60 * 60
+	periods := ra.periods()
+	if len(periods) == 0 {
+		return PeriodsReport{}, nil
+	}
+	first, last := periods[0], periods[len(periods)-1]
+	lastStart := last - (days-1)*secondsInDay
+	if lastStart < first {
+		lastStart = first
+	}
+	report := make(PeriodsReport, 0, (lastStart-first)/secondsInDay+1)
+	for start := first; start <= lastStart; start += secondsInDay {
+		var windowCells []*treemap.Map
+		for day := start; day < start+days*secondsInDay; day += secondsInDay {
+			if cells, ok := ra.cells[bucket{period: day}]; ok {
+				windowCells = append(windowCells, cells)
+			}
+		}
+		windowReport, err := ra.windowReport(start, windowCells)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		report = append(report, &PeriodStatistics{Start: start, Report: windowReport})
+	}
+	return report, nil
+}
+
+// periods returns the sorted starts of periods that have rides.
+func (ra *RidesAggregator) periods() []int {
+	periods := make([]int, 0, len(ra.cells))
+	for b, bucketCells := range ra.cells {
+		hasRides := false
+		bucketCells.Each(func(_ interface{}, hourCellsValue interface{}) {
+			hourCellsValue.(*treemap.Map).Each(func(_ interface{}, cellValue interface{}) {
+				hasRides = hasRides || cellValue.(*aggregationCell).count() != 0
+			})
+		})
+		if ra.period != "" && hasRides {
+			periods = append(periods, b.period)
+		}
+	}
+	sort.Ints(periods)
+	return periods
+}
+
+// windowReport calculates the report of the rides from all the buckets cells together,
+// the window start identifies the window for confidence intervals resampling.
+func (ra *RidesAggregator) windowReport(start int, cells []*treemap.Map) (StatisticsReport, error) {
+	report := make(StatisticsReport, 0, hoursRangesNo)
+	for hour := 0; hour < hoursRangesNo; hour++ {
+		hs := &HourStatistics{StartHour: hour, DistanceStatistics: make([]*DistanceStatistics, 0, len(distanceRanges))}
+		report = append(report, hs)
+		for _, dr := range distanceRanges {
+			var (
+				windowCells []*aggregationCell
+				count       int
+			)
+			for _, bucketCells := range cells {
+				hourCellsValue, _ := bucketCells.Get(hour)
+				cellValue, _ := hourCellsValue.(*treemap.Map).Get(dr)
+				cell := cellValue.(*aggregationCell)
+				windowCells = append(windowCells, cell)
+				count += cell.keptCount()
+			}
+			valuesAt := func(positions []int) ([]int, error) {
+				iterators := make([]sortedIterator, 0, len(windowCells))
+				for _, cell := range windowCells {
+					iterators = append(iterators, &sliceIterator{values: cell.durations[cell.from:cell.to]})
+				}
+				return nthValues(iterators, positions)
+			}
+			ds := &DistanceStatistics{DistanceRange: dr, Count: count}
+			hs.DistanceStatistics = append(hs.DistanceStatistics, ds)
+			if count == 0 {
+				if ra.bootstrap != nil {
+					ds.Interval = &Interval{}
+				}
+				continue
+			}
+			value, err := ra.percentile(count, percentile95).value(valuesAt)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			ds.setValue(value)
+			if ra.bootstrap != nil {
+				b := bucket{period: start}
+				if ds.Interval, err = ra.bootstrap.interval(count, ra.percentile, b, hour, dr, valuesAt); err != nil {
+					return nil, errors.WithStack(err)
+				}
+			}
+		}
+	}
+	return report, nil
+}
+
+func bucketReport(cells *treemap.Map) StatisticsReport {
+	report := make(StatisticsReport, 0, cells.Size())
+	cells.Each(func(hourKey interface{}, hourCellsValue interface{}) {
 		startHour := hourKey.(int)
 		hourCells := hourCellsValue.(*treemap.Map)
 		hs := &HourStatistics{
@@ -104,8 +507,10 @@ func (ra *RidesAggregator) Report95Percentile() StatisticsReport {
 			cell := cellValue.(*aggregationCell)
 			ds := &DistanceStatistics{
 				DistanceRange: distanceRange,
-				Value:         cell.get95Percentile(),
+				Count:         cell.keptCount(),
+				Interval:      cell.interval,
 			}
+			ds.setValue(cell.get95Percentile())
 			hs.DistanceStatistics = append(hs.DistanceStatistics, ds)
 		})
 	})
@@ -114,50 +519,249 @@ func (ra *RidesAggregator) Report95Percentile() StatisticsReport {
 
 type aggregationCell struct {
 	durations []int
-	mx        *sync.Mutex
+
+	// runs are sorted durations spilled to disk, they are merged with durations in Finish.
+	runs []spill.Run
+	// from and to are the range of positions of the sorted durations including the spilled runs
+	// that are kept after outliers trimming, they are calculated in Finish.
+	from, to int
+	// percentile95 is the 95th percentile of the kept durations calculated in Finish.
+	percentile95 float64
+	// interval is calculated in Finish if confidence intervals are enabled.
+	interval *Interval
+	// histogram is calculated in Finish if histograms are enabled.
+	histogram []int
 }
 
-func (ac *aggregationCell) add(duration int) {
-	ac.mx.Lock()
-	defer ac.mx.Unlock()
-	ac.durations = append(ac.durations, duration)
+func (ac *aggregationCell) add(durations ...int) {
+	ac.durations = append(ac.durations, durations...)
 }
 
 func (ac *aggregationCell) sort() {
 	sort.Ints(ac.durations)
 }
 
-func (ac *aggregationCell) get95Percentile() int {
-	if len(ac.durations) == 0 {
+func (ac *aggregationCell) count() int {
+	count := len(ac.durations)
+	for _, run := range ac.runs {
+		count += run.Len()
+	}
+	return count
+}
+
+func (ac *aggregationCell) keptCount() int {
+	return ac.to - ac.from
+}
+
+func (ac *aggregationCell) get95Percentile() float64 {
+	return ac.percentile95
+}
+
+// collect reads rides data into the partial cells.
+// If maxDurations isn't zero the partial cells are spilled every time they reach that many durations.
+func (ra *RidesAggregator) collect(worker workerCells, maxDurations int) {
+	durationsNo := 0
+	// Partial cells of the last ride bucket, without zones and time series they are always the same.
+	var (
+		partial       *partialCells
+		partialBucket bucket
+	)
+	for batch := range ra.inCh {
+		for i := range batch.Rides {
+			data := &batch.Rides[i]
+			if data.Distance < 0 || data.StartTs < 0 || data.Duration < 0 {
+				log.Printf("Ride data is invalid, skip it: %+v", *data)
+				ra.metrics.AddDropped(metrics.DropReasonInvalidRideData, 1)
+				continue
+			}
+			if ra.speedLimits != nil && !ra.speedLimits.plausible(data) {
+				ra.metrics.AddDropped(metrics.DropReasonImplausibleSpeed, 1)
+				continue
+			}
+			z, ok := ra.zoneOf(data)
+			if !ok {
+				ra.metrics.AddDropped(metrics.DropReasonOutsideZones, 1)
+				continue
+			}
+			value, ok := ra.metricValue(data)
+			if !ok {
+				ra.metrics.AddDropped(metrics.DropReasonUndefinedMetric, 1)
+				continue
+			}
+			b := bucket{zone: z, period: ra.periodOf(data)}
+			if partial == nil || b != partialBucket {
+				partial = worker.get(b)
+				partialBucket = b
+			}
+			hour := startHour(data.StartTs)
+			dri := distanceRangeIndex(data.Distance, ra.upperInclusive)
+			partial[hour][dri] = append(partial[hour][dri], value)
+			durationsNo++
+			if durationsNo == maxDurations {
+				ra.spill(worker)
+				durationsNo = 0
+			}
+		}
+		batch.Release()
+	}
+}
+
+func (ra *RidesAggregator) zoneOf(data *ride.Data) (Zone, bool) {
+	if ra.zones == nil {
+		return Zone{}, true
+	}
+	pickup, ok := ra.zones.pickup.Zone(data.StartLat, data.StartLng)
+	if !ok {
+		return Zone{}, false
+	}
+	z := Zone{Pickup: pickup}
+	if ra.zones.dropoff != nil {
+		if z.Dropoff, ok = ra.zones.dropoff.Zone(data.EndLat, data.EndLng); !ok {
+			return Zone{}, false
+		}
+	}
+	return z, true
+}
+
+// periodOf returns the start of the ride period, it's zero if time series aren't enabled.
+func (ra *RidesAggregator) periodOf(data *ride.Data) int {
+	const (
+		secondsInDay = 24 * 60 * 60
+		daysInWeek   = 7
+		// The UNIX epoch is on Thursday, so a week starts on Monday 3 days earlier.
+		epochWeekday = 3
+	)
+	switch ra.period {
+	case PeriodDay:
+		return floorDiv(data.StartTs, secondsInDay) * secondsInDay
+	case PeriodWeek:
+		day := floorDiv(data.StartTs, secondsInDay)
+		return (floorDiv(day+epochWeekday, daysInWeek)*daysInWeek - epochWeekday) * secondsInDay
+	default:
 		return 0
 	}
-	idx := int(math.Round(float64(len(ac.durations)) * percentile95))
-	if idx == len(ac.durations) {
-		idx--
+}
+
+// floorDiv divides rounding towards negative infinity, so rides before the UNIX epoch
+// fall into the period they started in as well.
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b < 0 {
+		q--
 	}
-	return ac.durations[idx]
+	return q
 }
 
-func (ra *RidesAggregator) writeRideDataToCell() {
-	for data := range ra.inCh {
-		if data.Distance < 0 || data.StartTs < 0 || data.Duration < 0 {
-			log.Printf("Ride data is invalid, skip it: %+v", data)
+func (wc workerCells) get(b bucket) *partialCells {
+	partial, ok := wc[b]
+	if !ok {
+		partial = &partialCells{}
+		wc[b] = partial
+	}
+	return partial
+}
+
+// cell returns the aggregation cell, cells of the bucket are created if there are no such cells yet.
+func (ra *RidesAggregator) cell(b bucket, hour, dr int) *aggregationCell {
+	bucketCells, ok := ra.cells[b]
+	if !ok {
+		bucketCells = newBucketCells()
+		ra.cells[b] = bucketCells
+	}
+	hourCellsValue, found := bucketCells.Get(hour)
+	if !found {
+		panic(fmt.Sprintf("can't find map value for hour %d, map keys: %v", hour, bucketCells.Keys()))
+	}
+	hourCells := hourCellsValue.(*treemap.Map)
+	cellValue, found := hourCells.Get(dr)
+	if !found {
+		panic(fmt.Sprintf("can't find map value for distance range %d, map keys: %v", dr, hourCells.Keys()))
+	}
+	return cellValue.(*aggregationCell)
+}
+
+// Lookup finds statistics of the cell that a ride with the given start timestamp and distance in meters belongs to,
+// distance ranges include their lower bounds. It returns nil values if the report doesn't contain such cell.
+func (sr StatisticsReport) Lookup(startTs, distance int) (*HourStatistics, *DistanceStatistics) {
+	hour := startHour(startTs)
+	dr := distanceRange(distance, false)
+	for _, hs := range sr {
+		if hs.StartHour != hour {
 			continue
 		}
-		startTimeUTC := time.Unix(int64(data.StartTs), 0).UTC()
-		startHour := startTimeUTC.Hour()
-		hourCellsValue, found := ra.cells.Get(startHour)
-		if !found {
-			panic(fmt.Sprintf("can't find map value for hour %d, map keys: %v", startHour, ra.cells.Keys()))
+		for _, ds := range hs.DistanceStatistics {
+			if ds.DistanceRange == dr {
+				return hs, ds
+			}
 		}
-		hourCells := hourCellsValue.(*treemap.Map)
-		const metersInKm = 1000
-		distanceKM := int(math.Round(float64(data.Distance) / metersInKm))
-		_, cellValue := hourCells.Ceiling(distanceKM)
-		if cellValue == nil {
-			panic(fmt.Sprintf("can't find map value for distance %d, map keys: %v", distanceKM, hourCells.Keys()))
+	}
+	return nil, nil
+}
+
+func (ds *DistanceStatistics) RangeName() string {
+	return rangeName(ds.DistanceRange)
+}
+
+// ExactValue returns the value before it's rounded to whole seconds.
+func (ds *DistanceStatistics) ExactValue() float64 {
+	return float64(ds.Value) + ds.Fraction
+}
+
+func (ds *DistanceStatistics) setValue(value float64) {
+	ds.Value = int(math.Round(value))
+	ds.Fraction = value - float64(ds.Value)
+}
+
+// rangeName returns the distance range bounds in km, e.g. "1-2 km" or "21+ km" for the last range.
+func rangeName(distanceRange int) string {
+	lower, upper := distanceRangeBounds(distanceRange)
+	if upper == DistanceRangeOver21KM {
+		return fmt.Sprintf("%d+ km", lower/metersInKm)
+	}
+	return fmt.Sprintf("%d-%d km", lower/metersInKm, upper/metersInKm)
+}
+
+// Bounds returns the distance range bounds in meters, the upper bound is math.MaxInt64 for the last distance range.
+// The report doesn't keep which of the bounds the range includes, see EnableUpperInclusiveDistances.
+func (ds *DistanceStatistics) Bounds() (int, int) {
+	return distanceRangeBounds(ds.DistanceRange)
+}
+
+func startHour(startTs int) int {
+	startTimeUTC := time.Unix(int64(startTs), 0).UTC()
+	return startTimeUTC.Hour()
+}
+
+func distanceRangeBounds(dr int) (int, int) {
+	lower := 0
+	for _, r := range distanceRanges {
+		if r == DistanceRangeOver21KM {
+			return lower, DistanceRangeOver21KM
+		}
+		upper := r * metersInKm
+		if r == dr {
+			return lower, upper
+		}
+		lower = upper
+	}
+	return lower, DistanceRangeOver21KM
+}
+
+func distanceRange(distance int, upperInclusive bool) int {
+	return distanceRanges[distanceRangeIndex(distance, upperInclusive)]
+}
+
+// distanceRangeIndex returns the index of the distance range [lower, upper) the distance in meters belongs to
+// or (lower, upper] if upperInclusive is true, the first range includes zero distance in both cases.
+func distanceRangeIndex(distance int, upperInclusive bool) int {
+	for i, dr := range distanceRanges {
+		if dr == DistanceRangeOver21KM {
+			return i
+		}
+		upper := dr * metersInKm
+		if distance < upper || upperInclusive && distance == upper {
+			return i
 		}
-		cell := cellValue.(*aggregationCell)
-		cell.add(data.Duration)
 	}
+	return len(distanceRanges) - 1
 }
@@ -1,17 +1,24 @@
 package aggregation_test
 
 import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/metrics"
 	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/zone"
 )
 
 func TestRidesAggregator(t *testing.T) {
 	t.Parallel()
-	inputData := []*ride.Data{
+	inputData := []ride.Data{
 		{RideID: 1, StartTs: 1609113888, Distance: 700, Duration: 600},
 		{RideID: 2, StartTs: 1609113898, Distance: 1000, Duration: 700},
 		{RideID: 3, StartTs: 1609113889, Distance: 1500, Duration: 800},
@@ -21,19 +28,530 @@ func TestRidesAggregator(t *testing.T) {
 		{RideID: 7, StartTs: 1609117489, Distance: 1600, Duration: 850},
 		{RideID: 8, StartTs: 1609117499, Distance: 1700, Duration: 950},
 	}
-	inCh := make(chan *ride.Data, len(inputData))
-	for _, v := range inputData {
-		inCh <- v
+	expected := getTestReport()
+	for _, workersNo := range []int{1, 3} {
+		ra := aggregation.NewRidesAggregator(dataChannel(inputData, 3), nil)
+		ra.StartCollecting(workersNo)
+		err := ra.Finish()
+		require.NoError(t, err)
+		actual := ra.Report95Percentile()
+
+		assert.Equal(t, expected, actual, "workers %d", workersNo)
 	}
-	close(inCh)
+}
 
-	ra := aggregation.NewRidesAggregator(inCh)
-	ra.StartCollecting()
-	ra.Finish()
-	actual := ra.Report95Percentile()
+func TestRidesAggregator_Spilling(t *testing.T) {
+	t.Parallel()
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]ride.Data, 5000)
+	for i := range data {
+		data[i] = ride.Data{
+			RideID:   i,
+			StartTs:  1609113888 + rnd.Intn(24*3600),
+			Distance: rnd.Intn(30000),
+			Duration: rnd.Intn(3600),
+		}
+	}
+	ra := aggregation.NewRidesAggregator(dataChannel(data, 100), nil)
+	ra.StartCollecting(1)
+	require.NoError(t, ra.Finish())
+	expected := ra.Report95Percentile()
 
-	expected := getTestReport()
-	assert.Equal(t, expected, actual)
+	cases := []struct {
+		maxDurations int
+		workersNo    int
+	}{
+		{maxDurations: 1, workersNo: 1},
+		{maxDurations: 7, workersNo: 2},
+		{maxDurations: 1000, workersNo: 3},
+		{maxDurations: 10000, workersNo: 4},
+	}
+	for _, tc := range cases {
+		ra := aggregation.NewRidesAggregator(dataChannel(data, 100), nil)
+		err := ra.EnableSpilling(tc.maxDurations, tempDir(t))
+		require.NoError(t, err)
+		ra.StartCollecting(tc.workersNo)
+		require.NoError(t, ra.Finish())
+		actual := ra.Report95Percentile()
+
+		assert.Equal(t, expected, actual, "max durations %d, workers %d", tc.maxDurations, tc.workersNo)
+	}
+}
+
+func TestRidesAggregator_ConfidenceIntervals(t *testing.T) {
+	t.Parallel()
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]ride.Data, 0, 2020)
+	// The 00:00 0-1 km cell has 2000 rides with uniformly distributed durations.
+	for i := 0; i < 2000; i++ {
+		data = append(data, ride.Data{RideID: i, StartTs: 1609113888, Distance: 700, Duration: rnd.Intn(1000)})
+	}
+	// The 01:00 0-1 km cell has 20 rides with the same duration.
+	for i := 0; i < 20; i++ {
+		data = append(data, ride.Data{RideID: 2000 + i, StartTs: 1609117488, Distance: 700, Duration: 300})
+	}
+	report := func(seed int64, spill bool) aggregation.StatisticsReport {
+		ra := aggregation.NewRidesAggregator(dataChannel(data, 100), nil)
+		require.NoError(t, ra.EnableConfidenceIntervals(200, seed))
+		if spill {
+			require.NoError(t, ra.EnableSpilling(50, tempDir(t)))
+		}
+		ra.StartCollecting(3)
+		require.NoError(t, ra.Finish())
+		return ra.Report95Percentile()
+	}
+
+	expected := report(1, false)
+	uniform := expected[0].DistanceStatistics[0]
+	require.NotNil(t, uniform.Interval)
+	assert.Less(t, uniform.Interval.Lower, uniform.Value)
+	assert.Greater(t, uniform.Interval.Upper, uniform.Value)
+	// The standard error of the 95th percentile of 2000 uniform values is about 5 for this range.
+	assert.InDelta(t, 940, uniform.Interval.Lower, 15)
+	assert.InDelta(t, 960, uniform.Interval.Upper, 15)
+	same := expected[1].DistanceStatistics[0]
+	assert.Equal(t, &aggregation.Interval{Lower: 300, Upper: 300}, same.Interval)
+	assert.Equal(t, &aggregation.Interval{}, expected[2].DistanceStatistics[0].Interval, "cell without rides")
+
+	assert.Equal(t, expected, report(1, false), "same seed")
+	assert.Equal(t, expected, report(1, true), "same seed with spilling")
+	assert.NotEqual(t, uniform.Interval, report(3, false)[0].DistanceStatistics[0].Interval, "other seed")
+
+	ra := aggregation.NewRidesAggregator(dataChannel(data, 100), nil)
+	assert.EqualError(t, ra.EnableConfidenceIntervals(0, 1), "bootstrap iterations must be a positive number")
+}
+
+func TestRidesAggregator_PercentileMethods(t *testing.T) {
+	t.Parallel()
+	var data []ride.Data
+	// The 00:00 0-1 km cell has 20 rides with durations 100, 200, ..., 2000,
+	// the 01:00 0-1 km cell has 10 rides with durations 100, 200, ..., 1000 and the 02:00 0-1 km cell has a single ride.
+	for i, n := range rand.New(rand.NewSource(1)).Perm(20) {
+		data = append(data, ride.Data{RideID: i, StartTs: 1609113888, Distance: 700, Duration: (n + 1) * 100})
+	}
+	for i, n := range rand.New(rand.NewSource(2)).Perm(10) {
+		data = append(data, ride.Data{RideID: 20 + i, StartTs: 1609117488, Distance: 700, Duration: (n + 1) * 100})
+	}
+	data = append(data, ride.Data{RideID: 30, StartTs: 1609121088, Distance: 700, Duration: 500})
+	report := func(method string, spill bool) aggregation.StatisticsReport {
+		ra := aggregation.NewRidesAggregator(dataChannel(data, 4), nil)
+		require.NoError(t, ra.SetPercentileMethod(method))
+		require.NoError(t, ra.EnableConfidenceIntervals(100, 1))
+		if spill {
+			require.NoError(t, ra.EnableSpilling(3, tempDir(t)))
+		}
+		ra.StartCollecting(2)
+		require.NoError(t, ra.Finish())
+		return ra.Report95Percentile()
+	}
+
+	// Reference values are numpy.percentile(values, 95, method=method) and R quantile(values, 0.95, type=N).
+	cases := []struct {
+		method   string
+		expected []string
+	}{
+		{method: aggregation.PercentileRound, expected: []string{"0/1=2000", "1/1=1000", "2/1=500"}},
+		{method: aggregation.PercentileInvertedCDF, expected: []string{"0/1=1900", "1/1=1000", "2/1=500"}},
+		{method: aggregation.PercentileAveragedInvertedCDF, expected: []string{"0/1=1950", "1/1=1000", "2/1=500"}},
+		{method: aggregation.PercentileClosestObservation, expected: []string{"0/1=1900", "1/1=1000", "2/1=500"}},
+		{method: aggregation.PercentileInterpolatedInvertedCDF, expected: []string{"0/1=1900", "1/1=950", "2/1=500"}},
+		{method: aggregation.PercentileHazen, expected: []string{"0/1=1950", "1/1=1000", "2/1=500"}},
+		{method: aggregation.PercentileWeibull, expected: []string{"0/1=1995", "1/1=1000", "2/1=500"}},
+		{method: aggregation.PercentileLinear, expected: []string{"0/1=1905", "1/1=955", "2/1=500"}},
+		{method: aggregation.PercentileMedianUnbiased, expected: []string{"0/1=1965", "1/1=1000", "2/1=500"}},
+		// 1961.25 is rounded to whole seconds.
+		{method: aggregation.PercentileNormalUnbiased, expected: []string{"0/1=1961", "1/1=1000", "2/1=500"}},
+		{method: aggregation.PercentileLower, expected: []string{"0/1=1900", "1/1=900", "2/1=500"}},
+		{method: aggregation.PercentileHigher, expected: []string{"0/1=2000", "1/1=1000", "2/1=500"}},
+		{method: aggregation.PercentileNearest, expected: []string{"0/1=1900", "1/1=1000", "2/1=500"}},
+		{method: aggregation.PercentileMidpoint, expected: []string{"0/1=1950", "1/1=950", "2/1=500"}},
+	}
+	require.Len(t, cases, len(aggregation.PercentileMethods()))
+	for _, tc := range cases {
+		expected := report(tc.method, false)
+		assert.Equal(t, tc.expected, cellsOf(expected), tc.method)
+		assert.Equal(t, expected, report(tc.method, true), "%s with spilling", tc.method)
+		for _, hs := range expected[:3] {
+			ds := hs.DistanceStatistics[0]
+			assert.LessOrEqual(t, ds.Interval.Lower, ds.Interval.Upper, tc.method)
+		}
+	}
+
+	ra := aggregation.NewRidesAggregator(dataChannel(data, 4), nil)
+	assert.EqualError(t, ra.SetPercentileMethod("R-7"), "unknown percentile method: R-7")
+}
+
+func TestRidesAggregator_OutlierTrimming(t *testing.T) {
+	t.Parallel()
+	var data []ride.Data
+	// The 00:00 0-1 km cell has 20 rides with durations 100, 101, ..., 119 and a 10 hours ride,
+	// the 01:00 0-1 km cell has 5 rides with the same duration, so it has zero spread.
+	for i := 0; i < 20; i++ {
+		data = append(data, ride.Data{RideID: i, StartTs: 1609113888, Distance: 700, Duration: 100 + i})
+	}
+	data = append(data, ride.Data{RideID: 20, StartTs: 1609113888, Distance: 700, Duration: 36000})
+	for i := 0; i < 5; i++ {
+		data = append(data, ride.Data{RideID: 21 + i, StartTs: 1609117488, Distance: 700, Duration: 300})
+	}
+	cases := []struct {
+		method string
+		spill  bool
+		reason string
+	}{
+		{method: aggregation.TrimIQR, reason: metrics.DropReasonOutlierIQR},
+		{method: aggregation.TrimIQR, spill: true, reason: metrics.DropReasonOutlierIQR},
+		{method: aggregation.TrimMAD, reason: metrics.DropReasonOutlierMAD},
+	}
+	for _, tc := range cases {
+		m := metrics.NewPipeline()
+		ra := aggregation.NewRidesAggregator(dataChannel(data, 4), m)
+		require.NoError(t, ra.EnableOutlierTrimming(tc.method, 1.5))
+		if tc.spill {
+			require.NoError(t, ra.EnableSpilling(3, tempDir(t)))
+		}
+		ra.StartCollecting(2)
+		require.NoError(t, ra.Finish())
+		report := ra.Report95Percentile()
+
+		assert.Equal(t, []string{"0/1=118", "1/1=300"}, cellsOf(report), "%s spill %v", tc.method, tc.spill)
+		assert.Equal(t, 20, report[0].DistanceStatistics[0].Count, tc.method)
+		assert.Equal(t, 5, report[1].DistanceStatistics[0].Count, tc.method)
+		assert.Equal(t, map[string]int{tc.reason: 1}, m.Dropped(), tc.method)
+	}
+
+	ra := aggregation.NewRidesAggregator(dataChannel(data, 4), nil)
+	require.NoError(t, ra.EnableOutlierTrimming(aggregation.TrimMAD, aggregation.DefaultMADMultiplier))
+	require.NoError(t, ra.EnableSpilling(3, tempDir(t)))
+	ra.StartCollecting(1)
+	assert.EqualError(t, ra.Finish(),
+		"MAD outlier trimming keeps all durations in memory, it can't be used with spilling")
+
+	assert.EqualError(t, ra.EnableOutlierTrimming("zscore", 3), "unknown outlier trimming method: zscore")
+	assert.EqualError(t, ra.EnableOutlierTrimming(aggregation.TrimIQR, 0),
+		"outlier trimming multiplier must be a positive number")
+}
+
+func TestRidesAggregator_SpeedLimits(t *testing.T) {
+	t.Parallel()
+	data := []ride.Data{
+		// 25.2 km/h is kept.
+		{RideID: 1, StartTs: 1609113888, Distance: 700, Duration: 100},
+		// 252 km/h and a distance covered in zero seconds are too fast.
+		{RideID: 2, StartTs: 1609113888, Distance: 700, Duration: 10},
+		{RideID: 3, StartTs: 1609113888, Distance: 700, Duration: 0},
+		// 0.07 km/h is too slow, a forgotten trip.
+		{RideID: 4, StartTs: 1609113888, Distance: 700, Duration: 36000},
+		// Exactly the limits are kept: 1 km/h and 150 km/h.
+		{RideID: 5, StartTs: 1609113888, Distance: 1000, Duration: 3600},
+		{RideID: 6, StartTs: 1609113888, Distance: 1000, Duration: 24},
+	}
+	m := metrics.NewPipeline()
+	ra := aggregation.NewRidesAggregator(dataChannel(data, 2), m)
+	require.NoError(t, ra.EnableSpeedLimits(1, 150))
+	ra.StartCollecting(1)
+	require.NoError(t, ra.Finish())
+	report := ra.Report95Percentile()
+
+	assert.Equal(t, []string{"0/1=100", "0/2=3421"}, cellsOf(report))
+	assert.Equal(t, 1, report[0].DistanceStatistics[0].Count)
+	assert.Equal(t, 2, report[0].DistanceStatistics[1].Count)
+	assert.Equal(t, map[string]int{metrics.DropReasonImplausibleSpeed: 3}, m.Dropped())
+
+	assert.EqualError(t, ra.EnableSpeedLimits(-1, 0), "speed limits must not be negative")
+	assert.EqualError(t, ra.EnableSpeedLimits(10, 5), "min speed must not be greater than max speed")
+}
+
+func TestRidesAggregator_Histograms(t *testing.T) {
+	t.Parallel()
+	var data []ride.Data
+	for i, duration := range []int{0, 30, 59, 60, 61, 119, 120, 500, 3600, 4000} {
+		data = append(data, ride.Data{RideID: i, StartTs: 1609113888, Distance: 700, Duration: duration})
+	}
+	linear, err := aggregation.NewLinearBins(60, 180)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{0, 60, 120, 180}, linear.Edges)
+	logBins, err := aggregation.NewLogBins(10, 1000, 2)
+	require.NoError(t, err)
+	assert.InDeltaSlice(t, []float64{0, 10, 100, 1000}, logBins.Edges, 1e-9)
+
+	cases := []struct {
+		name     string
+		bins     aggregation.Bins
+		spill    bool
+		expected []int
+	}{
+		{name: "linear", bins: linear, expected: []int{3, 3, 1, 3}},
+		{name: "linear spilled", bins: linear, spill: true, expected: []int{3, 3, 1, 3}},
+		{name: "log", bins: logBins, expected: []int{1, 4, 3, 2}},
+		{name: "log spilled", bins: logBins, spill: true, expected: []int{1, 4, 3, 2}},
+	}
+	for _, tc := range cases {
+		ra := aggregation.NewRidesAggregator(dataChannel(data, 3), nil)
+		require.NoError(t, ra.EnableHistograms(tc.bins))
+		if tc.spill {
+			require.NoError(t, ra.EnableSpilling(2, tempDir(t)))
+		}
+		ra.StartCollecting(2)
+		require.NoError(t, ra.Finish())
+		report := ra.HistogramReport()
+
+		require.Len(t, report, 24, tc.name)
+		assert.Equal(t, tc.expected, report[0].DistanceHistograms[0].Counts, tc.name)
+		assert.Equal(t, "0-1 km", report[0].DistanceHistograms[0].RangeName(), tc.name)
+		assert.Equal(t, []int{0, 0, 0, 0}, report[1].DistanceHistograms[0].Counts, tc.name)
+	}
+
+	// Trimmed outliers aren't counted.
+	ra := aggregation.NewRidesAggregator(dataChannel(data, 3), nil)
+	require.NoError(t, ra.EnableHistograms(linear))
+	require.NoError(t, ra.EnableOutlierTrimming(aggregation.TrimIQR, 1.5))
+	ra.StartCollecting(1)
+	require.NoError(t, ra.Finish())
+	assert.Equal(t, []int{3, 3, 1, 1}, ra.HistogramReport()[0].DistanceHistograms[0].Counts)
+
+	_, err = aggregation.NewLinearBins(60, 30)
+	assert.EqualError(t, err, "linear bins width must be positive and not greater than max")
+	_, err = aggregation.NewLogBins(0, 1000, 2)
+	assert.EqualError(t, err,
+		"log bins min must be positive and less than max, the number of bins must be positive")
+	_, err = aggregation.NewLinearBins(1, 86400)
+	assert.EqualError(t, err, "linear bins width gives 86400 bins up to max, at most 10000 are allowed")
+	_, err = aggregation.NewLinearBins(1, aggregation.MaxBins)
+	assert.NoError(t, err)
+	_, err = aggregation.NewLogBins(1, 3600, aggregation.MaxBins+1)
+	assert.EqualError(t, err, "log bins number is 10001, at most 10000 are allowed")
+	assert.EqualError(t, ra.EnableHistograms(aggregation.Bins{Edges: []float64{60, 0}}),
+		"histogram bins edges must be sorted")
+}
+
+func TestRidesAggregator_Metric(t *testing.T) {
+	t.Parallel()
+	data := []ride.Data{
+		// 1.5 km in 5 minutes is 18 km/h and 3m20s per km.
+		{RideID: 1, StartTs: 1609113888, Distance: 1500, Duration: 300},
+		// 1 km in 2 minutes is 30 km/h and 2m per km.
+		{RideID: 2, StartTs: 1609113888, Distance: 1000, Duration: 120},
+		// Zero duration has no speed and zero distance has no pace.
+		{RideID: 3, StartTs: 1609113888, Distance: 1200, Duration: 0},
+		{RideID: 4, StartTs: 1609113888, Distance: 0, Duration: 60},
+	}
+	cases := []struct {
+		metric   string
+		expected []string
+		dropped  int
+	}{
+		{metric: aggregation.MetricDuration, expected: []string{"0/1=60", "0/2=282"}},
+		{metric: aggregation.MetricSpeed, expected: []string{"0/1=0", "0/2=29400"}, dropped: 1},
+		{metric: aggregation.MetricPace, expected: []string{"0/2=192"}, dropped: 1},
+	}
+	for _, tc := range cases {
+		m := metrics.NewPipeline()
+		ra := aggregation.NewRidesAggregator(dataChannel(data, 2), m)
+		require.NoError(t, ra.SetMetric(tc.metric))
+		ra.StartCollecting(1)
+		require.NoError(t, ra.Finish())
+
+		assert.Equal(t, tc.expected, cellsOf(ra.Report95Percentile()), tc.metric)
+		assert.Equal(t, tc.dropped, m.Dropped()[metrics.DropReasonUndefinedMetric], tc.metric)
+	}
+
+	ra := aggregation.NewRidesAggregator(dataChannel(data, 2), nil)
+	assert.EqualError(t, ra.SetMetric("distance"), "unknown metric: distance")
+}
+
+// latZones puts points with lat in [0, 1) into zone "a", [1, 2) into zone "b", other points are outside zones.
+type latZones struct{}
+
+func (latZones) Zone(lat, _ float64) (string, bool) {
+	switch {
+	case lat >= 0 && lat < 1:
+		return "a", true
+	case lat >= 1 && lat < 2:
+		return "b", true
+	default:
+		return "", false
+	}
+}
+
+func TestRidesAggregator_Zones(t *testing.T) {
+	t.Parallel()
+	data := []ride.Data{
+		{RideID: 1, StartTs: 1609113888, Distance: 700, Duration: 600, StartLat: 0.5, EndLat: 1.5},
+		{RideID: 2, StartTs: 1609113898, Distance: 950, Duration: 700, StartLat: 0.5, EndLat: 0.5},
+		{RideID: 3, StartTs: 1609113889, Distance: 1500, Duration: 800, StartLat: 1.5, EndLat: 1.5},
+		{RideID: 4, StartTs: 1609117488, Distance: 800, Duration: 650, StartLat: 1.5, EndLat: 0.5},
+		{RideID: 5, StartTs: 1609117498, Distance: 900, Duration: 750, StartLat: 5, EndLat: 0.5},
+		{RideID: 6, StartTs: 1609117489, Distance: 1600, Duration: 850, StartLat: 0.5, EndLat: 5},
+	}
+	cases := []struct {
+		name      string
+		byDropoff bool
+		spill     bool
+		expected  map[aggregation.Zone][]string
+		dropped   int
+	}{
+		{
+			name: "pickup zones",
+			expected: map[aggregation.Zone][]string{
+				{Pickup: "a"}: {"0/1=695", "1/2=850"},
+				{Pickup: "b"}: {"0/2=800", "1/1=650"},
+			},
+			dropped: 1,
+		},
+		{
+			name:      "pickup and drop-off zones",
+			byDropoff: true,
+			expected: map[aggregation.Zone][]string{
+				{Pickup: "a", Dropoff: "a"}: {"0/1=700"},
+				{Pickup: "a", Dropoff: "b"}: {"0/1=600"},
+				{Pickup: "b", Dropoff: "a"}: {"1/1=650"},
+				{Pickup: "b", Dropoff: "b"}: {"0/2=800"},
+			},
+			dropped: 2,
+		},
+		{
+			name:  "pickup zones with spilling",
+			spill: true,
+			expected: map[aggregation.Zone][]string{
+				{Pickup: "a"}: {"0/1=695", "1/2=850"},
+				{Pickup: "b"}: {"0/2=800", "1/1=650"},
+			},
+			dropped: 1,
+		},
+	}
+	for _, tc := range cases {
+		m := metrics.NewPipeline()
+		ra := aggregation.NewRidesAggregator(dataChannel(data, 2), m)
+		var dropoff zone.Locator
+		if tc.byDropoff {
+			dropoff = latZones{}
+		}
+		ra.EnableZones(latZones{}, dropoff)
+		if tc.spill {
+			require.NoError(t, ra.EnableSpilling(1, tempDir(t)))
+		}
+		ra.StartCollecting(2)
+		require.NoError(t, ra.Finish())
+
+		actual := map[aggregation.Zone][]string{}
+		for _, zs := range ra.ZonesReport() {
+			actual[zs.Zone] = cellsOf(zs.Report)
+		}
+		assert.Equal(t, tc.expected, actual, tc.name)
+		assert.Equal(t, tc.dropped, m.Dropped()[metrics.DropReasonOutsideZones], tc.name)
+		assert.Empty(t, cellsOf(ra.Report95Percentile()), tc.name)
+	}
+}
+
+func TestRidesAggregator_TimeSeries(t *testing.T) {
+	t.Parallel()
+	const (
+		monday = 1609113600 // 2020-12-28T00:00:00Z.
+		day    = 24 * 3600
+	)
+	data := []ride.Data{
+		{RideID: 1, StartTs: monday + 10, Distance: 700, Duration: 600},
+		{RideID: 2, StartTs: monday + 20, Distance: 950, Duration: 700},
+		{RideID: 3, StartTs: monday + day + 10, Distance: 700, Duration: 800},
+		{RideID: 4, StartTs: monday + 6*day + 3600, Distance: 1600, Duration: 900},
+		{RideID: 5, StartTs: monday + 7*day + 10, Distance: 800, Duration: 500},
+	}
+	cases := []struct {
+		period   string
+		window   int
+		expected map[int][]string
+	}{
+		{
+			period: aggregation.PeriodDay,
+			expected: map[int][]string{
+				monday:         {"0/1=695"},
+				monday + day:   {"0/1=800"},
+				monday + 6*day: {"1/2=900"},
+				monday + 7*day: {"0/1=500"},
+			},
+		},
+		{
+			period: aggregation.PeriodWeek,
+			expected: map[int][]string{
+				monday:         {"0/1=790", "1/2=900"},
+				monday + 7*day: {"0/1=500"},
+			},
+		},
+		{
+			period: aggregation.PeriodDay,
+			window: 3,
+			expected: map[int][]string{
+				monday:         {"0/1=790"},
+				monday + day:   {"0/1=800"},
+				monday + 2*day: nil,
+				monday + 3*day: nil,
+				monday + 4*day: {"1/2=900"},
+				monday + 5*day: {"0/1=500", "1/2=900"},
+			},
+		},
+		{
+			period:   aggregation.PeriodDay,
+			window:   30,
+			expected: map[int][]string{monday: {"0/1=785", "1/2=900"}},
+		},
+	}
+	for _, tc := range cases {
+		ra := aggregation.NewRidesAggregator(dataChannel(data, 2), nil)
+		require.NoError(t, ra.EnableTimeSeries(tc.period))
+		ra.StartCollecting(2)
+		require.NoError(t, ra.Finish())
+
+		report := ra.PeriodsReport()
+		if tc.window != 0 {
+			var err error
+			report, err = ra.RollingReport(tc.window)
+			require.NoError(t, err)
+		}
+		actual := map[int][]string{}
+		for _, ps := range report {
+			actual[ps.Start] = cellsOf(ps.Report)
+		}
+		assert.Equal(t, tc.expected, actual, "period %s, window %d", tc.period, tc.window)
+		assert.Empty(t, cellsOf(ra.Report95Percentile()))
+	}
+
+	ra := aggregation.NewRidesAggregator(dataChannel(data, 2), nil)
+	assert.EqualError(t, ra.EnableTimeSeries("month"), "unknown time series period: month")
+	require.NoError(t, ra.EnableTimeSeries(aggregation.PeriodWeek))
+	ra.StartCollecting(1)
+	require.NoError(t, ra.Finish())
+	_, err := ra.RollingReport(7)
+	assert.EqualError(t, err, "rolling windows require time series by days")
+}
+
+// cellsOf returns non empty cells of the report as "hour/range=value" strings.
+func cellsOf(report aggregation.StatisticsReport) []string {
+	var cells []string
+	for _, hs := range report {
+		for _, ds := range hs.DistanceStatistics {
+			if ds.Count != 0 {
+				cells = append(cells, fmt.Sprintf("%d/%d=%d", hs.StartHour, ds.DistanceRange, ds.Value))
+			}
+		}
+	}
+	return cells
+}
+
+// dataChannel returns a closed channel with the rides data split into batches of the given size.
+func dataChannel(data []ride.Data, batchSize int) chan *ride.DataBatch {
+	ch := make(chan *ride.DataBatch, len(data)/batchSize+1)
+	for len(data) > 0 {
+		n := batchSize
+		if n > len(data) {
+			n = len(data)
+		}
+		batch := ride.NewDataBatch()
+		batch.Rides = append(batch.Rides, data[:n]...)
+		ch <- batch
+		data = data[n:]
+	}
+	close(ch)
+	return ch
 }
 
 func getTestReport() aggregation.StatisticsReport {
@@ -41,9 +559,9 @@ func getTestReport() aggregation.StatisticsReport {
 		{
 			StartHour: 0,
 			DistanceStatistics: []*aggregation.DistanceStatistics{
-				{DistanceRange: 1, Value: 700},
-				{DistanceRange: 2, Value: 900},
-				{DistanceRange: 3, Value: 0},
+				{DistanceRange: 1, Value: 600, Count: 1},
+				{DistanceRange: 2, Value: 795, Count: 2},
+				{DistanceRange: 3, Value: 900, Count: 1},
 				{DistanceRange: 5, Value: 0},
 				{DistanceRange: 8, Value: 0},
 				{DistanceRange: 13, Value: 0},
@@ -54,8 +572,8 @@ func getTestReport() aggregation.StatisticsReport {
 		{
 			StartHour: 1,
 			DistanceStatistics: []*aggregation.DistanceStatistics{
-				{DistanceRange: 1, Value: 750},
-				{DistanceRange: 2, Value: 950},
+				{DistanceRange: 1, Value: 745, Count: 2},
+				{DistanceRange: 2, Value: 945, Count: 2},
 				{DistanceRange: 3, Value: 0},
 				{DistanceRange: 5, Value: 0},
 				{DistanceRange: 8, Value: 0},
@@ -82,3 +600,168 @@ func getTestReport() aggregation.StatisticsReport {
 	}
 	return report
 }
+
+func TestDistanceStatistics_Bounds(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		distanceRange int
+		lower         int
+		upper         int
+		name          string
+	}{
+		{distanceRange: 1, lower: 0, upper: 1000, name: "0-1 km"},
+		{distanceRange: 2, lower: 1000, upper: 2000, name: "1-2 km"},
+		{distanceRange: 5, lower: 3000, upper: 5000, name: "3-5 km"},
+		{distanceRange: 21, lower: 13000, upper: 21000, name: "13-21 km"},
+		{
+			distanceRange: aggregation.DistanceRangeOver21KM,
+			lower:         21000,
+			upper:         aggregation.DistanceRangeOver21KM,
+			name:          "21+ km",
+		},
+	}
+	for _, tc := range cases {
+		ds := &aggregation.DistanceStatistics{DistanceRange: tc.distanceRange}
+		lower, upper := ds.Bounds()
+		assert.Equal(t, tc.lower, lower, "distance range %d", tc.distanceRange)
+		assert.Equal(t, tc.upper, upper, "distance range %d", tc.distanceRange)
+		assert.Equal(t, tc.name, ds.RangeName(), "distance range %d", tc.distanceRange)
+	}
+}
+
+func TestRidesAggregator_DistanceBoundaries(t *testing.T) {
+	t.Parallel()
+	distances := []int{0, 999, 1000, 1001, 1999, 2000, 4999, 5000, 20999, 21000, 21001}
+	data := make([]ride.Data, len(distances))
+	for i, distance := range distances {
+		data[i] = ride.Data{RideID: i, StartTs: 1609113888, Distance: distance, Duration: distance}
+	}
+	cases := []struct {
+		upperInclusive bool
+		expected       []string
+	}{
+		{
+			expected: []string{
+				"0/1=949", "0/2=1899", "0/3=2000", "0/5=4999", "0/8=5000", "0/21=20999",
+				fmt.Sprintf("0/%d=21001", aggregation.DistanceRangeOver21KM),
+			},
+		},
+		{
+			upperInclusive: true,
+			expected: []string{
+				"0/1=1000", "0/2=2000", "0/5=5000", "0/21=21000",
+				fmt.Sprintf("0/%d=21001", aggregation.DistanceRangeOver21KM),
+			},
+		},
+	}
+	for _, tc := range cases {
+		ra := aggregation.NewRidesAggregator(dataChannel(data, 3), nil)
+		if tc.upperInclusive {
+			ra.EnableUpperInclusiveDistances()
+		}
+		ra.StartCollecting(2)
+		require.NoError(t, ra.Finish())
+		report := ra.Report95Percentile()
+
+		assert.Equal(t, tc.expected, cellsOf(report), "upper inclusive %t", tc.upperInclusive)
+		hs, ds := report.Lookup(1609113888, 1000)
+		require.NotNil(t, hs)
+		assert.Equal(t, 2, ds.DistanceRange)
+	}
+}
+
+func TestRidesAggregator_Merge(t *testing.T) {
+	t.Parallel()
+	inputData := []ride.Data{
+		{RideID: 1, StartTs: 1609113888, Distance: 700, Duration: 600},
+		{RideID: 2, StartTs: 1609113898, Distance: 1000, Duration: 700},
+		{RideID: 3, StartTs: 1609113889, Distance: 1500, Duration: 800},
+		{RideID: 4, StartTs: 1609113899, Distance: 2000, Duration: 900},
+		{RideID: 5, StartTs: 1609117488, Distance: 800, Duration: 650},
+		{RideID: 6, StartTs: 1609117498, Distance: 900, Duration: 750},
+		{RideID: 7, StartTs: 1609117489, Distance: 1600, Duration: 850},
+		{RideID: 8, StartTs: 1609117499, Distance: 1700, Duration: 950},
+	}
+	aggregate := func(data []ride.Data, state *aggregation.State) *aggregation.RidesAggregator {
+		ra := aggregation.NewRidesAggregator(dataChannel(data, 2), nil)
+		if state != nil {
+			err := ra.Merge(state)
+			assert.NoError(t, err)
+		}
+		ra.StartCollecting(2)
+		err := ra.Finish()
+		require.NoError(t, err)
+		return ra
+	}
+
+	first := aggregate(inputData[:3], nil)
+	second := aggregate(inputData[3:], first.State())
+	actual := second.Report95Percentile()
+
+	expected := getTestReport()
+	assert.Equal(t, expected, actual)
+	assert.Len(t, second.State().Cells, 5)
+}
+
+func TestRidesAggregator_MergeUnknownCell(t *testing.T) {
+	t.Parallel()
+	ra := aggregation.NewRidesAggregator(nil, nil)
+	state := &aggregation.State{Cells: []*aggregation.CellState{{StartHour: 1, DistanceRange: 4, Durations: []int{1}}}}
+
+	err := ra.Merge(state)
+	assert.EqualError(t, err, "state contains unknown distance range 4")
+}
+
+func BenchmarkRidesAggregator(b *testing.B) {
+	const ridesNo = 100000
+	data := make([]ride.Data, ridesNo)
+	for i := range data {
+		data[i] = ride.Data{RideID: i, StartTs: 1609113888 + i*37, Distance: i % 30000, Duration: i % 3600}
+	}
+	for _, workersNo := range []int{1, 4} {
+		workersNo := workersNo
+		b.Run(fmt.Sprintf("workers=%d", workersNo), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ra := aggregation.NewRidesAggregator(dataChannel(data, ride.BatchSize), nil)
+				ra.StartCollecting(workersNo)
+				if err := ra.Finish(); err != nil {
+					b.Fatal(err)
+				}
+				ra.Report95Percentile()
+			}
+		})
+	}
+}
+
+func BenchmarkRidesAggregator_ConfidenceIntervals(b *testing.B) {
+	const ridesNo = 100000
+	data := make([]ride.Data, ridesNo)
+	for i := range data {
+		// All rides fall into a single cell.
+		data[i] = ride.Data{RideID: i, StartTs: 1609113888, Distance: 700, Duration: i % 3600}
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ra := aggregation.NewRidesAggregator(dataChannel(data, ride.BatchSize), nil)
+		if err := ra.EnableConfidenceIntervals(1000, 1); err != nil {
+			b.Fatal(err)
+		}
+		ra.StartCollecting(1)
+		if err := ra.Finish(); err != nil {
+			b.Fatal(err)
+		}
+		ra.Report95Percentile()
+	}
+}
+
+// tempDir creates a temporary directory that is removed when the test finishes.
+func tempDir(tb testing.TB) string {
+	tb.Helper()
+	dir, err := ioutil.TempDir("", "aggregation_*")
+	require.NoError(tb, err)
+	tb.Cleanup(func() {
+		os.RemoveAll(dir) // nolint: errcheck, gosec
+	})
+	return dir
+}
@@ -0,0 +1,145 @@
+package aggregation
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Interval is the confidence interval of a cell value, bounds are in seconds like the value.
+type Interval struct {
+	Lower int
+	Upper int
+}
+
+// confidenceLevel is the probability that the interval contains the true 95th percentile.
+const confidenceLevel = 0.95
+
+type bootstrap struct {
+	iterations int
+	seed       int64
+}
+
+// EnableConfidenceIntervals makes the aggregator calculate the confidence interval of each cell 95th percentile
+// with the bootstrap: cell durations are resampled with replacement the given number of iterations and the interval
+// is the central 95% of the resampled percentiles. The resampling of each cell is seeded from the seed and the cell,
+// so intervals are reproducible. It must be called before Finish.
+func (ra *RidesAggregator) EnableConfidenceIntervals(iterations int, seed int64) error {
+	if iterations <= 0 {
+		return errors.New("bootstrap iterations must be a positive number")
+	}
+	ra.bootstrap = &bootstrap{iterations: iterations, seed: seed}
+	return nil
+}
+
+// interval calculates the confidence interval of the 95th percentile of count sorted durations of the cell
+// with the percentile method. valuesAt returns the durations at the sorted zero based positions.
+func (bs *bootstrap) interval(
+	count int, method percentileMethod, b bucket, hour, dr int, valuesAt func(positions []int) ([]int, error),
+) (*Interval, error) {
+	rnd := rand.New(rand.NewSource(bs.seed ^ cellSeed(b, hour, dr))) // nolint: gosec
+	resamples := bs.resample(count, method(count, percentile95), rnd)
+	positions := make([]int, 0, 2*len(resamples))
+	for _, pp := range resamples {
+		positions = append(positions, pp.lower, pp.upper)
+	}
+	sort.Ints(positions)
+	values, err := valuesAt(positions)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	valueOf := make(map[int]int, len(positions))
+	for i, n := range positions {
+		valueOf[n] = values[i]
+	}
+	percentiles := make([]float64, len(resamples))
+	for i, pp := range resamples {
+		percentiles[i] = pp.interpolate(valueOf[pp.lower], valueOf[pp.upper])
+	}
+	sort.Float64s(percentiles)
+	tail := (1 - confidenceLevel) / 2
+	lower := int(math.Round(tail * float64(bs.iterations-1)))
+	upper := int(math.Round((1 - tail) * float64(bs.iterations-1)))
+	return &Interval{
+		Lower: int(math.Round(percentiles[lower])),
+		Upper: int(math.Round(percentiles[upper])),
+	}, nil
+}
+
+// resample returns the percentile of each resample as the positions in count sorted values.
+// Since values are sorted, the values of a resample at the percentile position pp are the values
+// at the corresponding positions of the original values, so only positions are resampled
+// and the values are looked up once for all resamples.
+// A resample draws count positions uniformly, they are the integer parts of count uniform values in [0, count),
+// so the k-th smallest position is drawn directly from the distribution of the k-th smallest uniform value,
+// which takes the same time for any count.
+func (bs *bootstrap) resample(count int, pp percentilePosition, rnd *rand.Rand) []percentilePosition {
+	resamples := make([]percentilePosition, bs.iterations)
+	for i := range resamples {
+		// The k-th smallest of n uniform values in [0, 1) (zero based) has the Beta(k+1, n-k) distribution.
+		lower := betaVariate(rnd, pp.lower+1, count-pp.lower)
+		upper := lower
+		if pp.upper > pp.lower {
+			// The values above the lower one are uniform in [lower, 1),
+			// so the upper one is above it by the Beta(m-k, n-m) share of the rest.
+			upper += (1 - lower) * betaVariate(rnd, pp.upper-pp.lower, count-pp.upper)
+		}
+		resamples[i] = percentilePosition{
+			lower:  sampledPosition(lower, count),
+			upper:  sampledPosition(upper, count),
+			weight: pp.weight,
+		}
+	}
+	return resamples
+}
+
+func sampledPosition(u float64, count int) int {
+	position := int(u * float64(count))
+	if position >= count {
+		position = count - 1
+	}
+	return position
+}
+
+// betaVariate draws a value from the Beta(a, b) distribution, a and b are positive.
+func betaVariate(rnd *rand.Rand, a, b int) float64 {
+	x := gammaVariate(rnd, float64(a))
+	y := gammaVariate(rnd, float64(b))
+	return x / (x + y)
+}
+
+// gammaVariate draws a value from the Gamma(shape, 1) distribution with the Marsaglia and Tsang method,
+// the shape is at least one.
+func gammaVariate(rnd *rand.Rand, shape float64) float64 {
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rnd.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rnd.Float64()
+		if u < 1-0.0331*x*x*x*x || math.Log(u) < 0.5*x*x+d*(1-v+math.Log(v)) {
+			return d * v
+		}
+	}
+}
+
+func cellSeed(b bucket, hour, dr int) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(b.zone.Pickup))  // nolint: errcheck, gosec
+	h.Write([]byte{0})              // nolint: errcheck, gosec
+	h.Write([]byte(b.zone.Dropoff)) // nolint: errcheck, gosec
+	numbers := make([]byte, 3*binary.MaxVarintLen64)
+	n := binary.PutVarint(numbers, int64(b.period))
+	n += binary.PutVarint(numbers[n:], int64(hour))
+	n += binary.PutVarint(numbers[n:], int64(dr))
+	h.Write(numbers[:n]) // nolint: errcheck, gosec
+	return int64(h.Sum64())
+}
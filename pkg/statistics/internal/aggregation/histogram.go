@@ -0,0 +1,136 @@
+package aggregation
+
+import (
+	"math"
+	"sort"
+
+	"github.com/emirpasic/gods/maps/treemap"
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/spill"
+)
+
+// HistogramReport contains duration histograms of each cell of the report of all rides.
+type HistogramReport []*HourHistograms
+
+type HourHistograms struct {
+	StartHour          int
+	DistanceHistograms []*DistanceHistogram
+}
+
+type DistanceHistogram struct {
+	DistanceRange int
+	// Counts are the numbers of durations in each bin.
+	Counts []int
+}
+
+func (dh *DistanceHistogram) RangeName() string {
+	return rangeName(dh.DistanceRange)
+}
+
+// Bins are duration bins of histograms in seconds, the bin i is [Edges[i], Edges[i+1])
+// and the last bin is [Edges[len(Edges)-1], +Inf), so each duration falls into a bin.
+type Bins struct {
+	Edges []float64
+}
+
+// MaxBins is the max number of bins between the edges given to NewLinearBins and NewLogBins,
+// each cell of the report keeps a counter per bin.
+const MaxBins = 10000
+
+// NewLinearBins returns bins of the width from zero up to max followed by the bin of durations longer than max,
+// the bin before max is narrower if max isn't a multiple of the width.
+func NewLinearBins(width, max float64) (Bins, error) {
+	if width <= 0 || max < width {
+		return Bins{}, errors.New("linear bins width must be positive and not greater than max")
+	}
+	if n := math.Ceil(max / width); n > MaxBins {
+		return Bins{}, errors.Errorf("linear bins width gives %.0f bins up to max, at most %d are allowed", n, MaxBins)
+	}
+	var edges []float64
+	for i := 0; float64(i)*width < max; i++ {
+		edges = append(edges, float64(i)*width)
+	}
+	return Bins{Edges: append(edges, max)}, nil
+}
+
+// NewLogBins returns the bin of durations shorter than min, n bins with the same ratio of edges from min to max
+// and the bin of durations longer than max.
+func NewLogBins(min, max float64, n int) (Bins, error) {
+	if min <= 0 || max <= min || n <= 0 {
+		return Bins{}, errors.New("log bins min must be positive and less than max, the number of bins must be positive")
+	}
+	if n > MaxBins {
+		return Bins{}, errors.Errorf("log bins number is %d, at most %d are allowed", n, MaxBins)
+	}
+	edges := make([]float64, 0, n+2)
+	edges = append(edges, 0)
+	ratio := math.Log(max/min) / float64(n)
+	for i := 0; i < n; i++ {
+		edges = append(edges, min*math.Exp(ratio*float64(i)))
+	}
+	return Bins{Edges: append(edges, max)}, nil
+}
+
+// EnableHistograms makes the aggregator count the kept durations of each cell in the bins,
+// the histograms are returned by HistogramReport. It must be called before Finish.
+func (ra *RidesAggregator) EnableHistograms(bins Bins) error {
+	if len(bins.Edges) == 0 || !sort.Float64sAreSorted(bins.Edges) {
+		return errors.New("histogram bins edges must be sorted")
+	}
+	ra.bins = &bins
+	return nil
+}
+
+// HistogramReport returns histograms of the report of all rides. It must be called after Finish.
+func (ra *RidesAggregator) HistogramReport() HistogramReport {
+	cells := ra.cells[bucket{}]
+	report := make(HistogramReport, 0, cells.Size())
+	cells.Each(func(hourKey interface{}, hourCellsValue interface{}) {
+		hourCells := hourCellsValue.(*treemap.Map)
+		hh := &HourHistograms{
+			StartHour:          hourKey.(int),
+			DistanceHistograms: make([]*DistanceHistogram, 0, hourCells.Size()),
+		}
+		report = append(report, hh)
+		hourCells.Each(func(distanceKey interface{}, cellValue interface{}) {
+			hh.DistanceHistograms = append(hh.DistanceHistograms, &DistanceHistogram{
+				DistanceRange: distanceKey.(int),
+				Counts:        cellValue.(*aggregationCell).histogram,
+			})
+		})
+	})
+	return report
+}
+
+// countBins counts the kept durations of the cell in each bin.
+// Spilled runs are merged in a single pass, in memory durations are counted with a binary search of each edge.
+func (ac *aggregationCell) countBins(store *spill.Store, bins *Bins) error {
+	edges := bins.Edges
+	counts := make([]int, len(edges))
+	ac.histogram = counts
+	if len(ac.runs) == 0 {
+		kept := ac.durations[ac.from:ac.to]
+		end := len(kept)
+		for i := len(edges) - 1; i >= 0; i-- {
+			start := sort.Search(len(kept), func(j int) bool { return float64(kept[j]) >= edges[i] })
+			counts[i] = end - start
+			end = start
+		}
+		return nil
+	}
+	bin := 0
+	err := eachValue(ac.iterators(store), func(n, v int) bool {
+		if n < ac.from {
+			return true
+		}
+		for bin+1 < len(edges) && float64(v) >= edges[bin+1] {
+			bin++
+		}
+		if float64(v) >= edges[bin] {
+			counts[bin]++
+		}
+		return n+1 < ac.to
+	})
+	return errors.WithStack(err)
+}
@@ -0,0 +1,36 @@
+package aggregation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+)
+
+func TestRidesAggregator_PeriodOf(t *testing.T) {
+	t.Parallel()
+	const (
+		monday       = 1609113600     // 2020-12-28T00:00:00Z.
+		mondayBefore = -3 * 24 * 3600 // 1969-12-29T00:00:00Z.
+		day          = 24 * 3600
+	)
+	cases := []struct {
+		period   string
+		startTs  int
+		expected int
+	}{
+		{period: PeriodDay, startTs: monday + day + 10, expected: monday + day},
+		{period: PeriodWeek, startTs: monday + 6*day + 3600, expected: monday},
+		{period: PeriodDay, startTs: -10, expected: -day},
+		{period: PeriodDay, startTs: -day, expected: -day},
+		{period: PeriodWeek, startTs: -10, expected: mondayBefore},
+		{period: PeriodWeek, startTs: mondayBefore - 10, expected: mondayBefore - 7*day},
+		{startTs: monday + 10, expected: 0},
+	}
+	for _, tc := range cases {
+		ra := &RidesAggregator{period: tc.period}
+		actual := ra.periodOf(&ride.Data{StartTs: tc.startTs})
+		assert.Equal(t, tc.expected, actual, "period %s, start %d", tc.period, tc.startTs)
+	}
+}
@@ -0,0 +1,51 @@
+package aggregation
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+)
+
+// Metrics of rides collected into cells, cells keep them as integers in the metric units.
+const (
+	// MetricDuration is the ride duration in seconds.
+	MetricDuration = "duration"
+	// MetricSpeed is the ride average speed in meters per hour, so km/h are kept with three decimal places.
+	MetricSpeed = "speed"
+	// MetricPace is the ride time per distance in seconds per km.
+	MetricPace = "pace"
+)
+
+// SetMetric sets the metric of rides collected into cells instead of durations, so cell values are percentiles
+// of the metric. Rides without the metric value are dropped: speed of rides with zero duration
+// and pace of rides with zero distance. It must be called before StartCollecting.
+func (ra *RidesAggregator) SetMetric(metric string) error {
+	switch metric {
+	case MetricDuration, MetricSpeed, MetricPace:
+	default:
+		return errors.Errorf("unknown metric: %s", metric)
+	}
+	ra.metric = metric
+	return nil
+}
+
+// metricValue returns the value of the ride metric and false if the ride doesn't have it.
+func (ra *RidesAggregator) metricValue(data *ride.Data) (int, bool) {
+	const secondsInHour = 60 * 60
+	switch ra.metric {
+	case MetricSpeed:
+		if data.Duration == 0 {
+			return 0, false
+		}
+		return int(math.Round(float64(data.Distance) / float64(data.Duration) * secondsInHour)), true
+	case MetricPace:
+		if data.Distance == 0 {
+			return 0, false
+		}
+		return int(math.Round(float64(data.Duration) / float64(data.Distance) * metersInKm)), true
+	default:
+		return data.Duration, true
+	}
+}
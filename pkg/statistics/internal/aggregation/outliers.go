@@ -0,0 +1,188 @@
+package aggregation
+
+import (
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/metrics"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/spill"
+)
+
+// Outlier trimming methods.
+const (
+	// TrimIQR trims durations outside of the Tukey fences: [Q1 - k*IQR, Q3 + k*IQR].
+	TrimIQR = "iqr"
+	// TrimMAD trims durations that are more than k scaled median absolute deviations away from the median.
+	TrimMAD = "mad"
+)
+
+// Default multipliers of the spread for each trimming method.
+const (
+	DefaultIQRMultiplier = 1.5
+	DefaultMADMultiplier = 3.5
+)
+
+// madScale makes the median absolute deviation a consistent estimator of the standard deviation of normal data.
+const madScale = 1.4826
+
+type trimming struct {
+	method string
+	k      float64
+	reason string
+}
+
+type speedLimits struct {
+	// min and max are in km/h, zero max means there is no upper limit.
+	min float64
+	max float64
+}
+
+// EnableOutlierTrimming makes the aggregator trim outliers of each cell before its value is calculated:
+// TrimIQR or TrimMAD with the k multiplier of the spread. Cells with zero spread aren't trimmed.
+// Each period is trimmed on its own, rolling windows merge the kept durations of their days.
+// Trimmed durations are counted as dropped by the method reason, they are kept in State, so they are trimmed again
+// when the state is merged. TrimIQR finds the fences of spilled cells with a binary search that merges the runs
+// for each probe. TrimMAD keeps all cell durations in memory, so it fails in Finish for spilled cells.
+// It must be called before Finish.
+func (ra *RidesAggregator) EnableOutlierTrimming(method string, k float64) error {
+	reasons := map[string]string{TrimIQR: metrics.DropReasonOutlierIQR, TrimMAD: metrics.DropReasonOutlierMAD}
+	reason, ok := reasons[method]
+	if !ok {
+		return errors.Errorf("unknown outlier trimming method: %s", method)
+	}
+	if k <= 0 {
+		return errors.New("outlier trimming multiplier must be a positive number")
+	}
+	ra.trimming = &trimming{method: method, k: k, reason: reason}
+	return nil
+}
+
+// EnableSpeedLimits makes the aggregator drop rides with the average speed outside of the limits in km/h,
+// e.g. trips drivers forgot to end. Zero max speed means there is no upper limit.
+// It must be called before StartCollecting.
+func (ra *RidesAggregator) EnableSpeedLimits(minSpeed, maxSpeed float64) error {
+	if minSpeed < 0 || maxSpeed < 0 {
+		return errors.New("speed limits must not be negative")
+	}
+	if maxSpeed != 0 && minSpeed > maxSpeed {
+		return errors.New("min speed must not be greater than max speed")
+	}
+	ra.speedLimits = &speedLimits{min: minSpeed, max: maxSpeed}
+	return nil
+}
+
+// trim calculates the range of the cell durations that aren't outliers and counts trimmed durations as dropped,
+// all durations are kept if trimming isn't enabled.
+func (ra *RidesAggregator) trim(cell *aggregationCell, store *spill.Store) error {
+	count := cell.count()
+	cell.from, cell.to = 0, count
+	if ra.trimming == nil || count == 0 {
+		return nil
+	}
+	if ra.trimming.method == TrimMAD && len(cell.runs) != 0 {
+		return errors.New("MAD outlier trimming keeps all durations in memory, it can't be used with spilling")
+	}
+	var err error
+	cell.from, cell.to, err = ra.trimming.keep(count, func(positions []int) ([]int, error) {
+		return cell.valuesAt(store, positions)
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if trimmed := count - cell.keptCount(); trimmed != 0 {
+		ra.metrics.AddDropped(ra.trimming.reason, trimmed)
+	}
+	return nil
+}
+
+// plausible reports whether the ride average speed is within the limits,
+// a ride that covers a distance in zero seconds has an infinite speed.
+func (sl *speedLimits) plausible(data *ride.Data) bool {
+	const msToKmh = 3.6
+	var speed float64
+	switch {
+	case data.Duration != 0:
+		speed = float64(data.Distance) / float64(data.Duration) * msToKmh
+	case data.Distance != 0:
+		speed = math.Inf(1)
+	}
+	return speed >= sl.min && (sl.max == 0 || speed <= sl.max)
+}
+
+// keep returns the range [from, to) of positions of count sorted values that aren't outliers.
+// valuesAt returns the values at the sorted zero based positions.
+func (t *trimming) keep(count int, valuesAt func(positions []int) ([]int, error)) (int, int, error) {
+	var lower, upper float64
+	switch t.method {
+	case TrimIQR:
+		q1, err := exactPercentile(count, 0.25, valuesAt)
+		if err != nil {
+			return 0, 0, errors.WithStack(err)
+		}
+		q3, err := exactPercentile(count, 0.75, valuesAt)
+		if err != nil {
+			return 0, 0, errors.WithStack(err)
+		}
+		if q3 == q1 {
+			return 0, count, nil
+		}
+		lower, upper = q1-t.k*(q3-q1), q3+t.k*(q3-q1)
+	case TrimMAD:
+		positions := make([]int, count)
+		for i := range positions {
+			positions[i] = i
+		}
+		values, err := valuesAt(positions)
+		if err != nil {
+			return 0, 0, errors.WithStack(err)
+		}
+		pp := percentileMethods[PercentileLinear](count, 0.5)
+		median := pp.interpolate(values[pp.lower], values[pp.upper])
+		deviations := make([]float64, count)
+		for i, v := range values {
+			deviations[i] = math.Abs(float64(v) - median)
+		}
+		sort.Float64s(deviations)
+		mad := deviations[pp.lower] + pp.weight*(deviations[pp.upper]-deviations[pp.lower])
+		if mad == 0 {
+			return 0, count, nil
+		}
+		lower, upper = median-t.k*madScale*mad, median+t.k*madScale*mad
+	}
+	from, err := searchPosition(count, valuesAt, func(v int) bool { return float64(v) >= lower })
+	if err != nil {
+		return 0, 0, errors.WithStack(err)
+	}
+	to, err := searchPosition(count, valuesAt, func(v int) bool { return float64(v) > upper })
+	return from, to, errors.WithStack(err)
+}
+
+// exactPercentile returns the not rounded p percentile of count sorted values with the PercentileLinear method.
+func exactPercentile(count int, p float64, valuesAt func(positions []int) ([]int, error)) (float64, error) {
+	pp := percentileMethods[PercentileLinear](count, p)
+	values, err := valuesAt(pp.positions())
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return pp.interpolate(values[0], values[len(values)-1]), nil
+}
+
+// searchPosition returns the first position of count sorted values for which f is true or count if there is none,
+// f must be false for values before the position and true after it.
+func searchPosition(count int, valuesAt func(positions []int) ([]int, error), f func(v int) bool) (int, error) {
+	var err error
+	position := sort.Search(count, func(n int) bool {
+		if err != nil {
+			return true
+		}
+		var values []int
+		if values, err = valuesAt([]int{n}); err != nil {
+			return true
+		}
+		return f(values[0])
+	})
+	return position, errors.WithStack(err)
+}
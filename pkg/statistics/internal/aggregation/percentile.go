@@ -0,0 +1,178 @@
+package aggregation
+
+import (
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Percentile methods, names and definitions follow numpy.percentile methods,
+// R-N is the sample quantile type N from Hyndman and Fan, which R and many other tools use.
+const (
+	// PercentileRound takes the value at the position n*p rounded to the nearest integer,
+	// it's the default method kept for compatibility with earlier reports.
+	PercentileRound = "round"
+	// PercentileInvertedCDF is the nearest-rank method, R-1.
+	PercentileInvertedCDF = "inverted_cdf"
+	// PercentileAveragedInvertedCDF is R-2.
+	PercentileAveragedInvertedCDF = "averaged_inverted_cdf"
+	// PercentileClosestObservation is R-3, SAS definition 2.
+	PercentileClosestObservation = "closest_observation"
+	// PercentileInterpolatedInvertedCDF is R-4.
+	PercentileInterpolatedInvertedCDF = "interpolated_inverted_cdf"
+	// PercentileHazen is R-5.
+	PercentileHazen = "hazen"
+	// PercentileWeibull is R-6, Excel PERCENTILE.EXC.
+	PercentileWeibull = "weibull"
+	// PercentileLinear is R-7, the default of numpy, pandas, R and Excel PERCENTILE.INC.
+	PercentileLinear = "linear"
+	// PercentileMedianUnbiased is R-8.
+	PercentileMedianUnbiased = "median_unbiased"
+	// PercentileNormalUnbiased is R-9.
+	PercentileNormalUnbiased = "normal_unbiased"
+	// PercentileLower, PercentileHigher, PercentileNearest and PercentileMidpoint take
+	// the lower, the higher, the nearest value or the mean of the two values around the PercentileLinear position.
+	PercentileLower    = "lower"
+	PercentileHigher   = "higher"
+	PercentileNearest  = "nearest"
+	PercentileMidpoint = "midpoint"
+)
+
+// percentileMethod returns the position of the p percentile in count sorted values.
+type percentileMethod func(count int, p float64) percentilePosition
+
+// percentilePosition is the percentile as the weighted mean of two adjacent values.
+type percentilePosition struct {
+	// lower and upper are zero based positions of the values, upper is either lower or the next position.
+	lower, upper int
+	// weight is the weight of the upper value.
+	weight float64
+}
+
+var percentileMethods = map[string]percentileMethod{
+	PercentileRound: func(count int, p float64) percentilePosition {
+		idx := int(math.Round(float64(count) * p))
+		if idx == count {
+			idx--
+		}
+		return percentilePosition{lower: idx, upper: idx}
+	},
+	PercentileInvertedCDF: func(count int, p float64) percentilePosition {
+		return virtualPosition(count, float64(count)*p-1, func(g, _ float64) float64 { return step(g != 0) })
+	},
+	PercentileAveragedInvertedCDF: func(count int, p float64) percentilePosition {
+		return virtualPosition(count, float64(count)*p-1, func(g, _ float64) float64 {
+			if g == 0 {
+				return 0.5
+			}
+			return 1
+		})
+	},
+	PercentileClosestObservation: func(count int, p float64) percentilePosition {
+		// Ties are resolved to the even 1-based position, which is the odd zero based one.
+		return virtualPosition(count, float64(count)*p-1.5, func(g, lower float64) float64 {
+			return step(g != 0 || math.Mod(lower, 2) == 0)
+		})
+	},
+	PercentileInterpolatedInvertedCDF: continuous(0, 1),
+	PercentileHazen:                   continuous(0.5, 0.5),
+	PercentileWeibull:                 continuous(0, 0),
+	PercentileLinear: func(count int, p float64) percentilePosition {
+		return virtualPosition(count, float64(count-1)*p, nil)
+	},
+	PercentileMedianUnbiased: continuous(1.0/3, 1.0/3),
+	PercentileNormalUnbiased: continuous(3.0/8, 3.0/8),
+	PercentileLower: func(count int, p float64) percentilePosition {
+		return virtualPosition(count, math.Floor(float64(count-1)*p), nil)
+	},
+	PercentileHigher: func(count int, p float64) percentilePosition {
+		return virtualPosition(count, math.Ceil(float64(count-1)*p), nil)
+	},
+	PercentileNearest: func(count int, p float64) percentilePosition {
+		return virtualPosition(count, math.RoundToEven(float64(count-1)*p), nil)
+	},
+	PercentileMidpoint: func(count int, p float64) percentilePosition {
+		return virtualPosition(count, float64(count-1)*p, func(g, _ float64) float64 { return 0.5 * step(g != 0) })
+	},
+}
+
+// PercentileMethods returns the sorted names of all percentile methods.
+func PercentileMethods() []string {
+	names := make([]string, 0, len(percentileMethods))
+	for name := range percentileMethods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetPercentileMethod sets the method cell values are calculated with, see the Percentile constants.
+// It must be called before Finish.
+func (ra *RidesAggregator) SetPercentileMethod(name string) error {
+	method, ok := percentileMethods[name]
+	if !ok {
+		return errors.Errorf("unknown percentile method: %s", name)
+	}
+	ra.percentile = method
+	return nil
+}
+
+// continuous returns a method that interpolates between values around the position n*p+m-1,
+// where m = alpha+p*(1-alpha-beta), alpha and beta are the plotting positions parameters.
+func continuous(alpha, beta float64) percentileMethod {
+	return func(count int, p float64) percentilePosition {
+		return virtualPosition(count, float64(count)*p+alpha+p*(1-alpha-beta)-1, nil)
+	}
+}
+
+// virtualPosition returns the position of the zero based fractional index in count sorted values.
+// The weight is the fractional part of the index unless gamma replaces it, gamma gets the fractional part
+// and the integer part of the index. Indexes outside of the values are clamped to the first or the last value.
+func virtualPosition(count int, index float64, gamma func(g, lower float64) float64) percentilePosition {
+	if index <= 0 {
+		return percentilePosition{}
+	}
+	if index >= float64(count-1) {
+		return percentilePosition{lower: count - 1, upper: count - 1}
+	}
+	lower := math.Floor(index)
+	g := index - lower
+	if gamma != nil {
+		g = gamma(g, lower)
+	}
+	return percentilePosition{lower: int(lower), upper: int(lower) + 1, weight: g}
+}
+
+func step(condition bool) float64 {
+	if condition {
+		return 1
+	}
+	return 0
+}
+
+// positions returns the positions of the values the percentile needs.
+func (pp percentilePosition) positions() []int {
+	if pp.weight == 0 {
+		return []int{pp.lower}
+	}
+	if pp.weight == 1 {
+		return []int{pp.upper}
+	}
+	return []int{pp.lower, pp.upper}
+}
+
+// interpolate returns the weighted mean of the lower and upper values.
+func (pp percentilePosition) interpolate(lower, upper int) float64 {
+	return float64(lower) + pp.weight*float64(upper-lower)
+}
+
+// value returns the percentile, valuesAt returns the values at the sorted zero based positions.
+func (pp percentilePosition) value(valuesAt func(positions []int) ([]int, error)) (float64, error) {
+	positions := pp.positions()
+	values, err := valuesAt(positions)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return pp.interpolate(values[0], values[len(values)-1]), nil
+}
@@ -0,0 +1,181 @@
+package aggregation
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/spill"
+)
+
+type spilling struct {
+	store        *spill.Store
+	maxDurations int
+
+	mx *sync.Mutex
+	// err is the first spilling error, collecting workers can't return it, so it's checked in Finish.
+	err error
+}
+
+func (s *spilling) error() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.err
+}
+
+// spill writes durations of each partial cell into the store as a sorted run and empties the partial cells.
+func (ra *RidesAggregator) spill(worker workerCells) {
+	s := ra.spilling
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for b, partial := range worker {
+		for hour := range partial {
+			for i, durations := range partial[hour] {
+				if len(durations) == 0 {
+					continue
+				}
+				// Partial cells memory is reused for next durations.
+				partial[hour][i] = durations[:0]
+				if s.err != nil {
+					continue
+				}
+				sort.Ints(durations)
+				run, err := s.store.Write(durations)
+				if err != nil {
+					s.err = errors.WithStack(err)
+					continue
+				}
+				cell := ra.cell(b, hour, distanceRanges[i])
+				cell.runs = append(cell.runs, run)
+			}
+		}
+	}
+}
+
+// valuesAt returns the values at the sorted zero based positions of the sorted cell durations
+// including the spilled runs. Runs are merged without loading them into memory until the last position is reached.
+func (ac *aggregationCell) valuesAt(store *spill.Store, positions []int) ([]int, error) {
+	if len(ac.runs) == 0 {
+		values := make([]int, len(positions))
+		for i, n := range positions {
+			values[i] = ac.durations[n]
+		}
+		return values, nil
+	}
+	values, err := nthValues(ac.iterators(store), positions)
+	return values, errors.WithStack(err)
+}
+
+// iterators returns iterators of the sorted in memory durations and each spilled run.
+func (ac *aggregationCell) iterators(store *spill.Store) []sortedIterator {
+	iterators := make([]sortedIterator, 0, len(ac.runs)+1)
+	iterators = append(iterators, &sliceIterator{values: ac.durations})
+	for _, run := range ac.runs {
+		iterators = append(iterators, store.Iterator(run))
+	}
+	return iterators
+}
+
+// keptValuesAt returns the values at the sorted zero based positions of the durations kept after outliers trimming.
+func (ac *aggregationCell) keptValuesAt(store *spill.Store, positions []int) ([]int, error) {
+	if ac.from == 0 {
+		return ac.valuesAt(store, positions)
+	}
+	shifted := make([]int, len(positions))
+	for i, n := range positions {
+		shifted[i] = ac.from + n
+	}
+	return ac.valuesAt(store, shifted)
+}
+
+type sortedIterator interface {
+	Next() (int, bool, error)
+}
+
+type sliceIterator struct {
+	values []int
+}
+
+func (it *sliceIterator) Next() (int, bool, error) {
+	if len(it.values) == 0 {
+		return 0, false, nil
+	}
+	v := it.values[0]
+	it.values = it.values[1:]
+	return v, true, nil
+}
+
+// nthValues returns the values at the sorted zero based positions in the merged sequence of the sorted iterators.
+func nthValues(iterators []sortedIterator, positions []int) ([]int, error) {
+	values := make([]int, 0, len(positions))
+	err := eachValue(iterators, func(n, v int) bool {
+		for len(values) < len(positions) && positions[len(values)] == n {
+			values = append(values, v)
+		}
+		return len(values) < len(positions)
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(values) < len(positions) {
+		return nil, errors.Errorf("position %d is beyond the merged runs", positions[len(values)])
+	}
+	return values, nil
+}
+
+// eachValue calls f with each zero based position and value of the merged sequence of the sorted iterators
+// until f returns false.
+func eachValue(iterators []sortedIterator, f func(n, v int) bool) error {
+	h := &iteratorsHeap{}
+	for _, it := range iterators {
+		if err := h.pushNext(it); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	for n := 0; h.Len() > 0; n++ {
+		item := heap.Pop(h).(iteratorsHeapItem)
+		if !f(n, item.value) {
+			return nil
+		}
+		if err := h.pushNext(item.iterator); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+type iteratorsHeapItem struct {
+	value    int
+	iterator sortedIterator
+}
+
+// iteratorsHeap is a min heap of the current iterator values.
+type iteratorsHeap []iteratorsHeapItem
+
+func (h *iteratorsHeap) pushNext(it sortedIterator) error {
+	v, ok, err := it.Next()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if ok {
+		heap.Push(h, iteratorsHeapItem{value: v, iterator: it})
+	}
+	return nil
+}
+
+func (h iteratorsHeap) Len() int           { return len(h) }
+func (h iteratorsHeap) Less(i, j int) bool { return h[i].value < h[j].value }
+func (h iteratorsHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *iteratorsHeap) Push(x interface{}) {
+	*h = append(*h, x.(iteratorsHeapItem))
+}
+
+func (h *iteratorsHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,106 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+)
+
+const fingerprintSize = 4096
+
+// Checkpoint keeps the result of processing the input file up to the offset.
+type Checkpoint struct {
+	// Offset is the input file offset at a ride sequence beginning.
+	// All rides before the offset are aggregated in the state.
+	Offset int `json:"offset"`
+	// Fingerprint is a checksum of the input file part right before the offset.
+	// It's used to detect that the input file was rewritten instead of being appended to.
+	Fingerprint uint32 `json:"fingerprint"`
+	// OptionsFingerprint is a checksum of the options the state is aggregated with.
+	// It's used to detect that the options changed, so the state can't be merged with new rides.
+	OptionsFingerprint uint32             `json:"options_fingerprint"`
+	State              *aggregation.State `json:"state"`
+}
+
+func New(inputPath string, offset int, optionsFingerprint uint32, state *aggregation.State) (*Checkpoint, error) {
+	fingerprint, err := calculateFingerprint(inputPath, offset)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Checkpoint{Offset: offset, Fingerprint: fingerprint, OptionsFingerprint: optionsFingerprint, State: state}, nil
+}
+
+// Load reads the checkpoint from the file. It returns nil if the checkpoint file doesn't exist.
+func Load(filePath string) (*Checkpoint, error) {
+	b, err := ioutil.ReadFile(path.Clean(filePath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read checkpoint file")
+	}
+	c := &Checkpoint{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, errors.Wrap(err, "can't decode checkpoint")
+	}
+	if c.State == nil {
+		c.State = &aggregation.State{}
+	}
+	return c, nil
+}
+
+// Save writes the checkpoint into a temporary file and renames it,
+// so the previous checkpoint stays untouched if the process crashes during writing.
+func Save(filePath string, c *Checkpoint) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return errors.Wrap(err, "can't encode checkpoint")
+	}
+	tmpPath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0o600); err != nil {
+		return errors.Wrap(err, "can't write checkpoint file")
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return errors.Wrap(err, "can't replace checkpoint file")
+	}
+	return nil
+}
+
+// Matches checks that the input file still contains the data the checkpoint was made from.
+func (c *Checkpoint) Matches(inputPath string) (bool, error) {
+	fileStat, err := os.Stat(inputPath)
+	if err != nil {
+		return false, errors.Wrap(err, "can't get input csv file stat")
+	}
+	if int(fileStat.Size()) < c.Offset {
+		return false, nil
+	}
+	fingerprint, err := calculateFingerprint(inputPath, c.Offset)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return fingerprint == c.Fingerprint, nil
+}
+
+func calculateFingerprint(inputPath string, offset int) (uint32, error) {
+	f, err := os.Open(path.Clean(inputPath))
+	if err != nil {
+		return 0, errors.Wrap(err, "can't open input csv file")
+	}
+	defer f.Close() // nolint: errcheck, gosec
+	start := offset - fingerprintSize
+	if start < 0 {
+		start = 0
+	}
+	b := make([]byte, offset-start)
+	if _, err := f.ReadAt(b, int64(start)); err != nil {
+		return 0, errors.Wrap(err, "can't read input csv file for fingerprint")
+	}
+	return crc32.ChecksumIEEE(b), nil
+}
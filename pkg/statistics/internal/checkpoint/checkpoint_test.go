@@ -0,0 +1,58 @@
+package checkpoint_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/checkpoint"
+)
+
+func TestCheckpoint(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "checkpoint_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	inputFile := filepath.Join(dir, "input.csv")
+	checkpointFile := filepath.Join(dir, "checkpoint.json")
+	content := "1,37.966660,23.728308,1405594957\n1,37.966627,23.728263,1405594966\n"
+	err = ioutil.WriteFile(inputFile, []byte(content), 0o600)
+	require.NoError(t, err)
+
+	loaded, err := checkpoint.Load(checkpointFile)
+	require.NoError(t, err)
+	assert.Nil(t, loaded)
+
+	state := &aggregation.State{Cells: []*aggregation.CellState{{StartHour: 10, DistanceRange: 2, Durations: []int{1, 2}}}}
+	const optionsFingerprint = 42
+	cp, err := checkpoint.New(inputFile, len(content), optionsFingerprint, state)
+	require.NoError(t, err)
+	err = checkpoint.Save(checkpointFile, cp)
+	require.NoError(t, err)
+	loaded, err = checkpoint.Load(checkpointFile)
+	require.NoError(t, err)
+	assert.Equal(t, cp, loaded)
+
+	cases := []struct {
+		name     string
+		content  string
+		expected bool
+	}{
+		{name: "same file", content: content, expected: true},
+		{name: "appended file", content: content + "2,37.946413,23.754767,1405591094\n", expected: true},
+		{name: "rewritten file", content: "3" + content[1:], expected: false},
+		{name: "truncated file", content: content[:10], expected: false},
+	}
+	for _, tc := range cases {
+		err = ioutil.WriteFile(inputFile, []byte(tc.content), 0o600)
+		require.NoError(t, err)
+		matches, err := loaded.Matches(inputFile)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, matches, tc.name)
+	}
+}
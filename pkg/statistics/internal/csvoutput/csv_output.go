@@ -4,6 +4,7 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"strconv"
 	"time"
@@ -13,13 +14,91 @@ import (
 	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
 )
 
-func WriteCSVReportToFile(filePath string, report aggregation.StatisticsReport) error {
+// Duration formats of report values.
+const (
+	// DurationFormatGo writes Go durations, e.g. 7m32s.
+	DurationFormatGo = "go"
+	// DurationFormatSeconds writes whole seconds, e.g. 452.
+	DurationFormatSeconds = "seconds"
+	// DurationFormatSecondsFloat writes seconds with three decimals, e.g. 452.250,
+	// interpolated percentiles keep the fraction of a second.
+	DurationFormatSecondsFloat = "seconds_float"
+	// DurationFormatMinutes writes minutes rounded to three decimals, e.g. 7.533.
+	DurationFormatMinutes = "minutes"
+	// DurationFormatClock writes hours, minutes and seconds, e.g. 00:07:32, hours aren't wrapped at a day.
+	DurationFormatClock = "hh:mm:ss"
+)
+
+// DurationFormats returns names of all duration formats.
+func DurationFormats() []string {
+	return []string{
+		DurationFormatGo, DurationFormatSeconds, DurationFormatSecondsFloat, DurationFormatMinutes, DurationFormatClock,
+	}
+}
+
+// Option changes how report values are written.
+type Option func(*options)
+
+type options struct {
+	metric         string
+	durationFormat string
+}
+
+// WithMetric sets the aggregation metric of report values, values are durations by default.
+// Durations and paces are written as Go durations, paces are per km, speeds are written in km/h.
+func WithMetric(metric string) Option {
+	return func(o *options) {
+		o.metric = metric
+	}
+}
+
+// WithDurationFormat sets the format of durations and paces in the reports with a column per distance range,
+// see the DurationFormat constants. The long-format reports always write them in seconds.
+func WithDurationFormat(format string) Option {
+	return func(o *options) {
+		o.durationFormat = format
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{metric: aggregation.MetricDuration, durationFormat: DurationFormatGo}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func WriteCSVReportToFile(filePath string, report aggregation.StatisticsReport, opts ...Option) error {
+	return writeToFile(filePath, func(w io.Writer) error {
+		return WriteCSVReport(w, report, opts...)
+	})
+}
+
+func WriteCSVZonesReportToFile(filePath string, report aggregation.ZonesReport, opts ...Option) error {
+	return writeToFile(filePath, func(w io.Writer) error {
+		return WriteCSVZonesReport(w, report, opts...)
+	})
+}
+
+func WriteCSVPeriodsReportToFile(filePath string, report aggregation.PeriodsReport, opts ...Option) error {
+	return writeToFile(filePath, func(w io.Writer) error {
+		return WriteCSVPeriodsReport(w, report, opts...)
+	})
+}
+
+func WriteCSVHistogramReportToFile(filePath string, report aggregation.HistogramReport, bins aggregation.Bins) error {
+	return writeToFile(filePath, func(w io.Writer) error {
+		return WriteCSVHistogramReport(w, report, bins)
+	})
+}
+
+func writeToFile(filePath string, write func(w io.Writer) error) error {
 	f, err := os.Create(filePath)
 	if err != nil {
 		return errors.Wrap(err, "can't open output file for writing")
 	}
 	defer f.Close() // nolint: errcheck, gosec
-	if err := WriteCSVReport(f, report); err != nil {
+	if err := write(f); err != nil {
 		return errors.WithStack(err)
 	}
 	if err := f.Close(); err != nil {
@@ -28,30 +107,146 @@ func WriteCSVReportToFile(filePath string, report aggregation.StatisticsReport)
 	return nil
 }
 
-func WriteCSVReport(w io.Writer, report aggregation.StatisticsReport) error {
+func WriteCSVReport(w io.Writer, report aggregation.StatisticsReport, opts ...Option) error {
+	o := newOptions(opts)
 	csvw := csv.NewWriter(w)
 	for i, hs := range report {
 		if i == 0 {
-			records := []string{"Time of Day"}
-			for _, ds := range hs.DistanceStatistics {
-				var dr string
-				if ds.DistanceRange == aggregation.DistanceRangeOver21KM {
-					dr = "21+"
-				} else {
-					dr = strconv.Itoa(ds.DistanceRange)
+			if err := csvw.Write(headerRecords(hs)); err != nil {
+				return errors.Wrap(err, "can't write csv header")
+			}
+		}
+		if err := csvw.Write(o.hourRecords(hs)); err != nil {
+			return errors.Wrap(err, "can't write report to csv")
+		}
+	}
+	csvw.Flush()
+	if err := csvw.Error(); err != nil {
+		return errors.Wrap(err, "can't write report to csv")
+	}
+	return nil
+}
+
+// WriteCSVZonesReport writes reports of all zones into a single table with the zone columns in front.
+// The drop-off zone column is written only if rides are bucketed by drop-off zones.
+func WriteCSVZonesReport(w io.Writer, report aggregation.ZonesReport, opts ...Option) error {
+	o := newOptions(opts)
+	byDropoff := false
+	for _, zs := range report {
+		if zs.Dropoff != "" {
+			byDropoff = true
+			break
+		}
+	}
+	csvw := csv.NewWriter(w)
+	for i, zs := range report {
+		zoneRecords := []string{zs.Pickup}
+		if byDropoff {
+			zoneRecords = append(zoneRecords, zs.Dropoff)
+		}
+		for j, hs := range zs.Report {
+			if i == 0 && j == 0 {
+				records := []string{"Pickup Zone"}
+				if byDropoff {
+					records = append(records, "Dropoff Zone")
+				}
+				if err := csvw.Write(append(records, headerRecords(hs)...)); err != nil {
+					return errors.Wrap(err, "can't write csv header")
 				}
-				records = append(records, fmt.Sprintf("%s km", dr))
 			}
+			records := append(append([]string(nil), zoneRecords...), o.hourRecords(hs)...)
 			if err := csvw.Write(records); err != nil {
-				return errors.Wrap(err, "can't write csv header")
+				return errors.Wrap(err, "can't write report to csv")
 			}
 		}
-		records := []string{fmt.Sprintf("%02d:00", hs.StartHour)}
-		for _, ds := range hs.DistanceStatistics {
-			records = append(records, (time.Duration(ds.Value) * time.Second).String())
+	}
+	csvw.Flush()
+	if err := csvw.Error(); err != nil {
+		return errors.Wrap(err, "can't write report to csv")
+	}
+	return nil
+}
+
+// WriteCSVPeriodsReport writes reports of all periods in the long format, so they can be charted as time series:
+// a row per period, hour and distance range with the 95th percentile in seconds and the number of rides.
+// Periods are written as UTC dates of their start, cells without rides are skipped.
+// If the report has confidence intervals, their bounds are written in the last columns.
+// Speeds are written in km/h and paces in seconds per km, the values columns are named after the units.
+func WriteCSVPeriodsReport(w io.Writer, report aggregation.PeriodsReport, opts ...Option) error {
+	o := newOptions(opts)
+	withIntervals := len(report) != 0 && len(report[0].Report) != 0 &&
+		report[0].Report[0].DistanceStatistics[0].Interval != nil
+	units := map[string]string{
+		aggregation.MetricDuration: "seconds",
+		aggregation.MetricSpeed:    "kmh",
+		aggregation.MetricPace:     "seconds_per_km",
+	}[o.metric]
+	header := []string{"period", "time_of_day", "distance_range", "p95_" + units, "rides"}
+	if withIntervals {
+		header = append(header, "p95_lower_"+units, "p95_upper_"+units)
+	}
+	csvw := csv.NewWriter(w)
+	if err := csvw.Write(header); err != nil {
+		return errors.Wrap(err, "can't write csv header")
+	}
+	for _, ps := range report {
+		period := time.Unix(int64(ps.Start), 0).UTC().Format("2006-01-02")
+		for _, hs := range ps.Report {
+			for _, ds := range hs.DistanceStatistics {
+				if ds.Count == 0 {
+					continue
+				}
+				records := []string{
+					period, fmt.Sprintf("%02d:00", hs.StartHour), ds.RangeName(),
+					o.formatNumber(ds.Value), strconv.Itoa(ds.Count),
+				}
+				if withIntervals {
+					records = append(records, o.formatNumber(ds.Interval.Lower), o.formatNumber(ds.Interval.Upper))
+				}
+				if err := csvw.Write(records); err != nil {
+					return errors.Wrap(err, "can't write report to csv")
+				}
+			}
 		}
-		if err := csvw.Write(records); err != nil {
-			return errors.Wrap(err, "can't write report to csv")
+	}
+	csvw.Flush()
+	if err := csvw.Error(); err != nil {
+		return errors.Wrap(err, "can't write report to csv")
+	}
+	return nil
+}
+
+// WriteCSVHistogramReport writes histograms of all cells in the long format: a row per hour, distance range and bin
+// with the bin bounds in seconds and the number of rides. The end of the last bin is empty since it isn't bounded,
+// cells without rides are skipped.
+func WriteCSVHistogramReport(w io.Writer, report aggregation.HistogramReport, bins aggregation.Bins) error {
+	csvw := csv.NewWriter(w)
+	header := []string{"time_of_day", "distance_range", "bin_start_seconds", "bin_end_seconds", "rides"}
+	if err := csvw.Write(header); err != nil {
+		return errors.Wrap(err, "can't write csv header")
+	}
+	for _, hh := range report {
+		for _, dh := range hh.DistanceHistograms {
+			rides := 0
+			for _, count := range dh.Counts {
+				rides += count
+			}
+			if rides == 0 {
+				continue
+			}
+			for i, count := range dh.Counts {
+				var end string
+				if i+1 < len(bins.Edges) {
+					end = formatSeconds(bins.Edges[i+1])
+				}
+				records := []string{
+					fmt.Sprintf("%02d:00", hh.StartHour), dh.RangeName(),
+					formatSeconds(bins.Edges[i]), end, strconv.Itoa(count),
+				}
+				if err := csvw.Write(records); err != nil {
+					return errors.Wrap(err, "can't write report to csv")
+				}
+			}
 		}
 	}
 	csvw.Flush()
@@ -60,3 +255,81 @@ func WriteCSVReport(w io.Writer, report aggregation.StatisticsReport) error {
 	}
 	return nil
 }
+
+// headerRecords returns the header, each distance range has the lower and upper bounds columns
+// after its value column if the report has confidence intervals.
+func headerRecords(hs *aggregation.HourStatistics) []string {
+	records := []string{"Time of Day"}
+	for _, ds := range hs.DistanceStatistics {
+		records = append(records, ds.RangeName())
+		if ds.Interval != nil {
+			records = append(records, ds.RangeName()+" Lower", ds.RangeName()+" Upper")
+		}
+	}
+	return records
+}
+
+func (o *options) hourRecords(hs *aggregation.HourStatistics) []string {
+	records := []string{fmt.Sprintf("%02d:00", hs.StartHour)}
+	for _, ds := range hs.DistanceStatistics {
+		records = append(records, o.formatValue(ds.ExactValue()))
+		if ds.Interval != nil {
+			records = append(records, o.formatValue(float64(ds.Interval.Lower)), o.formatValue(float64(ds.Interval.Upper)))
+		}
+	}
+	return records
+}
+
+// formatValue formats a value of the report of the metric, speeds are in km/h
+// and other values are durations in the duration format.
+func (o *options) formatValue(value float64) string {
+	if o.metric == aggregation.MetricSpeed {
+		return formatSpeed(int(math.Round(value)))
+	}
+	return formatDuration(value, o.durationFormat)
+}
+
+// formatNumber formats a value of the long-format report, speeds are in km/h and other values are in seconds.
+func (o *options) formatNumber(value int) string {
+	if o.metric == aggregation.MetricSpeed {
+		return formatSpeed(value)
+	}
+	return strconv.Itoa(value)
+}
+
+// formatSpeed formats a speed in meters per hour as km/h.
+func formatSpeed(metersPerHour int) string {
+	const metersInKm = 1000
+	return strconv.FormatFloat(float64(metersPerHour)/metersInKm, 'f', -1, 64)
+}
+
+// formatDuration formats a duration in seconds, the seconds and minutes with decimals keep the fraction of a second
+// and other formats are rounded to whole seconds. Unknown formats fall back to Go durations.
+func formatDuration(exactSeconds float64, format string) string {
+	const secondsInMinute = 60
+	seconds := int(math.Round(exactSeconds))
+	switch format {
+	case DurationFormatSeconds:
+		return strconv.Itoa(seconds)
+	case DurationFormatSecondsFloat:
+		return strconv.FormatFloat(exactSeconds, 'f', 3, 64)
+	case DurationFormatMinutes:
+		minutes := math.Round(exactSeconds/secondsInMinute*1000) / 1000
+		return strconv.FormatFloat(minutes, 'f', -1, 64)
+	case DurationFormatClock:
+		sign := ""
+		if seconds < 0 {
+			sign, seconds = "-", -seconds
+		}
+		return fmt.Sprintf(
+			"%s%02d:%02d:%02d", sign, seconds/3600, seconds/secondsInMinute%secondsInMinute, seconds%secondsInMinute,
+		)
+	default:
+		return (time.Duration(seconds) * time.Second).String()
+	}
+}
+
+// formatSeconds formats a bin edge in seconds, log bins edges are rounded to milliseconds.
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(math.Round(seconds*1000)/1000, 'f', -1, 64)
+}
@@ -20,7 +20,7 @@ func TestWriteCSVReport(t *testing.T) {
 	require.NoError(t, err)
 	actual := w.String()
 
-	expected := `Time of Day,1 km,2 km,3 km,5 km,8 km,13 km,21 km,21+ km
+	expected := `Time of Day,0-1 km,1-2 km,2-3 km,3-5 km,5-8 km,8-13 km,13-21 km,21+ km
 00:00,1s,2s,3s,4s,5s,6s,7s,8s
 01:00,11s,12s,13s,14s,15s,16s,17s,18s
 02:00,21s,22s,23s,24s,25s,26s,27s,28s
@@ -49,6 +49,91 @@ func TestWriteCSVReport(t *testing.T) {
 	assert.Equal(t, expected, actual)
 }
 
+func TestWriteCSVReport_Intervals(t *testing.T) {
+	t.Parallel()
+	report := getTestReport()[:2]
+	for _, hs := range report {
+		for _, ds := range hs.DistanceStatistics {
+			ds.Interval = &aggregation.Interval{Lower: ds.Value - 1, Upper: ds.Value + 60}
+		}
+	}
+	w := bytes.NewBufferString("")
+
+	err := csvoutput.WriteCSVReport(w, report)
+	require.NoError(t, err)
+
+	expected := `Time of Day,0-1 km,0-1 km Lower,0-1 km Upper,1-2 km,1-2 km Lower,1-2 km Upper,` +
+		`2-3 km,2-3 km Lower,2-3 km Upper,3-5 km,3-5 km Lower,3-5 km Upper,5-8 km,5-8 km Lower,5-8 km Upper,` +
+		`8-13 km,8-13 km Lower,8-13 km Upper,` +
+		`13-21 km,13-21 km Lower,13-21 km Upper,21+ km,21+ km Lower,21+ km Upper
+00:00,1s,0s,1m1s,2s,1s,1m2s,3s,2s,1m3s,4s,3s,1m4s,5s,4s,1m5s,6s,5s,1m6s,7s,6s,1m7s,8s,7s,1m8s
+01:00,11s,10s,1m11s,12s,11s,1m12s,13s,12s,1m13s,14s,13s,1m14s,15s,14s,1m15s,16s,15s,1m16s,17s,16s,1m17s,18s,17s,1m18s
+`
+	assert.Equal(t, expected, w.String())
+}
+
+func TestWriteCSVZonesReport(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name     string
+		report   aggregation.ZonesReport
+		expected string
+	}{
+		{
+			name: "pickup zones",
+			report: aggregation.ZonesReport{
+				{Zone: aggregation.Zone{Pickup: "airport"}, Report: getTestReport()[:1]},
+				{Zone: aggregation.Zone{Pickup: "downtown"}, Report: getTestReport()[1:2]},
+			},
+			expected: `Pickup Zone,Time of Day,0-1 km,1-2 km,2-3 km,3-5 km,5-8 km,8-13 km,13-21 km,21+ km
+airport,00:00,1s,2s,3s,4s,5s,6s,7s,8s
+downtown,01:00,11s,12s,13s,14s,15s,16s,17s,18s
+`,
+		},
+		{
+			name: "pickup and drop-off zones",
+			report: aggregation.ZonesReport{
+				{Zone: aggregation.Zone{Pickup: "airport", Dropoff: "downtown"}, Report: getTestReport()[:2]},
+			},
+			expected: `Pickup Zone,Dropoff Zone,Time of Day,0-1 km,1-2 km,2-3 km,3-5 km,5-8 km,8-13 km,13-21 km,21+ km
+airport,downtown,00:00,1s,2s,3s,4s,5s,6s,7s,8s
+airport,downtown,01:00,11s,12s,13s,14s,15s,16s,17s,18s
+`,
+		},
+	}
+	for _, tc := range cases {
+		w := bytes.NewBufferString("")
+		err := csvoutput.WriteCSVZonesReport(w, tc.report)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, w.String(), tc.name)
+	}
+}
+
+func TestWriteCSVPeriodsReport(t *testing.T) {
+	t.Parallel()
+	firstDay := getTestReport()[:1]
+	firstDay[0].DistanceStatistics[0].Count = 2
+	firstDay[0].DistanceStatistics[7].Count = 1
+	secondDay := getTestReport()[10:11]
+	secondDay[0].DistanceStatistics[2].Count = 5
+	report := aggregation.PeriodsReport{
+		{Start: 1609113600, Report: firstDay},
+		{Start: 1609200000, Report: secondDay},
+		{Start: 1609286400, Report: getTestReport()},
+	}
+	w := bytes.NewBufferString("")
+
+	err := csvoutput.WriteCSVPeriodsReport(w, report)
+	require.NoError(t, err)
+
+	expected := `period,time_of_day,distance_range,p95_seconds,rides
+2020-12-28,00:00,0-1 km,1,2
+2020-12-28,00:00,21+ km,8,1
+2020-12-29,10:00,2-3 km,103,5
+`
+	assert.Equal(t, expected, w.String())
+}
+
 func getTestReport() aggregation.StatisticsReport {
 	report := aggregation.StatisticsReport{}
 	for i := 0; i < 24; i++ {
@@ -68,3 +153,89 @@ func getTestReport() aggregation.StatisticsReport {
 	}
 	return report
 }
+
+func TestWriteCSVHistogramReport(t *testing.T) {
+	t.Parallel()
+	report := aggregation.HistogramReport{
+		{StartHour: 0, DistanceHistograms: []*aggregation.DistanceHistogram{
+			{DistanceRange: 1, Counts: []int{1, 0, 2}},
+			{DistanceRange: 2, Counts: []int{0, 0, 0}},
+		}},
+		{StartHour: 1, DistanceHistograms: []*aggregation.DistanceHistogram{
+			{DistanceRange: aggregation.DistanceRangeOver21KM, Counts: []int{0, 3, 0}},
+		}},
+	}
+	bins := aggregation.Bins{Edges: []float64{0, 31.6227766, 1000}}
+	w := bytes.NewBufferString("")
+
+	err := csvoutput.WriteCSVHistogramReport(w, report, bins)
+	require.NoError(t, err)
+
+	expected := `time_of_day,distance_range,bin_start_seconds,bin_end_seconds,rides
+00:00,0-1 km,0,31.623,1
+00:00,0-1 km,31.623,1000,0
+00:00,0-1 km,1000,,2
+01:00,21+ km,0,31.623,0
+01:00,21+ km,31.623,1000,3
+01:00,21+ km,1000,,0
+`
+	assert.Equal(t, expected, w.String())
+}
+
+func TestWriteCSVReport_Metric(t *testing.T) {
+	t.Parallel()
+	report := aggregation.StatisticsReport{{StartHour: 0, DistanceStatistics: []*aggregation.DistanceStatistics{
+		{DistanceRange: 1, Value: 18500, Count: 2, Interval: &aggregation.Interval{Lower: 12000, Upper: 30000}},
+		{DistanceRange: 2, Value: 0, Interval: &aggregation.Interval{}},
+	}}}
+	w := bytes.NewBufferString("")
+
+	require.NoError(t, csvoutput.WriteCSVReport(w, report, csvoutput.WithMetric(aggregation.MetricSpeed)))
+	expected := `Time of Day,0-1 km,0-1 km Lower,0-1 km Upper,1-2 km,1-2 km Lower,1-2 km Upper
+00:00,18.5,12,30,0,0,0
+`
+	assert.Equal(t, expected, w.String())
+
+	w.Reset()
+	periods := aggregation.PeriodsReport{{Start: 1609113600, Report: report}}
+	require.NoError(t, csvoutput.WriteCSVPeriodsReport(w, periods, csvoutput.WithMetric(aggregation.MetricSpeed)))
+	expected = `period,time_of_day,distance_range,p95_kmh,rides,p95_lower_kmh,p95_upper_kmh
+2020-12-28,00:00,0-1 km,18.5,2,12,30
+`
+	assert.Equal(t, expected, w.String())
+
+	w.Reset()
+	require.NoError(t, csvoutput.WriteCSVPeriodsReport(w, periods, csvoutput.WithMetric(aggregation.MetricPace)))
+	assert.Equal(t, "period,time_of_day,distance_range,p95_seconds_per_km,rides,"+
+		"p95_lower_seconds_per_km,p95_upper_seconds_per_km\n2020-12-28,00:00,0-1 km,18500,2,12000,30000\n", w.String())
+}
+
+func TestWriteCSVReport_DurationFormat(t *testing.T) {
+	t.Parallel()
+	report := aggregation.StatisticsReport{{StartHour: 9, DistanceStatistics: []*aggregation.DistanceStatistics{
+		{DistanceRange: 1, Value: 452, Fraction: 0.25, Count: 2},
+		{DistanceRange: 2, Value: 90061, Count: 1},
+		{DistanceRange: 3, Value: 0},
+	}}}
+	cases := []struct {
+		format   string
+		expected string
+	}{
+		{format: csvoutput.DurationFormatGo, expected: "09:00,7m32s,25h1m1s,0s\n"},
+		{format: csvoutput.DurationFormatSeconds, expected: "09:00,452,90061,0\n"},
+		{format: csvoutput.DurationFormatSecondsFloat, expected: "09:00,452.250,90061.000,0.000\n"},
+		{format: csvoutput.DurationFormatMinutes, expected: "09:00,7.538,1501.017,0\n"},
+		{format: csvoutput.DurationFormatClock, expected: "09:00,00:07:32,25:01:01,00:00:00\n"},
+	}
+	for _, tc := range cases {
+		w := bytes.NewBufferString("")
+		require.NoError(t, csvoutput.WriteCSVReport(w, report, csvoutput.WithDurationFormat(tc.format)), tc.format)
+		assert.Equal(t, "Time of Day,0-1 km,1-2 km,2-3 km\n"+tc.expected, w.String(), tc.format)
+	}
+
+	w := bytes.NewBufferString("")
+	periods := aggregation.PeriodsReport{{Start: 1609113600, Report: report}}
+	err := csvoutput.WriteCSVPeriodsReport(w, periods, csvoutput.WithDurationFormat(csvoutput.DurationFormatClock))
+	require.NoError(t, err)
+	assert.Contains(t, w.String(), "\n2020-12-28,09:00,0-1 km,452,2\n", "long format is always in seconds")
+}
@@ -2,23 +2,80 @@ package fileread
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"io"
+	"log"
 	"os"
 	"path"
 	"strconv"
-	"strings"
 
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/metrics"
 	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
 )
 
-func StartFileReaders(filePath string, outs []chan *ride.Row) (func() error, error) {
+// ToEnd is used as the range end to read until the end of the file.
+const ToEnd = -1
+
+// Range is a part of the input file in bytes: [Start, End).
+// Start must point to the beginning of a ride sequence.
+type Range struct {
+	Start int
+	End   int
+}
+
+var WholeFile = Range{Start: 0, End: ToEnd}
+
+// DefaultChunkSize is small enough for the chunks to be evenly distributed between readers
+// and big enough to make skipping bytes at the chunk start negligible.
+const DefaultChunkSize = 1024 * 1024
+
+// IOMode defines how readers access the input file.
+type IOMode string
+
+const (
+	// IORead reads chunks with read syscalls through a buffered reader.
+	IORead IOMode = "read"
+	// IOMmap maps the file into memory and scans chunks directly in the mapped region.
+	// If mmap isn't available readers fall back to IORead.
+	IOMmap IOMode = "mmap"
+)
+
+type Config struct {
+	// Range is the part of the file to read.
+	Range Range
+	// ChunkSize is the approximate size of chunks the file range is split into.
+	ChunkSize int
+	// IO is the way to access the file, IORead is used if it's empty.
+	IO IOMode
+	// Window limits the number of chunks taken ahead of the oldest unfinished one if it isn't nil:
+	// a reader sends a value into it before taking each chunk and the consumer of the rows receives a value
+	// from it after it's done with each chunk in order. The channel capacity is the window size.
+	Window chan struct{}
+}
+
+// StartFileReaders starts a reader for each out channel.
+// The file range is split into chunks which readers take from the shared queue one by one.
+// Each chunk contains whole rides and a reader sends all rows of a chunk into its own channel,
+// so rows of a ride always end up in the same channel and in the original order.
+// Rows are sent in batches tagged with the chunk sequence number, the last batch of each chunk is marked,
+// so the input order can be restored from several channels.
+func StartFileReaders(filePath string, cfg Config, outs []chan *ride.Batch, m *metrics.Pipeline,
+) (func() error, error) {
 	if len(outs) == 0 {
 		return nil, errors.New("slice of out channels can't be empty")
 	}
+	if cfg.ChunkSize <= 0 {
+		return nil, errors.New("chunk size must be a positive number")
+	}
+	switch cfg.IO {
+	case "", IORead, IOMmap:
+	default:
+		return nil, errors.Errorf("unknown io mode: %s", cfg.IO)
+	}
 	f, err := os.Open(path.Clean(filePath))
 	if err != nil {
 		return nil, errors.Wrap(err, "can't open input csv file")
@@ -27,27 +84,71 @@ func StartFileReaders(filePath string, outs []chan *ride.Row) (func() error, err
 	if err != nil {
 		return nil, errors.Wrap(err, "can't get input csv file stat")
 	}
-	fileSize := int(fileStat.Size())
-	// Equally split the input file into chunks, 1 chunk for each out channel.
-	chunks := splitFile(fileSize, len(outs))
-	eg, ctx := errgroup.WithContext(context.Background())
-	if len(chunks) > 1 {
-		for i, chunk := range chunks {
-			chunk := chunk
-			out := outs[i]
-			eg.Go(func() error {
-				return errors.WithStack(readRidesSequence(ctx, f, fileSize, chunk, out))
-			})
+	end := int(fileStat.Size())
+	if cfg.Range.End != ToEnd && cfg.Range.End < end {
+		end = cfg.Range.End
+	}
+	if cfg.Range.Start > end {
+		return nil, errors.Errorf("range start %d is beyond the range end %d", cfg.Range.Start, end)
+	}
+	var (
+		src   chunkSource = readerAtSource{f: f}
+		unmap             = func() error { return nil }
+	)
+	if cfg.IO == IOMmap && end > 0 {
+		data, unmapData, err := mmapFile(f, end)
+		if err != nil {
+			log.Printf("Can't memory map input csv file, fall back to reading it: %v", err)
+		} else {
+			src = mappedSource{data: data}
+			unmap = unmapData
 		}
-	} else {
+	}
+	chunks := splitFile(cfg.Range.Start, end, chunksNumber(end-cfg.Range.Start, cfg.ChunkSize))
+	queue := make(chan *fileChunk, len(chunks))
+	for _, chunk := range chunks {
+		queue <- chunk
+	}
+	close(queue)
+	eg, ctx := errgroup.WithContext(context.Background())
+	for _, out := range outs {
+		out := out
 		eg.Go(func() error {
-			return errors.WithStack(readAllRidesSequence(ctx, f, outs[0]))
+			defer close(out)
+			w := &batchWriter{out: out, metrics: m}
+			for {
+				if cfg.Window != nil {
+					select {
+					case cfg.Window <- struct{}{}:
+					case <-ctx.Done():
+						return nil
+					}
+				}
+				chunk, ok := <-queue
+				if !ok {
+					// No chunk is taken for the value, so other readers waiting for the window can finish too.
+					if cfg.Window != nil {
+						<-cfg.Window
+					}
+					return nil
+				}
+				w.chunk = chunk.seq
+				if err := readRidesSequence(ctx, src, end, chunk, w); err != nil {
+					return errors.WithStack(err)
+				}
+				w.finishChunk()
+			}
 		})
 	}
 	return func() error {
 		defer f.Close() // nolint: errcheck, gosec
-		if err := eg.Wait(); err != nil {
-			return errors.WithStack(err)
+		// Rows are parsed into values, so nothing refers to the mapped data after readers finish.
+		waitErr := eg.Wait()
+		if err := unmap(); err != nil {
+			return errors.Wrap(err, "can't unmap input csv file")
+		}
+		if waitErr != nil {
+			return errors.WithStack(waitErr)
 		}
 		if err := f.Close(); err != nil {
 			return errors.Wrap(err, "can't close input csv file")
@@ -56,33 +157,17 @@ func StartFileReaders(filePath string, outs []chan *ride.Row) (func() error, err
 	}, nil
 }
 
-func readAllRidesSequence(ctx context.Context, f io.Reader, out chan<- *ride.Row) error {
-	defer close(out)
-	r := bufio.NewScanner(f)
-	for r.Scan() {
-		select {
-		case <-ctx.Done():
-			return errors.WithStack(ctx.Err())
-		default:
-		}
-		s := r.Text()
-		row, err := parseRow(s)
-		if err != nil {
-			return errors.WithStack(err)
-		}
-		out <- row
+func chunksNumber(size, chunkSize int) int {
+	chunksNo := size / chunkSize
+	if chunksNo == 0 {
+		return 1
 	}
-	if err := r.Err(); err != nil {
-		return errors.Wrap(err, "file scanner final error")
-	}
-	return nil
+	return chunksNo
 }
 
-func readRidesSequence(ctx context.Context, f io.ReaderAt, totalSize int, chunk *fileChunk, out chan<- *ride.Row,
-) error {
-	defer close(out)
-	sr := io.NewSectionReader(f, int64(chunk.start), int64(totalSize))
-	r := bufio.NewReader(sr)
+// readRidesSequence reads rows of the rides that start within the chunk, the data beyond the end offset is never read.
+func readRidesSequence(ctx context.Context, src chunkSource, end int, chunk *fileChunk, w *batchWriter) error {
+	r := src.lineReader(chunk.start, end)
 	var (
 		bytesRead int
 
@@ -93,10 +178,10 @@ func readRidesSequence(ctx context.Context, f io.ReaderAt, totalSize int, chunk
 
 	// If it's the first chunk, sequence is always started.
 	// For non-first chunks we need to skip some bytes until '\n' to start from a new row beginning.
-	if chunk.start == 0 {
+	if chunk.first {
 		sequenceStarted = true
 	} else {
-		s, err := r.ReadString('\n')
+		s, err := r.readLine()
 		if errors.Is(err, io.EOF) {
 			return nil
 		}
@@ -127,7 +212,7 @@ func readRidesSequence(ctx context.Context, f io.ReaderAt, totalSize int, chunk
 		}
 		// If we were able to capture the start of a new ride sequence we can start sending rows to the out channel.
 		if sequenceStarted {
-			out <- currentRow
+			w.write(currentRow)
 		}
 		nextRow, nextRowSize, err := getRow(r)
 		if err != nil && !errors.Is(err, io.EOF) {
@@ -150,69 +235,148 @@ func readRidesSequence(ctx context.Context, f io.ReaderAt, totalSize int, chunk
 	return nil
 }
 
-func getRow(r *bufio.Reader) (*ride.Row, int, error) {
-	s, err := readLine(r)
+// chunkSource provides line readers for parts of the input file.
+type chunkSource interface {
+	// lineReader returns a reader of lines in [start, end) of the file.
+	lineReader(start, end int) lineReader
+}
+
+type lineReader interface {
+	// readLine returns the next line including the delimiter or io.EOF if there are no more lines.
+	// The returned slice is valid only until the next call.
+	readLine() ([]byte, error)
+}
+
+// readerAtSource reads lines with a buffered reader on top of the file.
+type readerAtSource struct {
+	f io.ReaderAt
+}
+
+func (s readerAtSource) lineReader(start, end int) lineReader {
+	return bufferedLineReader{r: bufio.NewReader(io.NewSectionReader(s.f, int64(start), int64(end-start)))}
+}
+
+type bufferedLineReader struct {
+	r *bufio.Reader
+}
+
+func (r bufferedLineReader) readLine() ([]byte, error) {
+	return readLine(r.r)
+}
+
+// mappedSource reads lines directly from the memory mapped file without copying them.
+type mappedSource struct {
+	data []byte
+}
+
+func (s mappedSource) lineReader(start, end int) lineReader {
+	return &sliceLineReader{data: s.data[start:end]}
+}
+
+type sliceLineReader struct {
+	data []byte
+}
+
+func (r *sliceLineReader) readLine() ([]byte, error) {
+	if len(r.data) == 0 {
+		return nil, io.EOF
+	}
+	n := bytes.IndexByte(r.data, '\n') + 1
+	if n == 0 {
+		n = len(r.data)
+	}
+	line := r.data[:n]
+	r.data = r.data[n:]
+	return line, nil
+}
+
+func getRow(r lineReader) (ride.Row, int, error) {
+	line, err := r.readLine()
 	if err != nil {
-		return nil, 0, err
+		return ride.Row{}, 0, err
 	}
-	row, err := parseRow(s)
+	row, err := parseRow(line)
 	if err != nil {
-		return nil, 0, errors.WithStack(err)
+		return ride.Row{}, 0, errors.WithStack(err)
 	}
-	return row, len(s), nil
+	return row, len(line), nil
 }
 
-func readLine(r *bufio.Reader) (string, error) {
-	s, err := r.ReadString('\n')
+// readLine returns the next line including the delimiter.
+// The returned slice points into the reader buffer and is valid only until the next read.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		// The line doesn't fit into the reader buffer, collect it into a separate slice.
+		long := append([]byte(nil), line...)
+		for errors.Is(err, bufio.ErrBufferFull) {
+			line, err = r.ReadSlice('\n')
+			long = append(long, line...)
+		}
+		line = long
+	}
 	if err != nil && !errors.Is(err, io.EOF) {
-		return "", errors.Wrap(err, "read line failed")
+		return nil, errors.Wrap(err, "read line failed")
 	}
-	if errors.Is(err, io.EOF) && s == "" {
-		return "", io.EOF
+	if errors.Is(err, io.EOF) && len(line) == 0 {
+		return nil, io.EOF
 	}
-	return s, nil
+	return line, nil
 }
 
-func parseRow(s string) (*ride.Row, error) {
-	s = strings.TrimSpace(s)
-	columns := strings.Split(s, ",")
-	const csvColumnsNo = 4
-	if len(columns) != csvColumnsNo {
-		return nil, errors.Errorf("not enough columns in csv row: %s", s)
-	}
-	rideID, err := strconv.Atoi(columns[0])
-	if err != nil {
-		return nil, errors.Wrap(err, "can't parse rideID column")
+// batchWriter collects rows of the current chunk into batches and sends full batches into the out channel.
+type batchWriter struct {
+	out     chan<- *ride.Batch
+	batch   *ride.Batch
+	chunk   int
+	metrics *metrics.Pipeline
+}
+
+func (w *batchWriter) write(row ride.Row) {
+	if w.batch == nil {
+		w.batch = ride.NewBatch()
+		w.batch.Chunk = w.chunk
 	}
-	lat, err := strconv.ParseFloat(columns[1], 64 /* bitSize */)
-	if err != nil {
-		return nil, errors.Wrap(err, "can't parse lat column")
+	w.batch.Rows = append(w.batch.Rows, row)
+	if w.batch.Full() {
+		w.flush()
 	}
-	lng, err := strconv.ParseFloat(columns[2], 64 /* bitSize */)
-	if err != nil {
-		return nil, errors.Wrap(err, "can't parse lng column")
+}
+
+// finishChunk sends the current batch marked as the last one of the chunk, an empty batch is sent if there is none.
+func (w *batchWriter) finishChunk() {
+	if w.batch == nil {
+		w.batch = ride.NewBatch()
+		w.batch.Chunk = w.chunk
 	}
-	timestamp, err := strconv.Atoi(columns[3])
-	if err != nil {
-		return nil, errors.Wrap(err, "can't parse timestamp column")
+	w.batch.ChunkEnd = true
+	w.flush()
+}
+
+// flush sends the current batch even if it isn't full.
+func (w *batchWriter) flush() {
+	if w.batch == nil {
+		return
 	}
-	return &ride.Row{
-		RideID:    rideID,
-		Lat:       lat,
-		Lng:       lng,
-		Timestamp: timestamp,
-	}, nil
+	rowsNo := len(w.batch.Rows)
+	w.out <- w.batch
+	w.metrics.AddRowsRead(rowsNo)
+	w.batch = nil
 }
 
 type fileChunk struct {
+	// seq is the sequence number of the chunk in the range.
+	seq   int
 	start int
 	size  int
+	// first indicates that the chunk is the first one in the range and starts at a ride sequence beginning.
+	first bool
 }
 
-func splitFile(fileSize, chunksNo int) []*fileChunk {
-	var currentOffset int
-	baseChunkSize := fileSize / chunksNo
-	remainingSize := fileSize % chunksNo
+func splitFile(start, end, chunksNo int) []*fileChunk {
+	currentOffset := start
+	baseChunkSize := (end - start) / chunksNo
+	remainingSize := (end - start) % chunksNo
 	chunks := make([]*fileChunk, chunksNo)
 	for i := 0; i < chunksNo; i++ {
 		chunkSize := baseChunkSize
@@ -221,10 +385,135 @@ func splitFile(fileSize, chunksNo int) []*fileChunk {
 			remainingSize--
 		}
 		chunks[i] = &fileChunk{
+			seq:   i,
 			start: currentOffset,
 			size:  chunkSize,
+			first: i == 0,
 		}
 		currentOffset += chunkSize
 	}
 	return chunks
 }
+
+const lastRideBlockSize = 64 * 1024
+
+// LastRideOffset returns the offset of the first row of the last ride in the file.
+// Only the part of the file after the start offset is considered,
+// so start is returned if this part contains rows of a single ride.
+func LastRideOffset(filePath string, start int) (int, error) {
+	f, err := os.Open(path.Clean(filePath))
+	if err != nil {
+		return 0, errors.Wrap(err, "can't open input csv file")
+	}
+	defer f.Close() // nolint: errcheck, gosec
+	fileStat, err := f.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "can't get input csv file stat")
+	}
+	fileSize := int(fileStat.Size())
+	if start > fileSize {
+		return 0, errors.Errorf("start offset %d is beyond the file size %d", start, fileSize)
+	}
+	// Read the file backwards block by block until the beginning of the last ride is found.
+	var buf []byte
+	bufStart := fileSize
+	for bufStart > start {
+		blockStart := bufStart - lastRideBlockSize
+		if blockStart < start {
+			blockStart = start
+		}
+		block := make([]byte, bufStart-blockStart)
+		if _, err := f.ReadAt(block, int64(blockStart)); err != nil {
+			return 0, errors.Wrap(err, "can't read input csv file block")
+		}
+		buf = append(block, buf...)
+		bufStart = blockStart
+		offset, found, err := findLastRideStart(buf, bufStart == start)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		if found {
+			return bufStart + offset, nil
+		}
+	}
+	return start, nil
+}
+
+// findLastRideStart returns the offset of the first row of the last ride in the buffer.
+// If the buffer doesn't start at a row beginning (atRowStart is false)
+// the first line in the buffer can be incomplete and it's never used.
+func findLastRideStart(buf []byte, atRowStart bool) (int, bool, error) {
+	end := len(buf)
+	for end > 0 && (buf[end-1] == '\n' || buf[end-1] == '\r') {
+		end--
+	}
+	lastRideID := -1
+	for end > 0 {
+		lineStart := bytes.LastIndexByte(buf[:end], '\n') + 1
+		if lineStart == 0 && !atRowStart {
+			return 0, false, nil
+		}
+		line := buf[lineStart:end]
+		if idx := bytes.IndexByte(line, ','); idx >= 0 {
+			line = line[:idx]
+		}
+		rideID, err := strconv.Atoi(string(line))
+		if err != nil {
+			return 0, false, errors.Wrap(err, "can't parse rideID column")
+		}
+		if lastRideID == -1 {
+			lastRideID = rideID
+		} else if rideID != lastRideID {
+			return end + 1, true, nil
+		}
+		if lineStart == 0 {
+			break
+		}
+		end = lineStart - 1
+	}
+	return 0, true, nil
+}
+
+// NextRideOffset returns the offset of the first ride sequence beginning after the given offset.
+// It's the same offset a non-first chunk starting at the given offset begins reading rides from.
+// The file size is returned if there is no ride beginning after the offset.
+func NextRideOffset(filePath string, offset int) (int, error) {
+	f, err := os.Open(path.Clean(filePath))
+	if err != nil {
+		return 0, errors.Wrap(err, "can't open input csv file")
+	}
+	defer f.Close() // nolint: errcheck, gosec
+	fileStat, err := f.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "can't get input csv file stat")
+	}
+	fileSize := int(fileStat.Size())
+	if offset >= fileSize {
+		return fileSize, nil
+	}
+	r := readerAtSource{f: f}.lineReader(offset, fileSize)
+	// Skip bytes until '\n' to start from a new row beginning.
+	s, err := r.readLine()
+	if errors.Is(err, io.EOF) {
+		return fileSize, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "can't skip bytes at the offset")
+	}
+	currentOffset := offset + len(s)
+	lastRideID := -1
+	for {
+		row, rowSize, err := getRow(r)
+		if errors.Is(err, io.EOF) {
+			return fileSize, nil
+		}
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		if lastRideID != -1 && lastRideID != row.RideID {
+			return currentOffset, nil
+		}
+		lastRideID = row.RideID
+		currentOffset += rowSize
+	}
+}
@@ -1,6 +1,13 @@
 package fileread_test
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"testing"
 
@@ -13,40 +20,367 @@ import (
 
 func TestStartFileReaders(t *testing.T) {
 	t.Parallel()
-	expected := [][]*ride.Row{
-		{
+	expected := map[int][]ride.Row{
+		1: {
 			{1, 37.966660, 23.728308, 1405594957},
 			{1, 37.966627, 23.728263, 1405594966},
 			{1, 37.966625, 23.728264, 1405594974},
+		},
+		2: {
 			{2, 37.946413, 23.754767, 1405591094},
 			{2, 37.946260, 23.754830, 1405591103},
 			{2, 37.946032, 23.755347, 1405591112},
 		},
-		{
+		3: {
 			{3, 37.926738, 23.935701, 1405591810},
 			{3, 37.927245, 23.935000, 1405591818},
 			{3, 37.926763, 23.934286, 1405591827},
 		},
 	}
-	actual := make([][]*ride.Row, len(expected))
-	outs := make([]chan *ride.Row, len(expected))
+	cases := []struct {
+		readersNo int
+		chunkSize int
+		io        fileread.IOMode
+	}{
+		{readersNo: 1, chunkSize: fileread.DefaultChunkSize},
+		{readersNo: 2, chunkSize: fileread.DefaultChunkSize},
+		{readersNo: 2, chunkSize: fileread.LineSize / 2},
+		{readersNo: 3, chunkSize: fileread.LineSize},
+		{readersNo: 3, chunkSize: 2 * fileread.LineSize},
+		{readersNo: 4, chunkSize: 3*fileread.LineSize + 1},
+		{readersNo: 1, chunkSize: fileread.DefaultChunkSize, io: fileread.IOMmap},
+		{readersNo: 3, chunkSize: fileread.LineSize, io: fileread.IOMmap},
+		{readersNo: 4, chunkSize: 3*fileread.LineSize + 1, io: fileread.IOMmap},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(fmt.Sprintf("readers=%d,chunk_size=%d,io=%s", tc.readersNo, tc.chunkSize, tc.io), func(t *testing.T) {
+			t.Parallel()
+			outs := make([]chan *ride.Batch, tc.readersNo)
+			actual := make([][]ride.Row, tc.readersNo)
+			wg := &sync.WaitGroup{}
+			wg.Add(len(outs))
+			for i := range outs {
+				outs[i] = make(chan *ride.Batch)
+				go func(i int) {
+					defer wg.Done()
+					actual[i] = readBatches(outs[i])
+				}(i)
+			}
+			cfg := fileread.Config{Range: fileread.WholeFile, ChunkSize: tc.chunkSize, IO: tc.io}
+
+			wait, err := fileread.StartFileReaders(fileread.SimpleInputFile, cfg, outs, nil)
+			require.NoError(t, err)
+			err = wait()
+			require.NoError(t, err)
+			wg.Wait()
+
+			assert.Equal(t, expected, groupByRide(t, actual))
+		})
+	}
+}
+
+// readBatches reads rows from all batches in the channel and releases the batches.
+func readBatches(in <-chan *ride.Batch) []ride.Row {
+	var rows []ride.Row
+	for batch := range in {
+		rows = append(rows, batch.Rows...)
+		batch.Release()
+	}
+	return rows
+}
+
+// groupByRide groups rows from all channels by ride and checks that all rows of a ride are in the same channel.
+func groupByRide(t *testing.T, channelsRows [][]ride.Row) map[int][]ride.Row {
+	rides := make(map[int][]ride.Row)
+	rideChannels := make(map[int]int)
+	for i, rows := range channelsRows {
+		for _, row := range rows {
+			if channel, ok := rideChannels[row.RideID]; ok {
+				assert.Equal(t, channel, i, "rows of the ride %d are in different channels", row.RideID)
+			}
+			rideChannels[row.RideID] = i
+			rides[row.RideID] = append(rides[row.RideID], row)
+		}
+	}
+	return rides
+}
+
+func TestStartFileReaders_Range(t *testing.T) {
+	t.Parallel()
+	expected := []ride.Row{
+		{2, 37.946413, 23.754767, 1405591094},
+		{2, 37.946260, 23.754830, 1405591103},
+		{2, 37.946032, 23.755347, 1405591112},
+	}
+	for _, concurrency := range []int{1, 2} {
+		outs := make([]chan *ride.Batch, concurrency)
+		for i := range outs {
+			outs[i] = make(chan *ride.Batch, len(expected))
+		}
+		cfg := fileread.Config{
+			Range:     fileread.Range{Start: 3 * fileread.LineSize, End: 6 * fileread.LineSize},
+			ChunkSize: fileread.LineSize,
+		}
+
+		wait, err := fileread.StartFileReaders(fileread.SimpleInputFile, cfg, outs, nil)
+		require.NoError(t, err)
+		err = wait()
+		require.NoError(t, err)
+
+		var actual []ride.Row
+		for _, out := range outs {
+			actual = append(actual, readBatches(out)...)
+		}
+		assert.Equal(t, expected, actual, "concurrency %d", concurrency)
+	}
+}
+
+func TestStartFileReaders_ChunksOrder(t *testing.T) {
+	t.Parallel()
+	content, err := ioutil.ReadFile(fileread.SimpleInputFile)
+	require.NoError(t, err)
+	expectedIDs := []int{1, 1, 1, 2, 2, 2, 3, 3, 3}
+	require.Equal(t, len(expectedIDs), bytes.Count(content, []byte("\n")))
+
+	for _, chunkSize := range []int{fileread.LineSize / 2, fileread.LineSize, 4 * fileread.LineSize} {
+		const readersNo = 3
+		outs := make([]chan *ride.Batch, readersNo)
+		chunks := make([]map[int][]ride.Row, readersNo)
+		chunkEnds := make([]map[int]int, readersNo)
+		wg := &sync.WaitGroup{}
+		wg.Add(len(outs))
+		for i := range outs {
+			outs[i] = make(chan *ride.Batch)
+			chunks[i], chunkEnds[i] = map[int][]ride.Row{}, map[int]int{}
+			go func(i int) {
+				defer wg.Done()
+				for batch := range outs[i] {
+					chunks[i][batch.Chunk] = append(chunks[i][batch.Chunk], batch.Rows...)
+					if batch.ChunkEnd {
+						chunkEnds[i][batch.Chunk]++
+					}
+					batch.Release()
+				}
+			}(i)
+		}
+		cfg := fileread.Config{Range: fileread.WholeFile, ChunkSize: chunkSize}
+		wait, err := fileread.StartFileReaders(fileread.SimpleInputFile, cfg, outs, nil)
+		require.NoError(t, err)
+		require.NoError(t, wait())
+		wg.Wait()
+
+		// Concatenated in the chunks order rows restore the input order and each chunk is finished once.
+		chunksNo := len(content) / chunkSize
+		var actualIDs []int
+		for chunk := 0; chunk < chunksNo; chunk++ {
+			ends := 0
+			for i := range outs {
+				for _, row := range chunks[i][chunk] {
+					actualIDs = append(actualIDs, row.RideID)
+				}
+				ends += chunkEnds[i][chunk]
+			}
+			assert.Equal(t, 1, ends, "chunk size %d, chunk %d", chunkSize, chunk)
+		}
+		assert.Equal(t, expectedIDs, actualIDs, "chunk size %d", chunkSize)
+	}
+}
+
+func TestStartFileReaders_Window(t *testing.T) {
+	t.Parallel()
+	const readersNo = 3
+	outs := make([]chan *ride.Batch, readersNo)
+	merged := make(chan *ride.Batch)
 	wg := &sync.WaitGroup{}
 	wg.Add(len(outs))
 	for i := range outs {
-		outs[i] = make(chan *ride.Row, len(expected[i]))
+		outs[i] = make(chan *ride.Batch)
 		go func(i int) {
 			defer wg.Done()
-			for v := range outs[i] {
-				actual[i] = append(actual[i], v)
+			for batch := range outs[i] {
+				merged <- batch
 			}
 		}(i)
 	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+	// With a single chunk window the next chunk is taken only after the previous one is done.
+	window := make(chan struct{}, 1)
+	cfg := fileread.Config{Range: fileread.WholeFile, ChunkSize: fileread.LineSize, Window: window}
 
-	wait, err := fileread.StartFileReaders(fileread.SimpleInputFile, outs)
+	wait, err := fileread.StartFileReaders(fileread.SimpleInputFile, cfg, outs, nil)
 	require.NoError(t, err)
-	err = wait()
-	require.NoError(t, err)
-	wg.Wait()
+	var chunks []int
+	for batch := range merged {
+		chunks = append(chunks, batch.Chunk)
+		if batch.ChunkEnd {
+			<-window
+		}
+		batch.Release()
+	}
+	require.NoError(t, wait())
+
+	assert.True(t, sort.IntsAreSorted(chunks), "chunks %v", chunks)
+	assert.Equal(t, 8, chunks[len(chunks)-1])
+}
+
+func TestLastRideOffset(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name     string
+		start    int
+		expected int
+	}{
+		{name: "whole file", start: 0, expected: 6 * fileread.LineSize},
+		{name: "start at the last ride", start: 6 * fileread.LineSize, expected: 6 * fileread.LineSize},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			actual, err := fileread.LastRideOffset(fileread.SimpleInputFile, tc.start)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestNextRideOffset(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name     string
+		offset   int
+		expected int
+	}{
+		{name: "in the middle of the 1th ride", offset: fileread.LineSize / 2, expected: 3 * fileread.LineSize},
+		{name: "at the 2th ride beginning", offset: 3 * fileread.LineSize, expected: 6 * fileread.LineSize},
+		{name: "in the middle of the last ride", offset: 7 * fileread.LineSize, expected: 9 * fileread.LineSize},
+		{name: "beyond the file end", offset: 100 * fileread.LineSize, expected: 9 * fileread.LineSize},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			actual, err := fileread.NextRideOffset(fileread.SimpleInputFile, tc.offset)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+// BenchmarkStartFileReaders compares one chunk per reader (the chunk size is the file size divided by readers)
+// with small chunks taken from the shared queue.
+// Rows in the first part of the generated file are slow to process, so with one chunk per reader
+// the first reader determines the total time.
+func BenchmarkStartFileReaders(b *testing.B) {
+	const (
+		readersNo  = 8
+		ridesNo    = 20000
+		rowsNo     = 20
+		denseRides = ridesNo / 8
+	)
+	filePath, fileSize := generateInputFile(b, ridesNo, rowsNo)
+	// Processing of the rows from the dense rides takes more time, it simulates a skewed input file.
+	process := func(row *ride.Row) float64 {
+		if row.RideID >= denseRides {
+			return row.Lat
+		}
+		sum := row.Lat
+		for i := 0; i < 2000; i++ {
+			sum = math.Sqrt(sum + float64(i))
+		}
+		return sum
+	}
+	cases := []struct {
+		name      string
+		chunkSize int
+	}{
+		{name: "chunk_per_reader", chunkSize: fileSize / readersNo},
+		{name: "default_chunks", chunkSize: fileread.DefaultChunkSize},
+		{name: "small_chunks", chunkSize: 64 * 1024},
+	}
+	for _, tc := range cases {
+		tc := tc
+		b.Run(tc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				outs := make([]chan *ride.Batch, readersNo)
+				sums := make([]float64, readersNo)
+				wg := &sync.WaitGroup{}
+				wg.Add(len(outs))
+				for j := range outs {
+					outs[j] = make(chan *ride.Batch, 4)
+					go func(j int) {
+						defer wg.Done()
+						for batch := range outs[j] {
+							for k := range batch.Rows {
+								sums[j] += process(&batch.Rows[k])
+							}
+							batch.Release()
+						}
+					}(j)
+				}
+				cfg := fileread.Config{Range: fileread.WholeFile, ChunkSize: tc.chunkSize}
+				wait, err := fileread.StartFileReaders(filePath, cfg, outs, nil)
+				require.NoError(b, err)
+				require.NoError(b, wait())
+				wg.Wait()
+				benchmarkSink = sums
+			}
+		})
+	}
+}
+
+var benchmarkSink []float64
 
-	assert.Equal(t, expected, actual)
+func generateInputFile(b *testing.B, ridesNo, rowsNo int) (string, int) {
+	b.Helper()
+	dir, err := ioutil.TempDir("", "fileread_benchmark_*")
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		os.RemoveAll(dir) // nolint: errcheck, gosec
+	})
+	filePath := filepath.Join(dir, "input.csv")
+	buf := &bytes.Buffer{}
+	for rideID := 0; rideID < ridesNo; rideID++ {
+		for i := 0; i < rowsNo; i++ {
+			fmt.Fprintf(buf, "%d,%.6f,%.6f,%d\n", rideID, 37.96+float64(i)/1e4, 23.72+float64(i)/1e4, 1405594957+i*10)
+		}
+	}
+	err = ioutil.WriteFile(filePath, buf.Bytes(), 0o600)
+	require.NoError(b, err)
+	return filePath, buf.Len()
+}
+
+func BenchmarkStartFileReaders_IO(b *testing.B) {
+	const readersNo = 4
+	filePath, fileSize := generateInputFile(b, 20000, 20)
+	for _, mode := range []fileread.IOMode{fileread.IORead, fileread.IOMmap} {
+		mode := mode
+		b.Run(string(mode), func(b *testing.B) {
+			b.SetBytes(int64(fileSize))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				outs := make([]chan *ride.Batch, readersNo)
+				wg := &sync.WaitGroup{}
+				wg.Add(len(outs))
+				for j := range outs {
+					outs[j] = make(chan *ride.Batch, 4)
+					go func(j int) {
+						defer wg.Done()
+						for batch := range outs[j] {
+							batch.Release()
+						}
+					}(j)
+				}
+				cfg := fileread.Config{Range: fileread.WholeFile, ChunkSize: fileread.DefaultChunkSize, IO: mode}
+				wait, err := fileread.StartFileReaders(filePath, cfg, outs, nil)
+				require.NoError(b, err)
+				require.NoError(b, wait())
+				wg.Wait()
+			}
+		})
+	}
 }
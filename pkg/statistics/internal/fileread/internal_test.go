@@ -4,8 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -26,21 +30,25 @@ func TestReadRidesSequence(t *testing.T) {
 	b, err := ioutil.ReadFile(SimpleInputFile)
 	require.NoError(t, err)
 	totalSize := len(b)
-	r := bytes.NewReader(b)
+	sources := map[string]chunkSource{
+		"read": readerAtSource{f: bytes.NewReader(b)},
+		"mmap": mappedSource{data: b},
+	}
 	ctx := context.Background()
 	cases := []struct {
 		name     string
 		chunk    *fileChunk
-		expected []*ride.Row
+		expected []ride.Row
 	}{
 		{
 			name: "chunk starts at the beginning of the file and ends 1.5 line before the 2th ride - " +
 				"only the 1th ride must be processed",
 			chunk: &fileChunk{
 				start: 0,
+				first: true,
 				size:  LineSize + LineSize/2,
 			},
-			expected: []*ride.Row{
+			expected: []ride.Row{
 				{1, 37.966660, 23.728308, 1405594957},
 				{1, 37.966627, 23.728263, 1405594966},
 				{1, 37.966625, 23.728264, 1405594974},
@@ -53,7 +61,7 @@ func TestReadRidesSequence(t *testing.T) {
 				start: LineSize + LineSize/2,
 				size:  3 * LineSize,
 			},
-			expected: []*ride.Row{
+			expected: []ride.Row{
 				{2, 37.946413, 23.754767, 1405591094},
 				{2, 37.946260, 23.754830, 1405591103},
 				{2, 37.946032, 23.755347, 1405591112},
@@ -66,7 +74,7 @@ func TestReadRidesSequence(t *testing.T) {
 				start: 2*LineSize - 2,
 				size:  2*LineSize + LineSize/2,
 			},
-			expected: []*ride.Row{
+			expected: []ride.Row{
 				{2, 37.946413, 23.754767, 1405591094},
 				{2, 37.946260, 23.754830, 1405591103},
 				{2, 37.946032, 23.755347, 1405591112},
@@ -79,7 +87,7 @@ func TestReadRidesSequence(t *testing.T) {
 				start: 2*LineSize - 1,
 				size:  2*LineSize + LineSize/2,
 			},
-			expected: []*ride.Row{
+			expected: []ride.Row{
 				{2, 37.946413, 23.754767, 1405591094},
 				{2, 37.946260, 23.754830, 1405591103},
 				{2, 37.946032, 23.755347, 1405591112},
@@ -101,7 +109,7 @@ func TestReadRidesSequence(t *testing.T) {
 				start: LineSize + LineSize/2,
 				size:  5*LineSize - (LineSize + LineSize/2) - 2,
 			},
-			expected: []*ride.Row{
+			expected: []ride.Row{
 				{2, 37.946413, 23.754767, 1405591094},
 				{2, 37.946260, 23.754830, 1405591103},
 				{2, 37.946032, 23.755347, 1405591112},
@@ -114,7 +122,7 @@ func TestReadRidesSequence(t *testing.T) {
 				start: LineSize + LineSize/2,
 				size:  5*LineSize - (LineSize + LineSize/2),
 			},
-			expected: []*ride.Row{
+			expected: []ride.Row{
 				{2, 37.946413, 23.754767, 1405591094},
 				{2, 37.946260, 23.754830, 1405591103},
 				{2, 37.946032, 23.755347, 1405591112},
@@ -130,7 +138,7 @@ func TestReadRidesSequence(t *testing.T) {
 				start: LineSize + LineSize/2,
 				size:  5*LineSize - (LineSize + LineSize/2) + 1,
 			},
-			expected: []*ride.Row{
+			expected: []ride.Row{
 				{2, 37.946413, 23.754767, 1405591094},
 				{2, 37.946260, 23.754830, 1405591103},
 				{2, 37.946032, 23.755347, 1405591112},
@@ -144,9 +152,10 @@ func TestReadRidesSequence(t *testing.T) {
 				"1th, 2th rides must be processed",
 			chunk: &fileChunk{
 				start: 0,
+				first: true,
 				size:  2*LineSize + LineSize/2,
 			},
-			expected: []*ride.Row{
+			expected: []ride.Row{
 				{1, 37.966660, 23.728308, 1405594957},
 				{1, 37.966627, 23.728263, 1405594966},
 				{1, 37.966625, 23.728264, 1405594974},
@@ -162,7 +171,7 @@ func TestReadRidesSequence(t *testing.T) {
 				start: 4*LineSize + LineSize/2,
 				size:  totalSize - (4*LineSize + LineSize/2),
 			},
-			expected: []*ride.Row{
+			expected: []ride.Row{
 				{3, 37.926738, 23.935701, 1405591810},
 				{3, 37.927245, 23.935000, 1405591818},
 				{3, 37.926763, 23.934286, 1405591827},
@@ -178,25 +187,31 @@ func TestReadRidesSequence(t *testing.T) {
 		},
 	}
 	for _, tc := range cases {
-		tc := tc
-		t.Run(tc.name, func(t *testing.T) {
-			t.Parallel()
-			out := make(chan *ride.Row, len(tc.expected))
-			var actual []*ride.Row
-			wg := &sync.WaitGroup{}
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				for v := range out {
-					actual = append(actual, v)
-				}
-			}()
-			err := readRidesSequence(ctx, r, totalSize, tc.chunk, out)
-			require.NoError(t, err)
-			wg.Wait()
+		for sourceName, src := range sources {
+			tc, src := tc, src
+			t.Run(sourceName+": "+tc.name, func(t *testing.T) {
+				t.Parallel()
+				out := make(chan *ride.Batch)
+				var actual []ride.Row
+				wg := &sync.WaitGroup{}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for batch := range out {
+						actual = append(actual, batch.Rows...)
+						batch.Release()
+					}
+				}()
+				w := &batchWriter{out: out}
+				err := readRidesSequence(ctx, src, totalSize, tc.chunk, w)
+				w.flush()
+				close(out)
+				require.NoError(t, err)
+				wg.Wait()
 
-			assert.Equal(t, tc.expected, actual)
-		})
+				assert.Equal(t, tc.expected, actual)
+			})
+		}
 	}
 }
 
@@ -204,47 +219,59 @@ func TestSplitFile(t *testing.T) {
 	t.Parallel()
 	cases := []struct {
 		name     string
-		fileSize int
+		start    int
+		end      int
 		chunksNo int
 		expected []*fileChunk
 	}{
 		{
 			name:     "not equal split",
-			fileSize: 17,
+			end:      17,
 			chunksNo: 3,
 			expected: []*fileChunk{
-				{start: 0, size: 6},
-				{start: 6, size: 6},
-				{start: 12, size: 5},
+				{seq: 0, start: 0, size: 6, first: true},
+				{seq: 1, start: 6, size: 6},
+				{seq: 2, start: 12, size: 5},
 			},
 		},
 		{
 			name:     "equal split",
-			fileSize: 18,
+			end:      18,
 			chunksNo: 3,
 			expected: []*fileChunk{
-				{start: 0, size: 6},
-				{start: 6, size: 6},
-				{start: 12, size: 6},
+				{seq: 0, start: 0, size: 6, first: true},
+				{seq: 1, start: 6, size: 6},
+				{seq: 2, start: 12, size: 6},
 			},
 		},
 		{
 			name:     "not enough for every chunk",
-			fileSize: 2,
+			end:      2,
 			chunksNo: 4,
 			expected: []*fileChunk{
-				{start: 0, size: 1},
-				{start: 1, size: 1},
-				{start: 2, size: 0},
-				{start: 2, size: 0},
+				{seq: 0, start: 0, size: 1, first: true},
+				{seq: 1, start: 1, size: 1},
+				{seq: 2, start: 2, size: 0},
+				{seq: 3, start: 2, size: 0},
+			},
+		},
+		{
+			name:     "range in the middle of the file",
+			start:    10,
+			end:      27,
+			chunksNo: 3,
+			expected: []*fileChunk{
+				{seq: 0, start: 10, size: 6, first: true},
+				{seq: 1, start: 16, size: 6},
+				{seq: 2, start: 22, size: 5},
 			},
 		},
 		{
 			name:     "single chunk",
-			fileSize: 10,
+			end:      10,
 			chunksNo: 1,
 			expected: []*fileChunk{
-				{start: 0, size: 10},
+				{seq: 0, start: 0, size: 10, first: true},
 			},
 		},
 	}
@@ -252,7 +279,7 @@ func TestSplitFile(t *testing.T) {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
-			actual := splitFile(tc.fileSize, tc.chunksNo)
+			actual := splitFile(tc.start, tc.end, tc.chunksNo)
 			assert.Equal(t, tc.expected, actual)
 		})
 	}
@@ -296,8 +323,204 @@ func TestReadLine(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 			actual, err := readLine(bufio.NewReader(strings.NewReader(tc.content)))
-			assert.Equal(t, tc.expected, actual)
+			assert.Equal(t, tc.expected, string(actual))
 			assert.Equal(t, tc.expectedErr, err)
 		})
 	}
 }
+
+func TestSliceLineReader(t *testing.T) {
+	t.Parallel()
+	r := &sliceLineReader{data: []byte("foo\n\nbar")}
+	for _, expected := range []string{"foo\n", "\n", "bar"} {
+		actual, err := r.readLine()
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(actual))
+	}
+	_, err := r.readLine()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestFindLastRideStart(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name          string
+		content       string
+		atRowStart    bool
+		expected      int
+		expectedFound bool
+	}{
+		{
+			name:          "last ride starts in the middle",
+			content:       "1,0,0,1\n2,0,0,1\n2,0,0,2\n",
+			atRowStart:    true,
+			expected:      8,
+			expectedFound: true,
+		},
+		{
+			name:          "last ride starts in the middle of a buffer with an incomplete first line",
+			content:       "0,1\n1,0,0,1\n2,0,0,1\n2,0,0,2",
+			atRowStart:    false,
+			expected:      12,
+			expectedFound: true,
+		},
+		{
+			name:          "single ride buffer at the row start",
+			content:       "2,0,0,1\n2,0,0,2\n",
+			atRowStart:    true,
+			expected:      0,
+			expectedFound: true,
+		},
+		{
+			name:          "incomplete first line can belong to the last ride",
+			content:       "0,0,1\n2,0,0,1\n2,0,0,2\n",
+			atRowStart:    false,
+			expected:      0,
+			expectedFound: false,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			actual, found, err := findLastRideStart([]byte(tc.content), tc.atRowStart)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+			assert.Equal(t, tc.expectedFound, found)
+		})
+	}
+}
+
+func TestParseRow(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name     string
+		line     string
+		expected ride.Row
+	}{
+		{
+			name:     "row with delimiter",
+			line:     "1,37.966660,23.728308,1405594957\n",
+			expected: ride.Row{RideID: 1, Lat: 37.966660, Lng: 23.728308, Timestamp: 1405594957},
+		},
+		{
+			name:     "row with windows delimiter",
+			line:     "2,37.946413,23.754767,1405591094\r\n",
+			expected: ride.Row{RideID: 2, Lat: 37.946413, Lng: 23.754767, Timestamp: 1405591094},
+		},
+		{
+			name:     "signed and integer values",
+			line:     "+3,-1,38.,-1405591094",
+			expected: ride.Row{RideID: 3, Lat: -1, Lng: 38, Timestamp: -1405591094},
+		},
+		{
+			name:     "values parsed by strconv",
+			line:     "4,3.7966660e1,0x1p-2,1405594957",
+			expected: ride.Row{RideID: 4, Lat: 37.966660, Lng: 0.25, Timestamp: 1405594957},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			actual, err := parseRow([]byte(tc.line))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestParseRow_Invalid(t *testing.T) {
+	t.Parallel()
+	cases := []string{
+		"1,37.966660,23.728308",
+		"1,37.966660,23.728308,1405594957,1",
+		"a,37.966660,23.728308,1405594957",
+		"1,37.96.6660,23.728308,1405594957",
+		"1,37.966660,,1405594957",
+		"1,37.966660,23.728308,-",
+		"1,37.966660,23.728308,99999999999999999999",
+	}
+	for _, line := range cases {
+		_, err := parseRow([]byte(line))
+		assert.Error(t, err, line)
+	}
+}
+
+func TestParseFloat(t *testing.T) {
+	t.Parallel()
+	cases := []string{
+		"0", "-0", "0.0", "37.966660", "-23.728308", "90", ".5", "5.", "0.000001",
+		"123456789012345.6", "9007199254740993", "1.00000000000000000000001", "0.1234567890123456789",
+		"1e3", "NaN", "Inf",
+	}
+	for _, s := range cases {
+		expected, err := strconv.ParseFloat(s, 64)
+		require.NoError(t, err, s)
+		actual, err := parseFloat([]byte(s))
+		require.NoError(t, err, s)
+		assert.Equal(t, math.Float64bits(expected), math.Float64bits(actual), s)
+	}
+	// Coordinates with 6 fraction digits like in the input file.
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		s := strconv.FormatFloat(rnd.Float64()*180-90, 'f', 6, 64)
+		expected, err := strconv.ParseFloat(s, 64)
+		require.NoError(t, err, s)
+		actual, err := parseFloat([]byte(s))
+		require.NoError(t, err, s)
+		require.Equal(t, expected, actual, s)
+	}
+}
+
+func TestParseRow_Allocations(t *testing.T) {
+	line := []byte("1,37.966660,23.728308,1405594957\n")
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := parseRow(line); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Zero(t, allocs)
+}
+
+func BenchmarkParseRow(b *testing.B) {
+	line := []byte("1,37.966660,23.728308,1405594957\n")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseRow(line); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadRidesSequence(b *testing.B) {
+	buf := &bytes.Buffer{}
+	for rideID := 0; rideID < 1000; rideID++ {
+		for i := 0; i < 100; i++ {
+			fmt.Fprintf(buf, "%d,%.6f,%.6f,%d\n", rideID, 37.96+float64(i)/1e4, 23.72+float64(i)/1e4, 1405594957+i*10)
+		}
+	}
+	content := buf.Bytes()
+	b.SetBytes(int64(len(content)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out := make(chan *ride.Batch, 4)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for batch := range out {
+				batch.Release()
+			}
+		}()
+		w := &batchWriter{out: out}
+		chunk := &fileChunk{start: 0, size: len(content), first: true}
+		err := readRidesSequence(context.Background(), readerAtSource{f: bytes.NewReader(content)}, len(content), chunk, w)
+		if err != nil {
+			b.Fatal(err)
+		}
+		w.flush()
+		close(out)
+		<-done
+	}
+}
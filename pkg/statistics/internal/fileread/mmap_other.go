@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package fileread
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func mmapFile(*os.File, int) ([]byte, func() error, error) {
+	return nil, nil, errors.New("mmap isn't supported on this platform")
+}
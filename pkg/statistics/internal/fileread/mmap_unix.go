@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package fileread
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// mmapFile maps the first size bytes of the file into memory read only.
+// The returned function unmaps the memory, the mapped data must not be used after it's called.
+func mmapFile(f *os.File, size int) ([]byte, func() error, error) {
+	data, err := syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "mmap failed")
+	}
+	return data, func() error {
+		return errors.Wrap(syscall.Munmap(data), "munmap failed")
+	}, nil
+}
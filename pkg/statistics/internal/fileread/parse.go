@@ -0,0 +1,142 @@
+package fileread
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+)
+
+const csvColumnsNo = 4
+
+// parseRow parses a csv row in place, without allocations for valid rows.
+func parseRow(line []byte) (ride.Row, error) {
+	line = bytes.TrimSpace(line)
+	var columns [csvColumnsNo][]byte
+	rest := line
+	for i := 0; i < csvColumnsNo-1; i++ {
+		idx := bytes.IndexByte(rest, ',')
+		if idx < 0 {
+			return ride.Row{}, errors.Errorf("not enough columns in csv row: %s", line)
+		}
+		columns[i] = rest[:idx]
+		rest = rest[idx+1:]
+	}
+	if bytes.IndexByte(rest, ',') >= 0 {
+		return ride.Row{}, errors.Errorf("not enough columns in csv row: %s", line)
+	}
+	columns[csvColumnsNo-1] = rest
+
+	rideID, err := parseInt(columns[0])
+	if err != nil {
+		return ride.Row{}, errors.Wrap(err, "can't parse rideID column")
+	}
+	lat, err := parseFloat(columns[1])
+	if err != nil {
+		return ride.Row{}, errors.Wrap(err, "can't parse lat column")
+	}
+	lng, err := parseFloat(columns[2])
+	if err != nil {
+		return ride.Row{}, errors.Wrap(err, "can't parse lng column")
+	}
+	timestamp, err := parseInt(columns[3])
+	if err != nil {
+		return ride.Row{}, errors.Wrap(err, "can't parse timestamp column")
+	}
+	return ride.Row{
+		RideID:    rideID,
+		Lat:       lat,
+		Lng:       lng,
+		Timestamp: timestamp,
+	}, nil
+}
+
+// maxFastIntDigits is the number of digits that always fit into int64.
+const maxFastIntDigits = 18
+
+// parseInt parses a decimal integer the same way as strconv.Atoi does.
+func parseInt(b []byte) (int, error) {
+	digits, negative := trimSign(b)
+	if len(digits) == 0 || len(digits) > maxFastIntDigits {
+		return atoiFallback(b)
+	}
+	n := 0
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return atoiFallback(b)
+		}
+		n = n*10 + int(c-'0')
+	}
+	if negative {
+		n = -n
+	}
+	return n, nil
+}
+
+func atoiFallback(b []byte) (int, error) {
+	n, err := strconv.Atoi(string(b))
+	return n, errors.WithStack(err)
+}
+
+// Mantissas and powers of ten below these limits are exact float64 values,
+// so a single division is correctly rounded and gives the same result as strconv.ParseFloat.
+const (
+	maxExactMantissa = 1 << 53
+	maxExactPow10    = 22
+)
+
+var pow10 = [maxExactPow10 + 1]float64{
+	1e0, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9, 1e10,
+	1e11, 1e12, 1e13, 1e14, 1e15, 1e16, 1e17, 1e18, 1e19, 1e20, 1e21, 1e22,
+}
+
+// parseFloat parses plain decimal numbers like "37.966660" directly from bytes.
+// Anything else, e.g. exponents or too many digits, is parsed by strconv.ParseFloat.
+func parseFloat(b []byte) (float64, error) {
+	digits, negative := trimSign(b)
+	var (
+		mantissa     uint64
+		fractionDigs int
+		digitsNo     int
+		seenDot      bool
+	)
+	for _, c := range digits {
+		switch {
+		case c >= '0' && c <= '9':
+			mantissa = mantissa*10 + uint64(c-'0')
+			digitsNo++
+			if seenDot {
+				fractionDigs++
+			}
+		case c == '.' && !seenDot:
+			seenDot = true
+		default:
+			return parseFloatFallback(b)
+		}
+		if mantissa >= maxExactMantissa || fractionDigs > maxExactPow10 {
+			return parseFloatFallback(b)
+		}
+	}
+	if digitsNo == 0 {
+		return parseFloatFallback(b)
+	}
+	f := float64(mantissa) / pow10[fractionDigs]
+	if negative {
+		f = -f
+	}
+	return f, nil
+}
+
+func parseFloatFallback(b []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(b), 64 /* bitSize */)
+	return f, errors.WithStack(err)
+}
+
+func trimSign(b []byte) ([]byte, bool) {
+	if len(b) > 0 && (b[0] == '-' || b[0] == '+') {
+		return b[1:], b[0] == '-'
+	}
+	return b, false
+}
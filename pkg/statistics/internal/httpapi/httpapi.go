@@ -0,0 +1,160 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/prediction"
+)
+
+type ReportResponse struct {
+	Hours []*HourResponse `json:"hours"`
+}
+
+type HourResponse struct {
+	StartHour int                 `json:"start_hour"`
+	Distances []*DistanceResponse `json:"distances"`
+}
+
+// DistanceResponse is a report cell, the p95 of a cell without rides is zero.
+type DistanceResponse struct {
+	DistanceRange string `json:"distance_range"`
+	P95Seconds    int    `json:"p95_seconds"`
+	P95           string `json:"p95"`
+	Count         int    `json:"count"`
+}
+
+type P95Response struct {
+	StartHour int `json:"start_hour"`
+	DistanceResponse
+}
+
+type PredictResponse struct {
+	DurationSeconds int    `json:"duration_seconds"`
+	Duration        string `json:"duration"`
+	Confidence      string `json:"confidence"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewHandler creates a handler serving the report and the predictor built from it returned by the getReport function.
+// getReport is called for each request and can return nil if the report isn't calculated yet.
+func NewHandler(getReport func() (aggregation.StatisticsReport, *prediction.Predictor)) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		report, _, ok := getReportForRequest(w, r, getReport)
+		if !ok {
+			return
+		}
+		resp := &ReportResponse{Hours: make([]*HourResponse, 0, len(report))}
+		for _, hs := range report {
+			hr := &HourResponse{
+				StartHour: hs.StartHour,
+				Distances: make([]*DistanceResponse, 0, len(hs.DistanceStatistics)),
+			}
+			for _, ds := range hs.DistanceStatistics {
+				hr.Distances = append(hr.Distances, newDistanceResponse(ds))
+			}
+			resp.Hours = append(resp.Hours, hr)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+	mux.HandleFunc("/p95", func(w http.ResponseWriter, r *http.Request) {
+		report, _, ok := getReportForRequest(w, r, getReport)
+		if !ok {
+			return
+		}
+		start, distance, ok := parseRideParams(w, r)
+		if !ok {
+			return
+		}
+		hs, ds := report.Lookup(int(start.Unix()), distance)
+		if ds == nil {
+			writeError(w, http.StatusNotFound, "report doesn't contain a cell for the given start and distance")
+			return
+		}
+		if ds.Count == 0 {
+			writeError(w, http.StatusNotFound, "report cell for the given start and distance has no rides")
+			return
+		}
+		writeJSON(w, http.StatusOK, &P95Response{StartHour: hs.StartHour, DistanceResponse: *newDistanceResponse(ds)})
+	})
+	mux.HandleFunc("/predict", func(w http.ResponseWriter, r *http.Request) {
+		_, predictor, ok := getReportForRequest(w, r, getReport)
+		if !ok {
+			return
+		}
+		start, distance, ok := parseRideParams(w, r)
+		if !ok {
+			return
+		}
+		duration, confidence := predictor.Predict(start, distance)
+		writeJSON(w, http.StatusOK, &PredictResponse{
+			DurationSeconds: int(duration.Seconds()),
+			Duration:        duration.String(),
+			Confidence:      confidence.String(),
+		})
+	})
+	return mux
+}
+
+func parseRideParams(w http.ResponseWriter, r *http.Request) (start time.Time, distance int, ok bool) {
+	query := r.URL.Query()
+	start, err := time.Parse(time.RFC3339, query.Get("start"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "start parameter must be a RFC 3339 timestamp")
+		return time.Time{}, 0, false
+	}
+	// maxDistanceKM is far beyond any ride, it keeps the distance in meters within int.
+	const maxDistanceKM = 100000
+	distanceKM, err := strconv.ParseFloat(query.Get("distance_km"), 64 /* bitSize */)
+	if err != nil || math.IsNaN(distanceKM) || distanceKM < 0 || distanceKM > maxDistanceKM {
+		writeError(w, http.StatusBadRequest, "distance_km parameter must be a number from 0 to 100000")
+		return time.Time{}, 0, false
+	}
+	const metersInKm = 1000
+	return start, int(math.Round(distanceKM * metersInKm)), true
+}
+
+func getReportForRequest(w http.ResponseWriter, r *http.Request,
+	getReport func() (aggregation.StatisticsReport, *prediction.Predictor),
+) (aggregation.StatisticsReport, *prediction.Predictor, bool) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET method is allowed")
+		return nil, nil, false
+	}
+	report, predictor := getReport()
+	if report == nil {
+		writeError(w, http.StatusServiceUnavailable, "report isn't calculated yet")
+		return nil, nil, false
+	}
+	return report, predictor, true
+}
+
+func newDistanceResponse(ds *aggregation.DistanceStatistics) *DistanceResponse {
+	return &DistanceResponse{
+		DistanceRange: ds.RangeName(),
+		P95Seconds:    ds.Value,
+		P95:           (time.Duration(ds.Value) * time.Second).String(),
+		Count:         ds.Count,
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, &errorResponse{Error: msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Can't write http response: %v", err)
+	}
+}
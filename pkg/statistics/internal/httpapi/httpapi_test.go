@@ -0,0 +1,182 @@
+package httpapi_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/httpapi"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/prediction"
+)
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+	report := aggregation.StatisticsReport{
+		{
+			StartHour: 8,
+			DistanceStatistics: []*aggregation.DistanceStatistics{
+				{DistanceRange: 1, Value: 300, Count: 20},
+				{DistanceRange: 5, Value: 1085, Count: 20},
+				{DistanceRange: aggregation.DistanceRangeOver21KM, Value: 3600, Count: 1},
+			},
+		},
+		{
+			StartHour:          10,
+			DistanceStatistics: []*aggregation.DistanceStatistics{{DistanceRange: 5, Value: 0, Count: 0}},
+		},
+	}
+	cases := []struct {
+		name           string
+		method         string
+		target         string
+		report         aggregation.StatisticsReport
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "whole report",
+			method:         http.MethodGet,
+			target:         "/report",
+			report:         report,
+			expectedStatus: http.StatusOK,
+			expectedBody: `{"hours":[{"start_hour":8,"distances":[` +
+				`{"distance_range":"0-1 km","p95_seconds":300,"p95":"5m0s","count":20},` +
+				`{"distance_range":"3-5 km","p95_seconds":1085,"p95":"18m5s","count":20},` +
+				`{"distance_range":"21+ km","p95_seconds":3600,"p95":"1h0m0s","count":1}]},` +
+				`{"start_hour":10,"distances":[{"distance_range":"3-5 km","p95_seconds":0,"p95":"0s","count":0}]}]}` + "\n",
+		},
+		{
+			name:           "p95 for a cell",
+			method:         http.MethodGet,
+			target:         "/p95?start=2026-10-17T08:30:00Z&distance_km=4.2",
+			report:         report,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"start_hour":8,"distance_range":"3-5 km","p95_seconds":1085,"p95":"18m5s","count":20}` + "\n",
+		},
+		{
+			name:           "p95 for a cell with the start time in a non UTC timezone",
+			method:         http.MethodGet,
+			target:         "/p95?start=2026-10-17T10:30:00%2B02:00&distance_km=30",
+			report:         report,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"start_hour":8,"distance_range":"21+ km","p95_seconds":3600,"p95":"1h0m0s","count":1}` + "\n",
+		},
+		{
+			name:           "p95 for a missing cell",
+			method:         http.MethodGet,
+			target:         "/p95?start=2026-10-17T09:30:00Z&distance_km=4.2",
+			report:         report,
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `{"error":"report doesn't contain a cell for the given start and distance"}` + "\n",
+		},
+		{
+			name:           "p95 for a cell without rides",
+			method:         http.MethodGet,
+			target:         "/p95?start=2026-10-17T10:30:00Z&distance_km=4.2",
+			report:         report,
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `{"error":"report cell for the given start and distance has no rides"}` + "\n",
+		},
+		{
+			name:           "predict duration",
+			method:         http.MethodGet,
+			target:         "/predict?start=2026-10-17T08:30:00Z&distance_km=0.5",
+			report:         report,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"duration_seconds":300,"duration":"5m0s","confidence":"high"}` + "\n",
+		},
+		{
+			name:           "predict duration with invalid distance",
+			method:         http.MethodGet,
+			target:         "/predict?start=2026-10-17T08:30:00Z&distance_km=far",
+			report:         report,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `{"error":"distance_km parameter must be a number from 0 to 100000"}` + "\n",
+		},
+		{
+			name:           "p95 with invalid start",
+			method:         http.MethodGet,
+			target:         "/p95?start=yesterday&distance_km=4.2",
+			report:         report,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `{"error":"start parameter must be a RFC 3339 timestamp"}` + "\n",
+		},
+		{
+			name:           "p95 with negative distance",
+			method:         http.MethodGet,
+			target:         "/p95?start=2026-10-17T08:30:00Z&distance_km=-1",
+			report:         report,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `{"error":"distance_km parameter must be a number from 0 to 100000"}` + "\n",
+		},
+		{
+			name:           "p95 with NaN distance",
+			method:         http.MethodGet,
+			target:         "/p95?start=2026-10-17T08:30:00Z&distance_km=NaN",
+			report:         report,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `{"error":"distance_km parameter must be a number from 0 to 100000"}` + "\n",
+		},
+		{
+			name:           "p95 with infinite distance",
+			method:         http.MethodGet,
+			target:         "/p95?start=2026-10-17T08:30:00Z&distance_km=Inf",
+			report:         report,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `{"error":"distance_km parameter must be a number from 0 to 100000"}` + "\n",
+		},
+		{
+			name:           "p95 with huge distance",
+			method:         http.MethodGet,
+			target:         "/p95?start=2026-10-17T08:30:00Z&distance_km=1e300",
+			report:         report,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `{"error":"distance_km parameter must be a number from 0 to 100000"}` + "\n",
+		},
+		{
+			name:           "report isn't calculated yet",
+			method:         http.MethodGet,
+			target:         "/report",
+			report:         nil,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   `{"error":"report isn't calculated yet"}` + "\n",
+		},
+		{
+			name:           "method isn't allowed",
+			method:         http.MethodPost,
+			target:         "/report",
+			report:         report,
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedBody:   `{"error":"only GET method is allowed"}` + "\n",
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var predictor *prediction.Predictor
+			if tc.report != nil {
+				predictor = prediction.NewPredictor(tc.report, prediction.DefaultMinSamples)
+			}
+			handler := httpapi.NewHandler(func() (aggregation.StatisticsReport, *prediction.Predictor) {
+				return tc.report, predictor
+			})
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, nil))
+			resp := w.Result()
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			assert.Equal(t, tc.expectedBody, string(body))
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package jsonoutput
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+)
+
+type cellHistogram struct {
+	TimeOfDay     string `json:"time_of_day"`
+	DistanceRange string `json:"distance_range"`
+	Rides         int    `json:"rides"`
+	Bins          []bin  `json:"bins"`
+}
+
+type bin struct {
+	StartSeconds float64 `json:"start_seconds"`
+	// EndSeconds is nil for the last bin since it isn't bounded.
+	EndSeconds *float64 `json:"end_seconds"`
+	Rides      int      `json:"rides"`
+}
+
+func WriteJSONHistogramReportToFile(filePath string, report aggregation.HistogramReport, bins aggregation.Bins) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return errors.Wrap(err, "can't open output file for writing")
+	}
+	defer f.Close() // nolint: errcheck, gosec
+	if err := WriteJSONHistogramReport(f, report, bins); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "can't close output json file")
+	}
+	return nil
+}
+
+// WriteJSONHistogramReport writes histograms of all cells as an array of objects with the bins bounds in seconds
+// and the number of rides in each bin, cells without rides are skipped.
+func WriteJSONHistogramReport(w io.Writer, report aggregation.HistogramReport, bins aggregation.Bins) error {
+	cells := make([]*cellHistogram, 0, len(report))
+	for _, hh := range report {
+		for _, dh := range hh.DistanceHistograms {
+			cell := &cellHistogram{
+				TimeOfDay:     fmt.Sprintf("%02d:00", hh.StartHour),
+				DistanceRange: dh.RangeName(),
+				Bins:          make([]bin, 0, len(dh.Counts)),
+			}
+			for i, count := range dh.Counts {
+				b := bin{StartSeconds: roundSeconds(bins.Edges[i]), Rides: count}
+				if i+1 < len(bins.Edges) {
+					end := roundSeconds(bins.Edges[i+1])
+					b.EndSeconds = &end
+				}
+				cell.Bins = append(cell.Bins, b)
+				cell.Rides += count
+			}
+			if cell.Rides != 0 {
+				cells = append(cells, cell)
+			}
+		}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return errors.Wrap(encoder.Encode(cells), "can't write report to json")
+}
+
+// roundSeconds rounds a bin edge to milliseconds like the csv output.
+func roundSeconds(seconds float64) float64 {
+	return math.Round(seconds*1000) / 1000
+}
@@ -0,0 +1,53 @@
+package jsonoutput_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/jsonoutput"
+)
+
+func TestWriteJSONHistogramReport(t *testing.T) {
+	t.Parallel()
+	report := aggregation.HistogramReport{
+		{StartHour: 9, DistanceHistograms: []*aggregation.DistanceHistogram{
+			{DistanceRange: 1, Counts: []int{0, 0}},
+			{DistanceRange: 2, Counts: []int{1, 2}},
+		}},
+	}
+	bins := aggregation.Bins{Edges: []float64{0, 60.00049}}
+	w := &bytes.Buffer{}
+
+	err := jsonoutput.WriteJSONHistogramReport(w, report, bins)
+	require.NoError(t, err)
+
+	expected := `[
+  {
+    "time_of_day": "09:00",
+    "distance_range": "1-2 km",
+    "rides": 3,
+    "bins": [
+      {
+        "start_seconds": 0,
+        "end_seconds": 60,
+        "rides": 1
+      },
+      {
+        "start_seconds": 60,
+        "end_seconds": null,
+        "rides": 2
+      }
+    ]
+  }
+]
+`
+	assert.Equal(t, expected, w.String())
+
+	w.Reset()
+	require.NoError(t, jsonoutput.WriteJSONHistogramReport(w, aggregation.HistogramReport{}, bins))
+	assert.Equal(t, "[]\n", w.String())
+}
@@ -0,0 +1,331 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const namespace = "ride_statistics"
+
+const (
+	DropReasonInvalidCoordinates = "invalid_coordinates"
+	DropReasonSinglePoint        = "single_point"
+	DropReasonInvalidRideData    = "invalid_ride_data"
+	DropReasonOutsideZones       = "outside_zones"
+	DropReasonImplausibleSpeed   = "implausible_speed"
+	DropReasonOutlierIQR         = "outlier_iqr"
+	DropReasonOutlierMAD         = "outlier_mad"
+	DropReasonUndefinedMetric    = "undefined_metric"
+)
+
+const (
+	StageRead      = "read"
+	StageProcess   = "process"
+	StageAggregate = "aggregate"
+	StageReport    = "report"
+)
+
+const serverReadHeaderTimeout = 5 * time.Second
+
+// Pipeline collects counters and gauges of a single statistics calculation run.
+// All methods are safe for concurrent use and are no-op on a nil *Pipeline,
+// so pipeline stages can be instrumented optionally.
+type Pipeline struct {
+	rowsRead     int64
+	ridesEmitted int64
+
+	mx       *sync.Mutex
+	dropped  map[string]*int64
+	channels map[string]func() (length, capacity int)
+	stages   map[string]*stageTiming
+}
+
+type stageTiming struct {
+	start  time.Time
+	finish time.Time
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline{
+		mx:       new(sync.Mutex),
+		dropped:  make(map[string]*int64),
+		channels: make(map[string]func() (int, int)),
+		stages:   make(map[string]*stageTiming),
+	}
+}
+
+func (p *Pipeline) AddRowsRead(n int) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.rowsRead, int64(n))
+}
+
+func (p *Pipeline) AddRidesEmitted(n int) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.ridesEmitted, int64(n))
+}
+
+func (p *Pipeline) AddDropped(reason string, n int) {
+	if p == nil {
+		return
+	}
+	p.mx.Lock()
+	counter, ok := p.dropped[reason]
+	if !ok {
+		counter = new(int64)
+		p.dropped[reason] = counter
+	}
+	p.mx.Unlock()
+	atomic.AddInt64(counter, int64(n))
+}
+
+// ObserveChannel registers a function reporting the current length and capacity of a channel (or a group of channels).
+// The function is called each time metrics are exposed.
+func (p *Pipeline) ObserveChannel(name string, fill func() (length, capacity int)) {
+	if p == nil {
+		return
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.channels[name] = fill
+}
+
+// StartStage marks the stage as running.
+// If the stage has been started before, the original start time is kept,
+// so the stage duration covers all its runs.
+func (p *Pipeline) StartStage(name string) {
+	if p == nil {
+		return
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if st, ok := p.stages[name]; ok {
+		st.finish = time.Time{}
+		return
+	}
+	p.stages[name] = &stageTiming{start: time.Now()}
+}
+
+func (p *Pipeline) FinishStage(name string) {
+	if p == nil {
+		return
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if st, ok := p.stages[name]; ok {
+		st.finish = time.Now()
+	}
+}
+
+func (p *Pipeline) RowsRead() int {
+	if p == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&p.rowsRead))
+}
+
+func (p *Pipeline) RidesEmitted() int {
+	if p == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&p.ridesEmitted))
+}
+
+// Dropped returns the number of dropped items per drop reason.
+func (p *Pipeline) Dropped() map[string]int {
+	if p == nil {
+		return nil
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	dropped := make(map[string]int, len(p.dropped))
+	for reason, counter := range p.dropped {
+		dropped[reason] = int(atomic.LoadInt64(counter))
+	}
+	return dropped
+}
+
+// StageDuration returns how long the stage has been running.
+// For a finished stage it's the total stage duration.
+func (p *Pipeline) StageDuration(name string) time.Duration {
+	if p == nil {
+		return 0
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	st, ok := p.stages[name]
+	if !ok {
+		return 0
+	}
+	return st.duration()
+}
+
+func (st *stageTiming) duration() time.Duration {
+	if st.finish.IsZero() {
+		return time.Since(st.start)
+	}
+	return st.finish.Sub(st.start)
+}
+
+// Summary returns a single line human readable representation of the run counters.
+func (p *Pipeline) Summary() string {
+	if p == nil {
+		return ""
+	}
+	parts := []string{
+		fmt.Sprintf("rows_read=%d", p.RowsRead()),
+		fmt.Sprintf("rides_emitted=%d", p.RidesEmitted()),
+	}
+	dropped := p.Dropped()
+	for _, reason := range sortedKeys(dropped) {
+		parts = append(parts, fmt.Sprintf("dropped_%s=%d", reason, dropped[reason]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format.
+func (p *Pipeline) WriteText(w io.Writer) error {
+	if p == nil {
+		return nil
+	}
+	b := &strings.Builder{}
+	writeMetric(b, "rows_read_total", "counter", "Number of rows read from the input file.",
+		sample{value: float64(p.RowsRead())})
+	writeMetric(b, "rides_emitted_total", "counter", "Number of rides emitted by the rides processors.",
+		sample{value: float64(p.RidesEmitted())})
+
+	dropped := p.Dropped()
+	droppedSamples := make([]sample, 0, len(dropped))
+	for _, reason := range sortedKeys(dropped) {
+		droppedSamples = append(droppedSamples, sample{labels: label("reason", reason), value: float64(dropped[reason])})
+	}
+	writeMetric(b, "dropped_total", "counter", "Number of rows and rides dropped by the pipeline by reason.",
+		droppedSamples...)
+
+	p.mx.Lock()
+	channelNames := make([]string, 0, len(p.channels))
+	for name := range p.channels {
+		channelNames = append(channelNames, name)
+	}
+	sort.Strings(channelNames)
+	lengthSamples := make([]sample, 0, len(channelNames))
+	capacitySamples := make([]sample, 0, len(channelNames))
+	for _, name := range channelNames {
+		length, capacity := p.channels[name]()
+		lengthSamples = append(lengthSamples, sample{labels: label("channel", name), value: float64(length)})
+		capacitySamples = append(capacitySamples, sample{labels: label("channel", name), value: float64(capacity)})
+	}
+	stageNames := make([]string, 0, len(p.stages))
+	for name := range p.stages {
+		stageNames = append(stageNames, name)
+	}
+	sort.Strings(stageNames)
+	stageSamples := make([]sample, 0, len(stageNames))
+	for _, name := range stageNames {
+		stageSamples = append(stageSamples,
+			sample{labels: label("stage", name), value: p.stages[name].duration().Seconds()})
+	}
+	p.mx.Unlock()
+
+	writeMetric(b, "channel_length", "gauge", "Number of elements buffered in the pipeline channel.",
+		lengthSamples...)
+	writeMetric(b, "channel_capacity", "gauge", "Buffer capacity of the pipeline channel.", capacitySamples...)
+	writeMetric(b, "stage_duration_seconds", "gauge",
+		"Wall time of the pipeline stage, elapsed time so far for a running stage.", stageSamples...)
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return errors.Wrap(err, "can't write metrics")
+	}
+	return nil
+}
+
+// WriteTextToFile writes the metrics snapshot into a file,
+// which can be picked up by the node exporter textfile collector for example.
+func (p *Pipeline) WriteTextToFile(filePath string) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return errors.Wrap(err, "can't open metrics file for writing")
+	}
+	defer f.Close() // nolint: errcheck, gosec
+	if err := p.WriteText(f); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "can't close metrics file")
+	}
+	return nil
+}
+
+func (p *Pipeline) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := p.WriteText(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// Serve starts serving metrics on the /metrics path of the given address in background.
+// It returns a function to stop the server.
+func (p *Pipeline) Serve(addr string) (func() error, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't listen on metrics address")
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p.Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: serverReadHeaderTimeout}
+	go func() {
+		if err := server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Metrics server failed: %v", err)
+		}
+	}()
+	return func() error {
+		if err := server.Shutdown(context.Background()); err != nil {
+			return errors.Wrap(err, "can't shutdown metrics server")
+		}
+		return nil
+	}, nil
+}
+
+type sample struct {
+	labels string
+	value  float64
+}
+
+func label(name, value string) string {
+	return fmt.Sprintf("{%s=%q}", name, value)
+}
+
+func writeMetric(b *strings.Builder, name, metricType, help string, samples ...sample) {
+	fullName := namespace + "_" + name
+	fmt.Fprintf(b, "# HELP %s %s\n", fullName, help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", fullName, metricType)
+	for _, s := range samples {
+		fmt.Fprintf(b, "%s%s %g\n", fullName, s.labels, s.value)
+	}
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,89 @@
+package metrics_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/metrics"
+)
+
+const expectedText = `# HELP ride_statistics_rows_read_total Number of rows read from the input file.
+# TYPE ride_statistics_rows_read_total counter
+ride_statistics_rows_read_total 10
+# HELP ride_statistics_rides_emitted_total Number of rides emitted by the rides processors.
+# TYPE ride_statistics_rides_emitted_total counter
+ride_statistics_rides_emitted_total 3
+# HELP ride_statistics_dropped_total Number of rows and rides dropped by the pipeline by reason.
+# TYPE ride_statistics_dropped_total counter
+ride_statistics_dropped_total{reason="invalid_coordinates"} 2
+ride_statistics_dropped_total{reason="single_point"} 1
+# HELP ride_statistics_channel_length Number of elements buffered in the pipeline channel.
+# TYPE ride_statistics_channel_length gauge
+ride_statistics_channel_length{channel="rides"} 1
+# HELP ride_statistics_channel_capacity Buffer capacity of the pipeline channel.
+# TYPE ride_statistics_channel_capacity gauge
+ride_statistics_channel_capacity{channel="rides"} 4
+# HELP ride_statistics_stage_duration_seconds Wall time of the pipeline stage, elapsed time so far for a running stage.
+# TYPE ride_statistics_stage_duration_seconds gauge
+`
+
+func newTestPipeline() *metrics.Pipeline {
+	m := metrics.NewPipeline()
+	m.AddRowsRead(7)
+	m.AddRowsRead(3)
+	m.AddRidesEmitted(3)
+	m.AddDropped(metrics.DropReasonSinglePoint, 1)
+	m.AddDropped(metrics.DropReasonInvalidCoordinates, 2)
+	ch := make(chan int, 4)
+	ch <- 1
+	m.ObserveChannel("rides", func() (int, int) { return len(ch), cap(ch) })
+	return m
+}
+
+func TestPipeline_WriteText(t *testing.T) {
+	t.Parallel()
+	m := newTestPipeline()
+	w := &bytes.Buffer{}
+
+	err := m.WriteText(w)
+	require.NoError(t, err)
+
+	assert.Equal(t, expectedText, w.String())
+	assert.Equal(t, "rows_read=10, rides_emitted=3, dropped_invalid_coordinates=2, dropped_single_point=1", m.Summary())
+}
+
+func TestPipeline_Handler(t *testing.T) {
+	t.Parallel()
+	m := newTestPipeline()
+	m.StartStage(metrics.StageRead)
+	m.FinishStage(metrics.StageRead)
+	server := httptest.NewServer(m.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), expectedText+`ride_statistics_stage_duration_seconds{stage="read"} `)
+}
+
+func TestPipeline_Nil(t *testing.T) {
+	t.Parallel()
+	var m *metrics.Pipeline
+	m.AddRowsRead(1)
+	m.AddDropped(metrics.DropReasonInvalidRideData, 1)
+	m.StartStage(metrics.StageRead)
+	m.FinishStage(metrics.StageRead)
+
+	assert.Equal(t, 0, m.RowsRead())
+	assert.Equal(t, "", m.Summary())
+}
@@ -0,0 +1,197 @@
+package prediction
+
+import (
+	"math"
+	"time"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+)
+
+const (
+	DefaultMinSamples = 10
+	hoursNo           = 24
+)
+
+// Confidence describes how reliable the predicted duration is.
+type Confidence int
+
+const (
+	// ConfidenceNone means there is no data to predict the duration from.
+	ConfidenceNone Confidence = iota
+	// ConfidenceLow means the prediction falls back to the distance range statistics across all hours,
+	// because the cells around the ride start time are empty or have too few samples.
+	ConfidenceLow
+	// ConfidenceMedium means some of the cells around the ride are empty or have too few samples
+	// and the prediction is interpolated from the remaining ones.
+	ConfidenceMedium
+	// ConfidenceHigh means the prediction is interpolated from the cells around the ride
+	// and all of them have enough samples.
+	ConfidenceHigh
+)
+
+func (c Confidence) String() string {
+	switch c {
+	case ConfidenceLow:
+		return "low"
+	case ConfidenceMedium:
+		return "medium"
+	case ConfidenceHigh:
+		return "high"
+	default:
+		return "none"
+	}
+}
+
+// Predictor predicts ride duration from a statistics report.
+// It interpolates the cells values between the neighbouring hours and distance ranges:
+// an hour cell represents the middle of the hour and a distance range cell represents the middle of the range.
+type Predictor struct {
+	minSamples int
+
+	// midpoints are the representative distances in meters of the distance ranges.
+	midpoints []float64
+	// cells are indexed by the start hour and the distance range index.
+	cells [hoursNo][]cell
+	// columns are the cells of each distance range merged across all hours.
+	columns []cell
+}
+
+type cell struct {
+	value float64
+	count int
+}
+
+type weightedIndex struct {
+	idx    int
+	weight float64
+}
+
+// NewPredictor creates a predictor from the report.
+// Cells with less than minSamples rides aren't used for prediction.
+func NewPredictor(report aggregation.StatisticsReport, minSamples int) *Predictor {
+	p := &Predictor{minSamples: minSamples}
+	if len(report) == 0 {
+		return p
+	}
+	distances := report[0].DistanceStatistics
+	p.midpoints = make([]float64, len(distances))
+	for i, ds := range distances {
+		lower, upper := ds.Bounds()
+		if upper == aggregation.DistanceRangeOver21KM {
+			p.midpoints[i] = float64(lower)
+		} else {
+			p.midpoints[i] = float64(lower+upper) / 2
+		}
+	}
+	p.columns = make([]cell, len(distances))
+	for hour := range p.cells {
+		p.cells[hour] = make([]cell, len(distances))
+	}
+	for _, hs := range report {
+		for i, ds := range hs.DistanceStatistics {
+			c := cell{value: float64(ds.Value), count: ds.Count}
+			p.cells[hs.StartHour%hoursNo][i] = c
+			// Merged cell value is an approximation:
+			// the average of the percentiles weighted by the number of rides.
+			column := &p.columns[i]
+			column.value += c.value * float64(c.count)
+			column.count += c.count
+		}
+	}
+	for i := range p.columns {
+		if p.columns[i].count > 0 {
+			p.columns[i].value /= float64(p.columns[i].count)
+		}
+	}
+	return p
+}
+
+func (p *Predictor) Predict(start time.Time, distance int) (time.Duration, Confidence) {
+	if len(p.midpoints) == 0 {
+		return 0, ConfidenceNone
+	}
+	distanceWeights := p.distanceWeights(float64(distance))
+	hourWeights := hourWeights(start)
+
+	var cells []cell
+	var weights []float64
+	for _, hw := range hourWeights {
+		for _, dw := range distanceWeights {
+			cells = append(cells, p.cells[hw.idx][dw.idx])
+			weights = append(weights, hw.weight*dw.weight)
+		}
+	}
+	if value, complete, ok := p.interpolate(cells, weights); ok {
+		confidence := ConfidenceMedium
+		if complete {
+			confidence = ConfidenceHigh
+		}
+		return toDuration(value), confidence
+	}
+
+	cells = cells[:0]
+	weights = weights[:0]
+	for _, dw := range distanceWeights {
+		cells = append(cells, p.columns[dw.idx])
+		weights = append(weights, dw.weight)
+	}
+	if value, _, ok := p.interpolate(cells, weights); ok {
+		return toDuration(value), ConfidenceLow
+	}
+	return 0, ConfidenceNone
+}
+
+// interpolate calculates the weighted average of the cells values skipping cells with not enough samples.
+// complete reports whether all cells with a non-zero weight were used.
+func (p *Predictor) interpolate(cells []cell, weights []float64) (value float64, complete bool, ok bool) {
+	var totalWeight float64
+	complete = true
+	for i, c := range cells {
+		if weights[i] == 0 {
+			continue
+		}
+		if c.count == 0 || c.count < p.minSamples {
+			complete = false
+			continue
+		}
+		value += c.value * weights[i]
+		totalWeight += weights[i]
+	}
+	if totalWeight == 0 {
+		return 0, false, false
+	}
+	return value / totalWeight, complete, true
+}
+
+func (p *Predictor) distanceWeights(distance float64) []weightedIndex {
+	last := len(p.midpoints) - 1
+	if distance <= p.midpoints[0] {
+		return []weightedIndex{{idx: 0, weight: 1}}
+	}
+	if distance >= p.midpoints[last] {
+		return []weightedIndex{{idx: last, weight: 1}}
+	}
+	i := 0
+	for distance >= p.midpoints[i+1] {
+		i++
+	}
+	upperWeight := (distance - p.midpoints[i]) / (p.midpoints[i+1] - p.midpoints[i])
+	return []weightedIndex{{idx: i, weight: 1 - upperWeight}, {idx: i + 1, weight: upperWeight}}
+}
+
+func hourWeights(start time.Time) []weightedIndex {
+	start = start.UTC()
+	sinceHourStart := time.Duration(start.Minute())*time.Minute + time.Duration(start.Second())*time.Second
+	// Hour cell represents the middle of the hour, so shift the position by a half of hour.
+	const halfHour = 0.5
+	position := float64(start.Hour()) + sinceHourStart.Hours() - halfHour
+	lowerPosition := math.Floor(position)
+	upperWeight := position - lowerPosition
+	lower := (int(lowerPosition) + hoursNo) % hoursNo
+	upper := (lower + 1) % hoursNo
+	return []weightedIndex{{idx: lower, weight: 1 - upperWeight}, {idx: upper, weight: upperWeight}}
+}
+
+func toDuration(seconds float64) time.Duration {
+	return time.Duration(math.Round(seconds)) * time.Second
+}
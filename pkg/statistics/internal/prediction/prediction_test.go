@@ -0,0 +1,124 @@
+package prediction_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/prediction"
+)
+
+func TestPredictor_Predict(t *testing.T) {
+	t.Parallel()
+	predictor := prediction.NewPredictor(getTestReport(), 10 /* minSamples */)
+	cases := []struct {
+		name               string
+		start              string
+		distance           int
+		expected           time.Duration
+		expectedConfidence prediction.Confidence
+	}{
+		{
+			name:               "exactly in the middle of a cell",
+			start:              "2026-10-17T08:30:00Z",
+			distance:           500,
+			expected:           300 * time.Second,
+			expectedConfidence: prediction.ConfidenceHigh,
+		},
+		{
+			name:               "between hours and distance ranges",
+			start:              "2026-10-17T09:00:00Z",
+			distance:           1000,
+			expected:           385 * time.Second,
+			expectedConfidence: prediction.ConfidenceHigh,
+		},
+		{
+			name:               "start time in a non UTC timezone",
+			start:              "2026-10-17T11:00:00+02:00",
+			distance:           1000,
+			expected:           385 * time.Second,
+			expectedConfidence: prediction.ConfidenceHigh,
+		},
+		{
+			name:               "distance below the first range midpoint",
+			start:              "2026-10-17T08:30:00Z",
+			distance:           100,
+			expected:           300 * time.Second,
+			expectedConfidence: prediction.ConfidenceHigh,
+		},
+		{
+			name:               "neighbour hour cell has too few samples",
+			start:              "2026-10-17T10:00:00Z",
+			distance:           500,
+			expected:           360 * time.Second,
+			expectedConfidence: prediction.ConfidenceMedium,
+		},
+		{
+			name:               "empty cells fall back to the distance range across all hours",
+			start:              "2026-10-17T03:00:00Z",
+			distance:           500,
+			expected:           343 * time.Second,
+			expectedConfidence: prediction.ConfidenceLow,
+		},
+		{
+			name:               "no data for the distance",
+			start:              "2026-10-17T08:30:00Z",
+			distance:           4000,
+			expected:           0,
+			expectedConfidence: prediction.ConfidenceNone,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			start, err := time.Parse(time.RFC3339, tc.start)
+			require.NoError(t, err)
+
+			actual, confidence := predictor.Predict(start, tc.distance)
+			assert.Equal(t, tc.expected, actual)
+			assert.Equal(t, tc.expectedConfidence, confidence)
+		})
+	}
+}
+
+func TestPredictor_PredictEmptyReport(t *testing.T) {
+	t.Parallel()
+	predictor := prediction.NewPredictor(nil, prediction.DefaultMinSamples)
+
+	actual, confidence := predictor.Predict(time.Now(), 1000)
+	assert.Equal(t, time.Duration(0), actual)
+	assert.Equal(t, prediction.ConfidenceNone, confidence)
+}
+
+func getTestReport() aggregation.StatisticsReport {
+	cells := map[int][]*aggregation.DistanceStatistics{
+		8: {
+			{DistanceRange: 1, Value: 300, Count: 20},
+			{DistanceRange: 2, Value: 400, Count: 20},
+		},
+		9: {
+			{DistanceRange: 1, Value: 360, Count: 20},
+			{DistanceRange: 2, Value: 480, Count: 20},
+		},
+		10: {
+			{DistanceRange: 1, Value: 600, Count: 2},
+		},
+	}
+	report := aggregation.StatisticsReport{}
+	for i := 0; i < 24; i++ {
+		hs := &aggregation.HourStatistics{StartHour: i}
+		for j, dr := range []int{1, 2, 3, 5, 8, 13, 21, aggregation.DistanceRangeOver21KM} {
+			ds := &aggregation.DistanceStatistics{DistanceRange: dr}
+			if j < len(cells[i]) {
+				ds = cells[i][j]
+			}
+			hs.DistanceStatistics = append(hs.DistanceStatistics, ds)
+		}
+		report = append(report, hs)
+	}
+	return report
+}
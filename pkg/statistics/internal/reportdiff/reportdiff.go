@@ -0,0 +1,256 @@
+package reportdiff
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// timeOfDayColumn separates the key columns of a report from the distance ranges columns.
+const timeOfDayColumn = "Time of Day"
+
+// Report is a statistics report read back from a csv file written by csvoutput,
+// it can be the report of all rides or the zones report.
+type Report struct {
+	// KeyColumns are the columns in front of the distance ranges: the zones columns if any and the time of day.
+	KeyColumns []string
+	Cells      []Cell
+}
+
+type Cell struct {
+	// Key contains values of the key columns.
+	Key           []string
+	DistanceRange string
+	// Value is in seconds if Duration is true,
+	// otherwise it's a plain number in the report units, e.g. km/h of the speed metric.
+	Value    float64
+	Duration bool
+}
+
+func (c *Cell) id() string {
+	return strings.Join(append(append([]string(nil), c.Key...), c.DistanceRange), "\x00")
+}
+
+func ReadCSVFile(filePath string) (*Report, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't open report file")
+	}
+	defer f.Close() // nolint: errcheck, gosec
+	report, err := ReadCSV(f)
+	return report, errors.Wrapf(err, "can't read report %s", filePath)
+}
+
+// ReadCSV reads the report, cell values can be in any of the csvoutput duration formats or plain numbers.
+// Go durations and hh:mm:ss are read as durations, the other duration formats and speeds as plain numbers.
+func ReadCSV(r io.Reader) (*Report, error) {
+	csvr := csv.NewReader(r)
+	header, err := csvr.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read csv header")
+	}
+	keysNo := -1
+	for i, column := range header {
+		if column == timeOfDayColumn {
+			keysNo = i + 1
+			break
+		}
+	}
+	if keysNo < 0 {
+		return nil, errors.Errorf("report header doesn't contain %q column", timeOfDayColumn)
+	}
+	report := &Report{KeyColumns: header[:keysNo]}
+	for {
+		records, err := csvr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "can't read csv record")
+		}
+		key := records[:keysNo]
+		for i, record := range records[keysNo:] {
+			cell, err := parseCell(record)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value of %s %s", strings.Join(key, " "), header[keysNo+i])
+			}
+			cell.Key, cell.DistanceRange = key, header[keysNo+i]
+			report.Cells = append(report.Cells, cell)
+		}
+	}
+	return report, nil
+}
+
+func parseCell(record string) (Cell, error) {
+	// Numbers are checked first, because "0" is a valid duration too.
+	if value, err := strconv.ParseFloat(record, 64); err == nil && !math.IsNaN(value) && !math.IsInf(value, 0) {
+		return Cell{Value: value}, nil
+	}
+	if value, err := time.ParseDuration(record); err == nil {
+		return Cell{Value: value.Seconds(), Duration: true}, nil
+	}
+	if seconds, ok := parseClock(record); ok {
+		return Cell{Value: seconds, Duration: true}, nil
+	}
+	return Cell{}, errors.Errorf("%q is neither a duration nor a number", record)
+}
+
+// parseClock parses a duration in the hh:mm:ss format into seconds, hours aren't limited to a day.
+func parseClock(record string) (float64, bool) {
+	const secondsInMinute = 60
+	clock := strings.TrimPrefix(record, "-")
+	parts := strings.Split(clock, ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	var seconds float64
+	for i, part := range parts {
+		value, err := strconv.ParseUint(part, 10, 32)
+		if err != nil || i > 0 && (len(part) != 2 || value >= secondsInMinute) {
+			return 0, false
+		}
+		seconds = seconds*secondsInMinute + float64(value)
+	}
+	if clock != record {
+		seconds = -seconds
+	}
+	return seconds, true
+}
+
+// Change is the change of a cell value between the old and the new reports.
+// A cell can be missing in one of the reports, e.g. if a zone has no rides in it.
+type Change struct {
+	Key           []string
+	DistanceRange string
+	// Old and New are in seconds if Duration is true, otherwise they are plain numbers.
+	Old, New float64
+	Duration bool
+	HasOld   bool
+	HasNew   bool
+	// Exceeds is true if the relative change exceeds the threshold or if the cell is missing in one of the reports.
+	Exceeds bool
+}
+
+// Absolute returns the change of the value, it's zero if the cell is missing in one of the reports.
+func (c *Change) Absolute() float64 {
+	if !c.HasOld || !c.HasNew {
+		return 0
+	}
+	return c.New - c.Old
+}
+
+// Relative returns the change relative to the old value,
+// it returns false if the old value is zero or the cell is missing in one of the reports.
+func (c *Change) Relative() (float64, bool) {
+	if !c.HasOld || !c.HasNew || c.Old == 0 {
+		return 0, false
+	}
+	return (c.New - c.Old) / c.Old, true
+}
+
+// format formats the value the same way it's read: as a duration or as a plain number.
+func (c *Change) format(value float64) string {
+	if c.Duration {
+		return time.Duration(math.Round(value * float64(time.Second))).String()
+	}
+	// Rounding drops the floating point error of the difference, report values have a few decimal places.
+	return strconv.FormatFloat(math.Round(value*1e9)/1e9, 'f', -1, 64)
+}
+
+// Compare returns changes of all cells in the order of the new report followed by the cells missing in it.
+// The threshold is relative, e.g. 0.1 for 10%, a change from zero exceeds any threshold.
+// Numbers aren't converted between the duration formats, so both reports must be written in the same format
+// and a cell can't be a duration in one report and a number in the other.
+func Compare(oldReport, newReport *Report, threshold float64) ([]*Change, error) {
+	if strings.Join(oldReport.KeyColumns, ",") != strings.Join(newReport.KeyColumns, ",") {
+		return nil, errors.Errorf("reports have different columns: %s and %s",
+			strings.Join(oldReport.KeyColumns, ","), strings.Join(newReport.KeyColumns, ","))
+	}
+	oldCells := make(map[string]*Cell, len(oldReport.Cells))
+	for i := range oldReport.Cells {
+		cell := &oldReport.Cells[i]
+		oldCells[cell.id()] = cell
+	}
+	changes := make([]*Change, 0, len(newReport.Cells))
+	for i := range newReport.Cells {
+		cell := &newReport.Cells[i]
+		c := &Change{Key: cell.Key, DistanceRange: cell.DistanceRange, New: cell.Value, Duration: cell.Duration, HasNew: true}
+		if oldCell, ok := oldCells[cell.id()]; ok {
+			if oldCell.Duration != cell.Duration {
+				return nil, errors.Errorf(
+					"%s %s is a duration in one report and a number in the other, "+
+						"reports must be written in the same duration format",
+					strings.Join(cell.Key, " "), cell.DistanceRange,
+				)
+			}
+			c.Old, c.HasOld = oldCell.Value, true
+			delete(oldCells, cell.id())
+		}
+		changes = append(changes, c)
+	}
+	for i := range oldReport.Cells {
+		cell := &oldReport.Cells[i]
+		if _, ok := oldCells[cell.id()]; ok {
+			changes = append(changes, &Change{
+				Key: cell.Key, DistanceRange: cell.DistanceRange, Old: cell.Value, Duration: cell.Duration, HasOld: true,
+			})
+		}
+	}
+	for _, c := range changes {
+		switch relative, ok := c.Relative(); {
+		case ok:
+			c.Exceeds = math.Abs(relative) > threshold
+		case c.HasOld && c.HasNew:
+			c.Exceeds = c.New != c.Old
+		default:
+			c.Exceeds = true
+		}
+	}
+	return changes, nil
+}
+
+// WriteCSV writes a row per cell with the old and new values, the absolute and relative changes
+// and whether the change exceeds the threshold. Values missing in one of the reports are empty.
+func WriteCSV(w io.Writer, keyColumns []string, changes []*Change) error {
+	csvw := csv.NewWriter(w)
+	header := append(append([]string(nil), keyColumns...),
+		"Distance Range", "Old", "New", "Change", "Relative Change", "Exceeds Threshold")
+	if err := csvw.Write(header); err != nil {
+		return errors.Wrap(err, "can't write csv header")
+	}
+	for _, c := range changes {
+		var oldValue, newValue, absolute, relative string
+		if c.HasOld {
+			oldValue = c.format(c.Old)
+		}
+		if c.HasNew {
+			newValue = c.format(c.New)
+		}
+		if c.HasOld && c.HasNew {
+			absolute = c.format(c.Absolute())
+			if c.Absolute() > 0 {
+				absolute = "+" + absolute
+			}
+		}
+		if r, ok := c.Relative(); ok {
+			relative = fmt.Sprintf("%+.2f%%", r*100)
+		}
+		records := append(append([]string(nil), c.Key...),
+			c.DistanceRange, oldValue, newValue, absolute, relative, strconv.FormatBool(c.Exceeds))
+		if err := csvw.Write(records); err != nil {
+			return errors.Wrap(err, "can't write diff to csv")
+		}
+	}
+	csvw.Flush()
+	if err := csvw.Error(); err != nil {
+		return errors.Wrap(err, "can't write diff to csv")
+	}
+	return nil
+}
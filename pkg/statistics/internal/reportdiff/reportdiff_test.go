@@ -0,0 +1,152 @@
+package reportdiff_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/csvoutput"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/reportdiff"
+)
+
+func TestReadCSV(t *testing.T) {
+	t.Parallel()
+	report, err := reportdiff.ReadCSV(strings.NewReader(`Pickup Zone,Time of Day,1 km,21+ km
+airport,00:00,1m2s,0s
+downtown,01:00,1h0m5s,59s
+`))
+	require.NoError(t, err)
+	expected := &reportdiff.Report{
+		KeyColumns: []string{"Pickup Zone", "Time of Day"},
+		Cells: []reportdiff.Cell{
+			{Key: []string{"airport", "00:00"}, DistanceRange: "1 km", Value: 62, Duration: true},
+			{Key: []string{"airport", "00:00"}, DistanceRange: "21+ km", Value: 0, Duration: true},
+			{Key: []string{"downtown", "01:00"}, DistanceRange: "1 km", Value: 3605, Duration: true},
+			{Key: []string{"downtown", "01:00"}, DistanceRange: "21+ km", Value: 59, Duration: true},
+		},
+	}
+	assert.Equal(t, expected, report)
+
+	_, err = reportdiff.ReadCSV(strings.NewReader("period,time_of_day,distance_range,p95_seconds,rides\n"))
+	assert.EqualError(t, err, `report header doesn't contain "Time of Day" column`)
+	_, err = reportdiff.ReadCSV(strings.NewReader("Time of Day,1 km\n00:00,fast\n"))
+	assert.EqualError(t, err, `invalid value of 00:00 1 km: "fast" is neither a duration nor a number`)
+	_, err = reportdiff.ReadCSV(strings.NewReader("Time of Day,1 km\n00:00,NaN\n"))
+	assert.EqualError(t, err, `invalid value of 00:00 1 km: "NaN" is neither a duration nor a number`)
+
+	// Values of the speed metric are plain numbers.
+	report, err = reportdiff.ReadCSV(strings.NewReader("Time of Day,1 km\n00:00,13.474\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []reportdiff.Cell{{Key: []string{"00:00"}, DistanceRange: "1 km", Value: 13.474}}, report.Cells)
+}
+
+func TestReadCSV_DurationFormats(t *testing.T) {
+	t.Parallel()
+	write := func(format string, seconds int) *reportdiff.Report {
+		report := aggregation.StatisticsReport{{StartHour: 9, DistanceStatistics: []*aggregation.DistanceStatistics{
+			{DistanceRange: 1, Value: seconds},
+		}}}
+		buf := &bytes.Buffer{}
+		require.NoError(t, csvoutput.WriteCSVReport(buf, report, csvoutput.WithDurationFormat(format)), format)
+		read, err := reportdiff.ReadCSV(buf)
+		require.NoError(t, err, format)
+		require.Len(t, read.Cells, 1, format)
+		return read
+	}
+	cases := []struct {
+		format   string
+		expected reportdiff.Cell
+	}{
+		{format: csvoutput.DurationFormatGo, expected: reportdiff.Cell{Value: 1085, Duration: true}},
+		{format: csvoutput.DurationFormatSeconds, expected: reportdiff.Cell{Value: 1085}},
+		{format: csvoutput.DurationFormatSecondsFloat, expected: reportdiff.Cell{Value: 1085}},
+		{format: csvoutput.DurationFormatMinutes, expected: reportdiff.Cell{Value: 18.083}},
+		{format: csvoutput.DurationFormatClock, expected: reportdiff.Cell{Value: 1085, Duration: true}},
+	}
+	require.Len(t, cases, len(csvoutput.DurationFormats()))
+	for _, tc := range cases {
+		newReport := write(tc.format, 1085)
+		tc.expected.Key, tc.expected.DistanceRange = []string{"09:00"}, "0-1 km"
+		assert.Equal(t, tc.expected, newReport.Cells[0], tc.format)
+
+		changes, err := reportdiff.Compare(write(tc.format, 1000), newReport, 0.1)
+		require.NoError(t, err, tc.format)
+		relative, ok := changes[0].Relative()
+		assert.True(t, ok, tc.format)
+		assert.InDelta(t, 0.085, relative, 1e-4, tc.format)
+	}
+
+	report, err := reportdiff.ReadCSV(strings.NewReader("Time of Day,1 km,2 km\n00:00,-00:01:05,100:00:00\n"))
+	require.NoError(t, err)
+	assert.Equal(t, -65.0, report.Cells[0].Value)
+	assert.Equal(t, 360000.0, report.Cells[1].Value)
+	_, err = reportdiff.ReadCSV(strings.NewReader("Time of Day,1 km\n00:00,00:60:00\n"))
+	assert.EqualError(t, err, `invalid value of 00:00 1 km: "00:60:00" is neither a duration nor a number`)
+}
+
+func TestCompare(t *testing.T) {
+	t.Parallel()
+	oldReport := mustReadCSV(t, `Pickup Zone,Time of Day,1 km,2 km
+airport,00:00,1m40s,0s
+downtown,00:00,10s,10s
+`)
+	newReport := mustReadCSV(t, `Pickup Zone,Time of Day,1 km,2 km
+airport,00:00,1m50s,5s
+suburbs,00:00,20s,0s
+`)
+	changes, err := reportdiff.Compare(oldReport, newReport, 0.1)
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	require.NoError(t, reportdiff.WriteCSV(buf, newReport.KeyColumns, changes))
+
+	// 10% change doesn't exceed the 10% threshold, a change from zero and missing cells exceed it.
+	expected := `Pickup Zone,Time of Day,Distance Range,Old,New,Change,Relative Change,Exceeds Threshold
+airport,00:00,1 km,1m40s,1m50s,+10s,+10.00%,false
+airport,00:00,2 km,0s,5s,+5s,,true
+suburbs,00:00,1 km,,20s,,,true
+suburbs,00:00,2 km,,0s,,,true
+downtown,00:00,1 km,10s,,,,true
+downtown,00:00,2 km,10s,,,,true
+`
+	assert.Equal(t, expected, buf.String())
+
+	changes, err = reportdiff.Compare(oldReport, newReport, 0.05)
+	require.NoError(t, err)
+	assert.True(t, changes[0].Exceeds)
+	relative, ok := changes[0].Relative()
+	assert.True(t, ok)
+	assert.InDelta(t, 0.1, relative, 1e-9)
+
+	_, err = reportdiff.Compare(oldReport, mustReadCSV(t, "Time of Day,1 km\n00:00,1s\n"), 0.1)
+	assert.EqualError(t, err, "reports have different columns: Pickup Zone,Time of Day and Time of Day")
+}
+
+func TestCompare_Numbers(t *testing.T) {
+	t.Parallel()
+	oldReport := mustReadCSV(t, "Time of Day,1 km,2 km\n00:00,12.1,20\n")
+	newReport := mustReadCSV(t, "Time of Day,1 km,2 km\n00:00,13.474,19.5\n")
+	changes, err := reportdiff.Compare(oldReport, newReport, 0.1)
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	require.NoError(t, reportdiff.WriteCSV(buf, newReport.KeyColumns, changes))
+
+	expected := `Time of Day,Distance Range,Old,New,Change,Relative Change,Exceeds Threshold
+00:00,1 km,12.1,13.474,+1.374,+11.36%,true
+00:00,2 km,20,19.5,-0.5,-2.50%,false
+`
+	assert.Equal(t, expected, buf.String())
+
+	_, err = reportdiff.Compare(oldReport, mustReadCSV(t, "Time of Day,1 km\n00:00,13s\n"), 0.1)
+	assert.EqualError(t, err, "00:00 1 km is a duration in one report and a number in the other, "+
+		"reports must be written in the same duration format")
+}
+
+func mustReadCSV(t *testing.T, content string) *reportdiff.Report {
+	report, err := reportdiff.ReadCSV(strings.NewReader(content))
+	require.NoError(t, err)
+	return report
+}
@@ -0,0 +1,74 @@
+package ride
+
+import (
+	"sync"
+)
+
+// BatchSize is the maximum number of items in a batch.
+const BatchSize = 512
+
+// Batch is a group of rows passed between the pipeline stages at once,
+// so a channel operation isn't needed for each row. Batches are reused through a pool,
+// a batch and its rows must not be used after it's released.
+type Batch struct {
+	Rows []Row
+	// Chunk is the sequence number of the input file chunk the rows come from, a batch never mixes chunks.
+	Chunk int
+	// ChunkEnd marks the last batch of the chunk, it can be empty.
+	ChunkEnd bool
+}
+
+var batchPool = sync.Pool{
+	New: func() interface{} {
+		return &Batch{Rows: make([]Row, 0, BatchSize)}
+	},
+}
+
+// NewBatch returns an empty batch from the pool.
+func NewBatch() *Batch {
+	return batchPool.Get().(*Batch)
+}
+
+// Full reports whether the batch reached BatchSize rows.
+func (b *Batch) Full() bool {
+	return len(b.Rows) >= BatchSize
+}
+
+// Release returns the batch to the pool.
+func (b *Batch) Release() {
+	b.Rows = b.Rows[:0]
+	b.Chunk, b.ChunkEnd = 0, false
+	batchPool.Put(b)
+}
+
+// DataBatch is a group of rides data passed to the aggregation stage at once, it's reused through a pool like Batch.
+type DataBatch struct {
+	Rides []Data
+	// Chunk is the sequence number of the input file chunk the rides come from, a batch never mixes chunks.
+	Chunk int
+	// ChunkEnd marks the last batch of the chunk, all rides of the chunk are sent before or with it.
+	ChunkEnd bool
+}
+
+var dataBatchPool = sync.Pool{
+	New: func() interface{} {
+		return &DataBatch{Rides: make([]Data, 0, BatchSize)}
+	},
+}
+
+// NewDataBatch returns an empty rides data batch from the pool.
+func NewDataBatch() *DataBatch {
+	return dataBatchPool.Get().(*DataBatch)
+}
+
+// Full reports whether the batch reached BatchSize rides.
+func (b *DataBatch) Full() bool {
+	return len(b.Rides) >= BatchSize
+}
+
+// Release returns the batch to the pool.
+func (b *DataBatch) Release() {
+	b.Rides = b.Rides[:0]
+	b.Chunk, b.ChunkEnd = 0, false
+	dataBatchPool.Put(b)
+}
@@ -2,23 +2,133 @@ package ride
 
 import (
 	"math"
+
+	"github.com/pkg/errors"
 )
 
-const earthRadius float64 = 6378100
+// DistanceCalculator calculates the distance in meters between two points given by lat and lng in degrees.
+type DistanceCalculator interface {
+	Distance(lat1, lng1, lat2, lng2 float64) float64
+}
 
-func hsin(theta float64) float64 {
-	return math.Pow(math.Sin(theta/2), 2)
+const (
+	DistanceHaversine       = "haversine"
+	DistanceVincenty        = "vincenty"
+	DistanceEquirectangular = "equirectangular"
+)
+
+// NewDistanceCalculator returns the distance calculator by its name.
+func NewDistanceCalculator(name string) (DistanceCalculator, error) {
+	switch name {
+	case DistanceHaversine:
+		return Haversine{}, nil
+	case DistanceVincenty:
+		return Vincenty{}, nil
+	case DistanceEquirectangular:
+		return Equirectangular{}, nil
+	default:
+		return nil, errors.Errorf("unknown distance calculator: %s", name)
+	}
 }
 
+const (
+	// meanEarthRadius is the mean radius of the WGS-84 ellipsoid: (2a + b) / 3.
+	meanEarthRadius = 6371008.8
+
+	// WGS-84 ellipsoid parameters.
+	wgs84SemiMajorAxis  = 6378137.0
+	wgs84Flattening     = 1 / 298.257223563
+	wgs84SemiMinorAxis  = wgs84SemiMajorAxis * (1 - wgs84Flattening)
+	vincentyMaxIters    = 200
+	vincentyConvergence = 1e-12
+)
+
+func toRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// Haversine is the great-circle distance on a sphere with the mean Earth radius.
+// The error compared to the ellipsoid is up to about 0.6%, it's the biggest along meridians near the equator.
 // Implementation taken from https://gist.github.com/cdipaolo/d3f8db3848278b49db68
-func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
-	var la1, lo1, la2, lo2 float64
-	la1 = lat1 * math.Pi / 180
-	lo1 = lon1 * math.Pi / 180
-	la2 = lat2 * math.Pi / 180
-	lo2 = lon2 * math.Pi / 180
+type Haversine struct{}
+
+func (Haversine) Distance(lat1, lng1, lat2, lng2 float64) float64 {
+	la1, lo1 := toRadians(lat1), toRadians(lng1)
+	la2, lo2 := toRadians(lat2), toRadians(lng2)
 
 	h := hsin(la2-la1) + math.Cos(la1)*math.Cos(la2)*hsin(lo2-lo1)
 
-	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+	return 2 * meanEarthRadius * math.Asin(math.Sqrt(h))
+}
+
+func hsin(theta float64) float64 {
+	return math.Pow(math.Sin(theta/2), 2)
+}
+
+// Vincenty is the geodesic distance on the WGS-84 ellipsoid calculated by the Vincenty's inverse formula.
+// It's accurate to less than a millimeter, but is several times slower than Haversine.
+// For nearly antipodal points the formula doesn't converge and Haversine is used instead.
+type Vincenty struct{}
+
+func (Vincenty) Distance(lat1, lng1, lat2, lng2 float64) float64 {
+	const f = wgs84Flattening
+	l := toRadians(lng2 - lng1)
+	u1 := math.Atan((1 - f) * math.Tan(toRadians(lat1)))
+	u2 := math.Atan((1 - f) * math.Tan(toRadians(lat2)))
+	sinU1, cosU1 := math.Sincos(u1)
+	sinU2, cosU2 := math.Sincos(u2)
+
+	lambda := l
+	for i := 0; i < vincentyMaxIters; i++ {
+		sinLambda, cosLambda := math.Sincos(lambda)
+		sinSigma := math.Hypot(cosU2*sinLambda, cosU1*sinU2-sinU1*cosU2*cosLambda)
+		if sinSigma == 0 {
+			// Coincident points.
+			return 0
+		}
+		cosSigma := sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma := math.Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cosSqAlpha := 1 - sinAlpha*sinAlpha
+		cos2SigmaM := 0.0
+		if cosSqAlpha != 0 {
+			// Both points aren't on the equator.
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha
+		}
+		c := f / 16 * cosSqAlpha * (4 + f*(4-3*cosSqAlpha))
+		prevLambda := lambda
+		lambda = l + (1-c)*f*sinAlpha*
+			(sigma+c*sinSigma*(cos2SigmaM+c*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+		if math.Abs(lambda-prevLambda) > vincentyConvergence {
+			continue
+		}
+
+		const a, b = wgs84SemiMajorAxis, wgs84SemiMinorAxis
+		uSq := cosSqAlpha * (a*a - b*b) / (b * b)
+		bigA := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+		bigB := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+		deltaSigma := bigB * sinSigma * (cos2SigmaM + bigB/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+			bigB/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+		return b * bigA * (sigma - deltaSigma)
+	}
+	return Haversine{}.Distance(lat1, lng1, lat2, lng2)
+}
+
+// Equirectangular approximates the distance by projecting the points on a plane with the mean Earth radius.
+// It's the fastest one and is accurate enough for the short distances between consecutive ride points,
+// but the error grows with the distance and near the poles.
+type Equirectangular struct{}
+
+func (Equirectangular) Distance(lat1, lng1, lat2, lng2 float64) float64 {
+	la1, la2 := toRadians(lat1), toRadians(lat2)
+	dLng := toRadians(lng2 - lng1)
+	// Take the shorter way around the antimeridian.
+	if dLng > math.Pi {
+		dLng -= 2 * math.Pi
+	} else if dLng < -math.Pi {
+		dLng += 2 * math.Pi
+	}
+	x := dLng * math.Cos((la1+la2)/2)
+	y := la2 - la1
+	return meanEarthRadius * math.Hypot(x, y)
 }
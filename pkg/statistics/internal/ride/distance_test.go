@@ -0,0 +1,100 @@
+package ride_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+)
+
+// knownDistances are geodesic distances on the WGS-84 ellipsoid.
+var knownDistances = []struct {
+	name                   string
+	lat1, lng1, lat2, lng2 float64
+	distance               float64
+}{
+	{
+		// The test line from the Vincenty's paper.
+		name: "Flinders Peak to Buninyong",
+		lat1: -(37 + 57/60.0 + 3.72030/3600), lng1: 144 + 25/60.0 + 29.52440/3600,
+		lat2: -(37 + 39/60.0 + 10.15610/3600), lng2: 143 + 55/60.0 + 35.38390/3600,
+		distance: 54972.271,
+	},
+	{name: "one degree along the equator", lat1: 0, lng1: 0, lat2: 0, lng2: 1, distance: 111319.491},
+	{name: "one degree along the meridian", lat1: 0, lng1: 0, lat2: 1, lng2: 0, distance: 110574.389},
+	{name: "equator to the pole", lat1: 0, lng1: 0, lat2: 90, lng2: 0, distance: 10001965.729},
+	{name: "same point", lat1: 37.966660, lng1: 23.728308, lat2: 37.966660, lng2: 23.728308, distance: 0},
+}
+
+func TestDistanceCalculators(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name string
+		// relativeError is the max error relative to the known distance.
+		relativeError float64
+		// shortDistanceError is the max error in meters for the Flinders Peak to Buninyong distance.
+		shortDistanceError float64
+	}{
+		{name: ride.DistanceVincenty, relativeError: 1e-8, shortDistanceError: 0.001},
+		{name: ride.DistanceHaversine, relativeError: 0.006, shortDistanceError: 200},
+		{name: ride.DistanceEquirectangular, relativeError: 0.006, shortDistanceError: 200},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			calculator, err := ride.NewDistanceCalculator(tc.name)
+			require.NoError(t, err)
+			for _, kd := range knownDistances {
+				actual := calculator.Distance(kd.lat1, kd.lng1, kd.lat2, kd.lng2)
+				assert.InDelta(t, kd.distance, actual, kd.distance*tc.relativeError, kd.name)
+				reversed := calculator.Distance(kd.lat2, kd.lng2, kd.lat1, kd.lng1)
+				assert.InDelta(t, actual, reversed, 1e-6, "%s reversed", kd.name)
+			}
+			flinders := knownDistances[0]
+			actual := calculator.Distance(flinders.lat1, flinders.lng1, flinders.lat2, flinders.lng2)
+			assert.InDelta(t, flinders.distance, actual, tc.shortDistanceError)
+		})
+	}
+}
+
+func TestVincenty_Antipodal(t *testing.T) {
+	t.Parallel()
+	actual := ride.Vincenty{}.Distance(0, 0, 0.5, 179.7)
+	expected := ride.Haversine{}.Distance(0, 0, 0.5, 179.7)
+	assert.False(t, math.IsNaN(actual))
+	assert.InDelta(t, expected, actual, expected*0.005)
+}
+
+func TestEquirectangular_Antimeridian(t *testing.T) {
+	t.Parallel()
+	actual := ride.Equirectangular{}.Distance(0, 179.5, 0, -179.5)
+	expected := ride.Haversine{}.Distance(0, 179.5, 0, -179.5)
+	assert.InDelta(t, expected, actual, 1e-6)
+}
+
+func TestNewDistanceCalculator_Unknown(t *testing.T) {
+	t.Parallel()
+	_, err := ride.NewDistanceCalculator("manhattan")
+	assert.EqualError(t, err, "unknown distance calculator: manhattan")
+}
+
+// BenchmarkDistanceCalculators measures the distance between consecutive ride points.
+func BenchmarkDistanceCalculators(b *testing.B) {
+	for _, name := range []string{ride.DistanceHaversine, ride.DistanceVincenty, ride.DistanceEquirectangular} {
+		calculator, err := ride.NewDistanceCalculator(name)
+		require.NoError(b, err)
+		b.Run(name, func(b *testing.B) {
+			var sum float64
+			for i := 0; i < b.N; i++ {
+				sum += calculator.Distance(37.966660, 23.728308, 37.966627, 23.728263+float64(i%10)*1e-5)
+			}
+			benchmarkSink = sum
+		})
+	}
+}
+
+var benchmarkSink float64
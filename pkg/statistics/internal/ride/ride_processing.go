@@ -3,13 +3,25 @@ package ride
 import (
 	"log"
 	"sync"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/metrics"
 )
 
+// Data is the ride data calculated from its rows. Distance is in meters, duration in seconds and speeds in m/s.
 type Data struct {
 	RideID   int
 	StartTs  int
+	EndTs    int
 	Distance int
 	Duration int
+	StartLat float64
+	StartLng float64
+	EndLat   float64
+	EndLng   float64
+	Points   int
+	// MaxSpeed is the max speed between consecutive points, points with the same timestamp are skipped.
+	MaxSpeed float64
+	AvgSpeed float64
 }
 
 type Row struct {
@@ -19,13 +31,15 @@ type Row struct {
 	Timestamp int
 }
 
-func StartRidesProcessors(ins []chan *Row, out chan<- *Data) func() {
+func StartRidesProcessors(ins []chan *Batch, out chan<- *DataBatch, distance DistanceCalculator,
+	m *metrics.Pipeline,
+) func() {
 	wg := &sync.WaitGroup{}
 	wg.Add(len(ins))
 	for _, in := range ins {
-		go func(in <-chan *Row) {
+		go func(in <-chan *Batch) {
 			defer wg.Done()
-			processRides(in, out)
+			processRides(in, out, distance, m)
 		}(in)
 	}
 	return func() {
@@ -34,35 +48,103 @@ func StartRidesProcessors(ins []chan *Row, out chan<- *Data) func() {
 	}
 }
 
-func processRides(in <-chan *Row, out chan<- *Data) {
+func processRides(in <-chan *Batch, out chan<- *DataBatch, distance DistanceCalculator, m *metrics.Pipeline) {
 	var (
-		lastRow     *Row
-		currentRide *Data
+		// lastRow is a copy, because the batch it comes from is released after processing.
+		lastRow        Row
+		hasLastRow     bool
+		currentRide    Data
+		hasCurrentRide bool
+		outBatch       *DataBatch
 	)
-	for row := range in {
-		if 0 > row.Lat || row.Lat > 90 || 0 > row.Lng || row.Lng > 90 {
-			log.Printf("Input row contains invlide lat or lng: %+v", row)
-			continue
+	flush := func() {
+		if outBatch == nil {
+			return
+		}
+		ridesNo := len(outBatch.Rides)
+		out <- outBatch
+		m.AddRidesEmitted(ridesNo)
+		outBatch = nil
+	}
+	chunk := 0
+	newOutBatch := func() {
+		if outBatch == nil {
+			outBatch = NewDataBatch()
+			outBatch.Chunk = chunk
 		}
-		if lastRow != nil {
-			if lastRow.RideID == row.RideID {
-				if currentRide == nil {
-					currentRide = &Data{
-						RideID:  lastRow.RideID,
-						StartTs: lastRow.Timestamp,
+	}
+	emit := func(data Data) {
+		if data.Duration > 0 {
+			data.AvgSpeed = float64(data.Distance) / float64(data.Duration)
+		}
+		newOutBatch()
+		outBatch.Rides = append(outBatch.Rides, data)
+		if outBatch.Full() {
+			flush()
+		}
+	}
+	// finishRide emits the last ride, rides never continue in the next chunk or after the input end.
+	finishRide := func() {
+		if hasCurrentRide {
+			emit(currentRide)
+		} else if hasLastRow {
+			m.AddDropped(metrics.DropReasonSinglePoint, 1)
+		}
+		hasCurrentRide, hasLastRow = false, false
+	}
+	for batch := range in {
+		chunk = batch.Chunk
+		for i := range batch.Rows {
+			row := &batch.Rows[i]
+			if 0 > row.Lat || row.Lat > 90 || 0 > row.Lng || row.Lng > 90 {
+				log.Printf("Input row contains invlide lat or lng: %+v", *row)
+				m.AddDropped(metrics.DropReasonInvalidCoordinates, 1)
+				continue
+			}
+			if hasLastRow {
+				if lastRow.RideID == row.RideID {
+					if !hasCurrentRide {
+						currentRide = Data{
+							RideID:   lastRow.RideID,
+							StartTs:  lastRow.Timestamp,
+							StartLat: lastRow.Lat,
+							StartLng: lastRow.Lng,
+							Points:   1,
+						}
+						hasCurrentRide = true
 					}
+					elapsed := row.Timestamp - lastRow.Timestamp
+					segment := int(distance.Distance(row.Lat, row.Lng, lastRow.Lat, lastRow.Lng))
+					currentRide.Duration += elapsed
+					currentRide.Distance += segment
+					if elapsed > 0 {
+						if speed := float64(segment) / float64(elapsed); speed > currentRide.MaxSpeed {
+							currentRide.MaxSpeed = speed
+						}
+					}
+					currentRide.EndTs = row.Timestamp
+					currentRide.EndLat, currentRide.EndLng = row.Lat, row.Lng
+					currentRide.Points++
+				} else if hasCurrentRide {
+					emit(currentRide)
+					hasCurrentRide = false
+				} else {
+					// The previous ride consists of a single row, there is no distance and duration to calculate.
+					m.AddDropped(metrics.DropReasonSinglePoint, 1)
 				}
-				currentRide.Duration += row.Timestamp - lastRow.Timestamp
-				currentRide.Distance += int(calculateDistance(row.Lat, row.Lng, lastRow.Lat, lastRow.Lng))
-			} else if currentRide != nil {
-				out <- currentRide
-				currentRide = nil
 			}
+			lastRow = *row
+			hasLastRow = true
+		}
+		chunkEnd := batch.ChunkEnd
+		batch.Release()
+		if chunkEnd {
+			finishRide()
+			newOutBatch()
+			outBatch.ChunkEnd = true
+			flush()
 		}
-		lastRow = row
-	}
-	if currentRide != nil {
-		out <- currentRide
-		currentRide = nil
 	}
+	finishRide()
+	flush()
 }
@@ -11,37 +11,108 @@ import (
 
 func TestStartRidesProcessors(t *testing.T) {
 	t.Parallel()
-	input := []*ride.Row{
+	input := []ride.Row{
 		{RideID: 1, Lat: 37.966660, Lng: 23.728308, Timestamp: 1405594957},
 		{RideID: 1, Lat: 37.967660, Lng: 23.727308, Timestamp: 1405594967},
 		{RideID: 1, Lat: 37.968660, Lng: 23.726308, Timestamp: 1405594977},
 		{RideID: 2, Lat: 37.966660, Lng: 23.728308, Timestamp: 1405594957},
 		{RideID: 3, Lat: 37.966660, Lng: 23.728308, Timestamp: 1405594957},
 		{RideID: 3, Lat: 37.966760, Lng: 23.727308, Timestamp: 1405594958},
+		// The ride speeds up and the last point is duplicated.
+		{RideID: 4, Lat: 37.966660, Lng: 23.728308, Timestamp: 1405595000},
+		{RideID: 4, Lat: 37.967660, Lng: 23.727308, Timestamp: 1405595010},
+		{RideID: 4, Lat: 37.968660, Lng: 23.726308, Timestamp: 1405595015},
+		{RideID: 4, Lat: 37.968660, Lng: 23.726308, Timestamp: 1405595015},
 	}
-	inChan := make(chan *ride.Row, len(input))
-	for _, ir := range input {
-		inChan <- ir
+	// Rows of the first ride are split between batches.
+	inChan := make(chan *ride.Batch, 2)
+	for _, rows := range [][]ride.Row{input[:2], input[2:]} {
+		batch := ride.NewBatch()
+		batch.Rows = append(batch.Rows, rows...)
+		inChan <- batch
 	}
 	close(inChan)
 
-	outChan := make(chan *ride.Data)
-	var actual []*ride.Data
+	outChan := make(chan *ride.DataBatch)
+	var actual []ride.Data
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		for rd := range outChan {
-			actual = append(actual, rd)
+		for batch := range outChan {
+			actual = append(actual, batch.Rides...)
+			batch.Release()
 		}
 	}()
-	wait := ride.StartRidesProcessors([]chan *ride.Row{inChan}, outChan)
+	wait := ride.StartRidesProcessors([]chan *ride.Batch{inChan}, outChan, ride.Haversine{}, nil)
 	wait()
 	wg.Wait()
 
-	expected := []*ride.Data{
-		{RideID: 1, StartTs: 1405594957, Distance: 282, Duration: 20},
-		{RideID: 3, StartTs: 1405594957, Distance: 88, Duration: 1},
+	expected := []ride.Data{
+		{
+			RideID: 1, StartTs: 1405594957, EndTs: 1405594977, Distance: 282, Duration: 20,
+			StartLat: 37.966660, StartLng: 23.728308, EndLat: 37.968660, EndLng: 23.726308,
+			Points: 3, MaxSpeed: 14.1, AvgSpeed: 14.1,
+		},
+		{
+			RideID: 3, StartTs: 1405594957, EndTs: 1405594958, Distance: 88, Duration: 1,
+			StartLat: 37.966660, StartLng: 23.728308, EndLat: 37.966760, EndLng: 23.727308,
+			Points: 2, MaxSpeed: 88, AvgSpeed: 88,
+		},
+		{
+			RideID: 4, StartTs: 1405595000, EndTs: 1405595015, Distance: 282, Duration: 15,
+			StartLat: 37.966660, StartLng: 23.728308, EndLat: 37.968660, EndLng: 23.726308,
+			Points: 4, MaxSpeed: 28.2, AvgSpeed: 18.8,
+		},
+	}
+	assert.Equal(t, expected, actual)
+}
+
+func TestStartRidesProcessors_Chunks(t *testing.T) {
+	t.Parallel()
+	inChan := make(chan *ride.Batch, 3)
+	for i, rows := range [][]ride.Row{
+		{
+			{RideID: 1, Lat: 37.966660, Lng: 23.728308, Timestamp: 1405594957},
+			{RideID: 1, Lat: 37.967660, Lng: 23.727308, Timestamp: 1405594967},
+		},
+		// A chunk without rides.
+		nil,
+		{
+			{RideID: 2, Lat: 37.966660, Lng: 23.728308, Timestamp: 1405594957},
+			{RideID: 2, Lat: 37.966760, Lng: 23.727308, Timestamp: 1405594958},
+		},
+	} {
+		batch := ride.NewBatch()
+		batch.Rows = append(batch.Rows, rows...)
+		batch.Chunk, batch.ChunkEnd = i, true
+		inChan <- batch
+	}
+	close(inChan)
+
+	outChan := make(chan *ride.DataBatch, 3)
+	wait := ride.StartRidesProcessors([]chan *ride.Batch{inChan}, outChan, ride.Haversine{}, nil)
+	wait()
+
+	type chunkRides struct {
+		chunk    int
+		chunkEnd bool
+		rideIDs  []int
+	}
+	var actual []chunkRides
+	for batch := range outChan {
+		cr := chunkRides{chunk: batch.Chunk, chunkEnd: batch.ChunkEnd}
+		for _, data := range batch.Rides {
+			cr.rideIDs = append(cr.rideIDs, data.RideID)
+		}
+		actual = append(actual, cr)
+		batch.Release()
+	}
+	// Rides are finished at the chunk end without waiting for a row of the next ride.
+	expected := []chunkRides{
+		{chunk: 0, chunkEnd: true, rideIDs: []int{1}},
+		{chunk: 1, chunkEnd: true},
+		{chunk: 2, chunkEnd: true, rideIDs: []int{2}},
 	}
 	assert.Equal(t, expected, actual)
 }
@@ -0,0 +1,255 @@
+package rideexport
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+)
+
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// Writer writes rides data in one of the export formats. Flush must be called after the last ride.
+type Writer interface {
+	Write(data *ride.Data) error
+	Flush() error
+}
+
+func NewWriter(w io.Writer, format string) (Writer, error) {
+	switch format {
+	case FormatCSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	case FormatNDJSON:
+		bw := bufio.NewWriter(w)
+		return &ndjsonWriter{w: bw, encoder: json.NewEncoder(bw)}, nil
+	default:
+		return nil, errors.Errorf("unknown rides export format: %s", format)
+	}
+}
+
+// record is a single exported ride, field names are the CSV header and the JSON keys.
+type record struct {
+	RideID   int     `json:"ride_id"`
+	StartTs  int     `json:"start_ts"`
+	EndTs    int     `json:"end_ts"`
+	Duration int     `json:"duration"`
+	Distance int     `json:"distance"`
+	Points   int     `json:"points"`
+	StartLat float64 `json:"start_lat"`
+	StartLng float64 `json:"start_lng"`
+	EndLat   float64 `json:"end_lat"`
+	EndLng   float64 `json:"end_lng"`
+	MaxSpeed float64 `json:"max_speed"`
+	AvgSpeed float64 `json:"avg_speed"`
+}
+
+var csvHeader = []string{
+	"ride_id", "start_ts", "end_ts", "duration", "distance", "points",
+	"start_lat", "start_lng", "end_lat", "end_lng", "max_speed", "avg_speed",
+}
+
+type csvWriter struct {
+	w             *csv.Writer
+	headerWritten bool
+	records       []string
+}
+
+func (cw *csvWriter) writeHeader() error {
+	if cw.headerWritten {
+		return nil
+	}
+	cw.headerWritten = true
+	return errors.Wrap(cw.w.Write(csvHeader), "can't write rides csv header")
+}
+
+func (cw *csvWriter) Write(data *ride.Data) error {
+	if err := cw.writeHeader(); err != nil {
+		return err
+	}
+	formatFloat := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	cw.records = append(cw.records[:0],
+		strconv.Itoa(data.RideID), strconv.Itoa(data.StartTs), strconv.Itoa(data.EndTs),
+		strconv.Itoa(data.Duration), strconv.Itoa(data.Distance), strconv.Itoa(data.Points),
+		formatFloat(data.StartLat), formatFloat(data.StartLng), formatFloat(data.EndLat), formatFloat(data.EndLng),
+		formatFloat(data.MaxSpeed), formatFloat(data.AvgSpeed),
+	)
+	return errors.Wrap(cw.w.Write(cw.records), "can't write ride to csv")
+}
+
+func (cw *csvWriter) Flush() error {
+	// The header is written even if there are no rides.
+	if err := cw.writeHeader(); err != nil {
+		return err
+	}
+	cw.w.Flush()
+	return errors.Wrap(cw.w.Error(), "can't write rides to csv")
+}
+
+type ndjsonWriter struct {
+	w       *bufio.Writer
+	encoder *json.Encoder
+}
+
+func (nw *ndjsonWriter) Write(data *ride.Data) error {
+	r := record{
+		RideID:   data.RideID,
+		StartTs:  data.StartTs,
+		EndTs:    data.EndTs,
+		Duration: data.Duration,
+		Distance: data.Distance,
+		Points:   data.Points,
+		StartLat: data.StartLat,
+		StartLng: data.StartLng,
+		EndLat:   data.EndLat,
+		EndLng:   data.EndLng,
+		MaxSpeed: data.MaxSpeed,
+		AvgSpeed: data.AvgSpeed,
+	}
+	// Encode terminates each value with a newline.
+	return errors.Wrap(nw.encoder.Encode(r), "can't write ride to ndjson")
+}
+
+func (nw *ndjsonWriter) Flush() error {
+	return errors.Wrap(nw.w.Flush(), "can't write rides to ndjson")
+}
+
+// StartDump starts a stage that writes each ride from the in channel into the file and passes its batch
+// to the out channel. The out channel is closed when the in channel is closed.
+// The returned function waits for the stage to finish and returns the first writing error,
+// after an error the stage keeps passing batches, so the pipeline isn't blocked.
+func StartDump(in <-chan *ride.DataBatch, out chan<- *ride.DataBatch, filePath, format string,
+) (func() error, error) {
+	return start(in, out, filePath, format, false, nil)
+}
+
+// StartExport starts a stage that writes each ride from the in channel into the file.
+// If ordered is true rides are written in the input file order restored from the batches chunk numbers,
+// otherwise they are written as soon as they are received.
+// In the ordered mode a value is received from the window after each chunk is written if the window isn't nil,
+// so the readers sharing the window (see fileread.Config.Window) bound the batches kept for reordering.
+// The returned function waits for the stage to finish and returns the first writing error.
+func StartExport(in <-chan *ride.DataBatch, filePath, format string, ordered bool, window <-chan struct{},
+) (func() error, error) {
+	return start(in, nil, filePath, format, ordered, window)
+}
+
+func start(in <-chan *ride.DataBatch, out chan<- *ride.DataBatch, filePath, format string, ordered bool,
+	window <-chan struct{},
+) (func() error, error) {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create rides file")
+	}
+	w, err := NewWriter(f, format)
+	if err != nil {
+		f.Close() // nolint: errcheck, gosec
+		return nil, errors.WithStack(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		if out != nil {
+			defer close(out)
+		}
+		var writeErr error
+		write := func(batch *ride.DataBatch) {
+			for i := range batch.Rides {
+				if writeErr != nil {
+					break
+				}
+				writeErr = w.Write(&batch.Rides[i])
+			}
+			if out != nil {
+				out <- batch
+			} else {
+				batch.Release()
+			}
+		}
+		r := &reorderer{pending: make(map[int][]*ride.DataBatch), finished: make(map[int]bool), window: window}
+		for batch := range in {
+			if ordered {
+				r.add(batch, write)
+			} else {
+				write(batch)
+			}
+		}
+		r.flush(write)
+		if writeErr == nil {
+			writeErr = w.Flush()
+		}
+		if closeErr := f.Close(); writeErr == nil && closeErr != nil {
+			writeErr = errors.Wrap(closeErr, "can't close rides file")
+		}
+		done <- writeErr
+	}()
+	return func() error {
+		return errors.WithStack(<-done)
+	}, nil
+}
+
+// reorderer restores the input file order of batches from different channels by their chunk numbers.
+// Batches of a single chunk are always in order, since a chunk is read and processed by a single pipeline worker.
+// Batches of the next chunk in order are passed right away, the others are kept until their chunk is next.
+type reorderer struct {
+	next     int
+	pending  map[int][]*ride.DataBatch
+	finished map[int]bool
+	// window receives a value each time a chunk is passed if it isn't nil.
+	window <-chan struct{}
+}
+
+func (r *reorderer) add(batch *ride.DataBatch, pass func(batch *ride.DataBatch)) {
+	if batch.Chunk != r.next {
+		r.pending[batch.Chunk] = append(r.pending[batch.Chunk], batch)
+		if batch.ChunkEnd {
+			r.finished[batch.Chunk] = true
+		}
+		return
+	}
+	// The batch might be released by pass, so it isn't accessed afterwards.
+	chunkEnd := batch.ChunkEnd
+	pass(batch)
+	if !chunkEnd {
+		return
+	}
+	for {
+		r.next++
+		if r.window != nil {
+			<-r.window
+		}
+		for _, pending := range r.pending[r.next] {
+			pass(pending)
+		}
+		delete(r.pending, r.next)
+		if !r.finished[r.next] {
+			return
+		}
+		delete(r.finished, r.next)
+	}
+}
+
+// flush passes the remaining batches in the chunks order, there are none if all chunks are finished.
+func (r *reorderer) flush(pass func(batch *ride.DataBatch)) {
+	chunks := make([]int, 0, len(r.pending))
+	for chunk := range r.pending {
+		chunks = append(chunks, chunk)
+	}
+	sort.Ints(chunks)
+	for _, chunk := range chunks {
+		for _, batch := range r.pending[chunk] {
+			pass(batch)
+		}
+		delete(r.pending, chunk)
+	}
+}
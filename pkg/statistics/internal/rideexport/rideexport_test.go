@@ -0,0 +1,166 @@
+package rideexport_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/rideexport"
+)
+
+var testRides = []ride.Data{
+	{
+		RideID: 1, StartTs: 1405594957, EndTs: 1405594977, Distance: 282, Duration: 20,
+		StartLat: 37.96666, StartLng: 23.728308, EndLat: 37.96866, EndLng: 23.726308,
+		Points: 3, MaxSpeed: 28.2, AvgSpeed: 14.1,
+	},
+	{
+		RideID: 3, StartTs: 1405594957, EndTs: 1405594958, Distance: 88, Duration: 1,
+		StartLat: 37.96666, StartLng: 23.728308, EndLat: 37.96676, EndLng: 23.727308,
+		Points: 2, MaxSpeed: 88, AvgSpeed: 88,
+	},
+}
+
+func TestWriter(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		format   string
+		rides    []ride.Data
+		expected string
+	}{
+		{
+			format: rideexport.FormatCSV,
+			rides:  testRides,
+			expected: `ride_id,start_ts,end_ts,duration,distance,points,start_lat,start_lng,end_lat,end_lng,max_speed,avg_speed
+1,1405594957,1405594977,20,282,3,37.96666,23.728308,37.96866,23.726308,28.2,14.1
+3,1405594957,1405594958,1,88,2,37.96666,23.728308,37.96676,23.727308,88,88
+`,
+		},
+		{
+			format: rideexport.FormatCSV,
+			expected: `ride_id,start_ts,end_ts,duration,distance,points,start_lat,start_lng,end_lat,end_lng,max_speed,avg_speed
+`,
+		},
+		{
+			format: rideexport.FormatNDJSON,
+			rides:  testRides,
+			expected: `{"ride_id":1,"start_ts":1405594957,"end_ts":1405594977,"duration":20,"distance":282,"points":3,` +
+				`"start_lat":37.96666,"start_lng":23.728308,"end_lat":37.96866,"end_lng":23.726308,` +
+				`"max_speed":28.2,"avg_speed":14.1}
+{"ride_id":3,"start_ts":1405594957,"end_ts":1405594958,"duration":1,"distance":88,"points":2,` +
+				`"start_lat":37.96666,"start_lng":23.728308,"end_lat":37.96676,"end_lng":23.727308,` +
+				`"max_speed":88,"avg_speed":88}
+`,
+		},
+	}
+	for _, tc := range cases {
+		buf := &bytes.Buffer{}
+		w, err := rideexport.NewWriter(buf, tc.format)
+		require.NoError(t, err)
+		for i := range tc.rides {
+			require.NoError(t, w.Write(&tc.rides[i]))
+		}
+		require.NoError(t, w.Flush())
+		assert.Equal(t, tc.expected, buf.String(), "format %s, rides %d", tc.format, len(tc.rides))
+	}
+
+	_, err := rideexport.NewWriter(&bytes.Buffer{}, "xml")
+	assert.EqualError(t, err, "unknown rides export format: xml")
+}
+
+func TestStartDump(t *testing.T) {
+	t.Parallel()
+	in := make(chan *ride.DataBatch, len(testRides))
+	for _, data := range testRides {
+		batch := ride.NewDataBatch()
+		batch.Rides = append(batch.Rides, data)
+		in <- batch
+	}
+	close(in)
+	out := make(chan *ride.DataBatch)
+	dir, err := ioutil.TempDir("", "rideexport_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "rides.csv")
+
+	wait, err := rideexport.StartDump(in, out, filePath, rideexport.FormatCSV)
+	require.NoError(t, err)
+	var passed []int
+	for batch := range out {
+		for _, data := range batch.Rides {
+			passed = append(passed, data.RideID)
+		}
+		batch.Release()
+	}
+	require.NoError(t, wait())
+
+	sort.Ints(passed)
+	assert.Equal(t, []int{1, 3}, passed)
+	actual, err := ioutil.ReadFile(filePath)
+	require.NoError(t, err)
+	assert.Equal(t, 3, bytes.Count(actual, []byte("\n")))
+}
+
+func TestStartExport_Ordered(t *testing.T) {
+	t.Parallel()
+	// Batches of different chunks arrive interleaved, the second chunk is empty.
+	batches := []struct {
+		chunk    int
+		chunkEnd bool
+		rideIDs  []int
+	}{
+		{chunk: 2, rideIDs: []int{5}},
+		{chunk: 3, chunkEnd: true, rideIDs: []int{7}},
+		{chunk: 0, rideIDs: []int{1}},
+		{chunk: 1, chunkEnd: true},
+		{chunk: 2, chunkEnd: true, rideIDs: []int{6}},
+		{chunk: 0, chunkEnd: true, rideIDs: []int{2, 3}},
+		{chunk: 4, chunkEnd: true, rideIDs: []int{8}},
+	}
+	in := make(chan *ride.DataBatch, len(batches))
+	for _, b := range batches {
+		batch := ride.NewDataBatch()
+		for _, id := range b.rideIDs {
+			batch.Rides = append(batch.Rides, ride.Data{RideID: id})
+		}
+		batch.Chunk, batch.ChunkEnd = b.chunk, b.chunkEnd
+		in <- batch
+	}
+	close(in)
+	dir, err := ioutil.TempDir("", "rideexport_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "rides.ndjson")
+
+	// A value is received from the window for each of the 5 chunks.
+	window := make(chan struct{}, 6)
+	for i := 0; i < cap(window); i++ {
+		window <- struct{}{}
+	}
+
+	wait, err := rideexport.StartExport(in, filePath, rideexport.FormatNDJSON, true, window)
+	require.NoError(t, err)
+	require.NoError(t, wait())
+	assert.Len(t, window, 1)
+
+	content, err := ioutil.ReadFile(filePath)
+	require.NoError(t, err)
+	var actual []int
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	for decoder.More() {
+		r := struct {
+			RideID int `json:"ride_id"`
+		}{}
+		require.NoError(t, decoder.Decode(&r))
+		actual = append(actual, r.RideID)
+	}
+	assert.Equal(t, []int{1, 2, 3, 5, 6, 7, 8}, actual)
+}
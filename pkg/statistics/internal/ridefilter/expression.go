@@ -0,0 +1,272 @@
+package ridefilter
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+)
+
+// fields are the ride data fields available in expressions, the names are the same as in the rides export.
+var fields = map[string]func(data *ride.Data) float64{
+	"ride_id":   func(data *ride.Data) float64 { return float64(data.RideID) },
+	"start_ts":  func(data *ride.Data) float64 { return float64(data.StartTs) },
+	"end_ts":    func(data *ride.Data) float64 { return float64(data.EndTs) },
+	"duration":  func(data *ride.Data) float64 { return float64(data.Duration) },
+	"distance":  func(data *ride.Data) float64 { return float64(data.Distance) },
+	"points":    func(data *ride.Data) float64 { return float64(data.Points) },
+	"start_lat": func(data *ride.Data) float64 { return data.StartLat },
+	"start_lng": func(data *ride.Data) float64 { return data.StartLng },
+	"end_lat":   func(data *ride.Data) float64 { return data.EndLat },
+	"end_lng":   func(data *ride.Data) float64 { return data.EndLng },
+	"max_speed": func(data *ride.Data) float64 { return data.MaxSpeed },
+	"avg_speed": func(data *ride.Data) float64 { return data.AvgSpeed },
+}
+
+var comparisons = map[string]func(a, b float64) bool{
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// Expression is a compiled boolean expression over the ride data fields.
+type Expression struct {
+	match func(data *ride.Data) bool
+}
+
+func (e *Expression) Match(data *ride.Data) bool {
+	return e.match(data)
+}
+
+// ParseExpression compiles an expression like "duration >= 60 && (points > 2 || distance > 1000)".
+// Comparisons (<, <=, >, >=, ==, !=) are between ride data fields and numbers,
+// they are combined with && and || and negated with !, && binds tighter than ||.
+// Fields are ride_id, start_ts, end_ts, duration, distance, points, start_lat, start_lng, end_lat, end_lng,
+// max_speed and avg_speed in the same units as in the rides export.
+func ParseExpression(s string) (*Expression, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid filter expression")
+	}
+	p := &parser{tokens: tokens}
+	match, err := p.parseOr()
+	if err == nil && !p.done() {
+		err = p.errorf("unexpected %q", p.peek().text)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid filter expression")
+	}
+	return &Expression{match: match}, nil
+}
+
+type tokenKind int
+
+const (
+	tokenField tokenKind = iota
+	tokenNumber
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// operators are ordered so that two characters operators are matched first.
+var operators = []string{"&&", "||", "<=", ">=", "==", "!=", "<", ">", "!", "(", ")"}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case isLetter(c):
+			start := i
+			for i < len(s) && (isLetter(s[i]) || isDigit(s[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenField, text: s[start:i], pos: start})
+		case isDigit(c) || c == '.' || c == '-':
+			start := i
+			i++
+			for i < len(s) && (isDigit(s[i]) || s[i] == '.' || s[i] == 'e' || s[i] == 'E' ||
+				(s[i] == '-' || s[i] == '+') && (s[i-1] == 'e' || s[i-1] == 'E')) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: s[start:i], pos: start})
+		default:
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, errors.Errorf("unexpected character %q at position %d", c, i)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// parser is a recursive descent parser, each parse method compiles its rule into a match function.
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) done() bool {
+	return p.pos == len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) accept(op string) bool {
+	if !p.done() && p.peek().kind == tokenOperator && p.peek().text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	pos := -1
+	if !p.done() {
+		pos = p.peek().pos
+	}
+	if pos < 0 {
+		return errors.Errorf(format+" at the end", args...)
+	}
+	return errors.Errorf(format+" at position %d", append(args, pos)...)
+}
+
+// parseOr parses: and { "||" and }.
+func (p *parser) parseOr() (func(data *ride.Data) bool, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(data *ride.Data) bool { return l(data) || right(data) }
+	}
+	return left, nil
+}
+
+// parseAnd parses: unary { "&&" unary }.
+func (p *parser) parseAnd() (func(data *ride.Data) bool, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(data *ride.Data) bool { return l(data) && right(data) }
+	}
+	return left, nil
+}
+
+// parseUnary parses: "!" unary | "(" or ")" | comparison.
+func (p *parser) parseUnary() (func(data *ride.Data) bool, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(data *ride.Data) bool { return !operand(data) }, nil
+	}
+	if p.accept("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.errorf("expected \")\"")
+		}
+		return inner, nil
+	}
+	return p.parseComparison()
+}
+
+// parseComparison parses: value comparison-operator value.
+func (p *parser) parseComparison() (func(data *ride.Data) bool, error) {
+	left, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if p.done() || p.peek().kind != tokenOperator || comparisons[p.peek().text] == nil {
+		return nil, p.errorf("expected comparison operator")
+	}
+	compare := comparisons[p.peek().text]
+	p.pos++
+	right, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return func(data *ride.Data) bool { return compare(left(data), right(data)) }, nil
+}
+
+// parseValue parses a field or a number.
+func (p *parser) parseValue() (func(data *ride.Data) float64, error) {
+	if p.done() {
+		return nil, p.errorf("expected field or number")
+	}
+	t := p.peek()
+	switch t.kind {
+	case tokenField:
+		field, ok := fields[t.text]
+		if !ok {
+			return nil, p.errorf("unknown field %q, known fields: %s", t.text, strings.Join(fieldNames(), ", "))
+		}
+		p.pos++
+		return field, nil
+	case tokenNumber:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", t.text)
+		}
+		p.pos++
+		return func(*ride.Data) float64 { return v }, nil
+	default:
+		return nil, p.errorf("expected field or number, got %q", t.text)
+	}
+}
+
+func fieldNames() []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,143 @@
+package ridefilter
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/metrics"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+)
+
+// Drop reasons of rides rejected by each filter.
+const (
+	ReasonFrom        = "filtered_from"
+	ReasonTo          = "filtered_to"
+	ReasonMinDuration = "filtered_min_duration"
+	ReasonMaxDuration = "filtered_max_duration"
+	ReasonMinDistance = "filtered_min_distance"
+	ReasonMinPoints   = "filtered_min_points"
+	ReasonExpression  = "filtered_expression"
+)
+
+// Config defines which rides are kept, zero fields don't filter rides.
+type Config struct {
+	// From and To is the range of the ride start time, From is inclusive and To is exclusive.
+	From time.Time
+	To   time.Time
+	// MinDuration and MaxDuration are inclusive.
+	MinDuration time.Duration
+	MaxDuration time.Duration
+	// MinDistance is in meters, inclusive.
+	MinDistance float64
+	MinPoints   int
+	// Expression is a boolean expression over the ride data fields, see ParseExpression.
+	Expression string
+}
+
+// IsZero reports whether the config doesn't filter any rides.
+func (c Config) IsZero() bool {
+	return c == Config{}
+}
+
+// Filter checks rides against the conditions of the config, the first failed condition rejects a ride.
+type Filter struct {
+	conditions []condition
+}
+
+type condition struct {
+	reason string
+	match  func(data *ride.Data) bool
+}
+
+func New(cfg Config) (*Filter, error) {
+	if cfg.MinDuration < 0 || cfg.MaxDuration < 0 || cfg.MinDistance < 0 || cfg.MinPoints < 0 {
+		return nil, errors.New("filter min and max values must not be negative")
+	}
+	if !cfg.From.IsZero() && !cfg.To.IsZero() && !cfg.From.Before(cfg.To) {
+		return nil, errors.New("filter from time must be before to time")
+	}
+	if cfg.MaxDuration != 0 && cfg.MinDuration > cfg.MaxDuration {
+		return nil, errors.New("filter min duration must not be greater than max duration")
+	}
+	f := &Filter{}
+	if !cfg.From.IsZero() {
+		from := cfg.From.Unix()
+		f.add(ReasonFrom, func(data *ride.Data) bool { return int64(data.StartTs) >= from })
+	}
+	if !cfg.To.IsZero() {
+		to := cfg.To.Unix()
+		f.add(ReasonTo, func(data *ride.Data) bool { return int64(data.StartTs) < to })
+	}
+	// Ride duration is in whole seconds.
+	if cfg.MinDuration != 0 {
+		minDuration := cfg.MinDuration.Seconds()
+		f.add(ReasonMinDuration, func(data *ride.Data) bool { return float64(data.Duration) >= minDuration })
+	}
+	if cfg.MaxDuration != 0 {
+		maxDuration := cfg.MaxDuration.Seconds()
+		f.add(ReasonMaxDuration, func(data *ride.Data) bool { return float64(data.Duration) <= maxDuration })
+	}
+	if cfg.MinDistance != 0 {
+		f.add(ReasonMinDistance, func(data *ride.Data) bool { return float64(data.Distance) >= cfg.MinDistance })
+	}
+	if cfg.MinPoints != 0 {
+		f.add(ReasonMinPoints, func(data *ride.Data) bool { return data.Points >= cfg.MinPoints })
+	}
+	if cfg.Expression != "" {
+		expr, err := ParseExpression(cfg.Expression)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		f.add(ReasonExpression, expr.Match)
+	}
+	return f, nil
+}
+
+func (f *Filter) add(reason string, match func(data *ride.Data) bool) {
+	f.conditions = append(f.conditions, condition{reason: reason, match: match})
+}
+
+// Check returns whether the ride passes the filter and the drop reason of the failed condition if it doesn't.
+func (f *Filter) Check(data *ride.Data) (string, bool) {
+	for _, c := range f.conditions {
+		if !c.match(data) {
+			return c.reason, false
+		}
+	}
+	return "", true
+}
+
+// Start starts a stage that removes rejected rides from batches of the in channel and passes the batches
+// to the out channel, rejected rides are counted as dropped by the filter reason.
+// Batches are passed even if all their rides are rejected, so chunk ends reach the next stage.
+// The stage is a single goroutine to keep the order of batches,
+// the out channel is closed when the in channel is closed.
+func Start(in <-chan *ride.DataBatch, out chan<- *ride.DataBatch, f *Filter, m *metrics.Pipeline) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(out)
+		rejected := make(map[string]int)
+		for batch := range in {
+			kept := batch.Rides[:0]
+			for i := range batch.Rides {
+				reason, ok := f.Check(&batch.Rides[i])
+				if !ok {
+					rejected[reason]++
+					continue
+				}
+				kept = append(kept, batch.Rides[i])
+			}
+			batch.Rides = kept
+			for reason, n := range rejected {
+				m.AddDropped(reason, n)
+				delete(rejected, reason)
+			}
+			out <- batch
+		}
+	}()
+	return func() {
+		<-done
+	}
+}
@@ -0,0 +1,178 @@
+package ridefilter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/metrics"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ridefilter"
+)
+
+// testRide starts at 2014-07-17T11:02:37Z.
+var testRide = ride.Data{
+	RideID: 1, StartTs: 1405594957, EndTs: 1405595017, Distance: 500, Duration: 60, Points: 3,
+	StartLat: 37.96666, StartLng: 23.728308, MaxSpeed: 12.5, AvgSpeed: 8.3,
+}
+
+func TestFilter_Check(t *testing.T) {
+	t.Parallel()
+	day := time.Date(2014, 7, 17, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name           string
+		cfg            ridefilter.Config
+		expectedReason string
+	}{
+		{name: "no filters", cfg: ridefilter.Config{}},
+		{
+			name: "all filters pass, bounds are inclusive",
+			cfg: ridefilter.Config{
+				From: time.Unix(1405594957, 0), To: day.AddDate(0, 0, 1),
+				MinDuration: time.Minute, MaxDuration: time.Minute, MinDistance: 500, MinPoints: 3,
+				Expression: "duration == 60",
+			},
+		},
+		{name: "from", cfg: ridefilter.Config{From: day.AddDate(0, 0, 1)}, expectedReason: ridefilter.ReasonFrom},
+		{name: "to is exclusive", cfg: ridefilter.Config{To: time.Unix(1405594957, 0)}, expectedReason: ridefilter.ReasonTo},
+		{
+			name:           "min duration",
+			cfg:            ridefilter.Config{MinDuration: 61 * time.Second},
+			expectedReason: ridefilter.ReasonMinDuration,
+		},
+		{
+			name:           "max duration",
+			cfg:            ridefilter.Config{MaxDuration: 59 * time.Second},
+			expectedReason: ridefilter.ReasonMaxDuration,
+		},
+		{name: "min distance", cfg: ridefilter.Config{MinDistance: 500.5}, expectedReason: ridefilter.ReasonMinDistance},
+		{name: "min points", cfg: ridefilter.Config{MinPoints: 4}, expectedReason: ridefilter.ReasonMinPoints},
+		{name: "expression", cfg: ridefilter.Config{Expression: "points > 3"}, expectedReason: ridefilter.ReasonExpression},
+		{
+			name:           "first failed filter is the reason",
+			cfg:            ridefilter.Config{MinPoints: 4, Expression: "points > 3"},
+			expectedReason: ridefilter.ReasonMinPoints,
+		},
+	}
+	for _, tc := range cases {
+		f, err := ridefilter.New(tc.cfg)
+		require.NoError(t, err, tc.name)
+		reason, ok := f.Check(&testRide)
+		assert.Equal(t, tc.expectedReason == "", ok, tc.name)
+		assert.Equal(t, tc.expectedReason, reason, tc.name)
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	t.Parallel()
+	day := time.Date(2014, 7, 17, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		cfg      ridefilter.Config
+		expected string
+	}{
+		{cfg: ridefilter.Config{MinPoints: -1}, expected: "filter min and max values must not be negative"},
+		{cfg: ridefilter.Config{From: day, To: day}, expected: "filter from time must be before to time"},
+		{
+			cfg:      ridefilter.Config{MinDuration: time.Hour, MaxDuration: time.Minute},
+			expected: "filter min duration must not be greater than max duration",
+		},
+		{cfg: ridefilter.Config{Expression: "speed > 1"}, expected: "invalid filter expression: unknown field \"speed\", " +
+			"known fields: avg_speed, distance, duration, end_lat, end_lng, end_ts, max_speed, points, ride_id, " +
+			"start_lat, start_lng, start_ts at position 0"},
+	}
+	for _, tc := range cases {
+		_, err := ridefilter.New(tc.cfg)
+		assert.EqualError(t, err, tc.expected)
+	}
+}
+
+func TestParseExpression(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		expression string
+		expected   bool
+	}{
+		{expression: "duration >= 60", expected: true},
+		{expression: "duration > 60", expected: false},
+		{expression: "distance<=500", expected: true},
+		{expression: "points != 3", expected: false},
+		{expression: "avg_speed < max_speed", expected: true},
+		{expression: "start_lat > 37.9 && start_lng < 2.4e1", expected: true},
+		{expression: "start_lng > -1 && end_lat == 0", expected: true},
+		{expression: "points > 3 || duration == 60", expected: true},
+		{expression: "!(points > 3 || duration == 60)", expected: false},
+		{expression: "!points > 3", expected: true},
+		{expression: "ride_id == 2 || ride_id == 1 && points > 3", expected: false},
+		{expression: "(ride_id == 2 || ride_id == 1) && points == 3", expected: true},
+		{expression: "start_ts >= 1405594957 && end_ts > start_ts", expected: true},
+	}
+	for _, tc := range cases {
+		expr, err := ridefilter.ParseExpression(tc.expression)
+		require.NoError(t, err, tc.expression)
+		assert.Equal(t, tc.expected, expr.Match(&testRide), tc.expression)
+	}
+}
+
+func TestParseExpression_Invalid(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		expression string
+		expected   string
+	}{
+		{expression: "", expected: "invalid filter expression: expected field or number at the end"},
+		{expression: "duration", expected: "invalid filter expression: expected comparison operator at the end"},
+		{expression: "duration > 60 points", expected: "invalid filter expression: unexpected \"points\" at position 14"},
+		{expression: "(duration > 60", expected: "invalid filter expression: expected \")\" at the end"},
+		{
+			expression: "duration > 60 & points > 1",
+			expected:   "invalid filter expression: unexpected character '&' at position 14",
+		},
+		{expression: "duration > 1.2.3", expected: "invalid filter expression: invalid number \"1.2.3\" at position 11"},
+		// There is no arithmetic.
+		{expression: "end_ts - 1 > 0", expected: "invalid filter expression: expected comparison operator at position 7"},
+		{
+			expression: "duration > (60)",
+			expected:   "invalid filter expression: expected field or number, got \"(\" at position 11",
+		},
+	}
+	for _, tc := range cases {
+		_, err := ridefilter.ParseExpression(tc.expression)
+		assert.EqualError(t, err, tc.expected, tc.expression)
+	}
+}
+
+func TestStart(t *testing.T) {
+	t.Parallel()
+	f, err := ridefilter.New(ridefilter.Config{MinPoints: 3})
+	require.NoError(t, err)
+	in := make(chan *ride.DataBatch, 2)
+	out := make(chan *ride.DataBatch, 2)
+	m := metrics.NewPipeline()
+	wait := ridefilter.Start(in, out, f, m)
+
+	batch := ride.NewDataBatch()
+	short := testRide
+	short.RideID, short.Points = 2, 2
+	batch.Rides = append(batch.Rides, testRide, short)
+	in <- batch
+	rejected := ride.NewDataBatch()
+	rejected.Rides = append(rejected.Rides, short)
+	rejected.Chunk, rejected.ChunkEnd = 1, true
+	in <- rejected
+	close(in)
+	wait()
+
+	var actual []*ride.DataBatch
+	for b := range out {
+		actual = append(actual, b)
+	}
+	require.Len(t, actual, 2)
+	assert.Equal(t, []ride.Data{testRide}, actual[0].Rides)
+	// The batch without rides is still passed, since it ends the chunk.
+	assert.Empty(t, actual[1].Rides)
+	assert.Equal(t, 1, actual[1].Chunk)
+	assert.True(t, actual[1].ChunkEnd)
+	assert.Equal(t, map[string]int{ridefilter.ReasonMinPoints: 2}, m.Dropped())
+}
@@ -0,0 +1,92 @@
+package roadnet
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+)
+
+type geoJSONObject struct {
+	Type        string           `json:"type"`
+	Features    []*geoJSONObject `json:"features"`
+	Geometry    *geoJSONObject   `json:"geometry"`
+	Geometries  []*geoJSONObject `json:"geometries"`
+	Coordinates json.RawMessage  `json:"coordinates"`
+}
+
+// loadGeoJSON builds the graph from LineString and MultiLineString geometries, other geometries are ignored.
+// Lines are connected where they share the same coordinates.
+func loadGeoJSON(filePath string, distance ride.DistanceCalculator) (*Graph, error) {
+	f, err := os.Open(path.Clean(filePath))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't open road network file")
+	}
+	defer f.Close() // nolint: errcheck, gosec
+	root := &geoJSONObject{}
+	if err := json.NewDecoder(f).Decode(root); err != nil {
+		return nil, errors.Wrap(err, "can't decode road network GeoJSON")
+	}
+	b := newGraphBuilder(distance)
+	if err := addGeoJSONObject(b, root); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return b.build()
+}
+
+func addGeoJSONObject(b *graphBuilder, obj *geoJSONObject) error {
+	if obj == nil {
+		return nil
+	}
+	switch obj.Type {
+	case "FeatureCollection":
+		for _, feature := range obj.Features {
+			if err := addGeoJSONObject(b, feature); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	case "Feature":
+		return addGeoJSONObject(b, obj.Geometry)
+	case "GeometryCollection":
+		for _, geometry := range obj.Geometries {
+			if err := addGeoJSONObject(b, geometry); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	case "LineString":
+		var line [][]float64
+		if err := json.Unmarshal(obj.Coordinates, &line); err != nil {
+			return errors.Wrap(err, "can't decode LineString coordinates")
+		}
+		return addGeoJSONLine(b, line)
+	case "MultiLineString":
+		var lines [][][]float64
+		if err := json.Unmarshal(obj.Coordinates, &lines); err != nil {
+			return errors.Wrap(err, "can't decode MultiLineString coordinates")
+		}
+		for _, line := range lines {
+			if err := addGeoJSONLine(b, line); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return nil
+}
+
+func addGeoJSONLine(b *graphBuilder, line [][]float64) error {
+	keys := make([]interface{}, len(line))
+	points := make([]point, len(line))
+	for i, position := range line {
+		if len(position) < 2 {
+			return errors.Errorf("invalid GeoJSON position: %v", position)
+		}
+		// GeoJSON positions are [lng, lat].
+		points[i] = point{lat: position[1], lng: position[0]}
+		keys[i] = points[i]
+	}
+	b.addRoad(keys, points)
+	return nil
+}
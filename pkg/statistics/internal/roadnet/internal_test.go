@@ -0,0 +1,179 @@
+package roadnet
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+)
+
+func TestLoadPBF(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "roadnet_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "roads.osm.pbf")
+	writePBF(t, filePath)
+
+	graph, err := Load(filePath, ride.Haversine{})
+	require.NoError(t, err)
+	// The footway and its only node aren't loaded.
+	assert.Len(t, graph.nodes, 5)
+	assert.Len(t, graph.edges, 3)
+
+	geoJSONGraph, err := Load("testdata/roads.geojson", ride.Haversine{})
+	require.NoError(t, err)
+	pbfMatcher := NewMatcher(graph, ride.Haversine{}, DefaultMaxSnapDistance)
+	geoJSONMatcher := NewMatcher(geoJSONGraph, ride.Haversine{}, DefaultMaxSnapDistance)
+	assert.InDelta(t,
+		geoJSONMatcher.Distance(52.5001, 13.40, 52.51, 13.4101),
+		pbfMatcher.Distance(52.5001, 13.40, 52.51, 13.4101),
+		1e-6,
+	)
+}
+
+func TestLoadPBF_MissingNodes(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "roadnet_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "roads.osm.pbf")
+	// Node 7 isn't in the file, so the way is split into 6 and 3-4, and the lone node 6 part is dropped.
+	writePBF(t, filePath, []int64{6, 7, 3, 4})
+
+	graph, err := Load(filePath, ride.Haversine{})
+	require.NoError(t, err)
+	assert.Len(t, graph.nodes, 5)
+	assert.Len(t, graph.edges, 4)
+	for _, node := range graph.nodes {
+		assert.NotEqual(t, point{}, node)
+	}
+	// Edges to (0, 0) would cover thousands of cells.
+	assert.Less(t, len(graph.grid), 10)
+}
+
+// writePBF writes the roads from testdata/roads.geojson, a footway and the extra residential ways
+// in the OSM PBF format. Nodes are split between a dense nodes group and a plain nodes group.
+func writePBF(t *testing.T, filePath string, extraWays ...[]int64) {
+	header := protoBuilder{}
+	header.bytes(4, []byte("OsmSchema-V0.6"))
+	header.bytes(4, []byte("DenseNodes"))
+
+	const granularity = 100
+	coordinate := func(degrees float64) uint64 {
+		return zigzagEncode(int64(degrees*1e9+0.5) / granularity)
+	}
+	dense := protoBuilder{}
+	dense.packed(1, zigzagEncode(1), zigzagEncode(1), zigzagEncode(1))
+	dense.packed(8, coordinate(52.50), 0, coordinate(0.01))
+	dense.packed(9, coordinate(13.40), coordinate(0.01), 0)
+	plainNodes := protoBuilder{}
+	for _, node := range []struct {
+		id       int64
+		lat, lng float64
+	}{{id: 4, lat: 52.52, lng: 13.40}, {id: 5, lat: 52.52, lng: 13.42}, {id: 6, lat: 52.53, lng: 13.42}} {
+		n := protoBuilder{}
+		n.varint(1, zigzagEncode(node.id))
+		n.varint(8, coordinate(node.lat))
+		n.varint(9, coordinate(node.lng))
+		plainNodes.bytes(1, n)
+	}
+
+	way := func(id int64, highway uint64, refs ...int64) []byte {
+		w := protoBuilder{}
+		w.varint(1, uint64(id))
+		w.packed(2, 1)
+		w.packed(3, highway)
+		var deltas []uint64
+		var last int64
+		for _, ref := range refs {
+			deltas = append(deltas, zigzagEncode(ref-last))
+			last = ref
+		}
+		w.packed(8, deltas...)
+		return w
+	}
+	ways := protoBuilder{}
+	ways.bytes(3, way(1, 2, 1, 2, 3))
+	ways.bytes(3, way(2, 3, 4, 5))
+	ways.bytes(3, way(3, 4, 5, 6))
+	for i, refs := range extraWays {
+		ways.bytes(3, way(int64(4+i), 3, refs...))
+	}
+
+	stringTable := protoBuilder{}
+	for _, s := range []string{"", "highway", "primary", "residential", "footway"} {
+		stringTable.bytes(1, []byte(s))
+	}
+	data := protoBuilder{}
+	data.bytes(1, stringTable)
+	denseNodes := protoBuilder{}
+	denseNodes.bytes(2, dense)
+	data.bytes(2, denseNodes)
+	data.bytes(2, plainNodes)
+	data.bytes(2, ways)
+	data.varint(17, granularity)
+
+	file := &bytes.Buffer{}
+	writeBlob(t, file, "OSMHeader", header)
+	writeBlob(t, file, "OSMData", data)
+	require.NoError(t, ioutil.WriteFile(filePath, file.Bytes(), 0o600))
+}
+
+func writeBlob(t *testing.T, file *bytes.Buffer, blobType string, data []byte) {
+	compressed := &bytes.Buffer{}
+	zw := zlib.NewWriter(compressed)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	blob := protoBuilder{}
+	blob.varint(2, uint64(len(data)))
+	blob.bytes(3, compressed.Bytes())
+
+	header := protoBuilder{}
+	header.bytes(1, []byte(blobType))
+	header.varint(3, uint64(len(blob)))
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(header)))
+	file.Write(size)
+	file.Write(header)
+	file.Write(blob)
+}
+
+type protoBuilder []byte
+
+func (b *protoBuilder) rawVarint(v uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	*b = append(*b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func (b *protoBuilder) varint(field int, v uint64) {
+	b.rawVarint(uint64(field<<3 | wireVarint))
+	b.rawVarint(v)
+}
+
+func (b *protoBuilder) bytes(field int, data []byte) {
+	b.rawVarint(uint64(field<<3 | wireBytes))
+	b.rawVarint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+func (b *protoBuilder) packed(field int, values ...uint64) {
+	packed := protoBuilder{}
+	for _, v := range values {
+		packed.rawVarint(v)
+	}
+	b.bytes(field, packed)
+}
+
+func zigzagEncode(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
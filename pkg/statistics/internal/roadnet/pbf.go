@@ -0,0 +1,584 @@
+package roadnet
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+)
+
+// OSM PBF format is described in https://wiki.openstreetmap.org/wiki/PBF_Format.
+// Only the parts needed to extract roads are decoded, so no protobuf dependency is required.
+
+const (
+	maxBlobHeaderSize = 64 * 1024
+	maxBlobSize       = 32 * 1024 * 1024
+
+	wireVarint = 0
+	wire64Bit  = 1
+	wireBytes  = 2
+	wire32Bit  = 5
+)
+
+var supportedPBFFeatures = map[string]bool{"OsmSchema-V0.6": true, "DenseNodes": true}
+
+// nonDrivableHighways are highway tag values that cars can't drive along.
+var nonDrivableHighways = map[string]bool{
+	"footway": true, "path": true, "cycleway": true, "steps": true, "pedestrian": true, "bridleway": true,
+	"corridor": true, "platform": true, "proposed": true, "construction": true, "elevator": true,
+}
+
+// loadPBF builds the graph from OSM ways with a drivable highway tag.
+// The file is read twice: ways are collected first and then only the nodes they reference,
+// so nodes of the other objects aren't kept in memory.
+// Nodes missing from the file (e.g. in a clipped extract) split the ways that reference them.
+func loadPBF(filePath string, distance ride.DistanceCalculator) (*Graph, error) {
+	var ways [][]int64
+	// Referenced nodes are nil until they are found in the file.
+	nodes := make(map[int64]*point)
+	err := readPBFBlocks(filePath, func(block *primitiveBlock) error {
+		return block.ways(func(refs []int64) {
+			for _, ref := range refs {
+				nodes[ref] = nil
+			}
+			ways = append(ways, refs)
+		})
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = readPBFBlocks(filePath, func(block *primitiveBlock) error {
+		return block.nodes(func(id int64, p point) {
+			if _, ok := nodes[id]; ok {
+				nodes[id] = &p
+			}
+		})
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	b := newGraphBuilder(distance)
+	for _, refs := range ways {
+		var keys []interface{}
+		var points []point
+		for _, ref := range refs {
+			p := nodes[ref]
+			if p == nil {
+				addPBFRoad(b, keys, points)
+				keys, points = nil, nil
+				continue
+			}
+			keys = append(keys, ref)
+			points = append(points, *p)
+		}
+		addPBFRoad(b, keys, points)
+	}
+	return b.build()
+}
+
+// addPBFRoad adds a part of a way between missing nodes, parts with a single node aren't roads.
+func addPBFRoad(b *graphBuilder, keys []interface{}, points []point) {
+	if len(keys) > 1 {
+		b.addRoad(keys, points)
+	}
+}
+
+// readPBFBlocks calls fn for each data block of the file.
+func readPBFBlocks(filePath string, fn func(block *primitiveBlock) error) error {
+	f, err := os.Open(path.Clean(filePath))
+	if err != nil {
+		return errors.Wrap(err, "can't open road network file")
+	}
+	defer f.Close() // nolint: errcheck, gosec
+	r := bufio.NewReader(f)
+	sizeBuf := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, sizeBuf); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return errors.Wrap(err, "can't read PBF blob header size")
+		}
+		headerSize := binary.BigEndian.Uint32(sizeBuf)
+		if headerSize > maxBlobHeaderSize {
+			return errors.Errorf("PBF blob header is too big: %d", headerSize)
+		}
+		header := make([]byte, headerSize)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return errors.Wrap(err, "can't read PBF blob header")
+		}
+		blobType, blobSize, err := parseBlobHeader(header)
+		if err != nil {
+			return errors.Wrap(err, "can't parse PBF blob header")
+		}
+		if blobSize > maxBlobSize {
+			return errors.Errorf("PBF blob is too big: %d", blobSize)
+		}
+		blob := make([]byte, blobSize)
+		if _, err := io.ReadFull(r, blob); err != nil {
+			return errors.Wrap(err, "can't read PBF blob")
+		}
+		data, err := decodeBlob(blob)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		switch blobType {
+		case "OSMHeader":
+			if err := checkHeaderBlock(data); err != nil {
+				return errors.Wrap(err, "invalid PBF header block")
+			}
+		case "OSMData":
+			block, err := parsePrimitiveBlock(data)
+			if err != nil {
+				return errors.Wrap(err, "can't parse PBF data block")
+			}
+			if err := fn(block); err != nil {
+				return errors.Wrap(err, "can't read PBF data block")
+			}
+		}
+	}
+}
+
+func parseBlobHeader(data []byte) (string, int, error) {
+	var blobType string
+	blobSize := -1
+	m := protoMessage(data)
+	for len(m) > 0 {
+		field, wireType, err := m.key()
+		if err != nil {
+			return "", 0, err
+		}
+		switch {
+		case field == 1 && wireType == wireBytes:
+			b, err := m.bytes()
+			if err != nil {
+				return "", 0, err
+			}
+			blobType = string(b)
+		case field == 3 && wireType == wireVarint:
+			v, err := m.varint()
+			if err != nil {
+				return "", 0, err
+			}
+			blobSize = int(v)
+		default:
+			if err := m.skip(wireType); err != nil {
+				return "", 0, err
+			}
+		}
+	}
+	if blobSize < 0 {
+		return "", 0, errors.New("PBF blob header doesn't contain blob size")
+	}
+	return blobType, blobSize, nil
+}
+
+func decodeBlob(data []byte) ([]byte, error) {
+	m := protoMessage(data)
+	for len(m) > 0 {
+		field, wireType, err := m.key()
+		if err != nil {
+			return nil, err
+		}
+		if wireType != wireBytes {
+			if err := m.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		b, err := m.bytes()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			return b, nil
+		case 3:
+			zr, err := zlib.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, errors.Wrap(err, "can't decompress PBF blob")
+			}
+			raw, err := ioutil.ReadAll(zr)
+			if err != nil {
+				return nil, errors.Wrap(err, "can't decompress PBF blob")
+			}
+			return raw, nil
+		case 4, 5, 6, 7:
+			return nil, errors.New("PBF blob compression isn't supported, only zlib is")
+		}
+	}
+	return nil, errors.New("PBF blob doesn't contain data")
+}
+
+func checkHeaderBlock(data []byte) error {
+	m := protoMessage(data)
+	for len(m) > 0 {
+		field, wireType, err := m.key()
+		if err != nil {
+			return err
+		}
+		if field != 4 || wireType != wireBytes {
+			if err := m.skip(wireType); err != nil {
+				return err
+			}
+			continue
+		}
+		feature, err := m.bytes()
+		if err != nil {
+			return err
+		}
+		if !supportedPBFFeatures[string(feature)] {
+			return errors.Errorf("PBF file requires unsupported feature: %s", feature)
+		}
+	}
+	return nil
+}
+
+type primitiveBlock struct {
+	strings     [][]byte
+	groups      [][]byte
+	granularity int64
+	latOffset   int64
+	lngOffset   int64
+}
+
+func parsePrimitiveBlock(data []byte) (*primitiveBlock, error) {
+	block := &primitiveBlock{granularity: 100}
+	m := protoMessage(data)
+	for len(m) > 0 {
+		field, wireType, err := m.key()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case field == 1 && wireType == wireBytes:
+			table, err := m.bytes()
+			if err != nil {
+				return nil, err
+			}
+			if block.strings, err = parseStringTable(table); err != nil {
+				return nil, err
+			}
+		case field == 2 && wireType == wireBytes:
+			group, err := m.bytes()
+			if err != nil {
+				return nil, err
+			}
+			block.groups = append(block.groups, group)
+		case (field == 17 || field == 19 || field == 20) && wireType == wireVarint:
+			v, err := m.varint()
+			if err != nil {
+				return nil, err
+			}
+			switch field {
+			case 17:
+				block.granularity = int64(v)
+			case 19:
+				block.latOffset = int64(v)
+			case 20:
+				block.lngOffset = int64(v)
+			}
+		default:
+			if err := m.skip(wireType); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return block, nil
+}
+
+func parseStringTable(data []byte) ([][]byte, error) {
+	var table [][]byte
+	m := protoMessage(data)
+	for len(m) > 0 {
+		field, wireType, err := m.key()
+		if err != nil {
+			return nil, err
+		}
+		if field != 1 || wireType != wireBytes {
+			if err := m.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s, err := m.bytes()
+		if err != nil {
+			return nil, err
+		}
+		table = append(table, s)
+	}
+	return table, nil
+}
+
+func (block *primitiveBlock) point(lat, lng int64) point {
+	return point{
+		lat: 1e-9 * float64(block.latOffset+block.granularity*lat),
+		lng: 1e-9 * float64(block.lngOffset+block.granularity*lng),
+	}
+}
+
+func (block *primitiveBlock) string(idx uint64) string {
+	if idx >= uint64(len(block.strings)) {
+		return ""
+	}
+	return string(block.strings[idx])
+}
+
+// nodes calls fn for each node of the block, both plain and dense ones.
+func (block *primitiveBlock) nodes(fn func(id int64, p point)) error {
+	return block.groupFields(func(field, wireType int, m *protoMessage) error {
+		if wireType != wireBytes || (field != 1 && field != 2) {
+			return m.skip(wireType)
+		}
+		data, err := m.bytes()
+		if err != nil {
+			return err
+		}
+		if field == 1 {
+			return block.node(data, fn)
+		}
+		return block.denseNodes(data, fn)
+	})
+}
+
+func (block *primitiveBlock) node(data []byte, fn func(id int64, p point)) error {
+	var id, lat, lng int64
+	m := protoMessage(data)
+	for len(m) > 0 {
+		field, wireType, err := m.key()
+		if err != nil {
+			return err
+		}
+		if wireType != wireVarint || (field != 1 && field != 8 && field != 9) {
+			if err := m.skip(wireType); err != nil {
+				return err
+			}
+			continue
+		}
+		v, err := m.varint()
+		if err != nil {
+			return err
+		}
+		switch field {
+		case 1:
+			id = zigzag(v)
+		case 8:
+			lat = zigzag(v)
+		case 9:
+			lng = zigzag(v)
+		}
+	}
+	fn(id, block.point(lat, lng))
+	return nil
+}
+
+func (block *primitiveBlock) denseNodes(data []byte, fn func(id int64, p point)) error {
+	var ids, lats, lngs []int64
+	m := protoMessage(data)
+	for len(m) > 0 {
+		field, wireType, err := m.key()
+		if err != nil {
+			return err
+		}
+		switch field {
+		case 1:
+			ids, err = m.deltas(wireType, ids)
+		case 8:
+			lats, err = m.deltas(wireType, lats)
+		case 9:
+			lngs, err = m.deltas(wireType, lngs)
+		default:
+			err = m.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(lats) != len(ids) || len(lngs) != len(ids) {
+		return errors.New("PBF dense nodes have inconsistent length")
+	}
+	for i, id := range ids {
+		fn(id, block.point(lats[i], lngs[i]))
+	}
+	return nil
+}
+
+// ways calls fn with the node references of each drivable way of the block.
+func (block *primitiveBlock) ways(fn func(refs []int64)) error {
+	return block.groupFields(func(field, wireType int, m *protoMessage) error {
+		if field != 3 || wireType != wireBytes {
+			return m.skip(wireType)
+		}
+		data, err := m.bytes()
+		if err != nil {
+			return err
+		}
+		return block.way(data, fn)
+	})
+}
+
+func (block *primitiveBlock) way(data []byte, fn func(refs []int64)) error {
+	var keys, vals []uint64
+	var refs []int64
+	m := protoMessage(data)
+	for len(m) > 0 {
+		field, wireType, err := m.key()
+		if err != nil {
+			return err
+		}
+		switch field {
+		case 2:
+			keys, err = m.varints(wireType, keys)
+		case 3:
+			vals, err = m.varints(wireType, vals)
+		case 8:
+			refs, err = m.deltas(wireType, refs)
+		default:
+			err = m.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(keys) != len(vals) {
+		return errors.New("PBF way has inconsistent tags")
+	}
+	for i, key := range keys {
+		if block.string(key) != "highway" {
+			continue
+		}
+		if !nonDrivableHighways[block.string(vals[i])] && len(refs) > 1 {
+			fn(refs)
+		}
+		return nil
+	}
+	return nil
+}
+
+func (block *primitiveBlock) groupFields(fn func(field, wireType int, m *protoMessage) error) error {
+	for _, group := range block.groups {
+		m := protoMessage(group)
+		for len(m) > 0 {
+			field, wireType, err := m.key()
+			if err != nil {
+				return err
+			}
+			if err := fn(field, wireType, &m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// protoMessage is the remaining part of an encoded protobuf message.
+type protoMessage []byte
+
+var errInvalidProto = errors.New("invalid PBF protobuf message")
+
+func (m *protoMessage) varint() (uint64, error) {
+	v, n := binary.Uvarint(*m)
+	if n <= 0 {
+		return 0, errInvalidProto
+	}
+	*m = (*m)[n:]
+	return v, nil
+}
+
+func (m *protoMessage) key() (int, int, error) {
+	v, err := m.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(v >> 3), int(v & 7), nil
+}
+
+func (m *protoMessage) bytes() ([]byte, error) {
+	size, err := m.varint()
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(len(*m)) {
+		return nil, errInvalidProto
+	}
+	b := (*m)[:size]
+	*m = (*m)[size:]
+	return b, nil
+}
+
+func (m *protoMessage) skip(wireType int) error {
+	var size int
+	switch wireType {
+	case wireVarint:
+		_, err := m.varint()
+		return err
+	case wireBytes:
+		_, err := m.bytes()
+		return err
+	case wire64Bit:
+		size = 8
+	case wire32Bit:
+		size = 4
+	default:
+		return errInvalidProto
+	}
+	if size > len(*m) {
+		return errInvalidProto
+	}
+	*m = (*m)[size:]
+	return nil
+}
+
+// varints appends values of a repeated varint field, which can be either packed or not.
+func (m *protoMessage) varints(wireType int, values []uint64) ([]uint64, error) {
+	if wireType == wireVarint {
+		v, err := m.varint()
+		return append(values, v), err
+	}
+	if wireType != wireBytes {
+		return values, errInvalidProto
+	}
+	data, err := m.bytes()
+	if err != nil {
+		return values, err
+	}
+	packed := protoMessage(data)
+	for len(packed) > 0 {
+		v, err := packed.varint()
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// deltas appends values of a repeated delta coded sint64 field.
+func (m *protoMessage) deltas(wireType int, values []int64) ([]int64, error) {
+	raw, err := m.varints(wireType, nil)
+	if err != nil {
+		return values, err
+	}
+	var last int64
+	if len(values) > 0 {
+		last = values[len(values)-1]
+	}
+	for _, v := range raw {
+		last += zigzag(v)
+		values = append(values, last)
+	}
+	return values, nil
+}
+
+func zigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
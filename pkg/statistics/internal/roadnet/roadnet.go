@@ -0,0 +1,284 @@
+package roadnet
+
+import (
+	"container/heap"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+)
+
+const (
+	// DefaultMaxSnapDistance is the max distance in meters from a point to a road to snap the point to it.
+	DefaultMaxSnapDistance = 50
+	// MaxSnapDistanceLimit is the largest allowed max snap distance in meters,
+	// the nearest road search scans all grid cells within the max snap distance.
+	MaxSnapDistanceLimit = 10000
+	// maxDetour limits the driven distance between two points relative to the straight line distance,
+	// a longer path means the points are snapped to wrong roads.
+	maxDetour = 5
+	// minDetourLimit is the detour limit in meters for points that are very close to each other.
+	minDetourLimit = 1000
+	// gridCellSize is the size of the spatial index cells in degrees, about 1 km.
+	gridCellSize    = 0.01
+	metersPerDegree = math.Pi / 180 * 6371008.8
+	// minCosLat keeps the longitude search radius finite near the poles.
+	minCosLat = 0.01
+)
+
+type point struct {
+	lat float64
+	lng float64
+}
+
+type edge struct {
+	from   int
+	to     int
+	length float64
+}
+
+type neighbor struct {
+	node   int
+	length float64
+}
+
+type gridCell struct {
+	lat int
+	lng int
+}
+
+// Graph is an undirected road network. Road directions (e.g. one-way roads) aren't taken into account.
+type Graph struct {
+	nodes     []point
+	edges     []edge
+	adjacency [][]neighbor
+	grid      map[gridCell][]int
+}
+
+// Load reads the road network from an OSM PBF (*.pbf) or a GeoJSON (*.geojson, *.json) file.
+// Road segments lengths are measured with the distance calculator.
+func Load(filePath string, distance ride.DistanceCalculator) (*Graph, error) {
+	switch ext := strings.ToLower(filepath.Ext(filePath)); ext {
+	case ".pbf":
+		g, err := loadPBF(filePath, distance)
+		return g, errors.WithStack(err)
+	case ".geojson", ".json":
+		g, err := loadGeoJSON(filePath, distance)
+		return g, errors.WithStack(err)
+	default:
+		return nil, errors.Errorf("unknown road network file format: %s", ext)
+	}
+}
+
+// graphBuilder deduplicates nodes by a key, so roads sharing nodes are connected.
+type graphBuilder struct {
+	graph    *Graph
+	nodes    map[interface{}]int
+	distance ride.DistanceCalculator
+}
+
+func newGraphBuilder(distance ride.DistanceCalculator) *graphBuilder {
+	return &graphBuilder{
+		graph:    &Graph{grid: make(map[gridCell][]int)},
+		nodes:    make(map[interface{}]int),
+		distance: distance,
+	}
+}
+
+func (b *graphBuilder) addRoad(keys []interface{}, points []point) {
+	prev := -1
+	for i, key := range keys {
+		node, ok := b.nodes[key]
+		if !ok {
+			node = len(b.graph.nodes)
+			b.nodes[key] = node
+			b.graph.nodes = append(b.graph.nodes, points[i])
+			b.graph.adjacency = append(b.graph.adjacency, nil)
+		}
+		if prev != -1 && prev != node {
+			b.addEdge(prev, node)
+		}
+		prev = node
+	}
+}
+
+func (b *graphBuilder) addEdge(from, to int) {
+	g := b.graph
+	p1, p2 := g.nodes[from], g.nodes[to]
+	length := b.distance.Distance(p1.lat, p1.lng, p2.lat, p2.lng)
+	edgeIdx := len(g.edges)
+	g.edges = append(g.edges, edge{from: from, to: to, length: length})
+	g.adjacency[from] = append(g.adjacency[from], neighbor{node: to, length: length})
+	g.adjacency[to] = append(g.adjacency[to], neighbor{node: from, length: length})
+
+	minCell, maxCell := cellOf(p1), cellOf(p2)
+	if minCell.lat > maxCell.lat {
+		minCell.lat, maxCell.lat = maxCell.lat, minCell.lat
+	}
+	if minCell.lng > maxCell.lng {
+		minCell.lng, maxCell.lng = maxCell.lng, minCell.lng
+	}
+	for lat := minCell.lat; lat <= maxCell.lat; lat++ {
+		for lng := minCell.lng; lng <= maxCell.lng; lng++ {
+			c := gridCell{lat: lat, lng: lng}
+			g.grid[c] = append(g.grid[c], edgeIdx)
+		}
+	}
+}
+
+func (b *graphBuilder) build() (*Graph, error) {
+	if len(b.graph.edges) == 0 {
+		return nil, errors.New("road network doesn't contain any roads")
+	}
+	return b.graph, nil
+}
+
+func cellOf(p point) gridCell {
+	return gridCell{lat: int(math.Floor(p.lat / gridCellSize)), lng: int(math.Floor(p.lng / gridCellSize))}
+}
+
+// position is a point snapped to an edge at the fraction of the edge length from the edge start.
+type position struct {
+	edge     int
+	fraction float64
+}
+
+// snap finds the nearest road position within the max distance.
+func (g *Graph) snap(p point, maxDistance float64) (position, bool) {
+	center := cellOf(p)
+	latCells, lngCells := searchRadius(p, maxDistance)
+	best := position{edge: -1}
+	bestDistance := maxDistance
+	for dLat := -latCells; dLat <= latCells; dLat++ {
+		for dLng := -lngCells; dLng <= lngCells; dLng++ {
+			for _, edgeIdx := range g.grid[gridCell{lat: center.lat + dLat, lng: center.lng + dLng}] {
+				e := g.edges[edgeIdx]
+				distance, fraction := distanceToSegment(p, g.nodes[e.from], g.nodes[e.to])
+				if distance <= bestDistance {
+					bestDistance = distance
+					best = position{edge: edgeIdx, fraction: fraction}
+				}
+			}
+		}
+	}
+	return best, best.edge != -1
+}
+
+// searchRadius returns the number of grid cells around the point's cell that cover the distance in meters
+// in the latitude and the longitude directions. Longitude cells get narrower towards the poles.
+func searchRadius(p point, distance float64) (latCells, lngCells int) {
+	cellHeight := gridCellSize * metersPerDegree
+	cellWidth := cellHeight * math.Max(math.Cos(p.lat*math.Pi/180), minCosLat)
+	return int(math.Ceil(distance / cellHeight)), int(math.Ceil(distance / cellWidth))
+}
+
+// distanceToSegment returns the distance in meters from the point to the segment and the fraction of the segment
+// where the nearest point is. Coordinates are projected on a local plane, which is accurate for short segments.
+func distanceToSegment(p, a, b point) (float64, float64) {
+	cosLat := math.Cos(p.lat * math.Pi / 180)
+	ax, ay := (a.lng-p.lng)*cosLat*metersPerDegree, (a.lat-p.lat)*metersPerDegree
+	bx, by := (b.lng-p.lng)*cosLat*metersPerDegree, (b.lat-p.lat)*metersPerDegree
+	dx, dy := bx-ax, by-ay
+	fraction := 0.0
+	if lengthSq := dx*dx + dy*dy; lengthSq > 0 {
+		fraction = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/lengthSq))
+	}
+	return math.Hypot(ax+fraction*dx, ay+fraction*dy), fraction
+}
+
+// pathLength returns the shortest driven distance between two road positions not longer than the limit.
+func (g *Graph) pathLength(from, to position, limit float64) (float64, bool) {
+	fromEdge, toEdge := g.edges[from.edge], g.edges[to.edge]
+	best := math.Inf(1)
+	if from.edge == to.edge {
+		best = math.Abs(to.fraction-from.fraction) * fromEdge.length
+	}
+	// Distances from the target edge ends to the target position.
+	targets := map[int]float64{
+		toEdge.from: to.fraction * toEdge.length,
+		toEdge.to:   (1 - to.fraction) * toEdge.length,
+	}
+	distances := map[int]float64{}
+	queue := &nodesQueue{}
+	push := func(node int, distance float64) {
+		if d, ok := distances[node]; ok && d <= distance {
+			return
+		}
+		distances[node] = distance
+		heap.Push(queue, queueItem{node: node, distance: distance})
+	}
+	push(fromEdge.from, from.fraction*fromEdge.length)
+	push(fromEdge.to, (1-from.fraction)*fromEdge.length)
+	for queue.Len() > 0 {
+		item := heap.Pop(queue).(queueItem)
+		if item.distance > distances[item.node] {
+			continue
+		}
+		if item.distance >= best || item.distance > limit {
+			break
+		}
+		if toTarget, ok := targets[item.node]; ok && item.distance+toTarget < best {
+			best = item.distance + toTarget
+		}
+		for _, n := range g.adjacency[item.node] {
+			push(n.node, item.distance+n.length)
+		}
+	}
+	return best, best <= limit
+}
+
+type queueItem struct {
+	node     int
+	distance float64
+}
+
+type nodesQueue []queueItem
+
+func (q nodesQueue) Len() int           { return len(q) }
+func (q nodesQueue) Less(i, j int) bool { return q[i].distance < q[j].distance }
+func (q nodesQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *nodesQueue) Push(x interface{}) {
+	*q = append(*q, x.(queueItem))
+}
+
+func (q *nodesQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// Matcher is a ride.DistanceCalculator that snaps points to the road network
+// and calculates the driven distance between them along the roads.
+// If a point can't be snapped or there is no reasonable path between the points,
+// the fallback calculator is used.
+type Matcher struct {
+	graph           *Graph
+	fallback        ride.DistanceCalculator
+	maxSnapDistance float64
+}
+
+func NewMatcher(graph *Graph, fallback ride.DistanceCalculator, maxSnapDistance float64) *Matcher {
+	return &Matcher{graph: graph, fallback: fallback, maxSnapDistance: maxSnapDistance}
+}
+
+func (m *Matcher) Distance(lat1, lng1, lat2, lng2 float64) float64 {
+	straight := m.fallback.Distance(lat1, lng1, lat2, lng2)
+	from, ok := m.graph.snap(point{lat: lat1, lng: lng1}, m.maxSnapDistance)
+	if !ok {
+		return straight
+	}
+	to, ok := m.graph.snap(point{lat: lat2, lng: lng2}, m.maxSnapDistance)
+	if !ok {
+		return straight
+	}
+	length, ok := m.graph.pathLength(from, to, math.Max(straight*maxDetour, minDetourLimit))
+	if !ok {
+		return straight
+	}
+	return length
+}
@@ -0,0 +1,101 @@
+package roadnet_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/roadnet"
+)
+
+func TestMatcher_Distance(t *testing.T) {
+	t.Parallel()
+	graph, err := roadnet.Load("testdata/roads.geojson", ride.Haversine{})
+	require.NoError(t, err)
+	matcher := roadnet.NewMatcher(graph, ride.Haversine{}, roadnet.DefaultMaxSnapDistance)
+
+	haversine := ride.Haversine{}.Distance
+	// The first road goes east from (52.50, 13.40) to the corner (52.50, 13.41) and then north to (52.51, 13.41).
+	eastLeg := haversine(52.50, 13.40, 52.50, 13.41)
+	northLeg := haversine(52.50, 13.41, 52.51, 13.41)
+	cases := []struct {
+		name                   string
+		lat1, lng1, lat2, lng2 float64
+		expected               float64
+	}{
+		{
+			name: "along the road around the corner",
+			lat1: 52.5001, lng1: 13.40, lat2: 52.51, lng2: 13.4101,
+			expected: eastLeg + northLeg,
+		},
+		{
+			name: "within a single road segment",
+			lat1: 52.5001, lng1: 13.40, lat2: 52.4999, lng2: 13.405,
+			expected: eastLeg / 2,
+		},
+		{
+			name: "opposite direction",
+			lat1: 52.51, lng1: 13.4101, lat2: 52.5001, lng2: 13.40,
+			expected: eastLeg + northLeg,
+		},
+		{
+			name: "point too far from roads",
+			lat1: 52.5001, lng1: 13.40, lat2: 52.505, lng2: 13.405,
+			expected: haversine(52.5001, 13.40, 52.505, 13.405),
+		},
+		{
+			name: "roads aren't connected",
+			lat1: 52.51, lng1: 13.41, lat2: 52.52, lng2: 13.41,
+			expected: haversine(52.51, 13.41, 52.52, 13.41),
+		},
+	}
+	for _, tc := range cases {
+		actual := matcher.Distance(tc.lat1, tc.lng1, tc.lat2, tc.lng2)
+		assert.InDelta(t, tc.expected, actual, 1, tc.name)
+	}
+}
+
+func TestMatcher_DistanceLargeSnapDistance(t *testing.T) {
+	t.Parallel()
+	graph, err := roadnet.Load("testdata/roads.geojson", ride.Haversine{})
+	require.NoError(t, err)
+	// The first point is about 2.4 km south of the first road, 3 grid cells away from it.
+	matcher := roadnet.NewMatcher(graph, ride.Haversine{}, 3000)
+
+	haversine := ride.Haversine{}.Distance
+	expected := haversine(52.50, 13.405, 52.50, 13.41) + haversine(52.50, 13.41, 52.51, 13.41)
+	actual := matcher.Distance(52.4785, 13.405, 52.51, 13.4101)
+	assert.InDelta(t, expected, actual, 1)
+}
+
+func TestLoad_DistanceCalculator(t *testing.T) {
+	t.Parallel()
+	graph, err := roadnet.Load("testdata/roads.geojson", ride.Vincenty{})
+	require.NoError(t, err)
+	matcher := roadnet.NewMatcher(graph, ride.Vincenty{}, roadnet.DefaultMaxSnapDistance)
+
+	vincenty := ride.Vincenty{}.Distance
+	expected := vincenty(52.50, 13.40, 52.50, 13.41) + vincenty(52.50, 13.41, 52.51, 13.41)
+	actual := matcher.Distance(52.50, 13.40, 52.51, 13.41)
+	assert.InDelta(t, expected, actual, 1e-6)
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "roadnet_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	noRoads := filepath.Join(dir, "no_roads.geojson")
+	err = ioutil.WriteFile(noRoads, []byte(`{"type": "Point", "coordinates": [13.40, 52.50]}`), 0o600)
+	require.NoError(t, err)
+	_, err = roadnet.Load(noRoads, ride.Haversine{})
+	assert.EqualError(t, err, "road network doesn't contain any roads")
+
+	_, err = roadnet.Load(filepath.Join(dir, "roads.osm"), ride.Haversine{})
+	assert.EqualError(t, err, "unknown road network file format: .osm")
+}
@@ -0,0 +1,101 @@
+package spill
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const valueSize = 8
+
+// Store keeps sorted runs of integers in a temporary file on disk.
+// It's safe for concurrent use.
+type Store struct {
+	mx      *sync.Mutex
+	f       *os.File
+	offset  int64
+	removed bool
+}
+
+// Run is a sorted sequence of integers written into the store.
+type Run struct {
+	offset int64
+	length int
+}
+
+func (r Run) Len() int {
+	return r.length
+}
+
+// NewStore creates a temporary file for runs in the dir, the system temporary directory is used if dir is empty.
+func NewStore(dir string) (*Store, error) {
+	f, err := ioutil.TempFile(dir, "ride_statistics_spill_*")
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create spill file")
+	}
+	// Where it's possible the file is removed right away, so the disk space is freed even if the process crashes.
+	// Otherwise it's removed on Close.
+	removed := os.Remove(f.Name()) == nil
+	return &Store{mx: new(sync.Mutex), f: f, removed: removed}, nil
+}
+
+// Write appends the sorted values to the store as a new run.
+func (s *Store) Write(sorted []int) (Run, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	// Runs are only appended and read with ReadAt, so the file position is always at the end.
+	w := bufio.NewWriter(s.f)
+	buf := make([]byte, valueSize)
+	for _, v := range sorted {
+		binary.LittleEndian.PutUint64(buf, uint64(v))
+		if _, err := w.Write(buf); err != nil {
+			return Run{}, errors.Wrap(err, "can't write run into spill file")
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return Run{}, errors.Wrap(err, "can't write run into spill file")
+	}
+	run := Run{offset: s.offset, length: len(sorted)}
+	s.offset += int64(len(sorted) * valueSize)
+	return run, nil
+}
+
+// Iterator returns an iterator over the run values in ascending order.
+func (s *Store) Iterator(run Run) *Iterator {
+	sr := io.NewSectionReader(s.f, run.offset, int64(run.length*valueSize))
+	return &Iterator{r: bufio.NewReader(sr), remaining: run.length, buf: make([]byte, valueSize)}
+}
+
+// Close closes and removes the spill file.
+func (s *Store) Close() error {
+	if err := s.f.Close(); err != nil {
+		return errors.Wrap(err, "can't close spill file")
+	}
+	if s.removed {
+		return nil
+	}
+	return errors.Wrap(os.Remove(s.f.Name()), "can't remove spill file")
+}
+
+type Iterator struct {
+	r         *bufio.Reader
+	remaining int
+	buf       []byte
+}
+
+// Next returns the next value, false is returned when the run is over.
+func (it *Iterator) Next() (int, bool, error) {
+	if it.remaining == 0 {
+		return 0, false, nil
+	}
+	if _, err := io.ReadFull(it.r, it.buf); err != nil {
+		return 0, false, errors.Wrap(err, "can't read run from spill file")
+	}
+	it.remaining--
+	return int(binary.LittleEndian.Uint64(it.buf)), true, nil
+}
@@ -0,0 +1,57 @@
+package spill_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/spill"
+)
+
+func TestStore(t *testing.T) {
+	t.Parallel()
+	s, err := spill.NewStore("")
+	require.NoError(t, err)
+
+	runs := [][]int{{1, 5, 7}, {}, {2, 3, 1 << 40}}
+	written := make([]spill.Run, len(runs))
+	for i, values := range runs {
+		written[i], err = s.Write(values)
+		require.NoError(t, err)
+		assert.Equal(t, len(values), written[i].Len())
+	}
+	for i, run := range written {
+		it := s.Iterator(run)
+		actual := []int{}
+		for {
+			v, ok, err := it.Next()
+			require.NoError(t, err)
+			if !ok {
+				break
+			}
+			actual = append(actual, v)
+		}
+		assert.Equal(t, runs[i], actual)
+	}
+
+	require.NoError(t, s.Close())
+}
+
+func TestStore_Close(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "spill_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := spill.NewStore(dir)
+	require.NoError(t, err)
+	_, err = s.Write([]int{1})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Close())
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,352 @@
+package xlsxoutput
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/csvoutput"
+)
+
+// Option changes how report values are written.
+type Option func(*options)
+
+type options struct {
+	metric         string
+	durationFormat string
+}
+
+// WithMetric sets the aggregation metric of report values, values are durations by default.
+// Speeds are written as numbers in km/h, durations and paces are written in the duration format.
+func WithMetric(metric string) Option {
+	return func(o *options) {
+		o.metric = metric
+	}
+}
+
+// WithDurationFormat sets the format of durations and paces, see the csvoutput.DurationFormat constants.
+// Go durations are written as text, other formats are written as numbers formatted by the cell style,
+// hh:mm:ss values are fractions of a day like spreadsheet times.
+func WithDurationFormat(format string) Option {
+	return func(o *options) {
+		o.durationFormat = format
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{metric: aggregation.MetricDuration, durationFormat: csvoutput.DurationFormatGo}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Cell styles, they are indexes of the cellXfs of the styles part.
+const (
+	styleGeneral = iota
+	styleInteger
+	styleDecimal
+	styleClock
+)
+
+const stylesXML = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<numFmts count="2"><numFmt numFmtId="164" formatCode="0.000"/><numFmt numFmtId="165" formatCode="[h]:mm:ss"/></numFmts>
+<fonts count="1"><font><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="4">
+<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>
+<xf numFmtId="1" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+</cellXfs>
+</styleSheet>
+`
+
+// maxSheetName is the max number of characters of a sheet name.
+const maxSheetName = 31
+
+type sheet struct {
+	name string
+	rows [][]cell
+}
+
+// cell is either a text or a number with the style.
+type cell struct {
+	text   string
+	number float64
+	isText bool
+	style  int
+}
+
+func WriteXLSXReportToFile(filePath string, report aggregation.StatisticsReport, opts ...Option) error {
+	return writeToFile(filePath, func(w io.Writer) error {
+		return WriteXLSXReport(w, report, opts...)
+	})
+}
+
+func WriteXLSXZonesReportToFile(filePath string, report aggregation.ZonesReport, opts ...Option) error {
+	return writeToFile(filePath, func(w io.Writer) error {
+		return WriteXLSXZonesReport(w, report, opts...)
+	})
+}
+
+func WriteXLSXPeriodsReportToFile(filePath string, report aggregation.PeriodsReport, opts ...Option) error {
+	return writeToFile(filePath, func(w io.Writer) error {
+		return WriteXLSXPeriodsReport(w, report, opts...)
+	})
+}
+
+func writeToFile(filePath string, write func(w io.Writer) error) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return errors.Wrap(err, "can't open output file for writing")
+	}
+	defer f.Close() // nolint: errcheck, gosec
+	if err := write(f); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "can't close output xlsx file")
+	}
+	return nil
+}
+
+// WriteXLSXReport writes the report into a workbook with a single sheet laid out like the csv report.
+func WriteXLSXReport(w io.Writer, report aggregation.StatisticsReport, opts ...Option) error {
+	o := newOptions(opts)
+	return writeWorkbook(w, []*sheet{o.reportSheet("Statistics", report)})
+}
+
+// WriteXLSXZonesReport writes the report of each zone into its own sheet named after the zone,
+// "<pickup> - <drop-off>" if rides are bucketed by drop-off zones.
+func WriteXLSXZonesReport(w io.Writer, report aggregation.ZonesReport, opts ...Option) error {
+	o := newOptions(opts)
+	sheets := make([]*sheet, 0, len(report))
+	for _, zs := range report {
+		name := zs.Pickup
+		if zs.Dropoff != "" {
+			name += " - " + zs.Dropoff
+		}
+		sheets = append(sheets, o.reportSheet(name, zs.Report))
+	}
+	return writeWorkbook(w, sheets)
+}
+
+// WriteXLSXPeriodsReport writes the report of each period into its own sheet named after the UTC date of its start.
+func WriteXLSXPeriodsReport(w io.Writer, report aggregation.PeriodsReport, opts ...Option) error {
+	o := newOptions(opts)
+	sheets := make([]*sheet, 0, len(report))
+	for _, ps := range report {
+		name := time.Unix(int64(ps.Start), 0).UTC().Format("2006-01-02")
+		sheets = append(sheets, o.reportSheet(name, ps.Report))
+	}
+	return writeWorkbook(w, sheets)
+}
+
+// reportSheet returns the sheet with a row per hour and a column per distance range, each distance range has
+// the lower and upper bounds columns after its value column if the report has confidence intervals.
+func (o *options) reportSheet(name string, report aggregation.StatisticsReport) *sheet {
+	s := &sheet{name: name}
+	for i, hs := range report {
+		if i == 0 {
+			header := []cell{textCell("Time of Day")}
+			for _, ds := range hs.DistanceStatistics {
+				header = append(header, textCell(ds.RangeName()))
+				if ds.Interval != nil {
+					header = append(header, textCell(ds.RangeName()+" Lower"), textCell(ds.RangeName()+" Upper"))
+				}
+			}
+			s.rows = append(s.rows, header)
+		}
+		row := []cell{textCell(fmt.Sprintf("%02d:00", hs.StartHour))}
+		for _, ds := range hs.DistanceStatistics {
+			row = append(row, o.valueCell(ds.ExactValue()))
+			if ds.Interval != nil {
+				row = append(row, o.valueCell(float64(ds.Interval.Lower)), o.valueCell(float64(ds.Interval.Upper)))
+			}
+		}
+		s.rows = append(s.rows, row)
+	}
+	return s
+}
+
+// valueCell returns the cell of a value of the report of the metric, the seconds and minutes with decimals
+// keep the fraction of a second and other values are rounded to whole seconds or meters per hour.
+func (o *options) valueCell(exactValue float64) cell {
+	const (
+		metersInKm      = 1000
+		secondsInMinute = 60
+		secondsInDay    = 24 * 3600
+	)
+	value := math.Round(exactValue)
+	if o.metric == aggregation.MetricSpeed {
+		return cell{number: value / metersInKm, style: styleDecimal}
+	}
+	switch o.durationFormat {
+	case csvoutput.DurationFormatSeconds:
+		return cell{number: value, style: styleInteger}
+	case csvoutput.DurationFormatSecondsFloat:
+		return cell{number: exactValue, style: styleDecimal}
+	case csvoutput.DurationFormatMinutes:
+		return cell{number: exactValue / secondsInMinute, style: styleDecimal}
+	case csvoutput.DurationFormatClock:
+		return cell{number: value / secondsInDay, style: styleClock}
+	default:
+		return textCell((time.Duration(value) * time.Second).String())
+	}
+}
+
+// part is a file of the workbook zip archive.
+type part struct {
+	name    string
+	content string
+}
+
+func textCell(text string) cell {
+	return cell{text: text, isText: true}
+}
+
+// writeWorkbook writes the sheets as an Office Open XML workbook: a zip archive of the XML parts.
+// Texts are written as inline strings, so the workbook doesn't need the shared strings part.
+func writeWorkbook(w io.Writer, sheets []*sheet) error {
+	names := sheetNames(sheets)
+	var contentTypes, workbook, workbookRels strings.Builder
+	contentTypes.WriteString(xml.Header +
+		`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ` +
+		`ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ` +
+		`ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	workbook.WriteString(xml.Header +
+		`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	workbookRels.WriteString(xml.Header +
+		`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i := range sheets {
+		n := i + 1
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" `+
+			`ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&workbook, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, escape(names[i]), n, n)
+		fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" `+
+			`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" `+
+			`Target="worksheets/sheet%d.xml"/>`, n, n)
+	}
+	contentTypes.WriteString(`</Types>`)
+	workbook.WriteString(`</sheets></workbook>`)
+	fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" `+
+		`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" `+
+		`Target="styles.xml"/></Relationships>`, len(sheets)+1)
+
+	parts := []part{
+		{name: "[Content_Types].xml", content: contentTypes.String()},
+		{name: "_rels/.rels", content: xml.Header +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" ` +
+			`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" ` +
+			`Target="xl/workbook.xml"/></Relationships>`},
+		{name: "xl/workbook.xml", content: workbook.String()},
+		{name: "xl/_rels/workbook.xml.rels", content: workbookRels.String()},
+		{name: "xl/styles.xml", content: stylesXML},
+	}
+	for i, s := range sheets {
+		parts = append(parts, part{name: fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), content: s.xml()})
+	}
+
+	zw := zip.NewWriter(w)
+	for _, part := range parts {
+		pw, err := zw.Create(part.name)
+		if err != nil {
+			return errors.Wrap(err, "can't write report to xlsx")
+		}
+		if _, err := io.WriteString(pw, part.content); err != nil {
+			return errors.Wrap(err, "can't write report to xlsx")
+		}
+	}
+	return errors.Wrap(zw.Close(), "can't write report to xlsx")
+}
+
+// xml returns the worksheet part of the sheet.
+func (s *sheet) xml() string {
+	var b strings.Builder
+	b.WriteString(xml.Header +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for i, row := range s.rows {
+		fmt.Fprintf(&b, `<row r="%d">`, i+1)
+		for j, c := range row {
+			ref := columnName(j) + strconv.Itoa(i+1)
+			if c.isText {
+				fmt.Fprintf(&b, `<c r="%s" t="inlineStr"><is><t>%s</t></is></c>`, ref, escape(c.text))
+				continue
+			}
+			number := strconv.FormatFloat(c.number, 'g', -1, 64)
+			fmt.Fprintf(&b, `<c r="%s" s="%d"><v>%s</v></c>`, ref, c.style, number)
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	return b.String()
+}
+
+// columnName returns the name of the zero based column: A, B, ..., Z, AA, AB and so on.
+func columnName(column int) string {
+	name := ""
+	for column++; column > 0; column = (column - 1) / 26 {
+		name = string(rune('A'+(column-1)%26)) + name
+	}
+	return name
+}
+
+// sheetNames returns unique sheet names, characters that aren't allowed in sheet names are replaced with "_"
+// and names are cut to the max length. A number is appended to names that are already taken.
+func sheetNames(sheets []*sheet) []string {
+	names := make([]string, len(sheets))
+	taken := make(map[string]bool, len(sheets))
+	for i, s := range sheets {
+		base := strings.Map(func(r rune) rune {
+			if strings.ContainsRune(`:\/?*[]`, r) {
+				return '_'
+			}
+			return r
+		}, s.name)
+		if base == "" {
+			base = "Sheet"
+		}
+		name := truncate(base, maxSheetName)
+		for n := 2; taken[strings.ToLower(name)]; n++ {
+			suffix := fmt.Sprintf(" (%d)", n)
+			name = truncate(base, maxSheetName-len(suffix)) + suffix
+		}
+		taken[strings.ToLower(name)] = true
+		names[i] = name
+	}
+	return names
+}
+
+func truncate(s string, maxChars int) string {
+	if utf8.RuneCountInString(s) <= maxChars {
+		return s
+	}
+	return string([]rune(s)[:maxChars])
+}
+
+func escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s)) // nolint: errcheck, gosec
+	return b.String()
+}
@@ -0,0 +1,113 @@
+package xlsxoutput_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/csvoutput"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/xlsxoutput"
+)
+
+func TestWriteXLSXReport(t *testing.T) {
+	t.Parallel()
+	report := aggregation.StatisticsReport{{StartHour: 9, DistanceStatistics: []*aggregation.DistanceStatistics{
+		{DistanceRange: 1, Value: 452, Fraction: 0.25, Count: 2},
+		{DistanceRange: aggregation.DistanceRangeOver21KM, Value: 0},
+	}}}
+	cases := []struct {
+		format   string
+		expected string
+	}{
+		{format: csvoutput.DurationFormatGo, expected: `<c r="B2" t="inlineStr"><is><t>7m32s</t></is></c>`},
+		{format: csvoutput.DurationFormatSeconds, expected: `<c r="B2" s="1"><v>452</v></c>`},
+		{format: csvoutput.DurationFormatSecondsFloat, expected: `<c r="B2" s="2"><v>452.25</v></c>`},
+		{format: csvoutput.DurationFormatMinutes, expected: `<c r="B2" s="2"><v>7.5375</v></c>`},
+		{format: csvoutput.DurationFormatClock, expected: `<c r="B2" s="3"><v>0.005231481481481481</v></c>`},
+	}
+	for _, tc := range cases {
+		w := &bytes.Buffer{}
+		err := xlsxoutput.WriteXLSXReport(w, report, xlsxoutput.WithDurationFormat(tc.format))
+		require.NoError(t, err, tc.format)
+		parts := readParts(t, w.Bytes())
+
+		assert.Contains(t, parts["xl/workbook.xml"], `<sheet name="Statistics" sheetId="1" r:id="rId1"/>`, tc.format)
+		sheet := parts["xl/worksheets/sheet1.xml"]
+		assert.Contains(t, sheet, `<row r="1"><c r="A1" t="inlineStr"><is><t>Time of Day</t></is></c>`+
+			`<c r="B1" t="inlineStr"><is><t>0-1 km</t></is></c><c r="C1" t="inlineStr"><is><t>21+ km</t></is></c></row>`,
+			tc.format)
+		assert.Contains(t, sheet, `<row r="2"><c r="A2" t="inlineStr"><is><t>09:00</t></is></c>`+tc.expected, tc.format)
+	}
+
+	w := &bytes.Buffer{}
+	err := xlsxoutput.WriteXLSXReport(w, report, xlsxoutput.WithMetric(aggregation.MetricSpeed))
+	require.NoError(t, err)
+	assert.Contains(t, readParts(t, w.Bytes())["xl/worksheets/sheet1.xml"], `<c r="B2" s="2"><v>0.452</v></c>`)
+}
+
+func TestWriteXLSXZonesReport(t *testing.T) {
+	t.Parallel()
+	hourReport := aggregation.StatisticsReport{{StartHour: 0, DistanceStatistics: []*aggregation.DistanceStatistics{
+		{DistanceRange: 1, Value: 60, Count: 1},
+	}}}
+	report := aggregation.ZonesReport{
+		{Zone: aggregation.Zone{Pickup: "airport", Dropoff: "downtown"}, Report: hourReport},
+		{Zone: aggregation.Zone{Pickup: "a/b", Dropoff: "c"}, Report: hourReport},
+		{Zone: aggregation.Zone{Pickup: "a:b", Dropoff: "c"}, Report: hourReport},
+		{Zone: aggregation.Zone{Pickup: "a very long pickup zone name", Dropoff: "downtown"}, Report: hourReport},
+	}
+	w := &bytes.Buffer{}
+
+	require.NoError(t, xlsxoutput.WriteXLSXZonesReport(w, report))
+	parts := readParts(t, w.Bytes())
+	workbook := parts["xl/workbook.xml"]
+	assert.Contains(t, workbook, `<sheet name="airport - downtown" sheetId="1" r:id="rId1"/>`)
+	assert.Contains(t, workbook, `<sheet name="a_b - c" sheetId="2" r:id="rId2"/>`)
+	assert.Contains(t, workbook, `<sheet name="a_b - c (2)" sheetId="3" r:id="rId3"/>`)
+	assert.Contains(t, workbook, `<sheet name="a very long pickup zone name - " sheetId="4" r:id="rId4"/>`)
+	assert.Contains(t, parts["xl/_rels/workbook.xml.rels"], `Target="worksheets/sheet4.xml"/>`)
+	assert.Contains(t, parts["xl/worksheets/sheet4.xml"], `<t>1m0s</t>`)
+}
+
+func TestWriteXLSXPeriodsReport(t *testing.T) {
+	t.Parallel()
+	hourReport := aggregation.StatisticsReport{{StartHour: 0, DistanceStatistics: []*aggregation.DistanceStatistics{
+		{DistanceRange: 1, Value: 60, Count: 1, Interval: &aggregation.Interval{Lower: 50, Upper: 70}},
+	}}}
+	report := aggregation.PeriodsReport{
+		{Start: 1609113600, Report: hourReport},
+		{Start: 1609200000, Report: hourReport},
+	}
+	w := &bytes.Buffer{}
+
+	err := xlsxoutput.WriteXLSXPeriodsReport(w, report, xlsxoutput.WithDurationFormat(csvoutput.DurationFormatSeconds))
+	require.NoError(t, err)
+	parts := readParts(t, w.Bytes())
+	assert.Contains(t, parts["xl/workbook.xml"], `<sheet name="2020-12-28" sheetId="1" r:id="rId1"/>`+
+		`<sheet name="2020-12-29" sheetId="2" r:id="rId2"/>`)
+	assert.Contains(t, parts["xl/worksheets/sheet2.xml"], `<c r="C1" t="inlineStr"><is><t>0-1 km Lower</t></is></c>`)
+	assert.Contains(t, parts["xl/worksheets/sheet2.xml"],
+		`<c r="B2" s="1"><v>60</v></c><c r="C2" s="1"><v>50</v></c><c r="D2" s="1"><v>70</v></c>`)
+	assert.Contains(t, parts["[Content_Types].xml"], `<Override PartName="/xl/worksheets/sheet2.xml"`)
+}
+
+// readParts returns the contents of the workbook parts by their names.
+func readParts(t *testing.T, workbook []byte) map[string]string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(workbook), int64(len(workbook)))
+	require.NoError(t, err)
+	parts := map[string]string{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		parts[f.Name] = string(content)
+	}
+	return parts
+}
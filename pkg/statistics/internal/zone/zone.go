@@ -0,0 +1,233 @@
+package zone
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Locator finds the zone a point given by lat and lng in degrees belongs to.
+// False is returned if the point doesn't belong to any zone.
+type Locator interface {
+	Zone(lat, lng float64) (string, bool)
+}
+
+const (
+	MinGeohashPrecision = 1
+	MaxGeohashPrecision = 12
+	geohashAlphabet     = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+// Geohash splits the world into geohash cells of the given precision (number of characters),
+// e.g. cells are about 5 x 5 km for precision 5 and 1.2 x 0.6 km for precision 6.
+type Geohash struct {
+	precision int
+}
+
+func NewGeohash(precision int) (*Geohash, error) {
+	if precision < MinGeohashPrecision || precision > MaxGeohashPrecision {
+		return nil, errors.Errorf(
+			"geohash precision must be between %d and %d", MinGeohashPrecision, MaxGeohashPrecision,
+		)
+	}
+	return &Geohash{precision: precision}, nil
+}
+
+func (g *Geohash) Zone(lat, lng float64) (string, bool) {
+	latRange, lngRange := [2]float64{-90, 90}, [2]float64{-180, 180}
+	hash := make([]byte, g.precision)
+	// Bits alternate between lng and lat starting with lng, each character encodes 5 bits.
+	isLng := true
+	for i := range hash {
+		var char byte
+		for bit := 0; bit < 5; bit++ {
+			r, v := &latRange, lat
+			if isLng {
+				r, v = &lngRange, lng
+			}
+			mid := (r[0] + r[1]) / 2
+			char <<= 1
+			if v >= mid {
+				char |= 1
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			isLng = !isLng
+		}
+		hash[i] = geohashAlphabet[char]
+	}
+	return string(hash), true
+}
+
+// Polygons are zones given by Polygon and MultiPolygon features of a GeoJSON file.
+// The zone name is taken from the "name" property, the feature id or the feature index in that order.
+// If zones overlap, the point belongs to the first one in the file.
+type Polygons struct {
+	zones []*polygonZone
+}
+
+type polygonZone struct {
+	name string
+	// polygons are lists of rings, the first ring is the outer boundary and the others are holes.
+	polygons [][][][2]float64
+	// Bounding box of the zone to skip most of the zones without checking polygons.
+	minLat, minLng, maxLat, maxLng float64
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	ID         interface{}            `json:"id"`
+	Properties map[string]interface{} `json:"properties"`
+	Geometry   *struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	} `json:"geometry"`
+}
+
+func LoadPolygons(filePath string) (*Polygons, error) {
+	f, err := os.Open(path.Clean(filePath))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't open zones file")
+	}
+	defer f.Close() // nolint: errcheck, gosec
+	collection := &struct {
+		Type     string            `json:"type"`
+		Features []*geoJSONFeature `json:"features"`
+	}{}
+	if err := json.NewDecoder(f).Decode(collection); err != nil {
+		return nil, errors.Wrap(err, "can't decode zones GeoJSON")
+	}
+	if collection.Type != "FeatureCollection" {
+		return nil, errors.Errorf("zones GeoJSON must be a FeatureCollection, got %s", collection.Type)
+	}
+	p := &Polygons{}
+	for i, feature := range collection.Features {
+		if feature.Geometry == nil {
+			continue
+		}
+		var polygons [][][][2]float64
+		switch feature.Geometry.Type {
+		case "Polygon":
+			var polygon [][][2]float64
+			if err := json.Unmarshal(feature.Geometry.Coordinates, &polygon); err != nil {
+				return nil, errors.Wrapf(err, "can't decode polygon of feature %d", i)
+			}
+			polygons = [][][][2]float64{polygon}
+		case "MultiPolygon":
+			if err := json.Unmarshal(feature.Geometry.Coordinates, &polygons); err != nil {
+				return nil, errors.Wrapf(err, "can't decode multipolygon of feature %d", i)
+			}
+		default:
+			continue
+		}
+		p.zones = append(p.zones, newPolygonZone(featureName(feature, i), polygons))
+	}
+	if len(p.zones) == 0 {
+		return nil, errors.New("zones file doesn't contain any polygons")
+	}
+	return p, nil
+}
+
+func featureName(feature *geoJSONFeature, idx int) string {
+	if name, ok := feature.Properties["name"].(string); ok && strings.TrimSpace(name) != "" {
+		return name
+	}
+	if feature.ID != nil {
+		return fmt.Sprint(feature.ID)
+	}
+	return fmt.Sprintf("zone-%d", idx)
+}
+
+func newPolygonZone(name string, polygons [][][][2]float64) *polygonZone {
+	z := &polygonZone{name: name, polygons: polygons, minLat: 90, minLng: 180, maxLat: -90, maxLng: -180}
+	for _, polygon := range polygons {
+		if len(polygon) == 0 {
+			continue
+		}
+		// GeoJSON positions are [lng, lat].
+		for _, position := range polygon[0] {
+			lng, lat := position[0], position[1]
+			if lat < z.minLat {
+				z.minLat = lat
+			}
+			if lat > z.maxLat {
+				z.maxLat = lat
+			}
+			if lng < z.minLng {
+				z.minLng = lng
+			}
+			if lng > z.maxLng {
+				z.maxLng = lng
+			}
+		}
+	}
+	return z
+}
+
+func (p *Polygons) Zone(lat, lng float64) (string, bool) {
+	for _, z := range p.zones {
+		if z.contains(lat, lng) {
+			return z.name, true
+		}
+	}
+	return "", false
+}
+
+func (z *polygonZone) contains(lat, lng float64) bool {
+	if lat < z.minLat || lat > z.maxLat || lng < z.minLng || lng > z.maxLng {
+		return false
+	}
+	for _, polygon := range z.polygons {
+		if len(polygon) == 0 || !ringContains(polygon[0], lat, lng) {
+			continue
+		}
+		inHole := false
+		for _, hole := range polygon[1:] {
+			if ringContains(hole, lat, lng) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+// ringContains checks if the point is inside the ring with the ray casting algorithm.
+// Coordinates are treated as planar, which is accurate enough for city zones.
+func ringContains(ring [][2]float64, lat, lng float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		lngI, latI := ring[i][0], ring[i][1]
+		lngJ, latJ := ring[j][0], ring[j][1]
+		if (latI > lat) != (latJ > lat) && lng < (lngJ-lngI)*(lat-latI)/(latJ-latI)+lngI {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+const geohashSpecPrefix = "geohash:"
+
+// NewLocator returns the geohash grid for the "geohash:<precision>" spec, e.g. "geohash:6",
+// otherwise the spec is a path to the GeoJSON file with zone polygons.
+func NewLocator(spec string) (Locator, error) {
+	if strings.HasPrefix(spec, geohashSpecPrefix) {
+		precision, err := strconv.Atoi(strings.TrimPrefix(spec, geohashSpecPrefix))
+		if err != nil {
+			return nil, errors.Errorf("invalid geohash precision in zones spec: %s", spec)
+		}
+		g, err := NewGeohash(precision)
+		return g, errors.WithStack(err)
+	}
+	p, err := LoadPolygons(spec)
+	return p, errors.WithStack(err)
+}
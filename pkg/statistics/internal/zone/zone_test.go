@@ -0,0 +1,75 @@
+package zone_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/zone"
+)
+
+func TestGeohash_Zone(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		lat, lng  float64
+		precision int
+		expected  string
+	}{
+		{lat: 57.64911, lng: 10.40744, precision: 11, expected: "u4pruydqqvj"},
+		{lat: 42.605, lng: -5.603, precision: 5, expected: "ezs42"},
+		{lat: -90, lng: -180, precision: 1, expected: "0"},
+		{lat: 90, lng: 180, precision: 1, expected: "z"},
+	}
+	for _, tc := range cases {
+		g, err := zone.NewGeohash(tc.precision)
+		require.NoError(t, err)
+		actual, ok := g.Zone(tc.lat, tc.lng)
+		assert.True(t, ok)
+		assert.Equal(t, tc.expected, actual, "lat %v, lng %v", tc.lat, tc.lng)
+	}
+}
+
+func TestPolygons_Zone(t *testing.T) {
+	t.Parallel()
+	polygons, err := zone.LoadPolygons("testdata/zones.geojson")
+	require.NoError(t, err)
+	cases := []struct {
+		name     string
+		lat, lng float64
+		expected string
+	}{
+		{name: "inside polygon", lat: 37.92, lng: 23.92, expected: "airport"},
+		{name: "inside polygon hole", lat: 37.95, lng: 23.95},
+		{name: "first polygon of multipolygon", lat: 37.97, lng: 23.72, expected: "downtown"},
+		{name: "second polygon of multipolygon", lat: 37.91, lng: 23.625, expected: "downtown"},
+		{name: "feature without name", lat: 37.91, lng: 23.78, expected: "7"},
+		{name: "inside bounding box but outside triangle", lat: 37.94, lng: 23.61},
+		{name: "outside all zones", lat: 37.5, lng: 23.5},
+	}
+	for _, tc := range cases {
+		actual, ok := polygons.Zone(tc.lat, tc.lng)
+		assert.Equal(t, tc.expected != "", ok, tc.name)
+		assert.Equal(t, tc.expected, actual, tc.name)
+	}
+}
+
+func TestNewLocator(t *testing.T) {
+	t.Parallel()
+	locator, err := zone.NewLocator("geohash:3")
+	require.NoError(t, err)
+	actual, _ := locator.Zone(37.966660, 23.728308)
+	assert.Equal(t, "sw8", actual)
+
+	locator, err = zone.NewLocator("testdata/zones.geojson")
+	require.NoError(t, err)
+	actual, _ = locator.Zone(37.92, 23.92)
+	assert.Equal(t, "airport", actual)
+
+	_, err = zone.NewLocator("geohash:13")
+	assert.EqualError(t, err, "geohash precision must be between 1 and 12")
+	_, err = zone.NewLocator("geohash:x")
+	assert.EqualError(t, err, "invalid geohash precision in zones spec: geohash:x")
+	_, err = zone.NewLocator("testdata/missing.geojson")
+	assert.Error(t, err)
+}
@@ -0,0 +1,63 @@
+package statistics
+
+import (
+	"reflect"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+)
+
+const (
+	// rowBatchesBufferSize is the buffer size of each rows channel in batches.
+	rowBatchesBufferSize = 4
+	// rideBatchesBufferSize is the buffer size of the rides channel in batches.
+	rideBatchesBufferSize = 64
+
+	// buffersMemoryShare is the part of the memory budget for the channels buffers: a quarter.
+	buffersMemoryShare = 4
+	durationSize       = 8
+)
+
+// memoryBudget is the pipeline configuration calculated from the max memory option.
+type memoryBudget struct {
+	rowBatchesBufferSize  int
+	rideBatchesBufferSize int
+	// maxDurations is the number of durations the aggregator keeps in memory before spilling them to disk.
+	// Zero means no limit.
+	maxDurations int
+}
+
+// newMemoryBudget splits the max memory between the channels buffers and the aggregated durations.
+// Buffers are never bigger than without the budget and always have a room for at least one batch.
+// The budget is approximate, it doesn't include memory of the batches being processed and of the runtime.
+func newMemoryBudget(maxMemory, concurrency int) memoryBudget {
+	if maxMemory == 0 {
+		return memoryBudget{
+			rowBatchesBufferSize:  rowBatchesBufferSize,
+			rideBatchesBufferSize: rideBatchesBufferSize,
+		}
+	}
+	buffersMemory := maxMemory / buffersMemoryShare
+	rowBatchMemory := ride.BatchSize * int(reflect.TypeOf(ride.Row{}).Size())
+	rideBatchMemory := ride.BatchSize * int(reflect.TypeOf(ride.Data{}).Size())
+	// Durations slices grow by doubling and are copied when workers partial cells are merged,
+	// so only a half of the remaining memory is used for the durations themselves.
+	maxDurations := (maxMemory - buffersMemory) / 2 / durationSize
+	if maxDurations == 0 {
+		maxDurations = 1
+	}
+	return memoryBudget{
+		rowBatchesBufferSize:  clamp(buffersMemory/2/concurrency/rowBatchMemory, 1, rowBatchesBufferSize),
+		rideBatchesBufferSize: clamp(buffersMemory/2/rideBatchMemory, 1, rideBatchesBufferSize),
+		maxDurations:          maxDurations,
+	}
+}
+
+func clamp(v, lower, upper int) int {
+	if v < lower {
+		return lower
+	}
+	if v > upper {
+		return upper
+	}
+	return v
+}
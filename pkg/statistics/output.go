@@ -0,0 +1,53 @@
+package statistics
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/csvoutput"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/xlsxoutput"
+)
+
+// Report output formats.
+const (
+	OutputFormatCSV  = "csv"
+	OutputFormatXLSX = "xlsx"
+)
+
+func isDurationFormat(format string) bool {
+	for _, f := range csvoutput.DurationFormats() {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *options) writeReport(outputPath string, report aggregation.StatisticsReport) error {
+	if o.outputFormat == OutputFormatXLSX {
+		return errors.WithStack(xlsxoutput.WriteXLSXReportToFile(outputPath, report, o.xlsxOptions()...))
+	}
+	return errors.WithStack(csvoutput.WriteCSVReportToFile(outputPath, report, o.csvOptions()...))
+}
+
+func (o *options) writeZonesReport(outputPath string, report aggregation.ZonesReport) error {
+	if o.outputFormat == OutputFormatXLSX {
+		return errors.WithStack(xlsxoutput.WriteXLSXZonesReportToFile(outputPath, report, o.xlsxOptions()...))
+	}
+	return errors.WithStack(csvoutput.WriteCSVZonesReportToFile(outputPath, report, o.csvOptions()...))
+}
+
+func (o *options) writePeriodsReport(outputPath string, report aggregation.PeriodsReport) error {
+	if o.outputFormat == OutputFormatXLSX {
+		return errors.WithStack(xlsxoutput.WriteXLSXPeriodsReportToFile(outputPath, report, o.xlsxOptions()...))
+	}
+	return errors.WithStack(csvoutput.WriteCSVPeriodsReportToFile(outputPath, report, o.csvOptions()...))
+}
+
+func (o *options) csvOptions() []csvoutput.Option {
+	return []csvoutput.Option{csvoutput.WithMetric(o.metric), csvoutput.WithDurationFormat(o.durationFormat)}
+}
+
+func (o *options) xlsxOptions() []xlsxoutput.Option {
+	return []xlsxoutput.Option{xlsxoutput.WithMetric(o.metric), xlsxoutput.WithDurationFormat(o.durationFormat)}
+}
@@ -0,0 +1,107 @@
+package statistics
+
+import (
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/checkpoint"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/fileread"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/metrics"
+)
+
+const defaultProgressInterval = 64 * 1024 * 1024
+
+type saveProgressFunc func(offset int, state *aggregation.State) error
+
+func calculateResumableReport(inputPath string, concurrency int, o *options, m *metrics.Pipeline,
+) (aggregation.StatisticsReport, error) {
+	var (
+		start int
+		state *aggregation.State
+	)
+	if o.resume {
+		cp, err := checkpoint.Load(o.progressFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if cp != nil {
+			matches, err := cp.Matches(inputPath)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if !matches {
+				return nil, errors.New("input file doesn't match the progress file, can't resume")
+			}
+			if cp.OptionsFingerprint != o.stateFingerprint() {
+				return nil, errors.New("options differ from the ones the progress file was saved with, can't resume")
+			}
+			start = cp.Offset
+			state = cp.State
+			log.Printf("Resume processing input file from the offset %d", start)
+		} else {
+			log.Printf("Progress file doesn't exist, process input file from the beginning")
+		}
+	}
+	saveProgress := func(offset int, state *aggregation.State) error {
+		return errors.WithStack(saveCheckpoint(inputPath, o.progressFile, o.stateFingerprint(), offset, state))
+	}
+	aggregator, err := aggregateRidesWithProgress(
+		inputPath, fileread.Range{Start: start, End: fileread.ToEnd}, concurrency, o, state, m, saveProgress,
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return aggregator.Report95Percentile(), nil
+}
+
+// aggregateRidesWithProgress runs the pipeline over the input file range part by part.
+// Each part is about the progress interval bytes long and ends at a ride sequence beginning,
+// after each part except the last one the aggregated state is passed to the saveProgress function,
+// so the processing can be resumed from that point.
+func aggregateRidesWithProgress(inputPath string, fileRange fileread.Range, concurrency int, o *options,
+	state *aggregation.State, m *metrics.Pipeline, saveProgress saveProgressFunc,
+) (*aggregation.RidesAggregator, error) {
+	fileStat, err := os.Stat(inputPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get input csv file stat")
+	}
+	end := int(fileStat.Size())
+	if fileRange.End != fileread.ToEnd && fileRange.End < end {
+		end = fileRange.End
+	}
+	start := fileRange.Start
+	for {
+		partEnd, err := fileread.NextRideOffset(inputPath, start+o.progressInterval)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't find the input file part end")
+		}
+		if partEnd > end {
+			partEnd = end
+		}
+		aggregator, err := aggregateRides(inputPath, fileread.Range{Start: start, End: partEnd}, concurrency, o, state, m)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if partEnd == end {
+			return aggregator, nil
+		}
+		state = aggregator.State()
+		if err := saveProgress(partEnd, state); err != nil {
+			return nil, errors.Wrap(err, "can't save progress")
+		}
+		start = partEnd
+	}
+}
+
+func saveCheckpoint(inputPath, checkpointPath string, optionsFingerprint uint32, offset int,
+	state *aggregation.State,
+) error {
+	cp, err := checkpoint.New(inputPath, offset, optionsFingerprint, state)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(checkpoint.Save(checkpointPath, cp))
+}
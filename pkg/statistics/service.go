@@ -0,0 +1,58 @@
+package statistics
+
+import (
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/httpapi"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/metrics"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/prediction"
+)
+
+// Service keeps the statistics report calculated from the input file in memory and serves it over HTTP.
+type Service struct {
+	inputPath   string
+	concurrency int
+
+	mx     *sync.RWMutex
+	report aggregation.StatisticsReport
+	// predictor is built from the report once per reload and swapped together with it.
+	predictor *prediction.Predictor
+}
+
+func NewService(inputPath string, concurrency int) *Service {
+	return &Service{
+		inputPath:   inputPath,
+		concurrency: concurrency,
+		mx:          new(sync.RWMutex),
+	}
+}
+
+// Reload recalculates the report from the input file.
+// If the calculation fails the previous report is kept.
+func (s *Service) Reload() error {
+	m := metrics.NewPipeline()
+	report, err := calculateReport(s.inputPath, s.concurrency, newOptions(nil), m)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	log.Printf("Report reloaded: %s", m.Summary())
+	predictor := prediction.NewPredictor(report, prediction.DefaultMinSamples)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.report = report
+	s.predictor = predictor
+	return nil
+}
+
+func (s *Service) Handler() http.Handler {
+	return httpapi.NewHandler(func() (aggregation.StatisticsReport, *prediction.Predictor) {
+		s.mx.RLock()
+		defer s.mx.RUnlock()
+		return s.report, s.predictor
+	})
+}
@@ -0,0 +1,49 @@
+package statistics_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics"
+)
+
+func TestService(t *testing.T) {
+	t.Parallel()
+	service := statistics.NewService("testdata/complete_input.csv", 4)
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/p95?start=2014-07-17T09:10:00Z&distance_km=4.6")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	err = service.Reload()
+	require.NoError(t, err)
+
+	resp, err = http.Get(server.URL + "/p95?start=2014-07-17T09:10:00Z&distance_km=4.6")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	expected := `{"start_hour":9,"distance_range":"3-5 km","p95_seconds":1085,"p95":"18m5s","count":1}` + "\n"
+	assert.Equal(t, expected, string(body))
+}
+
+func TestService_ReloadFailure(t *testing.T) {
+	t.Parallel()
+	service := statistics.NewService("testdata/not_existing_input.csv", 4)
+
+	err := service.Reload()
+	require.Error(t, err)
+
+	w := httptest.NewRecorder()
+	service.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/report", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
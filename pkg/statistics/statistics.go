@@ -1,46 +1,765 @@
 package statistics
 
 import (
+	"io/ioutil"
+	"log"
+	"os"
+
 	"github.com/pkg/errors"
 
 	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
 	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/csvoutput"
 	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/fileread"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/jsonoutput"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/metrics"
 	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ride"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/rideexport"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/ridefilter"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/roadnet"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/zone"
 )
 
-const defaultBufferSize = 4096
+type Option func(*options)
+
+type options struct {
+	metricsAddr      string
+	metricsFile      string
+	checkpointFile   string
+	progressFile     string
+	progressInterval int
+	resume           bool
+	chunkSize        int
+	ioMode           string
+	maxMemory        int
+	spillDir         string
+	distance         string
+	roadNetwork      string
+	maxSnapDistance  float64
+	roadGraph        *roadnet.Graph
+	chunkWindow      chan struct{}
+	zones            string
+	zonesByDropoff   bool
+	ridesDump        string
+	ridesDumpFormat  string
+	filter           ridefilter.Config
+	timeSeries       string
+	bootstrapIters   int
+	bootstrapSeed    int64
+	percentile       string
+	trimming         string
+	trimmingK        float64
+	minSpeed         float64
+	maxSpeed         float64
+	histogram        string
+	histogramFormat  string
+	metric           string
+	upperInclusive   bool
+	durationFormat   string
+	outputFormat     string
+}
+
+// WithMetricsAddr enables serving pipeline metrics in the Prometheus text format
+// on the /metrics path of the given address while the calculation is running.
+func WithMetricsAddr(addr string) Option {
+	return func(o *options) {
+		o.metricsAddr = addr
+	}
+}
+
+// WithMetricsFile enables writing the final pipeline metrics snapshot in the Prometheus text format into a file.
+func WithMetricsFile(filePath string) Option {
+	return func(o *options) {
+		o.metricsFile = filePath
+	}
+}
+
+// WithCheckpoint enables incremental processing of an append-only input file.
+// The aggregated state and the input file offset it's calculated up to are saved into the checkpoint file,
+// so the next run reads the input file from that offset and merges new rides into the saved state.
+func WithCheckpoint(filePath string) Option {
+	return func(o *options) {
+		o.checkpointFile = filePath
+	}
+}
+
+// WithProgressFile enables saving the run progress into the file after processing each interval bytes of the input,
+// so a crashed run can be resumed with the WithResume option. The progress file is removed after a successful run.
+func WithProgressFile(filePath string, interval int) Option {
+	return func(o *options) {
+		o.progressFile = filePath
+		o.progressInterval = interval
+	}
+}
+
+// WithResume makes the run continue from the progress file saved by a previous run, see WithProgressFile.
+func WithResume() Option {
+	return func(o *options) {
+		o.resume = true
+	}
+}
+
+// WithChunkSize sets the approximate size of chunks the input file is split into for parallel reading.
+// Readers take chunks from a shared queue, so smaller chunks are distributed between readers more evenly.
+func WithChunkSize(size int) Option {
+	return func(o *options) {
+		o.chunkSize = size
+	}
+}
+
+// WithIOMode sets how the input file is read: "read" uses read syscalls,
+// "mmap" maps the file into memory and falls back to "read" if mmap isn't available.
+func WithIOMode(mode string) Option {
+	return func(o *options) {
+		o.ioMode = mode
+	}
+}
+
+// WithMaxMemory sets the approximate memory budget in bytes.
+// Channels buffers are sized to fit into the budget and when collected durations don't fit into it
+// they are spilled into a temporary file in the spill dir (the system temporary directory if it's empty).
+// Spilled durations are merged when the report is calculated, so the report is the same.
+func WithMaxMemory(maxMemory int, spillDir string) Option {
+	return func(o *options) {
+		o.maxMemory = maxMemory
+		o.spillDir = spillDir
+	}
+}
+
+// WithDistance sets the ride distance calculation method: "haversine", "vincenty" or "equirectangular".
+func WithDistance(name string) Option {
+	return func(o *options) {
+		o.distance = name
+	}
+}
+
+// WithRoadNetwork enables map matching: ride points are snapped to the roads from the OSM PBF or GeoJSON file
+// within the max snap distance in meters and the ride distance is calculated along the roads.
+// Points that can't be snapped are measured with the distance method set by WithDistance.
+func WithRoadNetwork(filePath string, maxSnapDistance float64) Option {
+	return func(o *options) {
+		o.roadNetwork = filePath
+		o.maxSnapDistance = maxSnapDistance
+	}
+}
+
+// WithZones enables per-zone reports: rides are bucketed by the pickup zone
+// and by the drop-off zone as well if byDropoff is true. Zones are either a geohash grid given as "geohash:<precision>"
+// or polygons from a GeoJSON file given by its path. Rides outside of the zones are dropped.
+func WithZones(spec string, byDropoff bool) Option {
+	return func(o *options) {
+		o.zones = spec
+		o.zonesByDropoff = byDropoff
+	}
+}
+
+// WithRidesDump enables writing the data of each ride into the file in the "csv" or "ndjson" format,
+// so the inputs behind each percentile can be audited. Rides are written in no particular order.
+func WithRidesDump(filePath, format string) Option {
+	return func(o *options) {
+		o.ridesDump = filePath
+		o.ridesDumpFormat = format
+	}
+}
+
+// WithTimeSeries enables time series reports: a report per UTC calendar "day" or "week" (starting on Monday)
+// or per rolling window of N days given as "rolling:N", the windows start on each day.
+// Reports are written into a single long-format CSV with a row per period, hour and distance range.
+func WithTimeSeries(spec string) Option {
+	return func(o *options) {
+		o.timeSeries = spec
+	}
+}
+
+// WithConfidenceIntervals enables the 95% confidence interval of each cell percentile,
+// the interval bounds are written in the report after each value. The interval is calculated with the bootstrap:
+// cell durations are resampled the given number of iterations, which takes time proportional to the number of rides
+// multiplied by iterations. The seed makes intervals reproducible.
+func WithConfidenceIntervals(iterations int, seed int64) Option {
+	return func(o *options) {
+		o.bootstrapIters = iterations
+		o.bootstrapSeed = seed
+	}
+}
+
+// WithPercentileMethod sets how the 95th percentile of each cell is calculated, the methods and their names
+// are the same as in numpy.percentile, e.g. "inverted_cdf" (nearest rank) or "hazen". Interpolated values are rounded
+// to whole seconds. The default is "linear", the numpy and pandas default. "round" takes the duration
+// at the position of the number of rides multiplied by 0.95 and rounded, as the earlier reports did,
+// it's kept to compare with them.
+func WithPercentileMethod(method string) Option {
+	return func(o *options) {
+		o.percentile = method
+	}
+}
+
+// WithOutlierTrimming enables trimming outliers of each cell before its percentile is calculated:
+// "iqr" trims durations outside of [Q1 - k*IQR, Q3 + k*IQR] and "mad" trims durations more than k scaled
+// median absolute deviations away from the median. Zero k means the method default: 1.5 for "iqr" and 3.5 for "mad".
+// Trimmed durations are counted as dropped outliers in the run summary. "mad" can't be used with max memory.
+func WithOutlierTrimming(method string, k float64) Option {
+	return func(o *options) {
+		o.trimming = method
+		o.trimmingK = k
+	}
+}
+
+// WithSpeedLimits enables dropping rides with the average speed outside of the limits in km/h,
+// e.g. trips drivers forgot to end. Zero max speed means there is no upper limit.
+// Dropped rides are counted as implausible speed in the run summary.
+func WithSpeedLimits(minSpeed, maxSpeed float64) Option {
+	return func(o *options) {
+		o.minSpeed = minSpeed
+		o.maxSpeed = maxSpeed
+	}
+}
+
+// WithHistogram enables the histogram report instead of the percentiles report: the number of rides of each cell
+// in duration bins given as "linear:<width>:<max>", e.g. "linear:1m:1h", or "log:<min>:<max>:<bins>",
+// e.g. "log:10s:10h:20". Linear bins start at zero, log bins are preceded by the bin of durations shorter than min,
+// both are followed by the bin of durations longer than max. The format is "csv" or "json".
+func WithHistogram(spec, format string) Option {
+	return func(o *options) {
+		o.histogram = spec
+		o.histogramFormat = format
+	}
+}
+
+// WithMetric sets the ride metric percentiles are calculated of: "duration" (the default),
+// "speed" - the average speed in km/h, or "pace" - the time per km. Speed and pace depend less on the distance
+// within a distance range than the duration. Rides without the metric value, e.g. speed of rides with zero duration,
+// are dropped. Checkpoint and progress files keep durations only, so they can't be used with other metrics.
+func WithMetric(metric string) Option {
+	return func(o *options) {
+		o.metric = metric
+	}
+}
+
+// WithUpperInclusiveDistances makes distance ranges include their upper bounds instead of lower bounds,
+// e.g. a ride of exactly 2 km is counted in the "1-2 km" range instead of "2-3 km".
+func WithUpperInclusiveDistances() Option {
+	return func(o *options) {
+		o.upperInclusive = true
+	}
+}
+
+// WithDurationFormat sets the format of durations and paces in the report: "go" durations (the default),
+// e.g. 7m32s, whole "seconds", "seconds_float", "minutes" or "hh:mm:ss".
+// Spreadsheets can sum and sort all formats but Go durations.
+// The time series csv report always writes values in seconds.
+func WithDurationFormat(format string) Option {
+	return func(o *options) {
+		o.durationFormat = format
+	}
+}
+
+// WithOutputFormat sets the format of the output file: "csv" (the default) or "xlsx" - a workbook with a sheet
+// per report: a single sheet, a sheet per zone or per period. XLSX cells are formatted numbers unless durations
+// are Go durations. Histograms have their own formats, so the output format can't be used with them.
+func WithOutputFormat(format string) Option {
+	return func(o *options) {
+		o.outputFormat = format
+	}
+}
+
+func CalculateRidesStatistics(inputPath, outputPath string, concurrency int, opts ...Option) error {
+	o := newOptions(opts)
+	if err := o.validate(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(runWithMetrics(o, func(m *metrics.Pipeline) error {
+		return calculateRidesStatistics(inputPath, outputPath, concurrency, o, m)
+	}))
+}
+
+func calculateRidesStatistics(inputPath, outputPath string, concurrency int, o *options, m *metrics.Pipeline,
+) error {
+	switch {
+	case o.histogram != "":
+		report, bins, err := calculateHistogramReport(inputPath, concurrency, o, m)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		m.StartStage(metrics.StageReport)
+		write := csvoutput.WriteCSVHistogramReportToFile
+		if o.histogramFormat == HistogramFormatJSON {
+			write = jsonoutput.WriteJSONHistogramReportToFile
+		}
+		if err := write(outputPath, report, bins); err != nil {
+			return errors.Wrap(err, "can't write histogram report into output file")
+		}
+		m.FinishStage(metrics.StageReport)
+	case o.timeSeries != "":
+		report, err := calculatePeriodsReport(inputPath, concurrency, o, m)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		m.StartStage(metrics.StageReport)
+		if err := o.writePeriodsReport(outputPath, report); err != nil {
+			return errors.Wrap(err, "can't write time series report into output file")
+		}
+		m.FinishStage(metrics.StageReport)
+	case o.zones != "":
+		report, err := calculateZonesReport(inputPath, concurrency, o, m)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		m.StartStage(metrics.StageReport)
+		if err := o.writeZonesReport(outputPath, report); err != nil {
+			return errors.Wrap(err, "can't write zones report into output file")
+		}
+		m.FinishStage(metrics.StageReport)
+	default:
+		report, err := calculateReport(inputPath, concurrency, o, m)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		m.StartStage(metrics.StageReport)
+		if err := o.writeReport(outputPath, report); err != nil {
+			return errors.Wrap(err, "can't write report into output file")
+		}
+		m.FinishStage(metrics.StageReport)
+	}
+	if o.progressFile != "" {
+		if err := os.Remove(o.progressFile); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "can't remove progress file")
+		}
+	}
+	return nil
+}
+
+// runWithMetrics runs the pipeline with metrics served during the run and written after it according to the options.
+// The snapshot is written even if the run fails, the snapshot error is returned only if the run succeeds.
+func runWithMetrics(o *options, run func(m *metrics.Pipeline) error) (err error) {
+	m := metrics.NewPipeline()
+	if o.metricsAddr != "" {
+		stopMetricsServer, err := m.Serve(o.metricsAddr)
+		if err != nil {
+			return errors.Wrap(err, "can't start metrics server")
+		}
+		defer func() {
+			if err := stopMetricsServer(); err != nil {
+				log.Printf("Can't stop metrics server: %v", err)
+			}
+		}()
+	}
+	defer func() {
+		log.Printf("Run summary: %s", m.Summary())
+		if o.metricsFile == "" {
+			return
+		}
+		if writeErr := m.WriteTextToFile(o.metricsFile); writeErr != nil {
+			if err == nil {
+				err = errors.Wrap(writeErr, "can't write metrics snapshot")
+				return
+			}
+			log.Printf("Can't write metrics snapshot: %v", writeErr)
+		}
+	}()
+	return errors.WithStack(run(m))
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		progressInterval: defaultProgressInterval,
+		chunkSize:        fileread.DefaultChunkSize,
+		ioMode:           string(fileread.IORead),
+		distance:         ride.DistanceHaversine,
+		maxSnapDistance:  roadnet.DefaultMaxSnapDistance,
+		percentile:       aggregation.PercentileLinear,
+		metric:           aggregation.MetricDuration,
+		durationFormat:   csvoutput.DurationFormatGo,
+		outputFormat:     OutputFormatCSV,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func (o *options) validate() error {
+	if o.chunkSize <= 0 {
+		return errors.New("chunk size must be a positive number")
+	}
+	switch fileread.IOMode(o.ioMode) {
+	case fileread.IORead, fileread.IOMmap:
+	default:
+		return errors.Errorf("unknown io mode: %s", o.ioMode)
+	}
+	if o.progressInterval <= 0 {
+		return errors.New("progress interval must be a positive number")
+	}
+	if o.resume && o.progressFile == "" {
+		return errors.New("progress file is required to resume")
+	}
+	if o.checkpointFile != "" && o.progressFile != "" {
+		return errors.New("checkpoint file already keeps the progress, progress file can't be used with it")
+	}
+	if _, err := ride.NewDistanceCalculator(o.distance); err != nil {
+		return errors.WithStack(err)
+	}
+	if o.roadNetwork != "" && (o.maxSnapDistance <= 0 || o.maxSnapDistance > roadnet.MaxSnapDistanceLimit) {
+		return errors.Errorf("max snap distance must be a positive number up to %d", roadnet.MaxSnapDistanceLimit)
+	}
+	if o.zonesByDropoff && o.zones == "" {
+		return errors.New("zones are required to bucket rides by drop-off zones")
+	}
+	if o.zones != "" && (o.checkpointFile != "" || o.progressFile != "") {
+		return errors.New("checkpoint and progress files don't keep zones, zones can't be used with them")
+	}
+	if o.ridesDump != "" {
+		if _, err := rideexport.NewWriter(ioutil.Discard, o.ridesDumpFormat); err != nil {
+			return errors.WithStack(err)
+		}
+		if o.checkpointFile != "" || o.progressFile != "" {
+			return errors.New("rides are processed in several runs with checkpoint and progress files, " +
+				"rides dump can't be used with them")
+		}
+	}
+	if o.timeSeries != "" {
+		_, windowDays, err := parseTimeSeries(o.timeSeries)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if o.checkpointFile != "" || o.progressFile != "" {
+			return errors.New("checkpoint and progress files don't keep periods, time series can't be used with them")
+		}
+		if o.zones != "" {
+			return errors.New("time series and zones can't be used together")
+		}
+		if windowDays != 0 && o.maxMemory > 0 {
+			return errors.New("rolling windows merge durations of several days in memory, " +
+				"max memory can't be used with them")
+		}
+	}
+	if _, err := ridefilter.New(o.filter); err != nil {
+		return errors.WithStack(err)
+	}
+	if o.bootstrapIters < 0 {
+		return errors.New("bootstrap iterations must be a positive number")
+	}
+	if !isPercentileMethod(o.percentile) {
+		return errors.Errorf("unknown percentile method: %s", o.percentile)
+	}
+	if o.histogram != "" {
+		if _, err := parseHistogramBins(o.histogram); err != nil {
+			return errors.WithStack(err)
+		}
+		switch o.histogramFormat {
+		case HistogramFormatCSV, HistogramFormatJSON:
+		default:
+			return errors.Errorf("unknown histogram format: %s", o.histogramFormat)
+		}
+		if o.checkpointFile != "" || o.progressFile != "" || o.zones != "" || o.timeSeries != "" {
+			return errors.New("histograms are calculated of all rides of the input file, " +
+				"checkpoint, progress files, zones and time series can't be used with them")
+		}
+	}
+	switch o.metric {
+	case aggregation.MetricDuration:
+	case aggregation.MetricSpeed, aggregation.MetricPace:
+		if o.checkpointFile != "" || o.progressFile != "" || o.histogram != "" {
+			return errors.New("checkpoint and progress files and histograms support durations only, " +
+				"they can't be used with other metrics")
+		}
+	default:
+		return errors.Errorf("unknown metric: %s", o.metric)
+	}
+	if !isDurationFormat(o.durationFormat) {
+		return errors.Errorf("unknown duration format: %s", o.durationFormat)
+	}
+	switch o.outputFormat {
+	case OutputFormatCSV:
+	case OutputFormatXLSX:
+		if o.histogram != "" {
+			return errors.New("histograms have their own formats, xlsx output format can't be used with them")
+		}
+	default:
+		return errors.Errorf("unknown output format: %s", o.outputFormat)
+	}
+	switch o.trimming {
+	case "", aggregation.TrimIQR:
+	case aggregation.TrimMAD:
+		if o.maxMemory > 0 {
+			return errors.New("MAD outlier trimming keeps all durations in memory, max memory can't be used with it")
+		}
+	default:
+		return errors.Errorf("unknown outlier trimming method: %s", o.trimming)
+	}
+	if o.trimmingK < 0 {
+		return errors.New("outlier trimming multiplier must be a positive number")
+	}
+	if o.minSpeed < 0 || o.maxSpeed < 0 {
+		return errors.New("speed limits must not be negative")
+	}
+	if o.maxSpeed != 0 && o.minSpeed > o.maxSpeed {
+		return errors.New("min speed must not be greater than max speed")
+	}
+	if o.maxMemory < 0 {
+		return errors.New("max memory must be a positive number")
+	}
+	if o.maxMemory > 0 && (o.checkpointFile != "" || o.progressFile != "") {
+		return errors.New("checkpoint and progress files keep all durations in memory, max memory can't be used with them")
+	}
+	return nil
+}
+
+func calculateReport(inputPath string, concurrency int, o *options, m *metrics.Pipeline,
+) (aggregation.StatisticsReport, error) {
+	if concurrency <= 0 {
+		return nil, errors.New("concurrency parameter must be a positive number")
+	}
+	if err := o.loadRoadNetwork(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if o.checkpointFile != "" {
+		report, err := calculateIncrementalReport(inputPath, concurrency, o, m)
+		return report, errors.WithStack(err)
+	}
+	if o.progressFile != "" {
+		report, err := calculateResumableReport(inputPath, concurrency, o, m)
+		return report, errors.WithStack(err)
+	}
+	aggregator, err := aggregateRides(inputPath, fileread.WholeFile, concurrency, o, nil, m)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return aggregator.Report95Percentile(), nil
+}
 
-func CalculateRidesStatistics(inputPath, outputPath string, concurrency int) error {
+func calculateZonesReport(inputPath string, concurrency int, o *options, m *metrics.Pipeline,
+) (aggregation.ZonesReport, error) {
 	if concurrency <= 0 {
-		return errors.New("concurrency parameter must be a positive number")
+		return nil, errors.New("concurrency parameter must be a positive number")
+	}
+	if err := o.loadRoadNetwork(); err != nil {
+		return nil, errors.WithStack(err)
 	}
+	aggregator, err := aggregateRides(inputPath, fileread.WholeFile, concurrency, o, nil, m)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return aggregator.ZonesReport(), nil
+}
 
-	rowsChannels := make([]chan *ride.Row, concurrency)
-	for i := 0; i < concurrency; i++ {
-		rowsChannels[i] = make(chan *ride.Row, defaultBufferSize/concurrency)
+// loadRoadNetwork loads the road network once,
+// since the pipeline can be run several times for parts of the input file.
+func (o *options) loadRoadNetwork() error {
+	if o.roadNetwork == "" || o.roadGraph != nil {
+		return nil
+	}
+	distance, err := ride.NewDistanceCalculator(o.distance)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	graph, err := roadnet.Load(o.roadNetwork, distance)
+	if err != nil {
+		return errors.Wrap(err, "can't load road network")
+	}
+	o.roadGraph = graph
+	return nil
+}
+
+// aggregateRides runs the pipeline over the input file range and returns the finished aggregator.
+// If state isn't nil it's merged into the aggregator.
+func aggregateRides(inputPath string, fileRange fileread.Range, concurrency int, o *options,
+	state *aggregation.State, m *metrics.Pipeline,
+) (*aggregation.RidesAggregator, error) {
+	budget := newMemoryBudget(o.maxMemory, concurrency)
+	ridesChannel := make(chan *ride.DataBatch, budget.rideBatchesBufferSize)
+	m.ObserveChannel("ride_batches", func() (int, int) {
+		return len(ridesChannel), cap(ridesChannel)
+	})
+
+	aggregator := aggregation.NewRidesAggregator(ridesChannel, m)
+	if err := aggregator.SetPercentileMethod(o.percentile); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := aggregator.SetMetric(o.metric); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if o.upperInclusive {
+		aggregator.EnableUpperInclusiveDistances()
+	}
+	if o.histogram != "" {
+		bins, err := parseHistogramBins(o.histogram)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err := aggregator.EnableHistograms(bins); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if o.zones != "" {
+		pickup, err := zone.NewLocator(o.zones)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't create zones")
+		}
+		var dropoff zone.Locator
+		if o.zonesByDropoff {
+			dropoff = pickup
+		}
+		aggregator.EnableZones(pickup, dropoff)
+	}
+	if o.trimming != "" {
+		if err := aggregator.EnableOutlierTrimming(o.trimming, o.trimmingMultiplier()); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if o.minSpeed != 0 || o.maxSpeed != 0 {
+		if err := aggregator.EnableSpeedLimits(o.minSpeed, o.maxSpeed); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if o.bootstrapIters != 0 {
+		if err := aggregator.EnableConfidenceIntervals(o.bootstrapIters, o.bootstrapSeed); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if o.timeSeries != "" {
+		period, _, err := parseTimeSeries(o.timeSeries)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err := aggregator.EnableTimeSeries(period); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if state != nil {
+		if err := aggregator.Merge(state); err != nil {
+			return nil, errors.Wrap(err, "can't merge aggregation state")
+		}
+	}
+
+	// Spilling is enabled last, so the spill store isn't left open if the other settings are invalid.
+	if budget.maxDurations != 0 {
+		if err := aggregator.EnableSpilling(budget.maxDurations, o.spillDir); err != nil {
+			return nil, errors.Wrap(err, "can't enable spilling")
+		}
+	}
+
+	// With the rides dump the processors send rides to the dump stage which passes them to the aggregator.
+	var err error
+	processedChannel := ridesChannel
+	dumpWait := func() error { return nil }
+	if o.ridesDump != "" {
+		processedChannel = make(chan *ride.DataBatch, budget.rideBatchesBufferSize)
+		dumpWait, err = rideexport.StartDump(processedChannel, ridesChannel, o.ridesDump, o.ridesDumpFormat)
+		if err != nil {
+			aggregator.Finish() // nolint: errcheck, gosec
+			return nil, errors.Wrap(err, "can't start rides dump")
+		}
 	}
-	ridesChannel := make(chan *ride.Data, defaultBufferSize)
 
-	fileReadersWait, err := fileread.StartFileReaders(inputPath, rowsChannels)
+	m.StartStage(metrics.StageAggregate)
+	aggregator.StartCollecting(concurrency)
+	processWait, err := startProcessing(
+		inputPath, fileRange, concurrency, o, budget.rowBatchesBufferSize, processedChannel, m,
+	)
 	if err != nil {
-		return errors.Wrap(err, "can't start file readers")
+		// Nothing is sent into the processed channel, closing it lets the dump and aggregation stages finish.
+		close(processedChannel)
+	} else {
+		err = processWait()
 	}
+	// All stages are waited for even if one of them fails, so no goroutines or files are left behind.
+	if dumpErr := dumpWait(); dumpErr != nil && err == nil {
+		err = errors.Wrap(dumpErr, "rides dump failed")
+	}
+	if finishErr := aggregator.Finish(); finishErr != nil && err == nil {
+		err = errors.Wrap(finishErr, "aggregation failed")
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	m.FinishStage(metrics.StageAggregate)
 
-	calcWait := ride.StartRidesProcessors(rowsChannels, ridesChannel)
+	return aggregator, nil
+}
 
-	aggregator := aggregation.NewRidesAggregator(ridesChannel)
-	aggregator.StartCollecting()
+// startProcessing starts the read and process stages over the input file range,
+// rides data is sent into the out channel.
+// The returned function waits for the stages to finish, the out channel is closed by then.
+func startProcessing(inputPath string, fileRange fileread.Range, concurrency int, o *options,
+	rowBatchesBufferSize int, out chan<- *ride.DataBatch, m *metrics.Pipeline,
+) (func() error, error) {
+	distance, err := ride.NewDistanceCalculator(o.distance)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if o.roadGraph != nil {
+		distance = roadnet.NewMatcher(o.roadGraph, distance, o.maxSnapDistance)
+	}
+	rowsChannels := make([]chan *ride.Batch, concurrency)
+	for i := 0; i < concurrency; i++ {
+		rowsChannels[i] = make(chan *ride.Batch, rowBatchesBufferSize)
+	}
+	m.ObserveChannel("row_batches", func() (int, int) {
+		var length, capacity int
+		for _, ch := range rowsChannels {
+			length += len(ch)
+			capacity += cap(ch)
+		}
+		return length, capacity
+	})
 
-	if err := fileReadersWait(); err != nil {
-		return errors.Wrap(err, "file readers failed")
+	var filter *ridefilter.Filter
+	if !o.filter.IsZero() {
+		if filter, err = ridefilter.New(o.filter); err != nil {
+			return nil, errors.WithStack(err)
+		}
 	}
-	calcWait()
-	aggregator.Finish()
 
-	report := aggregator.Report95Percentile()
-	if err := csvoutput.WriteCSVReportToFile(outputPath, report); err != nil {
-		return errors.Wrap(err, "can't write report into output csv file")
+	// No stage is started until all of them can be, so nothing has to be stopped on errors.
+	m.StartStage(metrics.StageRead)
+	m.StartStage(metrics.StageProcess)
+	readConfig := fileread.Config{
+		Range: fileRange, ChunkSize: o.chunkSize, IO: fileread.IOMode(o.ioMode), Window: o.chunkWindow,
 	}
-	return nil
+	fileReadersWait, err := fileread.StartFileReaders(inputPath, readConfig, rowsChannels, m)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't start file readers")
+	}
+	// With filters the processors send rides to the filter stage which passes the kept rides to the out channel.
+	processedChannel := out
+	filterWait := func() {}
+	if filter != nil {
+		filteredChannel := make(chan *ride.DataBatch, cap(out))
+		processedChannel = filteredChannel
+		filterWait = ridefilter.Start(filteredChannel, out, filter, m)
+	}
+	calcWait := ride.StartRidesProcessors(rowsChannels, processedChannel, distance, m)
+	return func() error {
+		// Readers close their channels even if they fail, so the next stages are drained and waited for anyway.
+		readErr := fileReadersWait()
+		if readErr == nil {
+			m.FinishStage(metrics.StageRead)
+		}
+		calcWait()
+		filterWait()
+		if readErr != nil {
+			return errors.Wrap(readErr, "file readers failed")
+		}
+		m.FinishStage(metrics.StageProcess)
+		return nil
+	}, nil
+}
+
+func isPercentileMethod(name string) bool {
+	for _, method := range aggregation.PercentileMethods() {
+		if method == name {
+			return true
+		}
+	}
+	return false
+}
+
+// trimmingMultiplier returns the outlier trimming multiplier or the default one of the method if it's zero.
+func (o *options) trimmingMultiplier() float64 {
+	if o.trimmingK != 0 {
+		return o.trimmingK
+	}
+	if o.trimming == aggregation.TrimMAD {
+		return aggregation.DefaultMADMultiplier
+	}
+	return aggregation.DefaultIQRMultiplier
 }
@@ -1,10 +1,17 @@
 package statistics_test
 
 import (
+	"archive/zip"
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -20,22 +27,54 @@ func TestCalculateRidesStatistics(t *testing.T) {
 
 	cases := []struct {
 		concurrency int
+		chunkSize   int
+		ioMode      string
+		maxMemory   int
+		distance    string
 	}{
 		{concurrency: 1},
 		{concurrency: 2},
 		{concurrency: 3},
 		{concurrency: 4},
 		{concurrency: 5},
+		{concurrency: 1, chunkSize: 1024},
+		{concurrency: 3, chunkSize: 1024},
+		{concurrency: 4, chunkSize: 4096},
+		{concurrency: 1, ioMode: "mmap"},
+		{concurrency: 4, chunkSize: 4096, ioMode: "mmap"},
+		{concurrency: 1, maxMemory: 1024},
+		{concurrency: 4, maxMemory: 4096},
+		{concurrency: 2, distance: "vincenty"},
+		{concurrency: 2, distance: "equirectangular"},
 	}
 	for _, tc := range cases {
 		tc := tc
-		t.Run(fmt.Sprintf("concurrency=%d", tc.concurrency), func(t *testing.T) {
+		name := fmt.Sprintf(
+			"concurrency=%d,chunk_size=%d,io=%s,max_memory=%d,distance=%s",
+			tc.concurrency, tc.chunkSize, tc.ioMode, tc.maxMemory, tc.distance,
+		)
+		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 			outputFile, err := ioutil.TempFile("", "statistics_output_*.csv")
 			require.NoError(t, err)
 			defer require.NoError(t, os.Remove(outputFile.Name()))
 
-			err = statistics.CalculateRidesStatistics("testdata/complete_input.csv", outputFile.Name(), tc.concurrency)
+			var opts []statistics.Option
+			if tc.chunkSize != 0 {
+				opts = append(opts, statistics.WithChunkSize(tc.chunkSize))
+			}
+			if tc.ioMode != "" {
+				opts = append(opts, statistics.WithIOMode(tc.ioMode))
+			}
+			if tc.maxMemory != 0 {
+				opts = append(opts, statistics.WithMaxMemory(tc.maxMemory, ""))
+			}
+			if tc.distance != "" {
+				opts = append(opts, statistics.WithDistance(tc.distance))
+			}
+			err = statistics.CalculateRidesStatistics(
+				"testdata/complete_input.csv", outputFile.Name(), tc.concurrency, opts...,
+			)
 			require.NoError(t, err)
 
 			actualBytes, err := ioutil.ReadFile(outputFile.Name())
@@ -45,3 +84,689 @@ func TestCalculateRidesStatistics(t *testing.T) {
 		})
 	}
 }
+
+func TestCalculateRidesStatistics_MetricsFileOnFailure(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "statistics_metrics_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	metricsFile := filepath.Join(dir, "metrics.prom")
+
+	err = statistics.CalculateRidesStatistics(
+		"testdata/complete_input.csv", filepath.Join(dir, "missing", "output.csv"), 2,
+		statistics.WithMetricsFile(metricsFile),
+	)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't write report into output")
+	metricsContent, err := ioutil.ReadFile(metricsFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(metricsContent), "ride_statistics_rows_read_total 1826\n")
+}
+
+func TestCalculateRidesStatistics_Checkpoint(t *testing.T) {
+	t.Parallel()
+	expectedBytes, err := ioutil.ReadFile("testdata/statistics_output.golden.csv")
+	require.NoError(t, err)
+	expected := string(expectedBytes)
+	inputBytes, err := ioutil.ReadFile("testdata/complete_input.csv")
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "statistics_checkpoint_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	inputFile := filepath.Join(dir, "input.csv")
+	outputFile := filepath.Join(dir, "output.csv")
+	checkpointFile := filepath.Join(dir, "checkpoint.json")
+
+	// Split the input in the middle of the 3th ride, the rest of the ride is appended later.
+	const firstPartLinesNo = 500
+	lines := bytes.SplitAfter(inputBytes, []byte("\n"))
+	firstPart := bytes.Join(lines[:firstPartLinesNo], nil)
+	err = ioutil.WriteFile(inputFile, firstPart, 0o600)
+	require.NoError(t, err)
+	err = statistics.CalculateRidesStatistics(inputFile, outputFile, 3, statistics.WithCheckpoint(checkpointFile))
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(inputFile, inputBytes, 0o600)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		err = statistics.CalculateRidesStatistics(inputFile, outputFile, 3, statistics.WithCheckpoint(checkpointFile))
+		require.NoError(t, err)
+		actualBytes, err := ioutil.ReadFile(outputFile)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(actualBytes), "run %d after append", i)
+	}
+}
+
+func TestCalculateRidesStatistics_CheckpointOptionsChanged(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "statistics_checkpoint_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	outputFile := filepath.Join(dir, "output.csv")
+	checkpointFile := filepath.Join(dir, "checkpoint.json")
+	metricsFile := filepath.Join(dir, "metrics.prom")
+
+	cases := []struct {
+		distance         string
+		expectedRowsRead int
+	}{
+		{distance: "vincenty", expectedRowsRead: 1826},
+		// Only the last ride is processed again with the same options.
+		{distance: "vincenty", expectedRowsRead: 109},
+		// The checkpoint state is aggregated with another distance method, so it's dropped.
+		{distance: "haversine", expectedRowsRead: 1826},
+	}
+	for i, tc := range cases {
+		err = statistics.CalculateRidesStatistics(
+			"testdata/complete_input.csv", outputFile, 3,
+			statistics.WithCheckpoint(checkpointFile), statistics.WithDistance(tc.distance),
+			statistics.WithMetricsFile(metricsFile),
+		)
+		require.NoError(t, err)
+		metricsContent, err := ioutil.ReadFile(metricsFile)
+		require.NoError(t, err)
+		assert.Contains(
+			t, string(metricsContent), fmt.Sprintf("ride_statistics_rows_read_total %d\n", tc.expectedRowsRead), "run %d", i,
+		)
+	}
+}
+
+func TestCalculateRidesStatistics_Resume(t *testing.T) {
+	t.Parallel()
+	expectedBytes, err := ioutil.ReadFile("testdata/statistics_output.golden.csv")
+	require.NoError(t, err)
+	expected := string(expectedBytes)
+	inputBytes, err := ioutil.ReadFile("testdata/complete_input.csv")
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "statistics_resume_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	inputFile := filepath.Join(dir, "input.csv")
+	outputFile := filepath.Join(dir, "output.csv")
+	progressFile := filepath.Join(dir, "progress.json")
+
+	// Make the progress file of a run crashed in the middle of the input file:
+	// process the first part of the input with the same progress format.
+	const firstPartLinesNo = 1000
+	lines := bytes.SplitAfter(inputBytes, []byte("\n"))
+	err = ioutil.WriteFile(inputFile, bytes.Join(lines[:firstPartLinesNo], nil), 0o600)
+	require.NoError(t, err)
+	err = statistics.CalculateRidesStatistics(inputFile, outputFile, 3, statistics.WithCheckpoint(progressFile))
+	require.NoError(t, err)
+	err = ioutil.WriteFile(inputFile, inputBytes, 0o600)
+	require.NoError(t, err)
+
+	const progressInterval = 4096
+	err = statistics.CalculateRidesStatistics(
+		inputFile, outputFile, 3, statistics.WithProgressFile(progressFile, progressInterval), statistics.WithResume(),
+	)
+	require.NoError(t, err)
+
+	actualBytes, err := ioutil.ReadFile(outputFile)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(actualBytes))
+	_, err = os.Stat(progressFile)
+	assert.True(t, os.IsNotExist(err), "progress file must be removed after a successful run")
+}
+
+func TestCalculateRidesStatistics_ResumeOptionsChanged(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "statistics_resume_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	outputFile := filepath.Join(dir, "output.csv")
+	progressFile := filepath.Join(dir, "progress.json")
+
+	err = statistics.CalculateRidesStatistics(
+		"testdata/complete_input.csv", outputFile, 3,
+		statistics.WithCheckpoint(progressFile), statistics.WithDistance("vincenty"),
+	)
+	require.NoError(t, err)
+
+	err = statistics.CalculateRidesStatistics(
+		"testdata/complete_input.csv", outputFile, 3,
+		statistics.WithProgressFile(progressFile, 4096), statistics.WithResume(),
+	)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "options differ from the ones the progress file was saved with")
+}
+
+func TestCalculateRidesStatistics_ProgressInterval(t *testing.T) {
+	t.Parallel()
+	expectedBytes, err := ioutil.ReadFile("testdata/statistics_output.golden.csv")
+	require.NoError(t, err)
+	expected := string(expectedBytes)
+	dir, err := ioutil.TempDir("", "statistics_progress_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	outputFile := filepath.Join(dir, "output.csv")
+
+	for _, progressInterval := range []int{1, 1000, 10000} {
+		progressFile := filepath.Join(dir, fmt.Sprintf("progress_%d.json", progressInterval))
+		err = statistics.CalculateRidesStatistics(
+			"testdata/complete_input.csv", outputFile, 2, statistics.WithProgressFile(progressFile, progressInterval),
+		)
+		require.NoError(t, err)
+		actualBytes, err := ioutil.ReadFile(outputFile)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(actualBytes), "progress interval %d", progressInterval)
+	}
+}
+
+func TestCalculateRidesStatistics_Zones(t *testing.T) {
+	t.Parallel()
+	expectedBytes, err := ioutil.ReadFile("testdata/statistics_output.golden.csv")
+	require.NoError(t, err)
+	// All test rides are in a single geohash cell of precision 1, so the zones report is the golden one
+	// with the zone columns.
+	lines := strings.SplitAfter(string(expectedBytes), "\n")
+	cases := []struct {
+		byDropoff      bool
+		header, prefix string
+	}{
+		{byDropoff: false, header: "Pickup Zone,", prefix: "s,"},
+		{byDropoff: true, header: "Pickup Zone,Dropoff Zone,", prefix: "s,s,"},
+	}
+	for _, tc := range cases {
+		expected := tc.header + lines[0]
+		for _, line := range lines[1:] {
+			if line != "" {
+				expected += tc.prefix + line
+			}
+		}
+		outputFile := filepath.Join(tempDir(t), "output.csv")
+		err = statistics.CalculateRidesStatistics(
+			"testdata/complete_input.csv", outputFile, 2, statistics.WithZones("geohash:1", tc.byDropoff),
+		)
+		require.NoError(t, err)
+		actualBytes, err := ioutil.ReadFile(outputFile)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(actualBytes), "by drop-off %v", tc.byDropoff)
+	}
+}
+
+func TestCalculateRidesStatistics_TimeSeries(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		spec    string
+		periods []string
+	}{
+		{spec: "day", periods: []string{"2014-07-11", "2014-07-17"}},
+		{spec: "week", periods: []string{"2014-07-07", "2014-07-14"}},
+		// Windows without rides have no rows.
+		{spec: "rolling:3", periods: []string{"2014-07-11", "2014-07-15"}},
+	}
+	for _, tc := range cases {
+		outputFile := filepath.Join(tempDir(t), "output.csv")
+		err := statistics.CalculateRidesStatistics(
+			"testdata/complete_input.csv", outputFile, 3, statistics.WithTimeSeries(tc.spec),
+		)
+		require.NoError(t, err, tc.spec)
+		content, err := ioutil.ReadFile(outputFile)
+		require.NoError(t, err, tc.spec)
+
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		assert.Equal(t, "period,time_of_day,distance_range,p95_seconds,rides", lines[0], tc.spec)
+		var periods []string
+		rides := 0
+		for _, line := range lines[1:] {
+			records := strings.Split(line, ",")
+			if len(periods) == 0 || periods[len(periods)-1] != records[0] {
+				periods = append(periods, records[0])
+			}
+			n, err := strconv.Atoi(records[4])
+			require.NoError(t, err, tc.spec)
+			rides += n
+		}
+		assert.Equal(t, tc.periods, periods, tc.spec)
+		assert.Equal(t, 9, rides, tc.spec)
+	}
+
+	err := statistics.CalculateRidesStatistics(
+		"testdata/complete_input.csv", filepath.Join(tempDir(t), "output.csv"), 3,
+		statistics.WithTimeSeries("rolling:0"),
+	)
+	assert.EqualError(t, err, `invalid rolling window "rolling:0", expected rolling:<days>, e.g. rolling:7`)
+}
+
+func TestCalculateRidesStatistics_ConfidenceIntervals(t *testing.T) {
+	t.Parallel()
+	var outputs []string
+	for _, concurrency := range []int{1, 3} {
+		outputFile := filepath.Join(tempDir(t), "output.csv")
+		err := statistics.CalculateRidesStatistics(
+			"testdata/complete_input.csv", outputFile, concurrency, statistics.WithConfidenceIntervals(100, 7),
+		)
+		require.NoError(t, err)
+		content, err := ioutil.ReadFile(outputFile)
+		require.NoError(t, err)
+		outputs = append(outputs, string(content))
+	}
+	assert.True(t, strings.HasPrefix(outputs[0], "Time of Day,0-1 km,0-1 km Lower,0-1 km Upper,1-2 km,"))
+	assert.Contains(t, outputs[0], "\n09:00,0s,0s,0s,0s,0s,0s,0s,0s,0s,18m5s,18m5s,18m5s,")
+	assert.Equal(t, outputs[0], outputs[1], "intervals are reproducible")
+}
+
+func TestCalculateRidesStatistics_UpperInclusiveDistances(t *testing.T) {
+	t.Parallel()
+	expected, err := ioutil.ReadFile("testdata/statistics_output.golden.csv")
+	require.NoError(t, err)
+	outputFile := filepath.Join(tempDir(t), "output.csv")
+
+	err = statistics.CalculateRidesStatistics(
+		"testdata/complete_input.csv", outputFile, 2, statistics.WithUpperInclusiveDistances(),
+	)
+	require.NoError(t, err)
+	actual, err := ioutil.ReadFile(outputFile)
+	require.NoError(t, err)
+	// No test ride distance is a whole number of km, so the report doesn't change.
+	assert.Equal(t, string(expected), string(actual))
+}
+
+func TestCalculateRidesStatistics_PercentileMethod(t *testing.T) {
+	t.Parallel()
+	expected, err := ioutil.ReadFile("testdata/statistics_output.golden.csv")
+	require.NoError(t, err)
+	output := func(opts ...statistics.Option) string {
+		outputFile := filepath.Join(tempDir(t), "output.csv")
+		err := statistics.CalculateRidesStatistics("testdata/complete_input.csv", outputFile, 2, opts...)
+		require.NoError(t, err)
+		content, err := ioutil.ReadFile(outputFile)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	assert.Equal(t, string(expected), output(statistics.WithPercentileMethod("linear")), "default method")
+	round := output(statistics.WithPercentileMethod("round"))
+	assert.NotEqual(t, string(expected), round)
+	assert.Contains(t, round, "\n09:00,0s,0s,0s,18m5s,21m8s,47m43s,0s,36m37s\n")
+	assert.Equal(t, round, output(statistics.WithPercentileMethod("round"), statistics.WithMaxMemory(1024, "")))
+
+	err = statistics.CalculateRidesStatistics(
+		"testdata/complete_input.csv", filepath.Join(tempDir(t), "output.csv"), 1,
+		statistics.WithPercentileMethod("R-7"),
+	)
+	assert.EqualError(t, err, "unknown percentile method: R-7")
+}
+
+func TestCalculateRidesStatistics_Outliers(t *testing.T) {
+	t.Parallel()
+	expected, err := ioutil.ReadFile("testdata/statistics_output.golden.csv")
+	require.NoError(t, err)
+	output := func(opts ...statistics.Option) (string, string) {
+		outputFile := filepath.Join(tempDir(t), "output.csv")
+		metricsFile := filepath.Join(tempDir(t), "metrics.txt")
+		opts = append(opts, statistics.WithMetricsFile(metricsFile))
+		err := statistics.CalculateRidesStatistics("testdata/complete_input.csv", outputFile, 2, opts...)
+		require.NoError(t, err)
+		content, err := ioutil.ReadFile(outputFile)
+		require.NoError(t, err)
+		metricsContent, err := ioutil.ReadFile(metricsFile)
+		require.NoError(t, err)
+		return string(content), string(metricsContent)
+	}
+
+	// Cells of the test input have too few rides to have outliers.
+	for _, method := range []string{"iqr", "mad"} {
+		content, metricsContent := output(statistics.WithOutlierTrimming(method, 0))
+		assert.Equal(t, string(expected), content, method)
+		assert.NotContains(t, metricsContent, "outlier", method)
+	}
+	content, metricsContent := output(statistics.WithSpeedLimits(20, 0))
+	assert.NotEqual(t, string(expected), content)
+	assert.Contains(t, metricsContent, `ride_statistics_dropped_total{reason="implausible_speed"} 3`)
+
+	cases := []struct {
+		opts     []statistics.Option
+		expected string
+	}{
+		{
+			opts:     []statistics.Option{statistics.WithOutlierTrimming("zscore", 0)},
+			expected: "unknown outlier trimming method: zscore",
+		},
+		{
+			opts:     []statistics.Option{statistics.WithOutlierTrimming("iqr", -1)},
+			expected: "outlier trimming multiplier must be a positive number",
+		},
+		{
+			opts:     []statistics.Option{statistics.WithOutlierTrimming("mad", 0), statistics.WithMaxMemory(1024, "")},
+			expected: "MAD outlier trimming keeps all durations in memory, max memory can't be used with it",
+		},
+		{
+			opts:     []statistics.Option{statistics.WithSpeedLimits(10, 5)},
+			expected: "min speed must not be greater than max speed",
+		},
+	}
+	for _, tc := range cases {
+		err := statistics.CalculateRidesStatistics(
+			"testdata/complete_input.csv", filepath.Join(tempDir(t), "output.csv"), 1, tc.opts...,
+		)
+		assert.EqualError(t, err, tc.expected)
+	}
+}
+
+func TestCalculateRidesStatistics_Histogram(t *testing.T) {
+	t.Parallel()
+	output := func(format string) string {
+		outputFile := filepath.Join(tempDir(t), "output")
+		err := statistics.CalculateRidesStatistics(
+			"testdata/complete_input.csv", outputFile, 2, statistics.WithHistogram("linear:10m:1h", format),
+		)
+		require.NoError(t, err)
+		content, err := ioutil.ReadFile(outputFile)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	csvContent := output(statistics.HistogramFormatCSV)
+	assert.True(t, strings.HasPrefix(csvContent,
+		"time_of_day,distance_range,bin_start_seconds,bin_end_seconds,rides\n09:00,3-5 km,0,600,0\n"))
+	assert.Contains(t, csvContent, "\n09:00,8-13 km,1200,1800,1\n09:00,8-13 km,1800,2400,0\n09:00,8-13 km,2400,3000,1\n")
+	// 8 cells with rides and 7 bins in each.
+	assert.Equal(t, 1+8*7, strings.Count(csvContent, "\n"))
+	jsonContent := output(statistics.HistogramFormatJSON)
+	assert.Equal(t, 8, strings.Count(jsonContent, `"time_of_day"`))
+
+	cases := []struct {
+		opts     []statistics.Option
+		expected string
+	}{
+		{
+			opts: []statistics.Option{statistics.WithHistogram("linear:1m", "csv")},
+			expected: `invalid histogram "linear:1m", expected linear:<width>:<max> or log:<min>:<max>:<bins>, ` +
+				"e.g. linear:1m:1h",
+		},
+		{
+			opts:     []statistics.Option{statistics.WithHistogram("log:1h:1m:3", "csv")},
+			expected: "log bins min must be positive and less than max, the number of bins must be positive",
+		},
+		{
+			opts:     []statistics.Option{statistics.WithHistogram("linear:1s:24h", "csv")},
+			expected: "linear bins width gives 86400 bins up to max, at most 10000 are allowed",
+		},
+		{
+			opts:     []statistics.Option{statistics.WithHistogram("linear:1m:1h", "xml")},
+			expected: "unknown histogram format: xml",
+		},
+		{
+			opts: []statistics.Option{statistics.WithHistogram("linear:1m:1h", "csv"), statistics.WithTimeSeries("day")},
+			expected: "histograms are calculated of all rides of the input file, " +
+				"checkpoint, progress files, zones and time series can't be used with them",
+		},
+	}
+	for _, tc := range cases {
+		err := statistics.CalculateRidesStatistics(
+			"testdata/complete_input.csv", filepath.Join(tempDir(t), "output"), 1, tc.opts...,
+		)
+		assert.EqualError(t, err, tc.expected)
+	}
+}
+
+func TestCalculateRidesStatistics_Metric(t *testing.T) {
+	t.Parallel()
+	output := func(opts ...statistics.Option) string {
+		outputFile := filepath.Join(tempDir(t), "output.csv")
+		err := statistics.CalculateRidesStatistics("testdata/complete_input.csv", outputFile, 2, opts...)
+		require.NoError(t, err)
+		content, err := ioutil.ReadFile(outputFile)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	expected, err := ioutil.ReadFile("testdata/statistics_output.golden.csv")
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), output(statistics.WithMetric("duration")))
+	speed := output(statistics.WithMetric("speed"))
+	assert.Contains(t, speed, "\n09:00,0,0,0,13.474,22.125,28.226,0,44.034\n")
+	assert.Equal(t, speed, output(statistics.WithMetric("speed"), statistics.WithMaxMemory(1024, "")))
+	assert.Contains(t, output(statistics.WithMetric("pace")), "\n09:00,0s,0s,0s,4m27s,2m43s,4m36s,0s,1m22s\n")
+
+	err = statistics.CalculateRidesStatistics(
+		"testdata/complete_input.csv", filepath.Join(tempDir(t), "output.csv"), 1, statistics.WithMetric("distance"),
+	)
+	assert.EqualError(t, err, "unknown metric: distance")
+	err = statistics.CalculateRidesStatistics(
+		"testdata/complete_input.csv", filepath.Join(tempDir(t), "output.csv"), 1,
+		statistics.WithMetric("speed"), statistics.WithCheckpoint(filepath.Join(tempDir(t), "checkpoint.json")),
+	)
+	assert.EqualError(t, err, "checkpoint and progress files and histograms support durations only, "+
+		"they can't be used with other metrics")
+}
+
+func TestCalculateRidesStatistics_OutputFormats(t *testing.T) {
+	t.Parallel()
+	output := func(opts ...statistics.Option) string {
+		outputFile := filepath.Join(tempDir(t), "output")
+		err := statistics.CalculateRidesStatistics("testdata/complete_input.csv", outputFile, 2, opts...)
+		require.NoError(t, err)
+		content, err := ioutil.ReadFile(outputFile)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	expected, err := ioutil.ReadFile("testdata/statistics_output.golden.csv")
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), output(statistics.WithDurationFormat("go")))
+	assert.Contains(t, output(statistics.WithDurationFormat("seconds")), "\n09:00,0,0,0,1085,1268,2780,0,2197\n")
+	// The interpolated percentile of the 8-13 km cell keeps the fraction of a second.
+	assert.Contains(t, output(statistics.WithDurationFormat("seconds_float")),
+		"\n09:00,0.000,0.000,0.000,1085.000,1268.000,2780.350,0.000,2197.000\n")
+	assert.Contains(t, output(statistics.WithDurationFormat("hh:mm:ss")),
+		"\n09:00,00:00:00,00:00:00,00:00:00,00:18:05,00:21:08,00:46:20,00:00:00,00:36:37\n")
+
+	workbook := output(statistics.WithOutputFormat("xlsx"), statistics.WithDurationFormat("minutes"))
+	zr, err := zip.NewReader(strings.NewReader(workbook), int64(len(workbook)))
+	require.NoError(t, err)
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	assert.Contains(t, names, "xl/worksheets/sheet1.xml")
+
+	cases := []struct {
+		opts     []statistics.Option
+		expected string
+	}{
+		{opts: []statistics.Option{statistics.WithDurationFormat("days")}, expected: "unknown duration format: days"},
+		{opts: []statistics.Option{statistics.WithOutputFormat("ods")}, expected: "unknown output format: ods"},
+		{
+			opts: []statistics.Option{
+				statistics.WithOutputFormat("xlsx"), statistics.WithHistogram("linear:1m:1h", "csv"),
+			},
+			expected: "histograms have their own formats, xlsx output format can't be used with them",
+		},
+	}
+	for _, tc := range cases {
+		err := statistics.CalculateRidesStatistics(
+			"testdata/complete_input.csv", filepath.Join(tempDir(t), "output"), 1, tc.opts...,
+		)
+		assert.EqualError(t, err, tc.expected)
+	}
+}
+
+func TestCalculateRidesStatistics_RidesDump(t *testing.T) {
+	t.Parallel()
+	expected, err := ioutil.ReadFile("testdata/statistics_output.golden.csv")
+	require.NoError(t, err)
+	dir := tempDir(t)
+	outputFile := filepath.Join(dir, "output.csv")
+	dumpFile := filepath.Join(dir, "rides.ndjson")
+
+	err = statistics.CalculateRidesStatistics(
+		"testdata/complete_input.csv", outputFile, 3, statistics.WithRidesDump(dumpFile, "ndjson"),
+	)
+	require.NoError(t, err)
+	actual, err := ioutil.ReadFile(outputFile)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+	dump, err := ioutil.ReadFile(dumpFile)
+	require.NoError(t, err)
+	assert.Equal(t, 9, strings.Count(string(dump), "\n"), "each ride is dumped")
+}
+
+func TestCalculateRidesStatistics_ReaderFailure(t *testing.T) {
+	t.Parallel()
+	dir := tempDir(t)
+	inputFile := invalidInput(t, dir)
+	dumpFile := filepath.Join(dir, "rides.ndjson")
+
+	err := statistics.CalculateRidesStatistics(
+		inputFile, filepath.Join(dir, "output.csv"), 1,
+		statistics.WithRidesDump(dumpFile, "ndjson"), statistics.WithMaxMemory(1024, dir),
+	)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "file readers failed")
+	// The dump stage is waited for, so the rides processed before the failure are flushed into the file.
+	dump, err := ioutil.ReadFile(dumpFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(dump), `"ride_id":1,`)
+}
+
+func TestExportRides(t *testing.T) {
+	t.Parallel()
+	outputFile := filepath.Join(tempDir(t), "rides.csv")
+	// Small chunks are spread between readers, so rides are processed out of order.
+	cfg := statistics.ExportConfig{Format: "csv", Ordered: true}
+	err := statistics.ExportRides(
+		"testdata/complete_input.csv", outputFile, 4, cfg, statistics.WithChunkSize(512),
+	)
+	require.NoError(t, err)
+
+	content, err := ioutil.ReadFile(outputFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 10)
+	assert.True(t, strings.HasPrefix(lines[0], "ride_id,start_ts,end_ts,duration,distance,points,"))
+	for i, line := range lines[1:] {
+		assert.True(t, strings.HasPrefix(line, fmt.Sprintf("%d,", i+1)), "ride %d is in the input order", i+1)
+	}
+	assert.True(t, strings.HasPrefix(lines[1], "1,1405594957,1405596220,1263,12744,132,"))
+}
+
+func TestExportRides_Filter(t *testing.T) {
+	t.Parallel()
+	dir := tempDir(t)
+	outputFile := filepath.Join(dir, "rides.csv")
+	metricsFile := filepath.Join(dir, "metrics.prom")
+	filter := statistics.Filter{
+		From:        time.Date(2014, 7, 17, 0, 0, 0, 0, time.UTC),
+		MinDuration: 20 * time.Minute,
+		Expression:  "max_speed < 100 || points > 300",
+	}
+	cfg := statistics.ExportConfig{Format: "csv", Ordered: true}
+	err := statistics.ExportRides(
+		"testdata/complete_input.csv", outputFile, 4, cfg,
+		statistics.WithChunkSize(512), statistics.WithFilter(filter), statistics.WithMetricsFile(metricsFile),
+	)
+	require.NoError(t, err)
+
+	content, err := ioutil.ReadFile(outputFile)
+	require.NoError(t, err)
+	var rideIDs []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n")[1:] {
+		rideIDs = append(rideIDs, strings.Split(line, ",")[0])
+	}
+	assert.Equal(t, []string{"1", "3", "5", "6"}, rideIDs)
+	metricsContent, err := ioutil.ReadFile(metricsFile)
+	require.NoError(t, err)
+	for _, expected := range []string{
+		`ride_statistics_dropped_total{reason="filtered_from"} 1`,
+		`ride_statistics_dropped_total{reason="filtered_min_duration"} 2`,
+		`ride_statistics_dropped_total{reason="filtered_expression"} 2`,
+	} {
+		assert.Contains(t, string(metricsContent), expected)
+	}
+}
+
+func TestExportRides_ReaderFailure(t *testing.T) {
+	t.Parallel()
+	dir := tempDir(t)
+	outputFile := filepath.Join(dir, "rides.csv")
+
+	err := statistics.ExportRides(invalidInput(t, dir), outputFile, 1, statistics.ExportConfig{Format: "csv"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "file readers failed")
+	// The export stage is waited for, so the rides processed before the failure are flushed into the file.
+	content, err := ioutil.ReadFile(outputFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "\n1,1405594957,1405596220,")
+}
+
+// invalidInput writes the complete input with an invalid row at the end into the dir and returns its path.
+func invalidInput(t *testing.T, dir string) string {
+	t.Helper()
+	content, err := ioutil.ReadFile("testdata/complete_input.csv")
+	require.NoError(t, err)
+	filePath := filepath.Join(dir, "invalid_input.csv")
+	require.NoError(t, ioutil.WriteFile(filePath, append(content, "10,north,south,later\n"...), 0o600))
+	return filePath
+}
+
+func TestDiffReports(t *testing.T) {
+	t.Parallel()
+	outputFile := filepath.Join(tempDir(t), "output.csv")
+	err := statistics.CalculateRidesStatistics(
+		"testdata/complete_input.csv", outputFile, 3,
+		statistics.WithFilter(statistics.Filter{Expression: "ride_id != 4"}),
+	)
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	summary, err := statistics.DiffReports("testdata/statistics_output.golden.csv", outputFile, buf, 0.1)
+	require.NoError(t, err)
+	assert.Equal(t, &statistics.DiffSummary{Cells: 192, Exceeded: 1}, summary)
+	assert.Contains(t, buf.String(), "\n10:00,1-2 km,5m4s,0s,-5m4s,-100.00%,true\n")
+
+	summary, err = statistics.DiffReports(
+		"testdata/statistics_output.golden.csv", "testdata/statistics_output.golden.csv", &bytes.Buffer{}, 0,
+	)
+	require.NoError(t, err)
+	assert.Equal(t, &statistics.DiffSummary{Cells: 192, Exceeded: 0}, summary)
+
+	// Speed values are compared as plain numbers.
+	speedFile := filepath.Join(tempDir(t), "speed.csv")
+	err = statistics.CalculateRidesStatistics(
+		"testdata/complete_input.csv", speedFile, 3, statistics.WithMetric("speed"),
+	)
+	require.NoError(t, err)
+	summary, err = statistics.DiffReports(speedFile, speedFile, &bytes.Buffer{}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, &statistics.DiffSummary{Cells: 192, Exceeded: 0}, summary)
+	_, err = statistics.DiffReports("testdata/statistics_output.golden.csv", speedFile, &bytes.Buffer{}, 0)
+	assert.EqualError(t, err, "can't compare reports: 00:00 0-1 km is a duration in one report and a number "+
+		"in the other, reports must be written in the same duration format")
+}
+
+func BenchmarkCalculateRidesStatistics(b *testing.B) {
+	const inputFile = "../../recorded_rides.csv"
+	dir, err := ioutil.TempDir("", "statistics_benchmark_*")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	outputFile := filepath.Join(dir, "statistics.csv")
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, concurrency := range []int{1, 4, 16} {
+		concurrency := concurrency
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				err := statistics.CalculateRidesStatistics(inputFile, outputFile, concurrency)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+// tempDir creates a temporary directory that is removed when the test finishes.
+func tempDir(tb testing.TB) string {
+	tb.Helper()
+	dir, err := ioutil.TempDir("", "statistics_*")
+	require.NoError(tb, err)
+	tb.Cleanup(func() {
+		os.RemoveAll(dir) // nolint: errcheck, gosec
+	})
+	return dir
+}
@@ -0,0 +1,55 @@
+package statistics
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/aggregation"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/fileread"
+	"github.com/georgysavva/ride-statistics/pkg/statistics/internal/metrics"
+)
+
+const rollingPrefix = "rolling:"
+
+// parseTimeSeries parses the time series spec into the aggregation period and the rolling window days,
+// window days are zero if the spec isn't a rolling window.
+func parseTimeSeries(spec string) (string, int, error) {
+	if strings.HasPrefix(spec, rollingPrefix) {
+		days, err := strconv.Atoi(strings.TrimPrefix(spec, rollingPrefix))
+		if err != nil || days <= 0 {
+			return "", 0, errors.Errorf("invalid rolling window %q, expected rolling:<days>, e.g. rolling:7", spec)
+		}
+		return aggregation.PeriodDay, days, nil
+	}
+	switch spec {
+	case aggregation.PeriodDay, aggregation.PeriodWeek:
+		return spec, 0, nil
+	default:
+		return "", 0, errors.Errorf("unknown time series period: %s", spec)
+	}
+}
+
+func calculatePeriodsReport(inputPath string, concurrency int, o *options, m *metrics.Pipeline,
+) (aggregation.PeriodsReport, error) {
+	if concurrency <= 0 {
+		return nil, errors.New("concurrency parameter must be a positive number")
+	}
+	_, windowDays, err := parseTimeSeries(o.timeSeries)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := o.loadRoadNetwork(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aggregator, err := aggregateRides(inputPath, fileread.WholeFile, concurrency, o, nil, m)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if windowDays != 0 {
+		report, err := aggregator.RollingReport(windowDays)
+		return report, errors.WithStack(err)
+	}
+	return aggregator.PeriodsReport(), nil
+}